@@ -0,0 +1,229 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const ctxKeyProxyDetails = `proxy-details`
+
+// Access log formats.
+const (
+	accessLogJSON     = "json"
+	accessLogCombined = "combined"
+)
+
+// accessLogger writes access logs for the proxied requests in the JSON format
+// understood by Cloud Logging, or in the combined log format.
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string // defaults to accessLogJSON
+
+	// sampleRate is the fraction (0.0-1.0) of successful requests to log.
+	// Failed requests are always logged.
+	sampleRate float64
+	// slowThreshold, if non-zero, is the duration after which requests are
+	// always logged regardless of the sample rate.
+	slowThreshold time.Duration
+}
+
+type accessLogEntry struct {
+	Severity    string          `json:"severity"`
+	Message     string          `json:"message"`
+	Time        string          `json:"time"`
+	HTTPRequest accessLogRecord `json:"httpRequest"`
+
+	// Destination is the internal name called.
+	Destination string `json:"destination"`
+	// Backend is the URL the request was proxied to, if any.
+	Backend       string `json:"backend,omitempty"`
+	TokenInjected bool   `json:"tokenInjected"`
+}
+
+// accessLogRecord follows the HttpRequest type of Cloud Logging.
+type accessLogRecord struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	RequestSize   int64  `json:"requestSize,string,omitempty"`
+	Status        int    `json:"status"`
+	ResponseSize  int64  `json:"responseSize,string"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	Latency       string `json:"latency"`
+	Protocol      string `json:"protocol"`
+}
+
+// proxyDetails records how the reverse proxy handled a request, for the
+// access logs.
+type proxyDetails struct {
+	mu sync.Mutex
+
+	backend       string
+	tokenInjected bool
+}
+
+func proxyDetailsFromContext(ctx context.Context) *proxyDetails {
+	v, _ := ctx.Value(ctxKeyProxyDetails).(*proxyDetails)
+	return v
+}
+
+// record runs f with the lock held, if d is not nil.
+func (d *proxyDetails) record(f func(d *proxyDetails)) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f(d)
+}
+
+func (a *accessLogger) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		details := new(proxyDetails)
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), ctxKeyProxyDetails, details)))
+		a.log(req, rec.status, rec.bytes, time.Since(start), details)
+	})
+}
+
+// shouldLog decides whether the request is logged based on the sampling
+// configuration. Errors and slow requests are always logged.
+func (a *accessLogger) shouldLog(status int, took time.Duration) bool {
+	if status == 0 || status >= http.StatusInternalServerError {
+		return true
+	}
+	if a.slowThreshold > 0 && took >= a.slowThreshold {
+		return true
+	}
+	return a.sampleRate >= 1 || roll(a.sampleRate*100)
+}
+
+func (a *accessLogger) log(req *http.Request, status int, size int64, took time.Duration, details *proxyDetails) {
+	if !a.shouldLog(status, took) {
+		return
+	}
+	details.mu.Lock()
+	backend, tokenInjected := details.backend, details.tokenInjected
+	details.mu.Unlock()
+	if a.format == accessLogCombined {
+		a.write([]byte(combinedLogLine(req, status, size, took, backend, tokenInjected)))
+		return
+	}
+	severity := "INFO"
+	if status == 0 || status >= http.StatusInternalServerError {
+		severity = "ERROR"
+	} else if a.slowThreshold > 0 && took >= a.slowThreshold {
+		severity = "WARNING"
+	}
+	remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	e := accessLogEntry{
+		Severity: severity,
+		Message:  fmt.Sprintf("%s http://%s%s %d", req.Method, req.Host, req.URL.RequestURI(), status),
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		HTTPRequest: accessLogRecord{
+			RequestMethod: req.Method,
+			RequestURL:    "http://" + req.Host + req.URL.RequestURI(),
+			RequestSize:   req.ContentLength,
+			Status:        status,
+			ResponseSize:  size,
+			UserAgent:     req.UserAgent(),
+			RemoteIP:      remoteIP,
+			Latency:       fmt.Sprintf("%.6fs", took.Seconds()),
+			Protocol:      req.Proto,
+		},
+		Destination:   req.Host,
+		Backend:       backend,
+		TokenInjected: tokenInjected,
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		klog.Warningf("failed to marshal access log entry: %v", err)
+		return
+	}
+	a.write(append(b, '\n'))
+}
+
+func (a *accessLogger) write(b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.out.Write(b)
+}
+
+// combinedLogLine formats the request in the combined log format, followed by
+// the backend, whether a token was injected and the duration.
+func combinedLogLine(req *http.Request, status int, size int64, took time.Duration, backend string, tokenInjected bool) string {
+	remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if remoteIP == "" {
+		remoteIP = "-"
+	}
+	if backend == "" {
+		backend = "-"
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %d %q %q host=%s backend=%s token=%v duration=%.6fs\n",
+		remoteIP, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method+" "+req.URL.RequestURI()+" "+req.Proto, status, size,
+		req.Referer(), req.UserAgent(), req.Host, backend, tokenInjected, took.Seconds())
+}
+
+// responseRecorder captures the status code and the response size while
+// passing through the optional interfaces used by the reverse proxy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer %T does not support hijacking", r.ResponseWriter)
+	}
+	return hj.Hijack()
+}
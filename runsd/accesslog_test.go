@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	a := &accessLogger{sampleRate: 0, slowThreshold: time.Second}
+	cases := []struct {
+		status int
+		took   time.Duration
+		want   bool
+	}{
+		{status: http.StatusOK, took: time.Millisecond, want: false},
+		{status: http.StatusNotFound, took: time.Millisecond, want: false},
+		{status: http.StatusBadGateway, took: time.Millisecond, want: true},
+		{status: 0, took: time.Millisecond, want: true},
+		{status: http.StatusOK, took: 2 * time.Second, want: true},
+	}
+	for _, tt := range cases {
+		if got := a.shouldLog(tt.status, tt.took); got != tt.want {
+			t.Errorf("shouldLog(%d, %s) = %v, want %v", tt.status, tt.took, got, tt.want)
+		}
+	}
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	a := &accessLogger{out: &buf, sampleRate: 1}
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxyDetailsFromContext(req.Context()).record(func(d *proxyDetails) {
+			d.backend, d.tokenInjected = "https://hello-xyz-uc.a.run.app", true
+		})
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://hello/foo?bar", nil))
+
+	var e accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("failed to parse access log %q: %v", buf.String(), err)
+	}
+	if e.HTTPRequest.Status != http.StatusTeapot || e.HTTPRequest.ResponseSize != 5 ||
+		e.HTTPRequest.RequestURL != "http://hello/foo?bar" {
+		t.Fatalf("unexpected access log entry: %+v", e.HTTPRequest)
+	}
+	if e.Destination != "hello" || e.Backend != "https://hello-xyz-uc.a.run.app" || !e.TokenInjected {
+		t.Fatalf("unexpected proxy details in access log entry: %+v", e)
+	}
+}
+
+func TestAccessLogCombinedFormat(t *testing.T) {
+	var buf bytes.Buffer
+	a := &accessLogger{out: &buf, format: accessLogCombined, sampleRate: 1}
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://hello/foo?bar", nil)
+	req.Header.Set("user-agent", "test-agent")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	for _, want := range []string{`192.0.2.1 - - [`, `] "GET /foo?bar HTTP/1.1" 200 5 "" "test-agent" host=hello backend=- token=false duration=`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log line %q does not contain %q", line, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// startAdminServer serves the admin endpoints on addr in the background.
+// The admin server must only listen on loopback addresses.
+func startAdminServer(addr string, mux *http.ServeMux) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		klog.V(1).Infof("starting admin server at %s", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			klog.Fatalf("admin server (%s) fail: %v", addr, err)
+		}
+	}()
+	return srv
+}
+
+// writeAdminJSON responds with v as indented JSON.
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		klog.V(1).Infof("failed to write admin response: %v", err)
+	}
+}
+
+// recentProxyErrors keeps the last error responses generated by runsd.
+var recentProxyErrors = &errorLog{max: 100}
+
+type loggedError struct {
+	Time time.Time `json:"time"`
+	proxyError
+}
+
+// errorLog is a ring buffer of the recent errors.
+type errorLog struct {
+	mu     sync.Mutex
+	max    int
+	next   int
+	errors []loggedError
+}
+
+func (l *errorLog) add(e proxyError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v := loggedError{Time: time.Now(), proxyError: e}
+	if len(l.errors) < l.max {
+		l.errors = append(l.errors, v)
+		return
+	}
+	l.errors[l.next] = v
+	l.next = (l.next + 1) % l.max
+}
+
+// snapshot returns the errors, the most recent first.
+func (l *errorLog) snapshot() []loggedError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]loggedError, 0, len(l.errors))
+	for i := len(l.errors) - 1; i >= 0; i-- {
+		out = append(out, l.errors[(l.next+i)%len(l.errors)])
+	}
+	return out
+}
+
+// ServeHTTP serves the recent errors on the admin endpoint.
+func (l *errorLog) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, struct {
+		Errors []loggedError `json:"errors"`
+	}{l.snapshot()})
+}
+
+// serveTokenCache serves the audiences and the expiry of the cached ID
+// tokens (but not the tokens) on the admin endpoint.
+func serveTokenCache(w http.ResponseWriter, _ *http.Request) {
+	type entry struct {
+		Audience string    `json:"audience"`
+		Expiry   time.Time `json:"expiry"`
+	}
+	v := struct {
+		File   string  `json:"file,omitempty"`
+		Tokens []entry `json:"tokens"`
+	}{Tokens: []entry{}}
+	c := idTokenCache
+	c.mu.Lock()
+	v.File = c.file
+	for aud, t := range c.tokens {
+		v.Tokens = append(v.Tokens, entry{Audience: aud, Expiry: t.Expiry})
+	}
+	c.mu.Unlock()
+	sort.Slice(v.Tokens, func(i, j int) bool { return v.Tokens[i].Audience < v.Tokens[j].Audience })
+	writeAdminJSON(w, v)
+}
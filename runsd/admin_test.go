@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorLog(t *testing.T) {
+	l := &errorLog{max: 3}
+	for _, code := range []string{"a", "b", "c", "d"} {
+		l.add(proxyError{Code: code})
+	}
+	var got []string
+	for _, e := range l.snapshot() {
+		got = append(got, e.Code)
+	}
+	if strings.Join(got, ",") != "d,c,b" {
+		t.Errorf("got=%v, want the last 3 errors, most recent first", got)
+	}
+}
+
+func TestServeTokenCache(t *testing.T) {
+	defer func(v *tokenCache) { idTokenCache = v }(idTokenCache)
+	idTokenCache = newTokenCache("")
+	idTokenCache.put("https://hello-xyz-uc.a.run.app", testJWT(time.Now().Add(time.Hour)))
+
+	rec := httptest.NewRecorder()
+	serveTokenCache(rec, httptest.NewRequest(http.MethodGet, "/tokens", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `"audience": "https://hello-xyz-uc.a.run.app"`) {
+		t.Errorf("unexpected response: %s", body)
+	}
+	if strings.Contains(body, "eyJ") {
+		t.Errorf("response contains a token: %s", body)
+	}
+}
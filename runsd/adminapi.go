@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// adminAPIClient is used for the Cloud Run Admin API calls.
+var adminAPIClient = &http.Client{Timeout: 10 * time.Second}
+
+// cloudRunService is a Cloud Run service listed by the Admin API.
+type cloudRunService struct {
+	Name string
+	URL  string
+}
+
+// listCloudRunServices lists the Cloud Run services in the region using the
+// Cloud Run Admin API.
+func listCloudRunServices(region string) ([]cloudRunService, error) {
+	project, err := projectID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project id: %w", err)
+	}
+	tok, err := defaultAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+		"https://%s-run.googleapis.com/apis/serving.knative.dev/v1/namespaces/%s/services", region, project), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := adminAPIClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("admin api responded with code=%d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return parseServiceList(resp.Body)
+}
+
+// projectID returns the ID of the project of the Cloud Run services, from the
+// GOOGLE_CLOUD_PROJECT environment variable, the application default
+// credentials or the metadata server.
+func projectID() (string, error) {
+	if v := os.Getenv("GOOGLE_CLOUD_PROJECT"); v != "" {
+		return v, nil
+	}
+	c, err := applicationCredentials()
+	if err != nil {
+		return "", err
+	}
+	if c != nil && c.ProjectID != "" {
+		return c.ProjectID, nil
+	} else if c != nil && c.QuotaProjectID != "" {
+		return c.QuotaProjectID, nil
+	}
+	return queryMetadata("http://metadata.google.internal./computeMetadata/v1/project/project-id")
+}
+
+func parseServiceList(r io.Reader) ([]cloudRunService, error) {
+	var v struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				URL string `json:"url"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to decode service list: %w", err)
+	}
+	var out []cloudRunService
+	for _, it := range v.Items {
+		out = append(out, cloudRunService{Name: it.Metadata.Name, URL: it.Status.URL})
+	}
+	return out, nil
+}
+
+// cloudRunServiceNames lists the names of the Cloud Run services in the
+// region.
+func cloudRunServiceNames(region string) ([]string, error) {
+	svcs, err := listCloudRunServices(region)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(svcs))
+	for _, s := range svcs {
+		out = append(out, s.Name)
+	}
+	return out, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseServiceList(t *testing.T) {
+	got, err := parseServiceList(strings.NewReader(`{"apiVersion":"serving.knative.dev/v1","kind":"ServiceList",
+		"items":[{"metadata":{"name":"hello","namespace":"123"},"status":{"url":"https://hello-dpyb4duzqq-uc.a.run.app"}},
+		{"metadata":{"name":"billing"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cloudRunService{
+		{Name: "hello", URL: "https://hello-dpyb4duzqq-uc.a.run.app"},
+		{Name: "billing"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
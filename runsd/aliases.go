@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// serviceAliases maps internal names in the "svc" (current region) or
+// "svc.region" form to the internal name they are an alias of, in the same
+// form.
+type serviceAliases map[string]string
+
+// parseAliases parses comma-separated ALIAS=TARGET pairs, such as
+// billing=billing-v2.europe-west1.
+func parseAliases(s string) (serviceAliases, error) {
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(serviceAliases, len(kv))
+	for k, v := range kv {
+		v = strings.ToLower(v)
+		for _, name := range []string{k, v} {
+			parts := strings.Split(name, ".")
+			if len(parts) > 2 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid alias %s=%s: %q is not in SVC or SVC.REGION form", k, v, name)
+			}
+			if len(parts) == 2 {
+				if _, ok := regionCode(parts[1]); !ok {
+					return nil, fmt.Errorf("invalid alias %s=%s: unknown region %q", k, v, parts[1])
+				}
+			}
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// resolve returns the fully qualified internal hostname (svc.region.domain,
+// without the trailing dot) that hostname is an alias of.
+func (a serviceAliases) resolve(hostname, domain, curRegion string) (string, bool) {
+	if len(a) == 0 {
+		return "", false
+	}
+	domain = strings.Trim(domain, ".")
+	name := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(hostname), "."), "."+domain)
+	svc, region := name, curRegion
+	if parts := strings.Split(name, "."); len(parts) == 2 {
+		svc, region = parts[0], parts[1]
+	} else if len(parts) > 2 {
+		return "", false
+	}
+	target, ok := a[svc+"."+region]
+	if !ok && region == curRegion {
+		target, ok = a[svc]
+	}
+	if !ok {
+		return "", false
+	}
+	if !strings.Contains(target, ".") {
+		target += "." + curRegion
+	}
+	return target + "." + domain, true
+}
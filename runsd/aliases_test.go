@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestServiceAliases(t *testing.T) {
+	a, err := parseAliases("billing=billing-v2.europe-west1, Users.asia-east1=users-blue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host   string
+		want   string
+		wantOK bool
+	}{
+		{host: "billing", want: "billing-v2.europe-west1.run.internal", wantOK: true},
+		{host: "billing.us-central1.run.internal.", want: "billing-v2.europe-west1.run.internal", wantOK: true},
+		{host: "billing.us-east1", wantOK: false}, // alias is for the current region only
+		{host: "users.asia-east1", want: "users-blue.us-central1.run.internal", wantOK: true},
+		{host: "users", wantOK: false},
+		{host: "a.b.c.d", wantOK: false},
+	}
+	for _, tt := range cases {
+		got, ok := a.resolve(tt.host, "run.internal.", "us-central1")
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("resolve(%s) = (%q, %v), want (%q, %v)", tt.host, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	for _, bad := range []string{"a=b.c.d", "a=b.unknown-region", "a.b.c=d"} {
+		if _, err := parseAliases(bad); err == nil {
+			t.Errorf("expected error for aliases %q", bad)
+		}
+	}
+}
+
+func TestDNSAliases(t *testing.T) {
+	aliases, err := parseAliases("billing=billing-v2.europe-west1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		region:     "us-central1",
+		aliases:    aliases,
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	cname, err := r.LookupCNAME(context.TODO(), "billing.us-central1.foo.bar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cname != "billing-v2.europe-west1.foo.bar." {
+		t.Fatalf("got cname=%s", cname)
+	}
+	addrs, err := r.LookupHost(context.TODO(), "billing.us-central1.foo.bar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Fatalf("got addrs=%v", addrs)
+	}
+}
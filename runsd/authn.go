@@ -15,17 +15,118 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 func identityToken(audience string) (string, error) {
 	if v := os.Getenv("CLOUD_RUN_ID_TOKEN"); v != "" {
 		return strings.TrimSpace(v), nil
 	}
+	return idTokenCache.getOrFetch(audience, time.Now(), func() (string, error) {
+		return fetchIdentityToken(audience)
+	})
+}
+
+// fetchIdentityToken mints an ID token with the application credentials file
+// if there is one, or the metadata server.
+func fetchIdentityToken(audience string) (string, error) {
+	c, err := applicationCredentials()
+	if err != nil {
+		return "", err
+	}
+	if c != nil {
+		return c.identityToken(audience)
+	}
 	return identityTokenFromMetadata(audience)
 }
 
 func identityTokenFromMetadata(audience string) (string, error) {
-	return queryMetadata("http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/identity?audience=" + audience)
+	return queryMetadata("http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/identity?audience=" + url.QueryEscape(audience))
+}
+
+// defaultAccessToken returns an OAuth2 access token with the default scopes.
+func defaultAccessToken() (string, error) {
+	return accessToken(nil)
+}
+
+// scopedAccessTokenFromMetadata returns an OAuth2 access token of the service
+// account with the scopes (or the default ones if empty), and its expiry.
+func scopedAccessTokenFromMetadata(scopes []string) (string, time.Time, error) {
+	u := "http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/token"
+	if len(scopes) > 0 {
+		u += "?scopes=" + url.QueryEscape(strings.Join(scopes, ","))
+	}
+	v, err := queryMetadata(u)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(v), &tok); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to parse access token response: %w", err)
+	}
+	return tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second), nil
+}
+
+// accessTokens caches the access tokens by their scopes.
+var accessTokens = struct {
+	sync.Mutex
+	tokens map[string]*scopedAccessToken
+}{tokens: make(map[string]*scopedAccessToken)}
+
+// scopedAccessToken is the cached access token of a set of scopes, locked
+// while it's fetched so that the requests needing the token of other scopes
+// don't wait for it.
+type scopedAccessToken struct {
+	sync.Mutex
+	cachedToken
+}
+
+// accessToken returns an OAuth2 access token with the scopes, for the
+// destinations expecting one instead of an ID token.
+func accessToken(scopes []string) (string, error) {
+	if v := os.Getenv("CLOUD_RUN_ACCESS_TOKEN"); v != "" {
+		return strings.TrimSpace(v), nil
+	}
+	key := strings.Join(scopes, ",")
+	accessTokens.Lock()
+	t, ok := accessTokens.tokens[key]
+	if !ok {
+		t = new(scopedAccessToken)
+		accessTokens.tokens[key] = t
+	}
+	accessTokens.Unlock()
+
+	t.Lock()
+	defer t.Unlock()
+	if t.Token != "" && time.Now().Add(tokenExpiryMargin).Before(t.Expiry) {
+		return t.Token, nil
+	}
+	tok, exp, err := fetchAccessToken(scopes)
+	if err != nil {
+		return "", err
+	}
+	t.cachedToken = cachedToken{Token: tok, Expiry: exp}
+	return tok, nil
+}
+
+// fetchAccessToken gets an access token with the application credentials
+// file if there is one, or the metadata server.
+func fetchAccessToken(scopes []string) (string, time.Time, error) {
+	c, err := applicationCredentials()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if c != nil {
+		return c.accessToken(scopes)
+	}
+	return scopedAccessTokenFromMetadata(scopes)
 }
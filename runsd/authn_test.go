@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdentityTokenFromMetadataAudience(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.URL.Query().Get("audience")
+		w.Write([]byte("test-token"))
+	}))
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	defer func(v *http.Client) { metadataClient = v }(metadataClient)
+	metadataClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	audience := "https://hello.example.com/?a=b&c=d"
+	if _, err := identityTokenFromMetadata(audience); err != nil {
+		t.Fatal(err)
+	}
+	if got != audience {
+		t.Errorf("audience=%q, want=%q", got, audience)
+	}
+}
+
+func TestAccessTokenLocksPerScope(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = map[string]int{}
+	)
+	slowStarted, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		scopes := req.URL.Query().Get("scopes")
+		mu.Lock()
+		requests[scopes]++
+		mu.Unlock()
+		if scopes == "slow" {
+			slowStarted <- struct{}{}
+			<-release
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%s","expires_in":3600}`, scopes)
+	}))
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	defer func(v *http.Client) { metadataClient = v }(metadataClient)
+	metadataClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer func(v map[string]*scopedAccessToken) { accessTokens.tokens = v }(accessTokens.tokens)
+	accessTokens.tokens = make(map[string]*scopedAccessToken)
+
+	var wg sync.WaitGroup
+	slow := make([]string, 2)
+	for i := range slow {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tok, err := accessToken([]string{"slow"})
+			if err != nil {
+				t.Error(err)
+			}
+			slow[i] = tok
+		}(i)
+	}
+	<-slowStarted
+
+	// the tokens of the other scopes don't wait for the slow fetch
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if tok, err := accessToken([]string{"fast"}); err != nil || tok != "token-fast" {
+			t.Errorf("accessToken(fast) = %q, %v", tok, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accessToken(fast) blocked by the fetch of another scope")
+	}
+
+	close(release)
+	wg.Wait()
+	for i, tok := range slow {
+		if tok != "token-slow" {
+			t.Errorf("accessToken(slow) #%d = %q", i, tok)
+		}
+	}
+	if requests["slow"] != 1 {
+		t.Errorf("got %d requests for the slow scope, want 1", requests["slow"])
+	}
+}
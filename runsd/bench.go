@@ -0,0 +1,270 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// benchPhase is a single scenario measured by -bench.
+type benchPhase struct {
+	name string
+	url  string
+	// client is used for all requests of the phase.
+	client *http.Client
+	// authHeader, if set, is called before each request to obtain the
+	// Authorization header value.
+	authHeader func() (string, error)
+}
+
+type benchResult struct {
+	name      string
+	latencies []time.Duration
+	errors    int
+	elapsed   time.Duration
+}
+
+// runBench implements "runsd -bench", which sends requests to a service
+// through the local runsd proxy (and, for comparison, directly to its run.app
+// URL) and reports latency percentiles.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	var (
+		requests    = fs.Int("n", 200, "number of requests to send per phase")
+		concurrency = fs.Int("c", 10, "number of concurrent workers")
+		method      = fs.String("method", http.MethodGet, "HTTP method to use")
+		timeout     = fs.Duration("timeout", 30*time.Second, "per-request timeout")
+		region      = fs.String("gcp_region", "", "region of the calling service (default: from metadata server)")
+		projectHash = fs.String("gcp_project_hash", os.Getenv("CLOUD_RUN_PROJECT_HASH"), "cloud run project hash (or use CLOUD_RUN_PROJECT_HASH)")
+		skipDirect  = fs.Bool("skip_direct", false, "do not measure direct requests to the run.app URL (e.g. when not on Cloud Run)")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: runsd -bench [-- flags] URL  (e.g. runsd -bench -- -n=500 http://hello.us-central1/)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a single target URL, got %d args", fs.NArg())
+	}
+	if *requests < 1 || *concurrency < 1 {
+		return fmt.Errorf("-n and -c must be positive")
+	}
+	target, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to parse target url: %w", err)
+	}
+	if target.Scheme != "http" {
+		return fmt.Errorf("target url must use http:// scheme (runsd upgrades to https), got %q", target.Scheme)
+	}
+
+	phases := []benchPhase{
+		{
+			name:   "runsd (keep-alive)",
+			url:    target.String(),
+			client: &http.Client{Timeout: *timeout, Transport: benchTransport(*concurrency)},
+		},
+		{
+			name: "runsd (no keep-alive, dns lookup per request)",
+			url:  target.String(),
+			client: &http.Client{Timeout: *timeout,
+				Transport: &http.Transport{DisableKeepAlives: true}},
+		},
+	}
+	if !*skipDirect {
+		direct, err := directBenchPhases(target, *region, *projectHash, *timeout, *concurrency)
+		if err != nil {
+			return fmt.Errorf("cannot measure direct requests (use -skip_direct): %w", err)
+		}
+		phases = append(phases, direct...)
+	}
+
+	results := make([]benchResult, 0, len(phases))
+	for _, p := range phases {
+		klog.V(1).Infof("[bench] running phase %q n=%d c=%d", p.name, *requests, *concurrency)
+		results = append(results, p.run(*method, *requests, *concurrency))
+	}
+	printBenchResults(os.Stdout, results)
+	return nil
+}
+
+// directBenchPhases returns the phases that bypass runsd and query the run.app
+// URL of the target with a token fetched once (cached) or on every request.
+func directBenchPhases(target *url.URL, region, projectHash string, timeout time.Duration, concurrency int) ([]benchPhase, error) {
+	if projectHash == "" {
+		return nil, fmt.Errorf("project hash is not set")
+	}
+	if region == "" {
+		v, err := regionFromMetadata()
+		if err != nil {
+			return nil, fmt.Errorf("failed to infer region from metadata service: %w", err)
+		}
+		region = v
+	}
+	runHost, err := resolveCloudRunHost(defaultInternalDomain, target.Hostname(), region, projectHash)
+	if err != nil {
+		return nil, err
+	}
+	u := *target
+	u.Scheme = "https"
+	u.Host = runHost
+	audience := "https://" + runHost
+
+	token, err := identityToken(audience)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch identity token: %w", err)
+	}
+	return []benchPhase{
+		{
+			name:       "direct (cached token)",
+			url:        u.String(),
+			client:     &http.Client{Timeout: timeout, Transport: benchTransport(concurrency)},
+			authHeader: func() (string, error) { return "Bearer " + token, nil },
+		},
+		{
+			name:   "direct (token fetch per request)",
+			url:    u.String(),
+			client: &http.Client{Timeout: timeout, Transport: benchTransport(concurrency)},
+			authHeader: func() (string, error) {
+				t, err := identityToken(audience)
+				return "Bearer " + t, err
+			},
+		},
+	}, nil
+}
+
+// benchTransport returns a transport keeping a connection alive for each of
+// the concurrent workers, as http.DefaultTransport only keeps 2 per host and
+// the others would be redialed on every request.
+func benchTransport(concurrency int) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = concurrency
+	if tr.MaxIdleConns < concurrency {
+		tr.MaxIdleConns = concurrency
+	}
+	return tr
+}
+
+func (p benchPhase) run(method string, n, concurrency int) benchResult {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		res = benchResult{name: p.name, latencies: make([]time.Duration, 0, n)}
+	)
+	work := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		work <- struct{}{}
+	}
+	close(work)
+
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range work {
+				d, err := p.do(method)
+				mu.Lock()
+				if err != nil {
+					klog.V(2).Infof("[bench] %s: request failed: %v", p.name, err)
+					res.errors++
+				} else {
+					res.latencies = append(res.latencies, d)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+func (p benchPhase) do(method string) (time.Duration, error) {
+	start := time.Now()
+	req, err := http.NewRequest(method, p.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if p.authHeader != nil {
+		v, err := p.authHeader()
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("authorization", v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("unexpected response status=%d", resp.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+func printBenchResults(w io.Writer, results []benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tOK\tERR\tRPS\tP50\tP90\tP99\tMAX")
+	for _, r := range results {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		rps := float64(len(r.latencies)+r.errors) / r.elapsed.Seconds()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\n", r.name, len(r.latencies), r.errors, rps,
+			fmtDuration(percentile(r.latencies, 50)),
+			fmtDuration(percentile(r.latencies, 90)),
+			fmtDuration(percentile(r.latencies, 99)),
+			fmtDuration(percentile(r.latencies, 100)))
+	}
+	tw.Flush()
+}
+
+// percentile returns the p-th percentile (nearest-rank) of the sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func fmtDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(100 * time.Microsecond).String()
+}
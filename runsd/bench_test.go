@@ -0,0 +1,159 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var v []time.Duration
+	for i := 1; i <= 100; i++ {
+		v = append(v, time.Duration(i)*time.Millisecond)
+	}
+	cases := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 0, want: 1 * time.Millisecond},
+		{p: 50, want: 50 * time.Millisecond},
+		{p: 99, want: 99 * time.Millisecond},
+		{p: 100, want: 100 * time.Millisecond},
+	}
+	for _, tt := range cases {
+		if got := percentile(v, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile(nil) = %v, want 0", got)
+	}
+}
+
+func TestBenchPhaseKeepAlive(t *testing.T) {
+	const n, concurrency = 100, 10
+	var (
+		conns        int32
+		mu           sync.Mutex
+		cond         = sync.NewCond(&mu)
+		arrived, gen int
+	)
+	// respond to the requests of all workers at once, so that their
+	// connections become idle at the same time
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if arrived++; arrived == concurrency {
+			arrived, gen = 0, gen+1
+			cond.Broadcast()
+			return
+		}
+		for g := gen; g == gen; {
+			cond.Wait()
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	p := benchPhase{name: "keep-alive", url: srv.URL, client: &http.Client{Transport: benchTransport(concurrency)}}
+	// the connections of all workers are kept alive when they become idle at
+	// once, so the second run doesn't dial again
+	for i := 0; i < 2; i++ {
+		res := p.run(http.MethodGet, n, concurrency)
+		if len(res.latencies) != n || res.errors != 0 {
+			t.Fatalf("got %d ok, %d errors, want %d ok", len(res.latencies), res.errors, n)
+		}
+	}
+	if got := atomic.LoadInt32(&conns); got != concurrency {
+		t.Errorf("opened %d connections, want one per worker (%d)", got, concurrency)
+	}
+}
+
+func TestBenchPhaseErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name       string
+		authHeader func() (string, error)
+		wantErrors int
+	}{
+		{name: "authorized", authHeader: func() (string, error) { return "Bearer test-token", nil }},
+		{name: "unauthorized", wantErrors: 5},
+		{name: "token error", authHeader: func() (string, error) { return "", errors.New("no token") }, wantErrors: 5},
+	}
+	for _, tt := range cases {
+		p := benchPhase{name: tt.name, url: srv.URL, client: srv.Client(), authHeader: tt.authHeader}
+		res := p.run(http.MethodGet, 5, 2)
+		if res.errors != tt.wantErrors || len(res.latencies) != 5-tt.wantErrors {
+			t.Errorf("%s: got %d ok, %d errors, want %d errors", tt.name, len(res.latencies), res.errors, tt.wantErrors)
+		}
+	}
+}
+
+func TestPrintBenchResults(t *testing.T) {
+	var b bytes.Buffer
+	printBenchResults(&b, []benchResult{
+		{name: "runsd", latencies: []time.Duration{3 * time.Millisecond, time.Millisecond, 2 * time.Millisecond}, errors: 1, elapsed: time.Second},
+		{name: "direct", errors: 2, elapsed: time.Second},
+	})
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), b.String())
+	}
+	want := [][]string{
+		{"PHASE", "OK", "ERR", "RPS", "P50", "P90", "P99", "MAX"},
+		{"runsd", "3", "1", "4.0", "2ms", "3ms", "3ms", "3ms"},
+		{"direct", "0", "2", "2.0", "-", "-", "-", "-"},
+	}
+	for i, l := range lines {
+		if got := strings.Fields(l); strings.Join(got, " ") != strings.Join(want[i], " ") {
+			t.Errorf("line %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestRunBenchArgs(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"http://hello/", "http://world/"},
+		{"-c=0", "http://hello/"},
+		{"-n=0", "http://hello/"},
+		{"https://hello/"},
+		{"-skip_direct=false", "-gcp_project_hash=", "http://hello/"},
+	} {
+		if err := runBench(args); err == nil {
+			t.Errorf("runBench(%q) expected error", args)
+		}
+	}
+}
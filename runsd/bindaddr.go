@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// isLocalAddress reports whether ip is assigned to one of the network
+// interfaces.
+func isLocalAddress(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ensureLocalAddress makes sure that runsd can listen on ip. Any address in
+// 127.0.0.0/8 can be used without configuration on Linux. Other addresses
+// (such as link-local ones) are added to the loopback interface if create is
+// set, which requires the NET_ADMIN capability.
+func ensureLocalAddress(ip net.IP, create bool) error {
+	if ip.To4() != nil && ip.IsLoopback() {
+		return nil
+	}
+	ok, err := isLocalAddress(ip)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	if !create {
+		return fmt.Errorf("address %s is not assigned to any interface (use -bind_ip_create to add it)", ip)
+	}
+	prefix := "/32"
+	if ip.To4() == nil {
+		prefix = "/128"
+	}
+	klog.V(1).Infof("adding address %s to the loopback interface", ip)
+	out, err := exec.Command("ip", "addr", "add", ip.String()+prefix, "dev", "lo").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to add address %s to loopback interface: %w, output=%s", ip, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
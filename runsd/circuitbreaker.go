@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// circuitBreaker fails the requests to a destination fast once the rate of
+// the failed requests to it reaches a threshold, until a probe request
+// succeeds.
+type circuitBreaker struct {
+	// errorRate is the ratio of the failed requests in a window that opens
+	// the circuit.
+	errorRate float64
+	// minRequests is the number of requests a window must have to open the
+	// circuit.
+	minRequests int
+	// window is the period the failures are counted over.
+	window time.Duration
+	// openDuration is how long to fail the requests before letting a probe
+	// request through.
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuit struct {
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+}
+
+func newCircuitBreaker(errorRate float64, minRequests int, window, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		errorRate:    errorRate,
+		minRequests:  minRequests,
+		window:       window,
+		openDuration: openDuration,
+		circuits:     make(map[string]*circuit),
+	}
+}
+
+// allow reports whether a request to the host may be sent now. When the
+// circuit is open for longer than openDuration, a single probe request is
+// allowed.
+func (b *circuitBreaker) allow(host string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[host]
+	if !ok {
+		return true
+	}
+	switch c.state {
+	case circuitOpen:
+		if now.Sub(c.openedAt) < b.openDuration {
+			return false
+		}
+		klog.V(3).Infof("[circuit breaker] host=%s half-open, sending probe request", host)
+		c.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record records the outcome of a request to the host.
+func (b *circuitBreaker) record(host string, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[host]
+	if !ok {
+		c = &circuit{windowStart: now}
+		b.circuits[host] = c
+	}
+	switch c.state {
+	case circuitHalfOpen:
+		if failed {
+			klog.Warningf("circuit breaker: probe request to host=%s failed, circuit stays open", host)
+			c.state, c.openedAt = circuitOpen, now
+		} else {
+			klog.Warningf("circuit breaker: probe request to host=%s succeeded, closing circuit", host)
+			*c = circuit{windowStart: now}
+		}
+		return
+	case circuitOpen:
+		return // requests sent before the circuit opened
+	}
+	if now.Sub(c.windowStart) >= b.window {
+		c.windowStart, c.requests, c.failures = now, 0, 0
+	}
+	c.requests++
+	if failed {
+		c.failures++
+	}
+	if c.requests >= b.minRequests && float64(c.failures)/float64(c.requests) >= b.errorRate {
+		klog.Warningf("circuit breaker: opening circuit for host=%s after %d/%d failed requests",
+			host, c.failures, c.requests)
+		c.state, c.openedAt = circuitOpen, now
+	}
+}
+
+// circuitBreakerTransport fails the requests fast with 503 while the circuit
+// of the destination host is open.
+type circuitBreakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+var _ http.Flusher = circuitBreakerTransport{} // ensure it's a Flusher
+
+func (t circuitBreakerTransport) Flush() {
+	if v, ok := t.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (t circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Value(ctxKeyEarlyResponse).(*http.Response); ok {
+		return t.next.RoundTrip(req)
+	}
+	host := req.URL.Host
+	if !t.breaker.allow(host, time.Now()) {
+		klog.V(5).Infof("[circuit breaker] failing fast for host=%s", host)
+		return newProxyError(http.StatusServiceUnavailable, errCodeCircuitOpen, host,
+			fmt.Sprintf("circuit breaker is open for host=%q after too many failed requests", host)).response(req), nil
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && isProxyErrorResponse(resp) {
+		// e.g. a token couldn't be fetched, not a failure of the backend
+		return resp, nil
+	}
+	t.breaker.record(host, err != nil || resp.StatusCode >= http.StatusInternalServerError, time.Now())
+	return resp, err
+}
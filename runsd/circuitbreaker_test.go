@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(0.5, 4, 10*time.Second, 5*time.Second)
+	now := time.Unix(1000, 0)
+	const host = "hello-xyz-uc.a.run.app"
+
+	for _, failed := range []bool{false, true, true} {
+		if !b.allow(host, now) {
+			t.Fatal("circuit opened before min requests")
+		}
+		b.record(host, failed, now)
+	}
+	b.record(host, true, now) // 3/4 failed
+	if b.allow(host, now.Add(time.Second)) {
+		t.Fatal("circuit should be open")
+	}
+	if !b.allow("other", now) {
+		t.Fatal("circuit of other hosts should be closed")
+	}
+
+	probeAt := now.Add(6 * time.Second)
+	if !b.allow(host, probeAt) {
+		t.Fatal("probe request should be allowed after open duration")
+	}
+	if b.allow(host, probeAt) {
+		t.Fatal("only one probe request should be allowed")
+	}
+	b.record(host, true, probeAt)
+	if b.allow(host, probeAt.Add(time.Second)) {
+		t.Fatal("circuit should stay open after failed probe")
+	}
+
+	probeAt = probeAt.Add(6 * time.Second)
+	if !b.allow(host, probeAt) {
+		t.Fatal("probe request should be allowed after open duration")
+	}
+	b.record(host, false, probeAt)
+	if !b.allow(host, probeAt) {
+		t.Fatal("circuit should be closed after successful probe")
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := newCircuitBreaker(0.5, 2, 10*time.Second, 5*time.Second)
+	now := time.Unix(1000, 0)
+	const host = "hello-xyz-uc.a.run.app"
+	b.record(host, true, now)
+	b.record(host, false, now.Add(11*time.Second)) // new window
+	b.record(host, false, now.Add(12*time.Second))
+	if !b.allow(host, now.Add(12*time.Second)) {
+		t.Fatal("failures of the previous window should not count")
+	}
+}
+
+func TestCircuitBreakerTransport(t *testing.T) {
+	next := &sequenceTransport{statuses: []int{503}}
+	rt := circuitBreakerTransport{next: next, breaker: newCircuitBreaker(1, 2, time.Minute, time.Minute)}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://hello-xyz-uc.a.run.app/", nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want 503", resp.StatusCode)
+		}
+	}
+	if n := len(next.bodies); n != 2 {
+		t.Errorf("backend got %d requests, want 2 (third one failed fast)", n)
+	}
+}
+
+// tokenUnavailableTransport responds with the errors runsd generates when it
+// can't get a token.
+type tokenUnavailableTransport struct{ requests int }
+
+func (t *tokenUnavailableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return newProxyError(http.StatusServiceUnavailable, errCodeTokenUnavailable, req.URL.Host, "no token").response(req), nil
+}
+
+func TestCircuitBreakerTransportIgnoresProxyErrors(t *testing.T) {
+	next := &tokenUnavailableTransport{}
+	breaker := newCircuitBreaker(1, 2, time.Minute, time.Minute)
+	rt := circuitBreakerTransport{next: next, breaker: breaker}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://hello-xyz-uc.a.run.app/", nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := resp.Header.Get(errorHeader); v != errCodeTokenUnavailable {
+			t.Errorf("%s = %q, want %q", errorHeader, v, errCodeTokenUnavailable)
+		}
+	}
+	if next.requests != 3 {
+		t.Errorf("transport got %d requests, want 3 (circuit shouldn't open)", next.requests)
+	}
+	if !breaker.allow("hello-xyz-uc.a.run.app", time.Now()) {
+		t.Error("circuit opened for the errors generated by runsd")
+	}
+}
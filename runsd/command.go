@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// subprocessArgs returns the command line of the subprocess from (in the order
+// of precedence) the positional arguments, the argv file (one argument per
+// line) or the command line in the environment variable.
+func subprocessArgs(posArgs []string, argvFile, envCommand string) ([]string, error) {
+	if len(posArgs) > 0 {
+		return posArgs, nil
+	}
+	if argvFile != "" {
+		b, err := ioutil.ReadFile(argvFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read command file: %w", err)
+		}
+		var out []string
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				out = append(out, line)
+			}
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("command file %s is empty", argvFile)
+		}
+		return out, nil
+	}
+	if envCommand != "" {
+		return splitCommandLine(envCommand)
+	}
+	return nil, nil
+}
+
+// splitCommandLine splits s into words like a POSIX shell would, honoring
+// single quotes, double quotes and backslash escapes. It does not perform
+// any expansions.
+func splitCommandLine(s string) ([]string, error) {
+	var (
+		out     []string
+		cur     strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				out = append(out, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in command %q", s)
+	}
+	if inWord {
+		out = append(out, cur.String())
+	}
+	return out, nil
+}
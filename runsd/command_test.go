@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "python3 server.py", want: []string{"python3", "server.py"}},
+		{in: "  sh   -c  'echo $HOME; exit 1' ", want: []string{"sh", "-c", "echo $HOME; exit 1"}},
+		{in: `java -Dname="a b" -jar app.jar`, want: []string{"java", "-Dname=a b", "-jar", "app.jar"}},
+		{in: `echo a\ b ""`, want: []string{"echo", "a b", ""}},
+		{in: `echo "unterminated`, wantErr: true},
+	}
+	for _, tt := range cases {
+		got, err := splitCommandLine(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitCommandLine(%q) err=%v, wantErr=%v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("splitCommandLine(%q) diff: %s", tt.in, diff)
+		}
+	}
+}
+
+func TestSubprocessArgs(t *testing.T) {
+	f, err := ioutil.TempFile("", "argv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("/app/server\n--port=8080\n--name=a b\n")
+	f.Close()
+
+	got, err := subprocessArgs(nil, f.Name(), "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"/app/server", "--port=8080", "--name=a b"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	got, err = subprocessArgs([]string{"/bin/app"}, f.Name(), "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"/bin/app"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	got, err = subprocessArgs(nil, "", "node index.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"node", "index.js"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	modeCompose = "compose"
+
+	defaultComposePort = "8080"
+)
+
+// composeNetwork proxies the internal names to the containers of the services
+// on a Docker Compose network (in -mode=compose), where the service names
+// resolve with the Docker DNS, rather than to the run.app URLs.
+type composeNetwork struct {
+	// port is the port the services listen on, unless overridden in ports.
+	port  string
+	ports internalNameMap
+	// identity, if set, is the email in the unsigned ID tokens sent to the
+	// services, for the apps reading the caller from the token.
+	identity string
+}
+
+// newComposeNetwork parses the per-service ports in the comma-separated
+// NAME=PORT pairs.
+func newComposeNetwork(port, ports, identity string) (*composeNetwork, error) {
+	if err := validPort(port); err != nil {
+		return nil, err
+	}
+	m, err := parseInternalNameMap(ports)
+	if err != nil {
+		return nil, err
+	}
+	for name, p := range m {
+		if err := validPort(p); err != nil {
+			return nil, fmt.Errorf("invalid port for %s: %w", name, err)
+		}
+	}
+	return &composeNetwork{port: port, ports: m, identity: identity}, nil
+}
+
+func validPort(s string) error {
+	if p, err := strconv.ParseUint(s, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port %q", s)
+	}
+	return nil
+}
+
+// host returns the HOST:PORT of the container of the service the internal
+// hostname is for. The region of the name is ignored, as the services of all
+// regions are on the same network.
+func (c *composeNetwork) host(internalDomain, hostname, curRegion string) (string, error) {
+	trimmed := strings.TrimSuffix(strings.ToLower(hostname), "."+strings.Trim(internalDomain, "."))
+	tag, svc, _, err := parseInternalName(trimmed, curRegion)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse hostname %q: %w", hostname, err)
+	}
+	if tag != "" {
+		return "", fmt.Errorf("revision tags are not supported on the compose network (%q)", hostname)
+	}
+	port, ok := c.ports.lookup(trimmed, internalDomain, curRegion)
+	if !ok {
+		port = c.port
+	}
+	return net.JoinHostPort(svc, port), nil
+}
+
+// fakeIdentityToken returns an unsigned ID token for the email, shaped like
+// the ones minted by the metadata server, which the services on the compose
+// network can decode without verifying (as Cloud Run verifies the tokens
+// before passing them on).
+func fakeIdentityToken(email, audience string, now time.Time) string {
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            audience,
+		"sub":            email,
+		"email":          email,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims) + "."
+}
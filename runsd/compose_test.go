@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComposeNetworkHost(t *testing.T) {
+	c, err := newComposeNetwork("8080", "billing=8081,users.europe-west1=9000", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{hostname: "hello", want: "hello:8080"},
+		{hostname: "billing", want: "billing:8081"},
+		{hostname: "billing.us-central1.run.internal", want: "billing:8081"},
+		{hostname: "users.europe-west1", want: "users:9000"},
+		{hostname: "users", want: "users:8080"},
+		{hostname: "a.b.c.d", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := c.host("run.internal.", tt.hostname, "us-central1")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("host(%s) err=%v, wantErr=%v", tt.hostname, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("host(%s)=%q, want=%q", tt.hostname, got, tt.want)
+		}
+	}
+
+	for _, in := range [][2]string{{"0", ""}, {"http", ""}, {"8080", "billing=70000"}, {"8080", "billing"}} {
+		if _, err := newComposeNetwork(in[0], in[1], ""); err == nil {
+			t.Errorf("expected error for port=%q overrides=%q", in[0], in[1])
+		}
+	}
+}
+
+func TestComposeNetworkAuth(t *testing.T) {
+	rp := newReverseProxy("", "us-central1", "run.internal.")
+	rp.compose = &composeNetwork{port: "8080"}
+	if scheme, host, err := rp.backend("billing"); err != nil || scheme != "http" || host != "billing:8080" {
+		t.Errorf("got=%s://%s err=%v", scheme, host, err)
+	}
+	if !rp.noAuth("billing") {
+		t.Error("expected no auth without -compose_identity")
+	}
+
+	rp.compose.identity = "dev@example.com"
+	if rp.noAuth("billing") {
+		t.Error("expected auth with -compose_identity")
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://billing:8080/", nil)
+	req = req.WithContext(rp.authContext(context.Background(), "billing"))
+	tok, err := authenticatingTransport{}.token(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 || parts[2] != "" {
+		t.Fatalf("expected an unsigned jwt, got=%q", tok)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Email string `json:"email"`
+		Aud   string `json:"aud"`
+		Exp   int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "dev@example.com" || claims.Aud != "https://billing:8080" || claims.Exp <= time.Now().Unix() {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	// routes keep their own authentication
+	rp.routes = routes{"ledger": {target: &url.URL{Scheme: "https", Host: "10.128.0.9"}, noAuth: true}}
+	if !rp.noAuth("ledger") {
+		t.Error("expected no auth for the ledger route")
+	}
+}
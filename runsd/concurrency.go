@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// concurrencyLimiter sheds the proxied requests beyond the maximum number of
+// in-flight requests (in total and to each destination) with 503, rather than
+// queueing them while the backends are slow.
+type concurrencyLimiter struct {
+	internalDomain string
+	region         string
+
+	max            int // 0 for no limit
+	maxPerDest     int // 0 for no limit
+	mu             sync.Mutex
+	inFlight       int
+	inFlightByDest map[string]int
+}
+
+func newConcurrencyLimiter(max, maxPerDest int, internalDomain, region string) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		internalDomain: internalDomain,
+		region:         region,
+		max:            max,
+		maxPerDest:     maxPerDest,
+		inFlightByDest: make(map[string]int),
+	}
+}
+
+func (c *concurrencyLimiter) enabled() bool { return c.max > 0 || c.maxPerDest > 0 }
+
+// acquire reserves a slot for a request to dest, and returns a description of
+// the limit reached if there is none.
+func (c *concurrencyLimiter) acquire(dest string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max > 0 && c.inFlight >= c.max {
+		return fmt.Sprintf("%d requests in flight", c.inFlight), false
+	}
+	if c.maxPerDest > 0 && c.inFlightByDest[dest] >= c.maxPerDest {
+		return fmt.Sprintf("%d requests in flight to %s", c.inFlightByDest[dest], dest), false
+	}
+	c.inFlight++
+	c.inFlightByDest[dest]++
+	return "", true
+}
+
+func (c *concurrencyLimiter) release(dest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	if c.inFlightByDest[dest]--; c.inFlightByDest[dest] <= 0 {
+		delete(c.inFlightByDest, dest)
+	}
+}
+
+// handler responds with 503 to the requests beyond the limits. If no limits
+// are configured, next is returned as is.
+func (c *concurrencyLimiter) handler(next http.Handler) http.Handler {
+	if !c.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dest := internalDestinationName(req.Host, c.internalDomain, c.region)
+		limit, ok := c.acquire(dest)
+		if !ok {
+			klog.V(3).Infof("[proxy] shedding request to host=%s: %s", req.Host, limit)
+			newProxyError(http.StatusServiceUnavailable, errCodeOverloaded, dest,
+				fmt.Sprintf("too many concurrent requests (%s)", limit)).
+				withHint("the limits are set by -max_in_flight_requests and -max_in_flight_requests_per_destination of runsd").
+				write(w)
+			return
+		}
+		defer c.release(dest)
+		next.ServeHTTP(w, req)
+	})
+}
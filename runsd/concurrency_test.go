@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			started.Done()
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	c := newConcurrencyLimiter(3, 2, "run.internal.", "us-central1")
+	h := c.handler(next)
+	do := func(host, path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+path, nil))
+		return rec.Code
+	}
+
+	var done sync.WaitGroup
+	for _, host := range []string{"hello", "hello.us-central1.run.internal"} {
+		started.Add(1)
+		done.Add(1)
+		go func(host string) {
+			defer done.Done()
+			do(host, "/block")
+		}(host)
+	}
+	started.Wait()
+	if got := do("hello.us-central1", "/"); got != http.StatusServiceUnavailable {
+		t.Errorf("over the destination limit: got status %d", got)
+	}
+	if got := do("world", "/"); got != http.StatusOK {
+		t.Errorf("other destination: got status %d", got)
+	}
+
+	started.Add(1)
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		do("world", "/block")
+	}()
+	started.Wait()
+	if got := do("other", "/"); got != http.StatusServiceUnavailable {
+		t.Errorf("over the total limit: got status %d", got)
+	}
+
+	close(release)
+	done.Wait()
+	if got := do("hello", "/"); got != http.StatusOK {
+		t.Errorf("after the requests completed: got status %d", got)
+	}
+	if n := len(c.inFlightByDest); n != 0 || c.inFlight != 0 {
+		t.Errorf("in-flight requests not released: total=%d dests=%d", c.inFlight, n)
+	}
+}
+
+func TestConcurrencyLimiterDisabled(t *testing.T) {
+	if newConcurrencyLimiter(0, 0, "run.internal.", "us-central1").enabled() {
+		t.Fatal("expected limiter without limits to be disabled")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+
+	"k8s.io/klog/v2"
+)
+
+const redacted = "<redacted>"
+
+// effectiveConfig is the configuration runsd ended up with after merging
+// flags, environment variables and values inferred from the environment.
+type effectiveConfig struct {
+	Version              string `json:"version"`
+	Commit               string `json:"commit"`
+	ExecutionEnvironment string `json:"executionEnvironment"`
+	OnCloudRun           bool   `json:"onCloudRun"`
+	Mode                 string `json:"mode"`
+	IPv4                 bool   `json:"ipv4"`
+	IPv6                 bool   `json:"ipv6"`
+
+	Region            string `json:"region"`
+	RegionSource      string `json:"regionSource"`
+	ProjectHash       string `json:"projectHash"`
+	ProjectHashSource string `json:"projectHashSource"`
+	IDTokenSource     string `json:"idTokenSource"`
+
+	Nameserver    string   `json:"nameserver"`
+	Domain        string   `json:"domain"`
+	ExtraDomains  []string `json:"extraDomains,omitempty"`
+	SearchDomains []string `json:"searchDomains"`
+	Ndots         int      `json:"ndots"`
+
+	DNSListeners   []string `json:"dnsListeners"`
+	ProxyListeners []string `json:"proxyListeners"`
+	AdminListener  string   `json:"adminListener,omitempty"`
+
+	// Flags has the values of all flags, including the feature toggles.
+	Flags map[string]string `json:"flags"`
+}
+
+// sensitiveFlags are the flags whose values may carry secrets (e.g. the
+// credentials in the userinfo or the query of a URL), which are not logged.
+var sensitiveFlags = map[string]bool{
+	"nameserver_doh": true,
+	"otlp_endpoint":  true,
+}
+
+// flagValues returns the current values of all flags, with the sensitive ones
+// redacted.
+func flagValues(fs *flag.FlagSet) map[string]string {
+	out := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if v != "" && sensitiveFlags[f.Name] {
+			v = redacted
+		}
+		out[f.Name] = v
+	})
+	return out
+}
+
+func idTokenSource() string {
+	if os.Getenv("CLOUD_RUN_ID_TOKEN") != "" {
+		return "env:CLOUD_RUN_ID_TOKEN"
+	}
+	if c, err := applicationCredentials(); err == nil && c != nil {
+		return "file:" + c.path
+	}
+	return "metadata"
+}
+
+func (c *effectiveConfig) json() []byte {
+	b, err := json.Marshal(c)
+	if err != nil {
+		klog.Warningf("failed to marshal effective configuration: %v", err)
+		return nil
+	}
+	return b
+}
+
+// ServeHTTP serves the effective configuration on the admin endpoint.
+func (c *effectiveConfig) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Write(append(c.json(), '\n'))
+}
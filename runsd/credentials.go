@@ -0,0 +1,231 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+// credentialsClient is used to exchange the credentials in the key files for
+// tokens.
+var credentialsClient = &http.Client{Timeout: 10 * time.Second}
+
+// credentialsFile is a service account key file, or the application default
+// credentials of a user created by "gcloud auth application-default login".
+type credentialsFile struct {
+	path string
+
+	Type         string `json:"type"` // service_account or authorized_user
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	ProjectID      string `json:"project_id"`       // of service account keys
+	QuotaProjectID string `json:"quota_project_id"` // of gcloud credentials
+
+	key *rsa.PrivateKey
+}
+
+// loadCredentialsFile reads and validates the credentials file.
+func loadCredentialsFile(path string) (*credentialsFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &credentialsFile{path: path}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file %s: %w", path, err)
+	}
+	if c.TokenURI == "" {
+		c.TokenURI = defaultTokenURI
+	}
+	switch c.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(c.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("no private key found in credentials file %s", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("failed to parse private key in %s: %w", path, err)
+			}
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key in %s is not an RSA key", path)
+		}
+		c.key = rsaKey
+	case "authorized_user":
+		if c.RefreshToken == "" {
+			return nil, fmt.Errorf("no refresh token found in credentials file %s", path)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q in %s", c.Type, path)
+	}
+	return c, nil
+}
+
+var (
+	appCredentialsOnce sync.Once
+	appCredentials     *credentialsFile
+	appCredentialsErr  error
+)
+
+// applicationCredentials returns the credentials in the file in
+// $GOOGLE_APPLICATION_CREDENTIALS or the gcloud application default
+// credentials file, if any, to mint the tokens with instead of the metadata
+// server (e.g. when running locally).
+func applicationCredentials() (*credentialsFile, error) {
+	appCredentialsOnce.Do(func() {
+		path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		if path == "" {
+			path = wellKnownCredentialsFile()
+			if _, err := os.Stat(path); err != nil {
+				return
+			}
+		}
+		appCredentials, appCredentialsErr = loadCredentialsFile(path)
+		if appCredentialsErr == nil {
+			klog.V(1).Infof("using the credentials in %s to mint tokens", path)
+		}
+	})
+	return appCredentials, appCredentialsErr
+}
+
+// wellKnownCredentialsFile returns the path gcloud saves the application
+// default credentials to.
+func wellKnownCredentialsFile() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// identityToken returns an ID token for the audience. The tokens of users are
+// minted for the gcloud client ID rather than the audience, which Cloud Run
+// accepts too.
+func (c *credentialsFile) identityToken(audience string) (string, error) {
+	var v struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := c.exchange(map[string]interface{}{"target_audience": audience}, &v); err != nil {
+		return "", err
+	}
+	if v.IDToken == "" {
+		return "", fmt.Errorf("no id_token in the token response for %s", c.path)
+	}
+	return v.IDToken, nil
+}
+
+// accessToken returns an OAuth2 access token with the scopes, and its
+// expiry.
+func (c *credentialsFile) accessToken(scopes []string) (string, time.Time, error) {
+	if len(scopes) == 0 {
+		scopes = []string{cloudPlatformScope}
+	}
+	var v struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.exchange(map[string]interface{}{"scope": strings.Join(scopes, " ")}, &v); err != nil {
+		return "", time.Time{}, err
+	}
+	return v.AccessToken, time.Now().Add(time.Duration(v.ExpiresIn) * time.Second), nil
+}
+
+// exchange gets tokens from the token endpoint, with a JWT assertion signed
+// by the service account key (with the claims), or with the refresh token of
+// the user.
+func (c *credentialsFile) exchange(claims map[string]interface{}, out interface{}) error {
+	form := url.Values{}
+	if c.key != nil {
+		now := time.Now()
+		claims["iss"], claims["aud"] = c.ClientEmail, c.TokenURI
+		claims["iat"], claims["exp"] = now.Unix(), now.Add(time.Hour).Unix()
+		assertion, err := signJWT(c.key, c.PrivateKeyID, claims)
+		if err != nil {
+			return err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	} else {
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", c.ClientID)
+		form.Set("client_secret", c.ClientSecret)
+		form.Set("refresh_token", c.RefreshToken)
+	}
+	resp, err := credentialsClient.PostForm(c.TokenURI, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint responded with code=%d for %s: %s", resp.StatusCode, c.path, strings.TrimSpace(string(b)))
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("failed to parse token response: %w", err)
+	}
+	return nil
+}
+
+// signJWT returns the RS256-signed JWT with the claims.
+func signJWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
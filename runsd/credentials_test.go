@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testTokenEndpoint verifies the JWT assertions (signed by key) or the refresh
+// tokens, and responds with tokens echoing the requested audience or scope.
+func testTokenEndpoint(t *testing.T, key *rsa.PublicKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("grant_type") == "refresh_token" {
+			if req.Form.Get("refresh_token") != "test-refresh-token" {
+				http.Error(w, "invalid_grant", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"id_token": "user-id-token", "access_token": "user-access-token", "expires_in": 3600})
+			return
+		}
+		parts := strings.Split(req.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "invalid assertion", http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		json.Unmarshal(payload, &claims)
+		if claims["iss"] != "runsd@p.iam.gserviceaccount.com" {
+			http.Error(w, "invalid issuer", http.StatusUnauthorized)
+			return
+		}
+		if aud, ok := claims["target_audience"].(string); ok {
+			json.NewEncoder(w).Encode(map[string]string{"id_token": "id-token-for-" + aud})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access-token-for-" + claims["scope"].(string), "expires_in": 3600})
+	}))
+}
+
+func TestCredentialsFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testTokenEndpoint(t, &key.PublicKey)
+	defer srv.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	b, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "runsd@p.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL,
+	})
+	sa, err := loadCredentialsFile(writeTempFile(t, dir, "sa.json", string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := sa.identityToken("https://hello-xyz-uc.a.run.app"); err != nil || tok != "id-token-for-https://hello-xyz-uc.a.run.app" {
+		t.Errorf("service account id token=%q err=%v", tok, err)
+	}
+	if tok, _, err := sa.accessToken(nil); err != nil || tok != "access-token-for-"+cloudPlatformScope {
+		t.Errorf("service account access token=%q err=%v", tok, err)
+	}
+
+	b, _ = json.Marshal(map[string]string{
+		"type":          "authorized_user",
+		"client_id":     "gcloud",
+		"client_secret": "secret",
+		"refresh_token": "test-refresh-token",
+		"token_uri":     srv.URL,
+	})
+	user, err := loadCredentialsFile(writeTempFile(t, dir, "user.json", string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := user.identityToken("https://hello-xyz-uc.a.run.app"); err != nil || tok != "user-id-token" {
+		t.Errorf("user id token=%q err=%v", tok, err)
+	}
+}
+
+func TestLoadCredentialsFileInvalid(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, content := range []string{
+		`{"type": "external_account"}`,
+		`{"type": "service_account", "private_key": "not a key"}`,
+		`{"type": "authorized_user"}`,
+		`not json`,
+	} {
+		if _, err := loadCredentialsFile(writeTempFile(t, dir, "creds.json", content)); err == nil {
+			t.Errorf("expected error for %s", content)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseCustomDomains parses comma-separated DOMAIN=TARGET pairs, where TARGET
+// is the service (in SVC or SVC.REGION form) the custom domain is mapped to,
+// such as api.example.com=api.
+func parseCustomDomains(s string) (map[string]string, error) {
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(kv))
+	for domain, target := range kv {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if _, ok := dns.IsDomainName(domain); !ok || !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("invalid custom domain %q", domain)
+		}
+		target = strings.ToLower(target)
+		if parts := strings.Split(target, "."); len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid target for custom domain %s: %q is not in SVC or SVC.REGION form", domain, target)
+		}
+		out[domain] = target
+	}
+	return out, nil
+}
+
+// addCustomDomains adds the custom domains as entries proxied to the run.app
+// URLs of the services they are mapped to, so that the requests get an ID
+// token for the run.app URL.
+func (h hostOverrides) addCustomDomains(domains map[string]string, runHost func(svc string) (string, error)) error {
+	for domain, target := range domains {
+		if _, ok := h[domain]; ok {
+			return fmt.Errorf("custom domain %s is also in the hosts file", domain)
+		}
+		host, err := runHost(target)
+		if err != nil {
+			return fmt.Errorf("cannot find the url for custom domain %s: %w", domain, err)
+		}
+		h[domain] = hostOverride{target: &url.URL{Scheme: "https", Host: host}}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseCustomDomains(t *testing.T) {
+	got, err := parseCustomDomains("API.example.com.=api,shop.example.com=Shop.europe-west1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["api.example.com"] != "api" || got["shop.example.com"] != "shop.europe-west1" || len(got) != 2 {
+		t.Fatalf("got=%v", got)
+	}
+	for _, in := range []string{"localhost=api", "api.example.com=a.b.c", "api.example.com=.us-central1", "api.example.com"} {
+		if _, err := parseCustomDomains(in); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+}
+
+func TestAddCustomDomains(t *testing.T) {
+	runHost := func(svc string) (string, error) {
+		if svc == "missing.mars-north1" {
+			return "", errors.New("unknown region")
+		}
+		return svc + "-dpyb4duzqq-uc.a.run.app", nil
+	}
+	h := hostOverrides{"db": {}}
+	if err := h.addCustomDomains(map[string]string{"api.example.com": "api"}, runHost); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := h.lookup("api.example.com.")
+	if !ok || e.target == nil || e.target.String() != "https://api-dpyb4duzqq-uc.a.run.app" {
+		t.Fatalf("got=%+v ok=%v", e, ok)
+	}
+	if err := h.addCustomDomains(map[string]string{"db": "api"}, runHost); err == nil {
+		t.Fatal("expected error for domain already in the hosts file")
+	}
+	if err := h.addCustomDomains(map[string]string{"x.example.com": "missing.mars-north1"}, runHost); err == nil {
+		t.Fatal("expected error for unresolvable service")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// dependencyTracker records which destinations are called through the proxy
+// to build a service dependency graph.
+type dependencyTracker struct {
+	caller         string // this service, as "service.region"
+	internalDomain string
+	currentRegion  string
+
+	mu    sync.Mutex
+	edges map[string]*dependencyEdge // keyed by destination
+}
+
+type dependencyEdge struct {
+	Caller      string    `json:"caller"`
+	Destination string    `json:"destination"`
+	Requests    int64     `json:"requests"`
+	Errors      int64     `json:"errors"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+func newDependencyTracker(service, internalDomain, region string) *dependencyTracker {
+	caller := service
+	if caller == "" {
+		caller = "unknown"
+	}
+	if region != "" {
+		caller += "." + region
+	}
+	return &dependencyTracker{
+		caller:         caller,
+		internalDomain: internalDomain,
+		currentRegion:  region,
+		edges:          make(map[string]*dependencyEdge),
+	}
+}
+
+// destination normalizes the requested host to the "service.region" form, so
+// that a service is the same destination however it is addressed.
+func (d *dependencyTracker) destination(host string) string {
+	return internalDestinationName(host, d.internalDomain, d.currentRegion)
+}
+
+// destinationName normalizes the requested host to the "service.region" form.
+func destinationName(host, currentRegion string) string {
+	host = hostWithoutPort(host)
+	if !strings.Contains(host, ".") && currentRegion != "" {
+		return host + "." + currentRegion
+	}
+	return host
+}
+
+// internalDestinationName is like destinationName, but also removes the
+// internal domain, so that "hello" and "hello.REGION.run.internal" are the
+// same destination.
+func internalDestinationName(host, internalDomain, currentRegion string) string {
+	host = strings.TrimSuffix(hostWithoutPort(host), "."+strings.Trim(internalDomain, "."))
+	return destinationName(host, currentRegion)
+}
+
+func (d *dependencyTracker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		d.record(d.destination(req.Host), rec.status == 0 || rec.status >= http.StatusInternalServerError)
+	})
+}
+
+func (d *dependencyTracker) record(dest string, failed bool) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.edges[dest]
+	if !ok {
+		e = &dependencyEdge{Caller: d.caller, Destination: dest, FirstSeen: now}
+		d.edges[dest] = e
+	}
+	e.Requests++
+	if failed {
+		e.Errors++
+	}
+	e.LastSeen = now
+}
+
+// snapshot returns a copy of the edges sorted by destination.
+func (d *dependencyTracker) snapshot() []dependencyEdge {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]dependencyEdge, 0, len(d.edges))
+	for _, e := range d.edges {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Destination < out[j].Destination })
+	return out
+}
+
+// ServeHTTP serves the dependency edges as JSON on the admin endpoint.
+func (d *dependencyTracker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		Edges []dependencyEdge `json:"edges"`
+	}{d.snapshot()}); err != nil {
+		klog.V(1).Infof("failed to write dependencies response: %v", err)
+	}
+}
+
+// logPeriodically writes the dependency edges as a structured log entry to w
+// at every interval.
+func (d *dependencyTracker) logPeriodically(w io.Writer, interval time.Duration) {
+	for range time.Tick(interval) {
+		edges := d.snapshot()
+		if len(edges) == 0 {
+			continue
+		}
+		b, err := json.Marshal(struct {
+			Severity string           `json:"severity"`
+			Message  string           `json:"message"`
+			Edges    []dependencyEdge `json:"edges"`
+		}{"INFO", "runsd service dependencies", edges})
+		if err != nil {
+			klog.Warningf("failed to marshal dependencies: %v", err)
+			continue
+		}
+		w.Write(append(b, '\n'))
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDependencyTracker(t *testing.T) {
+	d := newDependencyTracker("caller", "run.internal.", "us-central1")
+	status := http.StatusOK
+	h := d.handler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	for _, host := range []string{"hello", "hello.us-central1", "hello.us-central1.run.internal", "hello.us-central1.run.internal.:80", "world.europe-west1"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	status = http.StatusBadGateway
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "hello"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	d.record("world.europe-west1", false)
+
+	type edge struct {
+		Caller, Destination string
+		Requests, Errors    int64
+	}
+	var got []edge
+	for _, e := range d.snapshot() {
+		if e.FirstSeen.IsZero() || e.LastSeen.Before(e.FirstSeen) {
+			t.Errorf("%s: unexpected times first=%v last=%v", e.Destination, e.FirstSeen, e.LastSeen)
+		}
+		got = append(got, edge{e.Caller, e.Destination, e.Requests, e.Errors})
+	}
+	want := []edge{
+		{"caller.us-central1", "hello.us-central1", 5, 1},
+		{"caller.us-central1", "world.europe-west1", 2, 0},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("edges mismatch (-want +got):\n%s", diff)
+	}
+
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dependencies", nil))
+	var resp struct {
+		Edges []dependencyEdge `json:"edges"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Edges) != 2 || resp.Edges[0].Destination != "hello.us-central1" || resp.Edges[0].Requests != 5 {
+		t.Errorf("unexpected admin response: %s", rec.Body)
+	}
+}
+
+func TestNewDependencyTrackerCaller(t *testing.T) {
+	for _, tt := range []struct{ service, region, want string }{
+		{"hello", "us-central1", "hello.us-central1"},
+		{"", "us-central1", "unknown.us-central1"},
+		{"hello", "", "hello"},
+	} {
+		if got := newDependencyTracker(tt.service, "run.internal.", tt.region).caller; got != tt.want {
+			t.Errorf("caller(%q, %q)=%q, want=%q", tt.service, tt.region, got, tt.want)
+		}
+	}
+}
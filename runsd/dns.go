@@ -15,23 +15,193 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"k8s.io/klog/v2"
 )
 
+// srvPrefix is the service and protocol labels of the SRV names answered for
+// the internal names.
+const srvPrefix = "_http._tcp."
+
+// ednsBufferSize is the EDNS0 UDP buffer size advertised to the upstream
+// nameserver (https://dnsflagday.net/2020/).
+const ednsBufferSize = 1232
+
 type dnsHijack struct {
-	domain     string
-	nameserver string
-	dots       int
-	serveIPv6  bool
+	domain string
+	// extraDomains are the other internal zones served in addition to the
+	// domain, for example during a migration to a new zone.
+	extraDomains []string
+	nameserver   string
+	// upstream, if set, is used instead of the nameserver to recurse.
+	upstream dnsExchanger
+	// forwards are the zones recursed to a designated upstream.
+	forwards  []forwardRule
+	dots      int
+	serveIPv6 bool
+	// ipv6Only disables synthesizing A records for internal names.
+	ipv6Only bool
+	// ipv4 and ipv6 are the addresses internal names resolve to (default:
+	// loopback addresses).
+	ipv4, ipv6 net.IP
+
+	// searchDomains are the search domains written to resolv.conf, used to
+	// detect queries that are search-list expansions of another name.
+	searchDomains []string
+	// expansionOverrides are checked to short-circuit search-list expansions
+	// of names under certain suffixes.
+	expansionOverrides []expansionOverride
+	// excludeSuffixes are the names that are always recursed and never
+	// expanded with the search domains.
+	excludeSuffixes []string
+	// hosts are the static entries answered authoritatively.
+	hosts hostOverrides
+	// runAppAuth resolves the run.app names to the reverse proxy, for the
+	// requests made with the run.app URLs of the services to get an ID token.
+	runAppAuth bool
+	// answerTTL is the TTL of the records synthesized for internal names.
+	answerTTL uint32
+	// proxyPort is the port of the proxy advertised in SRV records.
+	proxyPort uint16
+	// projectHash is used to compute the run.app hostnames in TXT records.
+	projectHash string
+	// region is the region of the current service, used for aliases of names
+	// without a region.
+	region string
+	// aliases are the internal names answered with CNAME records.
+	aliases serviceAliases
+	// unknownRegionRecurse makes the names in regions without a known region
+	// code recursed instead of answered with NXDOMAIN.
+	unknownRegionRecurse bool
+	// unknownRegionHost, if set, is the hostname template the proxy uses for
+	// the regions without a known region code, so such names are answered.
+	unknownRegionHost string
+
+	// cache holds the responses of the upstream nameserver, if not nil.
+	cache *dnsCache
+
+	// clientLimiter, if set, limits the queries per second of each client.
+	clientLimiter *keyedLimiter
+	// recursions, if set, bounds the number of concurrent recursions.
+	recursions chan struct{}
+	// queryLog, if set, records every query served.
+	queryLog *dnsQueryLogger
+	// serviceIPs, if set, allocates the addresses the names resolve to.
+	serviceIPs *serviceIPs
+}
+
+// expansionOverride overrides the ndots value used for names ending with
+// suffix: search-list expansions of a name with at least ndots dots are
+// answered with NXDOMAIN without recursing so the resolver moves on quickly.
+// An ndots of 0 means names under suffix are never expanded.
+type expansionOverride struct {
+	suffix string // without leading or trailing dots
+	ndots  int
+}
+
+// parseExpansionOverrides parses comma-separated SUFFIX=NDOTS pairs, sorted
+// with the longest (most specific) suffix first.
+func parseExpansionOverrides(s string) ([]expansionOverride, error) {
+	var out []expansionOverride
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid ndots override %q, expected SUFFIX=NDOTS", kv)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid ndots value in override %q", kv)
+		}
+		out = append(out, expansionOverride{
+			suffix: strings.ToLower(strings.Trim(parts[0], ".*")),
+			ndots:  n,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return len(out[i].suffix) > len(out[j].suffix) })
+	return out, nil
+}
+
+// parseExcludeSuffixes parses comma-separated name suffixes, optionally
+// containing "*" wildcards.
+func parseExcludeSuffixes(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.Trim(strings.TrimSpace(v), ".")); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// excluded reports whether name matches one of the exclusion patterns. A
+// pattern without wildcards matches the name itself and its subdomains.
+func (d *dnsHijack) excluded(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, p := range d.excludeSuffixes {
+		if strings.Contains(p, "*") {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		} else if name == p || strings.HasSuffix(name, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchExpansionOf returns the names that name may be a search-list
+// expansion of.
+func (d *dnsHijack) searchExpansionOf(name string) []string {
+	var out []string
+	name = strings.ToLower(name)
+	for _, sd := range d.searchDomains {
+		sd = dns.Fqdn(strings.ToLower(sd))
+		if strings.HasSuffix(name, "."+sd) {
+			out = append(out, strings.TrimSuffix(name, "."+sd))
+		}
+	}
+	return out
+}
+
+// suppressedExpansion reports whether name is a search-list expansion of a
+// name that should not be expanded according to the configured overrides.
+func (d *dnsHijack) suppressedExpansion(name string) bool {
+	if len(d.expansionOverrides) == 0 && len(d.excludeSuffixes) == 0 {
+		return false
+	}
+	for _, orig := range d.searchExpansionOf(name) {
+		if d.excluded(orig) {
+			return true
+		}
+		for _, o := range d.expansionOverrides {
+			if orig == o.suffix || strings.HasSuffix(orig, "."+o.suffix) {
+				if strings.Count(orig, ".") >= o.ndots {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
 }
 
 func (d *dnsHijack) handler() dns.Handler {
 	mux := dns.NewServeMux()
 	mux.HandleFunc(d.domain, d.handleLocal)
+	for _, domain := range d.extraDomains {
+		mux.HandleFunc(domain, d.handleLocal)
+	}
 
 	// TODO(ahmetb) issue#18: Cloud Run’s host DNS server is responding to
 	// nonexistent.google.internal. queries with SERVFAIL instead of NXDOMAIN
@@ -40,9 +210,33 @@ func (d *dnsHijack) handler() dns.Handler {
 	// NOTE: This bug is not visible if the Service is running in a VPC access
 	// connector. Internal bug/179796872.
 	mux.HandleFunc("google.internal.", d.tempHandleMetadataZone)
+	if d.runAppAuth {
+		mux.HandleFunc(runAppZone, d.handleRunApp)
+	}
 
 	mux.HandleFunc(".", d.recurse)
-	return mux
+
+	if len(d.expansionOverrides) == 0 && len(d.excludeSuffixes) == 0 && len(d.hosts) == 0 {
+		return mux
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		if d.handleHostOverride(w, msg) {
+			return
+		}
+		for _, q := range msg.Question {
+			if d.suppressedExpansion(q.Name) {
+				klog.V(4).Infof("[dns] < name=%v is a suppressed search expansion, nxdomain", q.Name)
+				nxdomain(w, msg)
+				return
+			}
+			if d.excluded(q.Name) {
+				klog.V(5).Infof("[dns] > name=%v is excluded, recursing", q.Name)
+				d.recurse(w, msg)
+				return
+			}
+		}
+		mux.ServeDNS(w, msg)
+	})
 }
 
 func dnsLogger(d dns.HandlerFunc) dns.HandlerFunc {
@@ -80,36 +274,80 @@ func (d *dnsHijack) tempHandleMetadataZone(w dns.ResponseWriter, msg *dns.Msg) {
 }
 
 func (d *dnsHijack) newServer(net, addr string) *dns.Server {
+	h := d.rateLimited(d.handler())
+	if d.queryLog != nil {
+		h = d.queryLog.handler(h)
+	}
 	return &dns.Server{
 		Addr:    addr,
 		Net:     net,
-		Handler: dnsLogger(d.handler().ServeDNS),
+		Handler: dnsLogger(h.ServeDNS),
+	}
+}
+
+// rateLimited refuses the queries of the clients exceeding their rate limit.
+func (d *dnsHijack) rateLimited(next dns.Handler) dns.Handler {
+	if d.clientLimiter == nil {
+		return next
 	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		client := w.RemoteAddr().String()
+		if h, _, err := net.SplitHostPort(client); err == nil {
+			client = h
+		}
+		if !d.clientLimiter.allow(client, time.Now()) {
+			klog.V(4).Infof("[dns] << client=%s exceeded its rate limit, refused", client)
+			refused(w, msg)
+			return
+		}
+		next.ServeDNS(w, msg)
+	})
 }
 
 func (d *dnsHijack) handleLocal(w dns.ResponseWriter, msg *dns.Msg) {
 	for _, q := range msg.Question {
-		dots := strings.Count(q.Name, ".")
-		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
-			klog.V(4).Infof("[dns] < unsupported dns msg type: %s, defer", dns.TypeToString[q.Qtype])
-			d.recurse(w, msg) // TODO probably should not do this since original resolver won’t know about local domains
-			return
+		name := d.canonicalName(q.Name)
+		switch q.Qtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeCNAME:
+		case dns.TypeSRV:
+			if !strings.HasPrefix(strings.ToLower(name), srvPrefix) {
+				klog.V(4).Infof("[dns] < srv query for name=%v is not for %s, nxdomain", q.Name, srvPrefix)
+				nxdomain(w, msg)
+				return
+			}
+			name = name[len(srvPrefix):]
+		default:
+			klog.V(4).Infof("[dns] < unsupported dns msg type: %s, answering with no records", dns.TypeToString[q.Qtype])
 		}
 
-		if dots != d.dots {
+		dots := strings.Count(name, ".")
+		tagged := revisionTagNames && dots == d.dots+1 // TAG.SVC.REGION.DOMAIN
+		if dots != d.dots && !tagged {
 			klog.V(4).Infof("[dns] < type=%v name=%v is too short or long (need ndots=%d; got=%d), nxdomain", dns.TypeToString[q.Qtype], q.Name, d.dots, dots)
 			nxdomain(w, msg)
 			return
 		}
 
-		parts := strings.SplitN(strings.TrimSuffix(q.Name, "."+d.domain), ".", 2)
+		parts := strings.SplitN(strings.TrimSuffix(name, "."+d.domain), ".", 2)
 		if len(parts) < 2 {
 			klog.V(4).Infof("[dns] < name=%q not enough segments to parse", q.Name)
 			return
 		}
 		region := parts[1]
-		_, ok := cloudRunRegionCodes[region]
-		if !ok {
+		if tagged {
+			var err error
+			if _, _, region, err = parseInternalName(strings.ToLower(strings.TrimSuffix(name, "."+d.domain)), d.region); err != nil {
+				klog.V(4).Infof("[dns] < name=%q is not a tagged name: %v, nxdomain", q.Name, err)
+				nxdomain(w, msg)
+				return
+			}
+		}
+		_, ok := regionCode(region)
+		if !ok && d.unknownRegionRecurse {
+			klog.V(4).Infof("[dns] < unknown region=%q from name=%q, recursing", region, q.Name)
+			d.recurse(w, msg)
+			return
+		} else if !ok && d.unknownRegionHost == "" {
 			klog.V(4).Infof("[dns] < unknown region=%q from name=%q, nxdomain", region, q.Name)
 			nxdomain(w, msg)
 			return
@@ -121,38 +359,187 @@ func (d *dnsHijack) handleLocal(w dns.ResponseWriter, msg *dns.Msg) {
 	r.Authoritative = true
 	for _, q := range msg.Question {
 		klog.V(5).Infof("[dns] < MATCH type=%v name=%v", dns.TypeToString[q.Qtype], q.Name)
+		name := q.Name
+		if target, ok := d.aliases.resolve(d.canonicalName(q.Name), d.domain, d.region); ok && q.Qtype != dns.TypeSRV {
+			name = dns.Fqdn(target)
+			klog.V(5).Infof("[dns] < ALIAS name=%v target=%v", q.Name, name)
+			r.Answer = append(r.Answer, &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+					Ttl:    d.answerTTL,
+				},
+				Target: name,
+			})
+		}
 		switch q.Qtype {
 		case dns.TypeA:
+			if d.ipv6Only {
+				continue
+			}
 			r.Answer = append(r.Answer, &dns.A{
 				Hdr: dns.RR_Header{
-					Name:   q.Name,
+					Name:   name,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
-					Ttl:    10, // TODO think about this
+					Ttl:    d.answerTTL,
 				},
-				A: ipv4Loopback,
+				A: d.answerIPv4(name),
 			})
 		case dns.TypeAAAA:
 			if d.serveIPv6 {
 				r.Answer = append(r.Answer, &dns.AAAA{
 					Hdr: dns.RR_Header{
-						Name:   q.Name,
+						Name:   name,
 						Rrtype: dns.TypeAAAA,
 						Class:  dns.ClassINET,
-						Ttl:    10, // TODO think about this
+						Ttl:    d.answerTTL,
 					},
-					AAAA: net.IPv6loopback,
+					AAAA: d.answerIPv6(),
+				})
+			}
+		case dns.TypeSRV:
+			target := dns.Fqdn(q.Name[len(srvPrefix):])
+			r.Answer = append(r.Answer, &dns.SRV{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeSRV,
+					Class:  dns.ClassINET,
+					Ttl:    d.answerTTL,
+				},
+				Port:   d.proxyPort,
+				Target: target,
+			})
+			if !d.ipv6Only {
+				r.Extra = append(r.Extra, &dns.A{
+					Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: d.answerTTL},
+					A:   d.answerIPv4(target),
+				})
+			}
+			if d.serveIPv6 {
+				r.Extra = append(r.Extra, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: d.answerTTL},
+					AAAA: d.answerIPv6(),
+				})
+			}
+		case dns.TypeTXT:
+			for _, txt := range d.debugTXT(d.canonicalName(name)) {
+				r.Answer = append(r.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:   name,
+						Rrtype: dns.TypeTXT,
+						Class:  dns.ClassINET,
+						Ttl:    d.answerTTL,
+					},
+					Txt: []string{txt},
 				})
 			}
 		}
 	}
+	if len(r.Answer) == 0 {
+		// NODATA response (RFC 2308), so that the negative answer is cached
+		r.Ns = append(r.Ns, d.soa())
+	}
 	w.WriteMsg(r)
 }
 
+// soa returns the SOA record of the internal zone.
+func (d *dnsHijack) soa() dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   d.domain,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    d.answerTTL,
+		},
+		Ns:      "ns." + d.domain,
+		Mbox:    "hostmaster." + d.domain,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  d.answerTTL,
+	}
+}
+
+// canonicalName returns the name in the primary internal zone, if it is in
+// one of the extra zones.
+func (d *dnsHijack) canonicalName(name string) string {
+	lower := strings.ToLower(name)
+	for _, domain := range d.extraDomains {
+		if strings.HasSuffix(lower, "."+domain) {
+			return name[:len(name)-len(domain)] + d.domain
+		}
+	}
+	return name
+}
+
+// debugTXT returns the TXT strings describing the run.app hostname the proxy
+// would connect to for the internal name.
+func (d *dnsHijack) debugTXT(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	trimmed := strings.TrimSuffix(name, "."+strings.Trim(d.domain, "."))
+	region := strings.SplitN(trimmed, ".", 2)[1]
+	if strings.Count(trimmed, ".") == 2 {
+		_, _, region, _ = parseInternalName(trimmed, d.region)
+	}
+	host, err := resolveCloudRunHostOrTemplate(d.unknownRegionHost, d.domain, name, region, d.projectHash)
+	if err != nil {
+		return []string{"error=" + err.Error()}
+	}
+	rc, _ := regionCode(region)
+	return []string{"host=" + host, "region=" + region, "region_code=" + rc}
+}
+
+// answerIPv4 returns the address the name resolves to, which is allocated
+// for the name if serviceIPs is set.
+func (d *dnsHijack) answerIPv4(name string) net.IP {
+	if d.serviceIPs != nil {
+		ip, err := d.serviceIPs.ipFor(strings.ToLower(strings.TrimSuffix(d.canonicalName(name), ".")))
+		if err == nil {
+			return ip
+		}
+		klog.Warningf("failed to allocate an ip for name=%s, using the default: %v", name, err)
+	}
+	if d.ipv4 != nil {
+		return d.ipv4
+	}
+	return ipv4Loopback
+}
+
+func (d *dnsHijack) answerIPv6() net.IP {
+	if d.ipv6 != nil {
+		return d.ipv6
+	}
+	return net.IPv6loopback
+}
+
 // recurse proxies the message to the backend nameserver.
 func (d *dnsHijack) recurse(w dns.ResponseWriter, msg *dns.Msg) {
+	if d.cache != nil {
+		if r := d.cache.get(msg, time.Now()); r != nil {
+			klog.V(5).Infof("[dns] << cached  type=%s name=%v rcode=%s answers=%d",
+				dns.TypeToString[msg.Question[0].Qtype], msg.Question[0].Name, dns.RcodeToString[r.Rcode], len(r.Answer))
+			setQuerySource(w, querySourceCached, "")
+			writeUpstreamResponse(w, msg, r)
+			return
+		}
+	}
+	if d.recursions != nil {
+		select {
+		case d.recursions <- struct{}{}:
+			defer func() { <-d.recursions }()
+		default:
+			klog.V(4).Infof("[dns] << too many concurrent recursions, refused name=%v", msg.Question[0].Name)
+			refused(w, msg)
+			return
+		}
+	}
 	klog.V(5).Infof("[dns] >> recursing type=%s name=%v", dns.TypeToString[msg.Question[0].Qtype], msg.Question[0].Name)
-	r, rtt, err := new(dns.Client).Exchange(msg, net.JoinHostPort(d.nameserver, "53"))
+	upstream := d.exchangerFor(msg.Question[0].Name)
+	setQuerySource(w, querySourceRecursed, upstream.String())
+	r, rtt, err := upstream.Exchange(withEDNS0(msg))
 	if err != nil {
 		klog.V(4).Infof("[dns] << WARNING: recursive dns fail: %v, servfail", err)
 		servfail(w, msg)
@@ -162,11 +549,66 @@ func (d *dnsHijack) recurse(w dns.ResponseWriter, msg *dns.Msg) {
 		dns.TypeToString[msg.Question[0].Qtype],
 		msg.Question[0].Name,
 		dns.RcodeToString[r.Rcode], len(r.Answer), rtt)
+	if d.cache != nil {
+		d.cache.put(msg, r, time.Now())
+	}
 
 	// r.SetReply(msg) // TODO(ahmetb): not sure why but removing this actually preserves the response hdrs and other sections well
+	writeUpstreamResponse(w, msg, r)
+}
+
+// withEDNS0 returns a copy of msg advertising at least the ednsBufferSize so
+// that large answers are not truncated by the upstream.
+func withEDNS0(msg *dns.Msg) *dns.Msg {
+	q := msg.Copy()
+	if opt := q.IsEdns0(); opt != nil {
+		if opt.UDPSize() < ednsBufferSize {
+			opt.SetUDPSize(ednsBufferSize)
+		}
+		return q
+	}
+	return q.SetEdns0(ednsBufferSize, false)
+}
+
+// writeUpstreamResponse writes the response of the upstream to the client,
+// dropping the OPT record if the client did not use EDNS0, and truncating
+// the response to fit the client's UDP buffer size.
+func writeUpstreamResponse(w dns.ResponseWriter, msg, r *dns.Msg) {
+	size := dns.MinMsgSize
+	if opt := msg.IsEdns0(); opt != nil {
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+	} else if r.IsEdns0() != nil {
+		r = r.Copy()
+		extra := r.Extra[:0]
+		for _, rr := range r.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		r.Extra = extra
+	}
+	if w.LocalAddr().Network() == "udp" {
+		r.Truncate(size)
+	}
 	w.WriteMsg(r)
 }
 
+func (d *dnsHijack) exchangerFor(name string) dnsExchanger {
+	name = strings.ToLower(name)
+	for _, f := range d.forwards {
+		if name == f.zone || strings.HasSuffix(name, "."+f.zone) {
+			klog.V(5).Infof("[dns] >> forwarding name=%v to %s (zone %s)", name, f.upstream, f.zone)
+			return f.upstream
+		}
+	}
+	if d.upstream != nil {
+		return d.upstream
+	}
+	return plainExchanger{nameserver: d.nameserver}
+}
+
 // nxdomain sends an authoritative NXDOMAIN (domain not found) reply
 func nxdomain(w dns.ResponseWriter, msg *dns.Msg) {
 	r := new(dns.Msg)
@@ -177,6 +619,14 @@ func nxdomain(w dns.ResponseWriter, msg *dns.Msg) {
 	return
 }
 
+// refused sends a REFUSED reply, used when the server is saturated.
+func refused(w dns.ResponseWriter, msg *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	r.Rcode = dns.RcodeRefused
+	w.WriteMsg(r)
+}
+
 //  servfail an authoritative SERVFAIL (error) reply
 func servfail(w dns.ResponseWriter, msg *dns.Msg) {
 	r := new(dns.Msg)
@@ -19,9 +19,13 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
 )
 
 var loopbackIPs = []string{ipv4Loopback.String(), net.IPv6loopback.String()}
@@ -71,6 +75,36 @@ func TestDNSInternalLookups(t *testing.T) {
 	}
 }
 
+func TestDNSRevisionTagLookups(t *testing.T) {
+	revisionTagNames = true
+	defer func() { revisionTagNames = false }()
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		region:     "us-central1",
+		dots:       4,
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	cases := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "abc.us-central1.foo.bar."},
+		{addr: "canary.abc.us-central1.foo.bar."},
+		{addr: "canary.abc.def.foo.bar.", wantErr: true},              // invalid region name 'def'
+		{addr: "abc.us-central1.us-central1.foo.bar.", wantErr: true}, // search expansion of abc.us-central1
+		{addr: "a.canary.abc.us-central1.foo.bar.", wantErr: true},    // too many dots
+	}
+	for _, tt := range cases {
+		_, err := r.LookupHost(context.TODO(), tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LookupHost(%s) error = %v, wantErr = %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
 func TestDNSInternalIPv4Only(t *testing.T) {
 	ds := &dnsHijack{
 		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
@@ -92,6 +126,58 @@ func TestDNSInternalIPv4Only(t *testing.T) {
 	}
 }
 
+func TestDNSInternalIPv6Only(t *testing.T) {
+	ds := &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		serveIPv6:  true,
+		ipv6Only:   true}
+
+	dnsSrv, shutdown := newTestDNSServer(t, ds)
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	v, err := r.LookupHost(context.TODO(), "abc.us-central1.foo.bar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{net.IPv6loopback.String()}
+	if diff := cmp.Diff(expected, v); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestDNSInternalCustomAddress(t *testing.T) {
+	ds := &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		ipv4:       net.IPv4(127, 0, 0, 53)}
+
+	dnsSrv, shutdown := newTestDNSServer(t, ds)
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	v, err := r.LookupHost(context.TODO(), "abc.us-central1.foo.bar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"127.0.0.53"}, v); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestPickNameserver(t *testing.T) {
+	servers := []string{"169.254.169.254", "fd20:ce::254"}
+	if got := pickNameserver(servers, true); got != "169.254.169.254" {
+		t.Errorf("with ipv4: got %s", got)
+	}
+	if got := pickNameserver(servers, false); got != "fd20:ce::254" {
+		t.Errorf("ipv6-only: got %s", got)
+	}
+}
+
 func TestDNSExternalRecursion(t *testing.T) {
 	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{nameserver: "8.8.8.8",
 		domain: "foo.bar.",
@@ -142,3 +228,370 @@ func newTestDNSServer(t *testing.T, d *dnsHijack) (string, func()) {
 	<-ch
 	return srv.PacketConn.LocalAddr().String(), func() { srv.Shutdown() }
 }
+
+func TestSuppressedExpansion(t *testing.T) {
+	overrides, err := parseExpansionOverrides("mongodb.net=0, *.corp.example.com=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dnsHijack{
+		searchDomains:      []string{"us-central1.run.internal.", "run.internal.", "c.project.internal"},
+		expansionOverrides: overrides,
+	}
+	cases := []struct {
+		name string
+		want bool
+	}{
+		{name: "cluster0.abc.mongodb.net.us-central1.run.internal.", want: true},
+		{name: "mongodb.net.c.project.internal.", want: true},
+		{name: "cluster0.abc.mongodb.net.", want: false},                    // absolute query
+		{name: "hello.us-central1.run.internal.", want: false},              // no override
+		{name: "db.corp.example.com.run.internal.", want: true},             // 3 dots >= 2
+		{name: "corp.example.com.run.internal.", want: true},                // 2 dots >= 2
+		{name: "api.notmongodb.net.us-central1.run.internal.", want: false}, // suffix is not a label boundary
+	}
+	for _, tt := range cases {
+		if got := d.suppressedExpansion(tt.name); got != tt.want {
+			t.Errorf("suppressedExpansion(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseExpansionOverrides("foo.com"); err == nil {
+		t.Error("expected error for override without ndots")
+	}
+}
+
+func TestExcludedSuffixes(t *testing.T) {
+	d := &dnsHijack{
+		searchDomains:   []string{"us-central1.run.internal.", "run.internal."},
+		excludeSuffixes: parseExcludeSuffixes("googleapis.com, *.rds.amazonaws.com ,"),
+	}
+	cases := []struct {
+		name         string
+		wantExcluded bool
+		wantNX       bool
+	}{
+		{name: "googleapis.com.", wantExcluded: true},
+		{name: "Storage.GoogleAPIs.com.", wantExcluded: true},
+		{name: "storage.googleapis.com.us-central1.run.internal.", wantNX: true},
+		{name: "db.abc.us-east-1.rds.amazonaws.com.", wantExcluded: true},
+		{name: "rds.amazonaws.com.", wantExcluded: false}, // wildcard requires a subdomain
+		{name: "db.abc.rds.amazonaws.com.run.internal.", wantNX: true},
+		{name: "notgoogleapis.com.", wantExcluded: false},
+		{name: "hello.us-central1.run.internal.", wantExcluded: false},
+	}
+	for _, tt := range cases {
+		if got := d.excluded(tt.name); got != tt.wantExcluded {
+			t.Errorf("excluded(%s) = %v, want %v", tt.name, got, tt.wantExcluded)
+		}
+		if got := d.suppressedExpansion(tt.name); got != tt.wantNX {
+			t.Errorf("suppressedExpansion(%s) = %v, want %v", tt.name, got, tt.wantNX)
+		}
+	}
+}
+
+func TestDNSInternalSRV(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		proxyPort:  80,
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	_, addrs, err := r.LookupSRV(context.TODO(), "http", "tcp", "hello.us-central1.foo.bar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Target != "hello.us-central1.foo.bar." || addrs[0].Port != 80 {
+		t.Fatalf("unexpected srv answer: %+v", addrs)
+	}
+
+	if _, _, err := r.LookupSRV(context.TODO(), "http", "tcp", "hello.invalid.foo.bar."); err == nil {
+		t.Fatal("expected error for unknown region")
+	}
+	if _, _, err := r.LookupSRV(context.TODO(), "grpc", "tcp", "hello.us-central1.foo.bar."); err == nil {
+		t.Fatal("expected error for unsupported service")
+	}
+}
+
+func TestDNSInternalTXT(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver:  "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:      "foo.bar.",
+		dots:        4,
+		projectHash: "dpyb4duzqq",
+	})
+	defer shutdown()
+
+	got, err := resolver(dnsSrv).LookupTXT(context.TODO(), "hello.us-central1.foo.bar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"host=hello-dpyb4duzqq-uc.a.run.app", "region=us-central1", "region_code=uc"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+// bigTXTExchanger answers all queries with many TXT records.
+type bigTXTExchanger struct {
+	mu         sync.Mutex
+	gotUDPSize uint16
+}
+
+func (b *bigTXTExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if opt := msg.IsEdns0(); opt != nil {
+		b.mu.Lock()
+		b.gotUDPSize = opt.UDPSize()
+		b.mu.Unlock()
+	}
+	r := new(dns.Msg).SetReply(msg)
+	for i := 0; i < 40; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN TXT \"record-%02d-%s\"", msg.Question[0].Name, i, strings.Repeat("x", 20)))
+		r.Answer = append(r.Answer, rr)
+	}
+	r.SetEdns0(4096, false)
+	return r, 0, nil
+}
+
+func (b *bigTXTExchanger) String() string { return "big" }
+
+func TestDNSRecurseEDNS0(t *testing.T) {
+	upstream := &bigTXTExchanger{}
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		domain:   "foo.bar.",
+		dots:     4,
+		upstream: upstream,
+	})
+	defer shutdown()
+
+	// client without edns0: truncated to 512 bytes, no OPT record
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)
+	r, err := dns.Exchange(q, dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.mu.Lock()
+	gotUDPSize := upstream.gotUDPSize
+	upstream.mu.Unlock()
+	if gotUDPSize != ednsBufferSize {
+		t.Errorf("upstream got udp size=%d, want %d", gotUDPSize, ednsBufferSize)
+	}
+	r.Compress = true
+	if !r.Truncated || r.Len() > dns.MinMsgSize {
+		t.Errorf("expected truncated response <=512 bytes, got truncated=%v len=%d", r.Truncated, r.Len())
+	}
+	if r.IsEdns0() != nil {
+		t.Error("response to non-edns0 client has OPT record")
+	}
+
+	// client with a large enough buffer gets all records
+	q = new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT).SetEdns0(4096, false)
+	c := &dns.Client{UDPSize: 4096}
+	r, _, err = c.Exchange(q, dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 40 {
+		t.Errorf("expected all records, got truncated=%v answers=%d", r.Truncated, len(r.Answer))
+	}
+}
+
+func TestDNSAnswerTTL(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		answerTTL:  42,
+	})
+	defer shutdown()
+
+	r, err := dns.Exchange(new(dns.Msg).SetQuestion("hello.us-central1.foo.bar.", dns.TypeA), dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 42 {
+		t.Fatalf("expected a single answer with ttl=42, got %v", r.Answer)
+	}
+}
+
+func TestDNSInternalUnsupportedType(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		answerTTL:  10,
+	})
+	defer shutdown()
+
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeHTTPS, dns.TypeNS} {
+		r, err := dns.Exchange(new(dns.Msg).SetQuestion("hello.us-central1.foo.bar.", qtype), dnsSrv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != dns.RcodeSuccess || !r.Authoritative || len(r.Answer) != 0 {
+			t.Errorf("type=%s: expected authoritative empty NOERROR, got rcode=%s aa=%v answers=%d",
+				dns.TypeToString[qtype], dns.RcodeToString[r.Rcode], r.Authoritative, len(r.Answer))
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("type=%s: expected SOA in authority section, got %v", dns.TypeToString[qtype], r.Ns)
+		}
+	}
+
+	r, err := dns.Exchange(new(dns.Msg).SetQuestion("hello.invalid.foo.bar.", dns.TypeMX), dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for unknown region, got %s", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestDNSExtraDomains(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver:   "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:       "run.internal.",
+		extraDomains: []string{"cloudrun.internal."},
+		dots:         4,
+		projectHash:  "dpyb4duzqq",
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	for _, name := range []string{"hello.us-central1.run.internal.", "hello.us-central1.cloudrun.internal."} {
+		got, err := r.LookupHost(context.TODO(), name)
+		if err != nil {
+			t.Fatalf("LookupHost(%s): %v", name, err)
+		}
+		if diff := cmp.Diff([]string{"127.0.0.1"}, got); diff != "" {
+			t.Errorf("LookupHost(%s): %s", name, diff)
+		}
+	}
+	txt, err := r.LookupTXT(context.TODO(), "hello.us-central1.cloudrun.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) == 0 || txt[0] != "host=hello-dpyb4duzqq-uc.a.run.app" {
+		t.Errorf("unexpected TXT answer for extra domain: %v", txt)
+	}
+	if _, err := r.LookupHost(context.TODO(), "hello.invalid.cloudrun.internal."); err == nil {
+		t.Error("expected error for unknown region in extra domain")
+	}
+}
+
+func TestDNSFQDNOnly(t *testing.T) {
+	search, _ := resolvSearch(cloudRunZones("us-central1", "run.internal."), nil,
+		&dns.ClientConfig{Search: []string{"c.project.internal"}, Ndots: 1}, 4, true)
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver:    "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:        "run.internal.",
+		dots:          4,
+		searchDomains: search,
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	// the fully qualified names resolve without the internal search domains
+	got, err := r.LookupHost(context.TODO(), "hello.us-central1.run.internal.")
+	if err != nil {
+		t.Fatalf("LookupHost(hello.us-central1.run.internal.): %v", err)
+	}
+	if diff := cmp.Diff([]string{"127.0.0.1"}, got); diff != "" {
+		t.Errorf("LookupHost(hello.us-central1.run.internal.): %s", diff)
+	}
+	if _, err := r.LookupHost(context.TODO(), "hello.run.internal."); err == nil {
+		t.Error("LookupHost(hello.run.internal.): expected error")
+	}
+}
+
+func TestDNSUnknownRegion(t *testing.T) {
+	cases := []struct {
+		name      string
+		recurse   bool
+		template  string
+		wantRcode int
+	}{
+		{name: "default", wantRcode: dns.RcodeNameError},
+		{name: "recurse", recurse: true, wantRcode: dns.RcodeServerFailure}, // from the unreachable upstream
+		{name: "template", template: "{service}-123.{region}.run.app", wantRcode: dns.RcodeSuccess},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+				nameserver:           "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+				upstream:             plainExchanger{nameserver: "192.0.2.255", timeout: 100 * time.Millisecond},
+				domain:               "foo.bar.",
+				dots:                 4,
+				unknownRegionRecurse: tt.recurse,
+				unknownRegionHost:    tt.template,
+			})
+			defer shutdown()
+			r, err := dns.Exchange(new(dns.Msg).SetQuestion("hello.mars-north1.foo.bar.", dns.TypeA), dnsSrv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Errorf("got rcode=%s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+}
+
+func TestDNSLimits(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)
+
+	t.Run("client qps", func(t *testing.T) {
+		d := &dnsHijack{
+			domain:        "run.internal.",
+			upstream:      &fakeExchanger{},
+			clientLimiter: newKeyedLimiter(0.001, 2),
+		}
+		addr, stop := newTestDNSServer(t, d)
+		defer stop()
+
+		var codes []int
+		for i := 0; i < 3; i++ {
+			r, _, err := new(dns.Client).Exchange(q, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, r.Rcode)
+		}
+		if want := []int{dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeRefused}; !cmp.Equal(codes, want) {
+			t.Fatalf("rcodes = %v, want %v", codes, want)
+		}
+	})
+
+	t.Run("concurrent recursions", func(t *testing.T) {
+		d := &dnsHijack{
+			domain:     "run.internal.",
+			upstream:   &slowExchanger{name: "slow", delay: 300 * time.Millisecond},
+			recursions: make(chan struct{}, 1),
+		}
+		addr, stop := newTestDNSServer(t, d)
+		defer stop()
+
+		done := make(chan int)
+		go func() {
+			r, _, err := new(dns.Client).Exchange(q, addr)
+			if err != nil {
+				done <- -1
+				return
+			}
+			done <- r.Rcode
+		}()
+		time.Sleep(100 * time.Millisecond)
+		r, _, err := new(dns.Client).Exchange(q, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != dns.RcodeRefused {
+			t.Errorf("saturated rcode = %s, want REFUSED", dns.RcodeToString[r.Rcode])
+		}
+		if rc := <-done; rc != dns.RcodeSuccess {
+			t.Errorf("first query rcode = %d, want NOERROR", rc)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsCacheMaxTTL caps how long a response is cached regardless of its TTLs.
+const dnsCacheMaxTTL = time.Hour
+
+type dnsCacheKey struct {
+	name          string
+	qtype, qclass uint16
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache is an in-memory cache of the responses received from the upstream
+// nameserver that honors the TTLs of the records.
+type dnsCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[dnsCacheKey]dnsCacheEntry
+}
+
+func newDNSCache(maxEntries int) *dnsCache {
+	return &dnsCache{maxEntries: maxEntries, entries: make(map[dnsCacheKey]dnsCacheEntry)}
+}
+
+func cacheKey(msg *dns.Msg) (dnsCacheKey, bool) {
+	if len(msg.Question) != 1 {
+		return dnsCacheKey{}, false
+	}
+	q := msg.Question[0]
+	return dnsCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}, true
+}
+
+// get returns a cached response to msg with the TTLs decremented by the time
+// spent in the cache, or nil if there is no fresh response cached.
+func (c *dnsCache) get(msg *dns.Msg, now time.Time) *dns.Msg {
+	key, ok := cacheKey(msg)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	r := e.msg.Copy()
+	r.Id = msg.Id
+	r.Question = msg.Question
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, sec := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return r
+}
+
+// put caches the response r to msg for the minimum TTL of its records.
+// Only successful and NXDOMAIN responses are cached; negative responses are
+// cached per the SOA record in the authority section (RFC 2308).
+func (c *dnsCache) put(msg, r *dns.Msg, now time.Time) {
+	key, ok := cacheKey(msg)
+	if !ok || r.Truncated || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl, ok := responseTTL(r)
+	if !ok || ttl == 0 {
+		return
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > dnsCacheMaxTTL {
+		d = dnsCacheMaxTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked(now)
+	}
+	c.entries[key] = dnsCacheEntry{msg: r.Copy(), stored: now, expires: now.Add(d)}
+}
+
+// evictLocked removes the expired entries, or an arbitrary entry if none
+// has expired.
+func (c *dnsCache) evictLocked(now time.Time) {
+	var evicted bool
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for k := range c.entries {
+		delete(c.entries, k)
+		return
+	}
+}
+
+// responseTTL returns the minimum TTL of the records in the response. For
+// responses without answers, the negative caching TTL of the SOA is used.
+func responseTTL(r *dns.Msg) (uint32, bool) {
+	if len(r.Answer) == 0 {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return ttl, true
+			}
+		}
+		return 0, false
+	}
+	var (
+		min   uint32
+		found bool
+	)
+	for _, sec := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < min {
+				min, found = rr.Header().Ttl, true
+			}
+		}
+	}
+	return min, found
+}
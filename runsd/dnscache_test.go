@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestDNSCache(t *testing.T) {
+	c := newDNSCache(10)
+	now := time.Now()
+
+	q := new(dns.Msg).SetQuestion("Example.com.", dns.TypeA)
+	r := new(dns.Msg).SetReply(q)
+	r.Answer = []dns.RR{
+		mustRR(t, "example.com. 60 IN A 192.0.2.1"),
+		mustRR(t, "example.com. 30 IN A 192.0.2.2"),
+	}
+	c.put(q, r, now)
+
+	q2 := new(dns.Msg).SetQuestion("example.COM.", dns.TypeA)
+	got := c.get(q2, now.Add(10*time.Second))
+	if got == nil {
+		t.Fatal("expected cached response")
+	}
+	if got.Id != q2.Id || got.Question[0].Name != "example.COM." {
+		t.Fatalf("cached response does not match the query: id=%d question=%v", got.Id, got.Question)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != 50 {
+		t.Fatalf("got ttl=%d, want 50", ttl)
+	}
+	if c.get(new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA), now) != nil {
+		t.Fatal("got cached response for a different qtype")
+	}
+	if c.get(q2, now.Add(30*time.Second)) != nil {
+		t.Fatal("expected response to expire after the minimum ttl")
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	c := newDNSCache(10)
+	now := time.Now()
+
+	q := new(dns.Msg).SetQuestion("nonexistent.example.com.", dns.TypeA)
+	nx := new(dns.Msg).SetRcode(q, dns.RcodeNameError)
+	c.put(q, nx, now)
+	if c.get(q, now) != nil {
+		t.Fatal("nxdomain without soa should not be cached")
+	}
+
+	nx.Ns = []dns.RR{mustRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 20")}
+	c.put(q, nx, now)
+	if got := c.get(q, now.Add(19*time.Second)); got == nil || got.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected cached nxdomain, got=%v", got)
+	}
+	if c.get(q, now.Add(20*time.Second)) != nil {
+		t.Fatal("expected nxdomain to expire after soa minimum ttl")
+	}
+
+	sf := new(dns.Msg).SetRcode(q, dns.RcodeServerFailure)
+	q3 := new(dns.Msg).SetQuestion("servfail.example.com.", dns.TypeA)
+	c.put(q3, sf, now)
+	if c.get(q3, now) != nil {
+		t.Fatal("servfail should not be cached")
+	}
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	c := newDNSCache(2)
+	now := time.Now()
+	for _, name := range []string{"a.com.", "b.com.", "c.com."} {
+		q := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		r := new(dns.Msg).SetReply(q)
+		r.Answer = []dns.RR{mustRR(t, name+" 60 IN A 192.0.2.1")}
+		c.put(q, r, now)
+	}
+	if n := len(c.entries); n > 2 {
+		t.Fatalf("cache has %d entries, want at most 2", n)
+	}
+}
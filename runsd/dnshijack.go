@@ -15,30 +15,110 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
-func configureResolvConf(path string, nameservers []string, searchDomains []string, ndots int) error {
+func resolvConfContents(nameservers []string, searchDomains []string, ndots int) []byte {
+	var b bytes.Buffer
+	for _, n := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", n)
+	}
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(searchDomains, " "))
+	}
+	fmt.Fprintf(&b, "options ndots:%d\n", ndots)
+	return b.Bytes()
+}
+
+func writeResolvConf(path string, contents []byte) error {
 	f, err := os.OpenFile(path, os.O_TRUNC|os.O_WRONLY|os.O_SYNC, 0)
 	if err != nil {
 		return err // TODO wrap
 	}
-	for _, n := range nameservers {
-		if _, err := fmt.Fprintf(f, "nameserver %s\n", n); err != nil {
-			return err // TODO wrap
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err // TODO wrap
+	}
+	return f.Close()
+}
+
+// maxNdots is the maximum ndots value supported in resolv.conf.
+const maxNdots = 15
+
+// internalNdots returns the number of dots in the internal names (in
+// SVC.REGION.DOMAIN form) for the domain.
+func internalNdots(domain string) int {
+	return strings.Count(dns.Fqdn(domain), ".") + 2
+}
+
+// resolvNdots returns the ndots value to use in resolv.conf for the domain,
+// validating the explicitly specified value (if not nil).
+func resolvNdots(domain string, explicit *int) (int, error) {
+	n := internalNdots(domain)
+	if n > maxNdots {
+		return 0, fmt.Errorf("domain %q has too many labels, internal names would need ndots=%d (max: %d)", domain, n, maxNdots)
+	}
+	if explicit == nil {
+		return n, nil
+	}
+	if *explicit < 0 || *explicit > maxNdots {
+		return 0, fmt.Errorf("ndots=%d is out of range [0, %d]", *explicit, maxNdots)
+	}
+	return *explicit, nil
+}
+
+// maxSearchDomains is the number of search domains older resolvers (e.g.
+// glibc before 2.26) use from resolv.conf.
+const maxSearchDomains = 6
+
+// parseSearchDomains parses a comma-separated list of search domains.
+func parseSearchDomains(s string) ([]string, error) {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v == "" {
+			continue
 		}
+		if _, ok := dns.IsDomainName(v); !ok || strings.Trim(v, ".") == "" {
+			return nil, fmt.Errorf("invalid search domain %q", v)
+		}
+		out = append(out, dns.Fqdn(v))
 	}
-	if _, err := fmt.Fprintf(f, "search %s\n", strings.Join(searchDomains, " ")); err != nil {
-		return err // TODO wrap
+	return out, nil
+}
+
+// searchList concatenates the lists of search domains, removing the
+// duplicates.
+func searchList(lists ...[]string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		for _, v := range l {
+			k := strings.ToLower(dns.Fqdn(v))
+			if !seen[k] {
+				seen[k] = true
+				out = append(out, v)
+			}
+		}
 	}
-	if _, err := fmt.Fprintf(f, "options ndots:%d\n", ndots); err != nil {
-		return err // TODO wrap
+	return out
+}
+
+// resolvSearch returns the search domains and ndots for resolv.conf: the
+// zones of the internal names followed by the extra and the original search
+// domains, or with fqdnOnly, only the original (and the extra) search domains
+// with the original ndots.
+func resolvSearch(zones, extra []string, rc *dns.ClientConfig, ndots int, fqdnOnly bool) ([]string, int) {
+	if fqdnOnly {
+		return searchList(rc.Search, extra), rc.Ndots
 	}
-	return f.Close()
+	return searchList(zones, extra, rc.Search), ndots
 }
 
 func cloudRunZones(region, domain string) []string {
@@ -48,11 +128,17 @@ func cloudRunZones(region, domain string) []string {
 	}
 }
 
+// resolver returns a resolver querying the nameserver, dialed like the
+// upstream nameservers (e.g. with the socket mark exempting the queries from
+// -redirect_dns) so that runsd doesn't resolve names with itself.
 func resolver(nameserver string) *net.Resolver {
 	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{}
+			d := upstreamDialerWithTimeout(0)
+			if d == nil {
+				d = new(net.Dialer)
+			}
 			return d.DialContext(ctx, "udp", nameserver)
 		},
 	}
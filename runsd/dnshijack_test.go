@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolvNdots(t *testing.T) {
+	intp := func(i int) *int { return &i }
+	cases := []struct {
+		domain   string
+		explicit *int
+		want     int
+		wantErr  bool
+	}{
+		{domain: "run.internal.", want: 4},
+		{domain: "run.internal", want: 4},
+		{domain: "svc.corp.example.", want: 5},
+		{domain: "run.internal.", explicit: intp(2), want: 2},
+		{domain: "run.internal.", explicit: intp(0), want: 0},
+		{domain: "run.internal.", explicit: intp(-1), wantErr: true},
+		{domain: "run.internal.", explicit: intp(16), wantErr: true},
+		{domain: strings.Repeat("a.", 14), wantErr: true},
+	}
+	for _, tt := range cases {
+		got, err := resolvNdots(tt.domain, tt.explicit)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolvNdots(%s) err=%v, wantErr=%v", tt.domain, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolvNdots(%s) = %d, want %d", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	extra, err := parseSearchDomains(" internal.corp, Example.COM. ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := searchList([]string{"us-central1.run.internal.", "run.internal."}, extra, []string{"example.com", "c.project.internal"})
+	want := []string{"us-central1.run.internal.", "run.internal.", "internal.corp.", "example.com.", "c.project.internal"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"a..b", "."} {
+		if _, err := parseSearchDomains(bad); err == nil {
+			t.Errorf("parseSearchDomains(%q) expected error", bad)
+		}
+	}
+}
+
+func TestResolvSearch(t *testing.T) {
+	zones := cloudRunZones("us-central1", "run.internal.")
+	extra := []string{"internal.corp."}
+	rc := &dns.ClientConfig{Search: []string{"c.project.internal"}, Ndots: 1}
+	cases := []struct {
+		name     string
+		fqdnOnly bool
+		want     string
+	}{
+		{name: "default", want: "nameserver 127.0.0.1\n" +
+			"search us-central1.run.internal. run.internal. internal.corp. c.project.internal\n" +
+			"options ndots:4\n"},
+		{name: "fqdn only", fqdnOnly: true, want: "nameserver 127.0.0.1\n" +
+			"search c.project.internal internal.corp.\n" +
+			"options ndots:1\n"},
+	}
+	for _, tt := range cases {
+		search, ndots := resolvSearch(zones, extra, rc, 4, tt.fqdnOnly)
+		if got := string(resolvConfContents([]string{"127.0.0.1"}, search, ndots)); got != tt.want {
+			t.Errorf("%s: got resolv.conf:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+
+	rc.Search = nil
+	search, _ := resolvSearch(zones, nil, rc, 4, true)
+	if got := string(resolvConfContents([]string{"127.0.0.1"}, search, 0)); strings.Contains(got, "search") {
+		t.Errorf("fqdn only without search domains: got resolv.conf:\n%s", got)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// Sources of the DNS answers recorded in the query log.
+const (
+	querySourceLocal    = "local"
+	querySourceRecursed = "recursed"
+	querySourceCached   = "cached"
+)
+
+// dnsQueryLogger writes a JSON line for each DNS query served, independent of
+// the log verbosity, as an audit trail of the names resolved by the workload.
+type dnsQueryLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type dnsQueryLogEntry struct {
+	Time     string `json:"time"`
+	Client   string `json:"client"`
+	Name     string `json:"qname"`
+	Type     string `json:"qtype"`
+	Rcode    string `json:"rcode"`
+	Answers  int    `json:"answers"`
+	Source   string `json:"source"`
+	Upstream string `json:"upstream,omitempty"`
+	Latency  string `json:"latency"`
+}
+
+func (l *dnsQueryLogger) handler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		start := time.Now()
+		rec := &queryRecorder{ResponseWriter: w, source: querySourceLocal}
+		next.ServeDNS(rec, msg)
+		l.log(w.RemoteAddr(), msg, rec, time.Since(start))
+	})
+}
+
+func (l *dnsQueryLogger) log(client net.Addr, msg *dns.Msg, rec *queryRecorder, took time.Duration) {
+	e := dnsQueryLogEntry{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Source:   rec.source,
+		Upstream: rec.upstream,
+		Latency:  fmt.Sprintf("%.6fs", took.Seconds()),
+	}
+	if client != nil {
+		e.Client = client.String()
+		if h, _, err := net.SplitHostPort(e.Client); err == nil {
+			e.Client = h
+		}
+	}
+	if len(msg.Question) > 0 {
+		e.Name, e.Type = msg.Question[0].Name, dns.TypeToString[msg.Question[0].Qtype]
+	}
+	if rec.resp != nil {
+		e.Rcode, e.Answers = dns.RcodeToString[rec.resp.Rcode], len(rec.resp.Answer)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		klog.Warningf("failed to marshal dns query log entry: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(b, '\n')); err != nil {
+		klog.Warningf("failed to write dns query log: %v", err)
+	}
+}
+
+// queryRecorder captures the response written for a query and where its answer
+// came from.
+type queryRecorder struct {
+	dns.ResponseWriter
+	resp     *dns.Msg
+	source   string
+	upstream string
+}
+
+func (r *queryRecorder) WriteMsg(m *dns.Msg) error {
+	r.resp = m
+	return r.ResponseWriter.WriteMsg(m)
+}
+
+// setQuerySource records the source of the answer if the query is logged.
+func setQuerySource(w dns.ResponseWriter, source, upstream string) {
+	if r, ok := w.(*queryRecorder); ok {
+		r.source, r.upstream = source, upstream
+	}
+}
+
+// rotatingFile is a file that is rotated once it grows over maxBytes, keeping
+// up to maxBackups previous files with .1, .2, ... suffixes.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Write is not safe for concurrent use.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %w", r.path, err)
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups < 1 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
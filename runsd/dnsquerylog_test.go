@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+// fakeResponseWriter is a dns.ResponseWriter for calling handlers directly.
+type fakeResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (f *fakeResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (f *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (f *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	f.msg = m
+	return nil
+}
+
+func TestDNSQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	d := &dnsHijack{
+		domain:   "run.internal.",
+		dots:     4,
+		ipv4:     net.IPv4(127, 0, 0, 1),
+		upstream: &slowExchanger{name: "upstream"},
+		cache:    newDNSCache(10),
+	}
+	h := (&dnsQueryLogger{out: &buf}).handler(d.handler())
+	for _, name := range []string{"hello.us-central1.run.internal.", "example.com.", "example.com."} {
+		h.ServeDNS(&fakeResponseWriter{}, new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+
+	var got []dnsQueryLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e dnsQueryLogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("failed to parse query log line %q: %v", line, err)
+		}
+		e.Time, e.Latency = "", ""
+		got = append(got, e)
+	}
+	want := []dnsQueryLogEntry{
+		{Client: "127.0.0.1", Name: "hello.us-central1.run.internal.", Type: "A", Rcode: "NOERROR", Answers: 1, Source: "local"},
+		{Client: "127.0.0.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Answers: 1, Source: "recursed", Upstream: "upstream"},
+		{Client: "127.0.0.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Answers: 1, Source: "cached"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("query log mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	p := filepath.Join(dir, "queries.log")
+
+	f, err := openRotatingFile(p, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		"queries.log":   "dddddd\n",
+		"queries.log.1": "cccccc\n",
+		"queries.log.2": "bbbbbb\n",
+	}
+	for name, content := range want {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("%s = %q, want %q", name, b, content)
+		}
+	}
+	if _, err := ioutil.ReadFile(p + ".3"); err == nil {
+		t.Error("more backups than maxBackups were kept")
+	}
+}
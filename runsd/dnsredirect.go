@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// dnsRedirectChain is the nat chain holding the redirection rules.
+	dnsRedirectChain = "RUNSD_DNS"
+	// dnsRedirectMark is the socket mark of the queries runsd sends to the
+	// upstream nameservers, which are exempt from the redirection.
+	dnsRedirectMark = 0x52534e
+)
+
+// dnsRedirectRules returns the iptables arguments to redirect the DNS queries
+// sent from the container to the DNS server at ip:port.
+func dnsRedirectRules(ip net.IP, port string) [][]string {
+	target := []string{"-j", "DNAT", "--to-destination", net.JoinHostPort(ip.String(), port)}
+	if ip.IsLoopback() {
+		target = []string{"-j", "REDIRECT", "--to-ports", port}
+	}
+	rules := [][]string{
+		{"-t", "nat", "-N", dnsRedirectChain},
+		{"-t", "nat", "-A", dnsRedirectChain, "-m", "mark", "--mark", fmt.Sprintf("%#x", dnsRedirectMark), "-j", "RETURN"},
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, append([]string{"-t", "nat", "-A", dnsRedirectChain, "-p", proto, "--dport", "53"}, target...))
+	}
+	return append(rules, []string{"-t", "nat", "-A", "OUTPUT", "-j", dnsRedirectChain})
+}
+
+// dnsRedirectCleanupRules returns the iptables arguments to remove the rules
+// added by dnsRedirectRules.
+func dnsRedirectCleanupRules() [][]string {
+	return [][]string{
+		{"-t", "nat", "-D", "OUTPUT", "-j", dnsRedirectChain},
+		{"-t", "nat", "-F", dnsRedirectChain},
+		{"-t", "nat", "-X", dnsRedirectChain},
+	}
+}
+
+// installDNSRedirect redirects all DNS queries (UDP/TCP port 53) sent from
+// the container to the DNS servers at ips, so that resolvers that don't use
+// resolv.conf also query runsd. It returns a function that removes the rules.
+func installDNSRedirect(ips []net.IP, port string) (func(), error) {
+	if err := checkSocketMark(); err != nil {
+		return nil, err
+	}
+	var installed []string
+	cleanup := func() {
+		for _, bin := range installed {
+			for _, args := range dnsRedirectCleanupRules() {
+				if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+					klog.Warningf("failed to remove dns redirect rule (%s %s): %v: %s", bin, strings.Join(args, " "), err, out)
+				}
+			}
+		}
+	}
+	for _, ip := range ips {
+		bin := "iptables"
+		if ip.To4() == nil {
+			bin = "ip6tables"
+		}
+		// remove the leftovers from a previous run
+		for _, args := range dnsRedirectCleanupRules() {
+			exec.Command(bin, args...).Run()
+		}
+		installed = append(installed, bin)
+		for _, args := range dnsRedirectRules(ip, port) {
+			klog.V(4).Infof("adding dns redirect rule: %s %s", bin, strings.Join(args, " "))
+			if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+				cleanup()
+				return nil, fmt.Errorf("%s %s failed: %v: %s", bin, strings.Join(args, " "), err, out)
+			}
+		}
+	}
+	addUpstreamDialControl(markSocket(dnsRedirectMark))
+	return cleanup, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// markSocket returns a dialer control function that sets the SO_MARK of the
+// sockets.
+func markSocket(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// checkSocketMark returns an error if the sockets cannot be marked (which
+// requires the CAP_NET_ADMIN capability).
+func checkSocketMark() error {
+	c, err := (&net.ListenConfig{Control: markSocket(dnsRedirectMark)}).ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolverMarksSockets(t *testing.T) {
+	if err := checkSocketMark(); err != nil {
+		t.Skipf("cannot mark sockets: %v", err)
+	}
+	defer func() { upstreamDialer = nil }()
+	addUpstreamDialControl(markSocket(dnsRedirectMark))
+	var got, dials int32
+	addUpstreamDialControl(func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&dials, 1)
+		c.Control(func(fd uintptr) {
+			mark, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+			atomic.StoreInt32(&got, int32(mark))
+		})
+		return errors.New("not sending the query")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resolver("192.0.2.255:53").LookupHost(ctx, "hello-2wvlk7vg3a-uc.a.run.app.")
+	if atomic.LoadInt32(&dials) == 0 {
+		t.Fatal("resolver did not use the upstream dialer")
+	}
+	if got := atomic.LoadInt32(&got); got != dnsRedirectMark {
+		t.Errorf("socket mark=%#x, want=%#x", got, dnsRedirectMark)
+	}
+}
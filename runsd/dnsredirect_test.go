@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDNSRedirectRules(t *testing.T) {
+	join := func(rules [][]string) []string {
+		var out []string
+		for _, r := range rules {
+			out = append(out, strings.Join(r, " "))
+		}
+		return out
+	}
+
+	got := join(dnsRedirectRules(net.IPv4(127, 0, 0, 1), "53"))
+	want := []string{
+		"-t nat -N RUNSD_DNS",
+		"-t nat -A RUNSD_DNS -m mark --mark 0x52534e -j RETURN",
+		"-t nat -A RUNSD_DNS -p udp --dport 53 -j REDIRECT --to-ports 53",
+		"-t nat -A RUNSD_DNS -p tcp --dport 53 -j REDIRECT --to-ports 53",
+		"-t nat -A OUTPUT -j RUNSD_DNS",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("loopback rules mismatch (-want +got):\n%s", diff)
+	}
+
+	got = join(dnsRedirectRules(net.ParseIP("fd00::1"), "5353"))
+	if want := "-t nat -A RUNSD_DNS -p udp --dport 53 -j DNAT --to-destination [fd00::1]:5353"; got[2] != want {
+		t.Errorf("non-loopback rule = %q, want %q", got[2], want)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	modeEmulator = "emulator"
+
+	// defaultEmulatorRegion is the region of the emulated services without a
+	// region, if -gcp_region isn't set.
+	defaultEmulatorRegion = "us-central1"
+)
+
+// parseEmulatedServices parses comma-separated NAME=HOST:PORT pairs (e.g.
+// billing=localhost:8081,users=localhost:8082) as routes to the local
+// processes the services are emulated by, which are sent no ID tokens. The
+// values can also be http(s) URLs, e.g. billing=http://billing:8080 for the
+// containers of a docker-compose stack.
+func parseEmulatedServices(s string) (routes, error) {
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(routes, len(kv))
+	for name, v := range kv {
+		if parts := strings.Split(name, "."); len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid emulated service %q: not in SVC or SVC.REGION form", name)
+		}
+		if !strings.Contains(v, "://") {
+			if _, _, err := net.SplitHostPort(v); err != nil {
+				return nil, fmt.Errorf("invalid address %q for emulated service %s: %w", v, name, err)
+			}
+			v = "http://" + v
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid address %q for emulated service %s, expected HOST:PORT or http(s)://HOST[:PORT]", v, name)
+		}
+		out[name] = route{target: &url.URL{Scheme: u.Scheme, Host: u.Host}, noAuth: true}
+	}
+	return out, nil
+}
+
+// merge returns the routes with the other routes added, failing if a name is
+// in both.
+func (r routes) merge(other routes) (routes, error) {
+	out := make(routes, len(r)+len(other))
+	for k, v := range r {
+		out[k] = v
+	}
+	for k, v := range other {
+		if _, ok := out[k]; ok {
+			return nil, fmt.Errorf("%s has multiple routes", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseEmulatedServices(t *testing.T) {
+	got, err := parseEmulatedServices("billing=localhost:8081, users.europe-west1=http://users:8080,Auth=https://auth:8443/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"billing":            "http://localhost:8081",
+		"users.europe-west1": "http://users:8080",
+		"auth":               "https://auth:8443",
+	}
+	gotURLs := make(map[string]string)
+	for name, rt := range got {
+		if !rt.noAuth {
+			t.Errorf("expected %s to be sent no id tokens", name)
+		}
+		gotURLs[name] = rt.target.String()
+	}
+	if diff := cmp.Diff(want, gotURLs); diff != "" {
+		t.Errorf("routes mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, in := range []string{
+		"billing",
+		"billing=localhost",
+		"billing=ftp://localhost:21",
+		"billing=http://localhost:8081/api",
+		"a.b.c=localhost:8081",
+	} {
+		if _, err := parseEmulatedServices(in); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+}
+
+func TestReverseProxyBackendEmulated(t *testing.T) {
+	emulated, err := parseEmulatedServices("billing=localhost:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := newReverseProxy("", "us-central1", "run.internal.")
+	rp.routes = routes{"ledger": {target: &url.URL{Scheme: "http", Host: "10.128.0.9:8080"}}}
+	if rp.routes, err = rp.routes.merge(emulated); err != nil {
+		t.Fatal(err)
+	}
+	rp.emulated = true
+
+	if scheme, host, err := rp.backend("billing.us-central1.run.internal."); err != nil || scheme != "http" || host != "localhost:8081" {
+		t.Errorf("billing: got=%s://%s err=%v", scheme, host, err)
+	}
+	if !rp.noAuth("billing") {
+		t.Error("expected no auth for billing")
+	}
+	if _, host, err := rp.backend("ledger"); err != nil || host != "10.128.0.9:8080" {
+		t.Errorf("ledger: got=%s err=%v", host, err)
+	}
+	if _, _, err := rp.backend("hello"); err == nil {
+		t.Error("expected error for a service that isn't emulated")
+	}
+	if _, err := rp.routes.merge(emulated); err == nil {
+		t.Error("expected error merging a name with multiple routes")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// executionEnvironment is the sandbox runsd is running in.
+type executionEnvironment int
+
+const (
+	envOther executionEnvironment = iota // not on Cloud Run (e.g. local docker)
+	envGen1                              // Cloud Run first generation (gVisor)
+	envGen2                              // Cloud Run second generation (microVM, full Linux kernel)
+)
+
+func (e executionEnvironment) String() string {
+	switch e {
+	case envGen1:
+		return "cloudrun-gen1"
+	case envGen2:
+		return "cloudrun-gen2"
+	default:
+		return "other"
+	}
+}
+
+// gvisorKernelRelease is the kernel version reported by the gVisor sandbox.
+const gvisorKernelRelease = "4.4.0"
+
+func detectExecutionEnvironment() executionEnvironment {
+	return detectExecutionEnvironmentFrom("/proc/sys/kernel/osrelease", "/proc/version", os.Getenv("K_SERVICE") != "")
+}
+
+func detectExecutionEnvironmentFrom(osReleaseFile, versionFile string, cloudRunEnv bool) executionEnvironment {
+	release, err := ioutil.ReadFile(osReleaseFile)
+	if err != nil {
+		klog.V(4).Infof("cannot read kernel release: %v", err)
+	}
+	version, err := ioutil.ReadFile(versionFile)
+	if err != nil {
+		klog.V(4).Infof("cannot read kernel version: %v", err)
+	}
+	if strings.TrimSpace(string(release)) == gvisorKernelRelease || strings.Contains(string(version), "gVisor") {
+		return envGen1
+	}
+	if cloudRunEnv {
+		return envGen2
+	}
+	return envOther
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectExecutionEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	gvisorRelease := write("gvisor-release", "4.4.0\n")
+	gvisorVersion := write("gvisor-version", "Linux version 4.4.0 #1 SMP Sun Jan 10 15:06:54 PST 2016\n")
+	linuxRelease := write("linux-release", "5.10.0-cloudrun\n")
+	linuxVersion := write("linux-version", "Linux version 5.10.0-cloudrun (gcc version 10.2.1)\n")
+
+	cases := []struct {
+		name             string
+		release, version string
+		cloudRun         bool
+		want             executionEnvironment
+	}{
+		{name: "gen1", release: gvisorRelease, version: gvisorVersion, cloudRun: true, want: envGen1},
+		{name: "gen2", release: linuxRelease, version: linuxVersion, cloudRun: true, want: envGen2},
+		{name: "local", release: linuxRelease, version: linuxVersion, cloudRun: false, want: envOther},
+		{name: "unreadable", release: filepath.Join(dir, "missing"), version: filepath.Join(dir, "missing"), want: envOther},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectExecutionEnvironmentFrom(tt.release, tt.version, tt.cloudRun); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
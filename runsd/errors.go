@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// errorHeader is set on the error responses generated by runsd (rather than
+// the backends) to the error code.
+const errorHeader = "X-Runsd-Error"
+
+// Error codes of the proxyErrors.
+const (
+	errCodeUnknownHost      = "unknown_host"
+	errCodeTokenUnavailable = "token_unavailable"
+	errCodeUpstreamFailed   = "upstream_unreachable"
+	errCodeUpstreamTimeout  = "upstream_timeout"
+	errCodeCircuitOpen      = "circuit_open"
+	errCodeRequestTooLarge  = "request_too_large"
+	errCodeResponseTooLarge = "response_too_large"
+	errCodeHeadersTooLarge  = "request_headers_too_large"
+	errCodeRateLimited      = "rate_limited"
+	errCodeOverloaded       = "overloaded"
+)
+
+// proxyError is the JSON body of the error responses generated by runsd.
+type proxyError struct {
+	Error       string `json:"error"`
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Destination string `json:"destination,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+}
+
+func newProxyError(status int, code, destination, msg string) proxyError {
+	return proxyError{Error: "runsd: " + msg, Code: code, Status: status, Destination: destination}
+}
+
+func (e proxyError) withHint(hint string) proxyError {
+	e.Hint = hint
+	return e
+}
+
+func (e proxyError) header() http.Header {
+	return http.Header{
+		"Content-Type":           {"application/json"},
+		"X-Content-Type-Options": {"nosniff"},
+		errorHeader:              {e.Code},
+	}
+}
+
+// write responds with the error.
+func (e proxyError) write(w http.ResponseWriter) {
+	recentProxyErrors.add(e)
+	for k, v := range e.header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// response returns the error as a response to req, for the transports.
+func (e proxyError) response(req *http.Request) *http.Response {
+	recentProxyErrors.add(e)
+	b, _ := json.Marshal(e)
+	b = append(b, '\n')
+	return &http.Response{
+		Request:       req,
+		Status:        strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header(),
+		ContentLength: int64(len(b)),
+		Body:          proxyErrorBody{bytes.NewReader(b)},
+	}
+}
+
+// proxyErrorBody is the body of the error responses generated by the
+// transports, to tell them apart from the responses of the backends.
+type proxyErrorBody struct{ *bytes.Reader }
+
+func (proxyErrorBody) Close() error { return nil }
+
+// isProxyErrorResponse reports whether the response was generated by runsd
+// rather than received from the backend.
+func isProxyErrorResponse(resp *http.Response) bool {
+	_, ok := resp.Body.(proxyErrorBody)
+	return ok
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	etcHostsBegin = "# BEGIN runsd managed entries"
+	etcHostsEnd   = "# END runsd managed entries"
+)
+
+// etcHostsSyncer materializes the names of the known services into the hosts
+// file, for the resolvers that don't handle the search domains well (the
+// "files" source is checked before "dns" in the default nsswitch.conf).
+type etcHostsSyncer struct {
+	path   string
+	domain string
+	region string
+	ips    []net.IP
+
+	// listServices returns the names of the services in the region.
+	listServices func() ([]string, error)
+}
+
+// entries returns the hosts file lines for the services.
+func (s *etcHostsSyncer) entries(services []string) []string {
+	sort.Strings(services)
+	var out []string
+	for _, svc := range services {
+		names := fmt.Sprintf("%s %s.%s %s.%s.%s", svc, svc, s.region, svc, s.region, strings.Trim(s.domain, "."))
+		for _, ip := range s.ips {
+			out = append(out, ip.String()+" "+names)
+		}
+	}
+	return out
+}
+
+// mergeEtcHosts replaces the runsd-managed block in the hosts file contents
+// with the entries.
+func mergeEtcHosts(contents []byte, entries []string) []byte {
+	var b bytes.Buffer
+	skip := false
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		switch strings.TrimSpace(line) {
+		case etcHostsBegin:
+			skip = true
+			continue
+		case etcHostsEnd:
+			skip = false
+			continue
+		}
+		if !skip {
+			b.WriteString(line)
+		}
+	}
+	if len(entries) == 0 {
+		return b.Bytes()
+	}
+	if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	fmt.Fprintln(&b, etcHostsBegin)
+	for _, e := range entries {
+		fmt.Fprintln(&b, e)
+	}
+	fmt.Fprintln(&b, etcHostsEnd)
+	return b.Bytes()
+}
+
+func (s *etcHostsSyncer) sync() error {
+	services, err := s.listServices()
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	cur, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	want := mergeEtcHosts(cur, s.entries(services))
+	if bytes.Equal(cur, want) {
+		return nil
+	}
+	klog.V(3).Infof("updating %s with %d services", s.path, len(services))
+	return writeResolvConf(s.path, want)
+}
+
+// run syncs the hosts file periodically.
+func (s *etcHostsSyncer) run(interval time.Duration) {
+	for {
+		if err := s.sync(); err != nil {
+			klog.Warningf("failed to sync %s: %v", s.path, err)
+		}
+		time.Sleep(interval)
+	}
+}
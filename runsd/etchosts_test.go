@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestEtcHostsSync(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	p := writeTempFile(t, dir, "hosts", "127.0.0.1 localhost\n10.0.0.5 db")
+
+	services := []string{"hello", "billing"}
+	s := &etcHostsSyncer{
+		path:         p,
+		domain:       "run.internal.",
+		region:       "us-central1",
+		ips:          []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		listServices: func() ([]string, error) { return services, nil },
+	}
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	want := "127.0.0.1 localhost\n10.0.0.5 db\n" +
+		etcHostsBegin + "\n" +
+		"127.0.0.1 billing billing.us-central1 billing.us-central1.run.internal\n" +
+		"::1 billing billing.us-central1 billing.us-central1.run.internal\n" +
+		"127.0.0.1 hello hello.us-central1 hello.us-central1.run.internal\n" +
+		"::1 hello hello.us-central1 hello.us-central1.run.internal\n" +
+		etcHostsEnd + "\n"
+	if b, _ := ioutil.ReadFile(p); string(b) != want {
+		t.Fatalf("got hosts file:\n%s\nwant:\n%s", b, want)
+	}
+
+	services = nil
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(p); string(b) != "127.0.0.1 localhost\n10.0.0.5 db\n" {
+		t.Fatalf("managed entries not removed:\n%s", b)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// faultRule is the artificial latency, errors and connection resets injected
+// to the requests to a destination.
+type faultRule struct {
+	delay        time.Duration
+	delayPercent float64
+	abortStatus  int
+	abortPercent float64
+	resetPercent float64
+}
+
+// validate returns an error if the status code or the percentages of the
+// rule are out of range.
+func (r faultRule) validate() error {
+	// other statuses wouldn't fail the requests (e.g. a 1xx response is
+	// followed by an implicit 200)
+	if r.abortStatus != 0 && (r.abortStatus < 400 || r.abortStatus > 599) {
+		return fmt.Errorf("invalid abort status %d, must be between 400 and 599", r.abortStatus)
+	}
+	for _, p := range []float64{r.delayPercent, r.abortPercent, r.resetPercent} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("invalid percentage %v, must be between 0 and 100", p)
+		}
+	}
+	return nil
+}
+
+func (r faultRule) enabled() bool {
+	return (r.delay > 0 && r.delayPercent > 0) ||
+		(r.abortStatus > 0 && r.abortPercent > 0) ||
+		r.resetPercent > 0
+}
+
+// faultInjector injects artificial latency, errors or connection resets to
+// the requests going through the reverse proxy for resilience testing.
+type faultInjector struct {
+	// targets are the destinations (service names or hostnames) faults are
+	// injected for. If empty, faults are injected for all destinations.
+	targets map[string]bool
+	faultRule
+
+	// destinations are the rules for specific destinations (service names or
+	// hostnames), used instead of the rule above.
+	destinations map[string]faultRule
+}
+
+func (f *faultInjector) enabled() bool {
+	if f.faultRule.enabled() {
+		return true
+	}
+	for _, r := range f.destinations {
+		if r.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the faults to inject for the host.
+func (f *faultInjector) rule(host string) (faultRule, bool) {
+	host = hostWithoutPort(host)
+	if r, ok := f.destinations[host]; ok {
+		return r, true
+	}
+	if r, ok := f.destinations[serviceName(host)]; ok {
+		return r, true
+	}
+	if len(f.targets) == 0 {
+		return f.faultRule, true
+	}
+	return f.faultRule, f.targets[host] || f.targets[serviceName(host)]
+}
+
+// handler wraps the next handler with fault injection. If no faults are
+// configured, next is returned as is.
+func (f *faultInjector) handler(next http.Handler) http.Handler {
+	if !f.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, ok := f.rule(req.Host)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if roll(r.delayPercent) && r.delay > 0 {
+			klog.V(4).Infof("[fault] delaying request to host=%s by %s", req.Host, r.delay)
+			select {
+			case <-time.After(r.delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if roll(r.resetPercent) {
+			klog.V(4).Infof("[fault] resetting connection for host=%s", req.Host)
+			resetConnection(w)
+			return
+		}
+		if roll(r.abortPercent) && r.abortStatus > 0 {
+			klog.V(4).Infof("[fault] aborting request to host=%s with status=%d", req.Host, r.abortStatus)
+			http.Error(w, fmt.Sprintf("runsd: fault injected (status=%d)", r.abortStatus), r.abortStatus)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// resetConnection abruptly closes the client connection (with a TCP RST if
+// possible). For HTTP/2 connections, only the stream is reset.
+func resetConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// roll returns true with the given probability (in percent).
+func roll(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// serviceName returns the first label of the hostname, which is the Cloud Run
+// service name for internal hostnames.
+func serviceName(host string) string {
+	return strings.SplitN(host, ".", 2)[0]
+}
+
+func parseTargets(s string) map[string]bool {
+	out := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out[v] = true
+		}
+	}
+	return out
+}
+
+// faultRuleSpec is the entry for a destination in the -fault_rules_file.
+type faultRuleSpec struct {
+	Delay        string  `json:"delay"`
+	DelayPercent float64 `json:"delayPercent"`
+	AbortStatus  int     `json:"abortStatus"`
+	AbortPercent float64 `json:"abortPercent"`
+	ResetPercent float64 `json:"resetPercent"`
+}
+
+// loadFaultRules reads a JSON file of destinations (service names or
+// hostnames) to the faults injected for them, e.g.
+// {"ledger": {"delay": "200ms", "abortStatus": 503, "abortPercent": 5}}.
+// The delay applies to all requests and the abort status defaults to 503
+// unless the percentages are set.
+func loadFaultRules(path string) (map[string]faultRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string]faultRuleSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse fault rules file %s: %w", path, err)
+	}
+	out := make(map[string]faultRule, len(specs))
+	for dest, spec := range specs {
+		r := faultRule{
+			delayPercent: spec.DelayPercent,
+			abortStatus:  spec.AbortStatus,
+			abortPercent: spec.AbortPercent,
+			resetPercent: spec.ResetPercent,
+		}
+		if spec.Delay != "" {
+			if r.delay, err = time.ParseDuration(spec.Delay); err != nil || r.delay < 0 {
+				return nil, fmt.Errorf("invalid delay %q for %s", spec.Delay, dest)
+			}
+			if r.delayPercent == 0 {
+				r.delayPercent = 100
+			}
+		}
+		if r.abortPercent > 0 && r.abortStatus == 0 {
+			r.abortStatus = http.StatusServiceUnavailable
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("invalid fault rule for %s: %w", dest, err)
+		}
+		out[strings.ToLower(strings.TrimSuffix(dest, "."))] = r
+	}
+	klog.V(1).Infof("loaded fault rules for %d destination(s) from %s", len(out), path)
+	return out, nil
+}
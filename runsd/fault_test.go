@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectorAbort(t *testing.T) {
+	f := &faultInjector{
+		targets:   parseTargets("hello, World.us-central1"),
+		faultRule: faultRule{abortStatus: http.StatusServiceUnavailable, abortPercent: 100},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := f.handler(next)
+
+	cases := []struct {
+		host string
+		want int
+	}{
+		{host: "hello", want: http.StatusServiceUnavailable},
+		{host: "hello.europe-west1:80", want: http.StatusServiceUnavailable},
+		{host: "world.us-central1", want: http.StatusServiceUnavailable},
+		{host: "world", want: http.StatusOK},
+		{host: "other", want: http.StatusOK},
+	}
+	for _, tt := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("host=%s: got status %d, want %d", tt.host, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestFaultInjectorDisabled(t *testing.T) {
+	f := &faultInjector{faultRule: faultRule{abortStatus: http.StatusServiceUnavailable}}
+	if f.enabled() {
+		t.Fatal("expected fault injector without percentages to be disabled")
+	}
+}
+
+func TestFaultInjectorDestinations(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	rules, err := loadFaultRules(writeTempFile(t, dir, "faults.json", `{
+		"Ledger": {"abortPercent": 100},
+		"orders.us-central1.run.internal": {"abortStatus": 429, "abortPercent": 100},
+		"users": {"delay": "1ms"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rules["users"]; r.delay != time.Millisecond || r.delayPercent != 100 {
+		t.Errorf("users: got=%+v", r)
+	}
+	f := &faultInjector{
+		targets:      parseTargets("hello"),
+		faultRule:    faultRule{abortStatus: http.StatusBadGateway, abortPercent: 100},
+		destinations: rules,
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := f.handler(next)
+	for _, tt := range []struct {
+		host string
+		want int
+	}{
+		{host: "hello", want: http.StatusBadGateway},
+		{host: "ledger", want: http.StatusServiceUnavailable},
+		{host: "ledger.europe-west1.run.internal.", want: http.StatusServiceUnavailable},
+		{host: "orders.us-central1.run.internal", want: http.StatusTooManyRequests},
+		{host: "orders", want: http.StatusOK},
+		{host: "users", want: http.StatusOK},
+		{host: "other", want: http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil))
+		if rec.Code != tt.want {
+			t.Errorf("host=%s: got status %d, want %d", tt.host, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestLoadFaultRulesInvalid(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, content := range []string{
+		`{"ledger": {"delay": "soon"}}`,
+		`{"ledger": {"abortStatus": 1000, "abortPercent": 5}}`,
+		`{"ledger": {"abortPercent": 150}}`,
+		`["ledger"]`,
+	} {
+		if _, err := loadFaultRules(writeTempFile(t, dir, "faults.json", content)); err == nil {
+			t.Errorf("expected error for %s", content)
+		}
+	}
+}
+
+func TestFaultRuleValidate(t *testing.T) {
+	cases := []struct {
+		rule    faultRule
+		wantErr bool
+	}{
+		{rule: faultRule{abortStatus: 503, abortPercent: 5}},
+		{rule: faultRule{}},
+		{rule: faultRule{abortStatus: 1000, abortPercent: 5}, wantErr: true},
+		{rule: faultRule{abortStatus: 400, abortPercent: 5}},
+		{rule: faultRule{abortStatus: 599, abortPercent: 5}},
+		{rule: faultRule{abortStatus: 99, abortPercent: 5}, wantErr: true},
+		{rule: faultRule{abortStatus: 103, abortPercent: 5}, wantErr: true},
+		{rule: faultRule{abortStatus: 200, abortPercent: 5}, wantErr: true},
+		{rule: faultRule{abortStatus: 399, abortPercent: 5}, wantErr: true},
+		{rule: faultRule{abortStatus: -1}, wantErr: true},
+		{rule: faultRule{delayPercent: 101}, wantErr: true},
+		{rule: faultRule{resetPercent: -1}, wantErr: true},
+	}
+	for _, tt := range cases {
+		if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) err=%v, wantErr=%v", tt.rule, err, tt.wantErr)
+		}
+	}
+}
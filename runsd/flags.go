@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseKeyValues parses comma-separated KEY=VALUE pairs (as used in flags
+// like -latency_budget=hello=100ms,world=1s). Keys are lowercased.
+func parseKeyValues(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid value %q, expected KEY=VALUE", kv)
+		}
+		out[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return out, nil
+}
+
+// parsePorts parses a comma-separated list of ports, removing duplicates.
+func parsePorts(s string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if p, err := strconv.ParseUint(v, 10, 16); err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid port %q", v)
+		}
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no ports specified")
+	}
+	return out, nil
+}
+
+// isFlagSet reports whether the flag was specified on the command line.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// repeatedFlag is a flag.Value collecting the values of a flag that can be
+// specified multiple times. The first value replaces the defaults.
+type repeatedFlag struct {
+	values []string
+	set    bool
+}
+
+func (r *repeatedFlag) String() string {
+	if r == nil {
+		return ""
+	}
+	return strings.Join(r.values, ",")
+}
+
+func (r *repeatedFlag) Set(v string) error {
+	if !r.set {
+		r.values, r.set = nil, true
+	}
+	r.values = append(r.values, v)
+	return nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	got, err := parsePorts("80, 8443,3000,80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "80,8443,3000" {
+		t.Errorf("got %v", got)
+	}
+	for _, bad := range []string{"", ",", "http", "0", "70000", "80,-1"} {
+		if _, err := parsePorts(bad); err == nil {
+			t.Errorf("parsePorts(%q) expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// grpcTrailers are the trailers gRPC servers end the responses with.
+var grpcTrailers = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// grpcTrailersTransport makes sure the trailers of the gRPC responses reach
+// the clients, even for the responses without a body: the trailers are
+// announced up front (so httputil.ReverseProxy sends the headers without
+// ending the stream, and uses chunked encoding on HTTP/1.1) and the
+// Content-Length of the backend is dropped, as it would otherwise end the
+// response before the trailers.
+type grpcTrailersTransport struct {
+	next http.RoundTripper
+}
+
+var _ http.Flusher = grpcTrailersTransport{} // ensure it's a Flusher
+
+func (g grpcTrailersTransport) Flush() {
+	if v, ok := g.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (g grpcTrailersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := g.next.RoundTrip(req)
+	if err != nil || !isGRPCResponse(resp) {
+		return resp, err
+	}
+	if resp.Header.Get("grpc-status") != "" {
+		// trailers-only response (e.g. an error before any message), the
+		// status is in the headers
+		return resp, nil
+	}
+	resp.Header.Del("content-length")
+	resp.ContentLength = -1
+	if resp.Trailer == nil {
+		// the transport sets the trailers to the same field once the body
+		// is read
+		resp.Trailer = make(http.Header)
+	}
+	for _, k := range grpcTrailers {
+		if _, ok := resp.Trailer[k]; !ok {
+			resp.Trailer[k] = nil
+		}
+	}
+	return resp, nil
+}
+
+func isGRPCResponse(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("content-type"))
+	return mt == "application/grpc" || strings.HasPrefix(mt, "application/grpc+")
+}
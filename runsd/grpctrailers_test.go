@@ -0,0 +1,151 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/http2"
+)
+
+// testGRPCServer is a minimal gRPC server (speaking the gRPC wire protocol
+// over HTTP/2) with methods ending their responses in the different ways the
+// gRPC servers do.
+var testGRPCServer = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	msgs, err := readGRPCMessages(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("content-type", "application/grpc")
+	switch req.URL.Path {
+	case "/test.Echo/Unary":
+		w.Write(grpcFrame(0, msgs[0]))
+	case "/test.Echo/Stream":
+		for _, m := range []string{"a", "b", "c"} {
+			w.Write(grpcFrame(0, m))
+			w.(http.Flusher).Flush()
+		}
+	case "/test.Echo/Empty":
+		// no messages, only the status in the trailers
+	case "/test.Echo/Fail":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		w.Header().Set(http.TrailerPrefix+"grpc-status", "13")
+		w.Header().Set(http.TrailerPrefix+"grpc-message", "boom")
+		w.Header().Set(http.TrailerPrefix+"grpc-status-details-bin", "CAE")
+		return
+	default:
+		// trailers-only response
+		w.Header().Set("grpc-status", "12")
+		w.Header().Set("grpc-message", "unknown method")
+		return
+	}
+	w.Header().Set(http.TrailerPrefix+"grpc-status", "0")
+})
+
+// readGRPCMessages reads the length-prefixed messages in the body.
+func readGRPCMessages(r io.Reader) ([]string, error) {
+	var out []string
+	for {
+		var hdr [5]byte
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		out = append(out, string(msg))
+	}
+}
+
+// grpcResult is what a gRPC client sees of a call.
+type grpcResult struct {
+	Messages []string
+	Status   string
+	Message  string
+	Details  string
+}
+
+func callGRPC(t *testing.T, client *http.Client, proxyURL, method, msg string) grpcResult {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, proxyURL+method, bytes.NewReader(grpcFrame(0, msg)))
+	req.Host = "echo"
+	req.Header.Set("content-type", "application/grpc")
+	req.Header.Set("te", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	msgs, err := readGRPCMessages(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	md := resp.Trailer
+	if resp.Header.Get("grpc-status") != "" {
+		md = resp.Header
+	}
+	return grpcResult{Messages: msgs, Status: md.Get("grpc-status"), Message: md.Get("grpc-message"), Details: md.Get("grpc-status-details-bin")}
+}
+
+func TestProxyGRPCTrailers(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	proxyURL, cleanup := newTestProxy(t, rp, testGRPCServer)
+	defer cleanup()
+
+	clients := map[string]*http.Client{
+		"h2c": {Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}},
+		// e.g. the gRPC-Web proxies of some frameworks
+		"http/1.1": http.DefaultClient,
+	}
+	cases := []struct {
+		method string
+		want   grpcResult
+	}{
+		{method: "/test.Echo/Unary", want: grpcResult{Messages: []string{"hello"}, Status: "0"}},
+		{method: "/test.Echo/Stream", want: grpcResult{Messages: []string{"a", "b", "c"}, Status: "0"}},
+		{method: "/test.Echo/Empty", want: grpcResult{Status: "0"}},
+		{method: "/test.Echo/Fail", want: grpcResult{Status: "13", Message: "boom", Details: "CAE"}},
+		{method: "/test.Echo/Unknown", want: grpcResult{Status: "12", Message: "unknown method"}},
+	}
+	for name, client := range clients {
+		for _, tt := range cases {
+			t.Run(name+tt.method, func(t *testing.T) {
+				got := callGRPC(t, client, proxyURL, tt.method, "hello")
+				if diff := cmp.Diff(tt.want, got); diff != "" {
+					t.Errorf("result mismatch (-want +got):\n%s", diff)
+				}
+			})
+		}
+	}
+}
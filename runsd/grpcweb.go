@@ -0,0 +1,159 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag marks the frame carrying the trailers at the end of
+	// the gRPC-Web response bodies.
+	grpcWebTrailerFlag = 0x80
+)
+
+// grpcWebTransport translates the gRPC-Web requests (e.g. from browsers) to
+// gRPC for the backends that don't speak gRPC-Web, and their responses back,
+// carrying the trailers in the body.
+type grpcWebTransport struct {
+	next http.RoundTripper
+}
+
+var _ http.Flusher = grpcWebTransport{} // ensure it's a Flusher
+
+func (g grpcWebTransport) Flush() {
+	if v, ok := g.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (g grpcWebTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct := req.Header.Get("content-type")
+	if !strings.HasPrefix(ct, grpcWebContentType) {
+		return g.next.RoundTrip(req)
+	}
+	webType, subtype := grpcWebContentType, strings.TrimPrefix(ct, grpcWebContentType)
+	text := strings.HasPrefix(ct, grpcWebTextContentType)
+	if text {
+		webType, subtype = grpcWebTextContentType, strings.TrimPrefix(ct, grpcWebTextContentType)
+	}
+	klog.V(5).Infof("[proxy] translating grpc-web request url=%s content-type=%s", req.URL, ct)
+
+	req = req.Clone(req.Context())
+	req.Header.Set("content-type", "application/grpc"+subtype)
+	req.Header.Set("te", "trailers")
+	req.Header.Del("content-length")
+	if text && req.Body != nil && req.Body != http.NoBody {
+		req.Body = ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, req.Body))
+		req.ContentLength = -1
+	}
+	resp, err := g.next.RoundTrip(req)
+	if err != nil || !strings.HasPrefix(resp.Header.Get("content-type"), "application/grpc") {
+		return resp, err
+	}
+
+	out := *resp
+	out.Header = resp.Header.Clone()
+	out.Header.Set("content-type", webType+strings.TrimPrefix(resp.Header.Get("content-type"), "application/grpc"))
+	out.Header.Del("content-length")
+	out.ContentLength = -1
+	// the trailers are sent in the body instead
+	out.Trailer = nil
+	out.Body = &grpcWebResponseBody{resp: resp, text: text}
+	return &out, nil
+}
+
+// grpcWebResponseBody is the body of a gRPC response, followed by a frame of
+// its trailers, and base64-encoded for the grpc-web-text requests.
+type grpcWebResponseBody struct {
+	resp *http.Response // of the backend
+	text bool
+
+	chunk []byte
+	buf   bytes.Buffer // the translated bytes not read yet
+	err   error        // returned once buf is drained
+}
+
+func (b *grpcWebResponseBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.chunk == nil {
+			b.chunk = make([]byte, 32<<10)
+		}
+		n, err := b.resp.Body.Read(b.chunk)
+		b.write(b.chunk[:n])
+		if err == io.EOF {
+			b.write(grpcWebTrailers(b.resp))
+		}
+		b.err = err
+	}
+	return b.buf.Read(p)
+}
+
+// write adds the data to the buffer, encoded for the grpc-web-text requests.
+// Each chunk is padded separately, so the clients can decode the messages as
+// soon as they arrive.
+func (b *grpcWebResponseBody) write(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if !b.text {
+		b.buf.Write(data)
+		return
+	}
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(enc, data)
+	b.buf.Write(enc)
+}
+
+func (b *grpcWebResponseBody) Close() error { return b.resp.Body.Close() }
+
+// grpcWebTrailers returns the frame with the trailers of the gRPC response,
+// or nothing for the trailers-only responses (e.g. errors) with the status in
+// the headers, which are passed on as is.
+func grpcWebTrailers(resp *http.Response) []byte {
+	if resp.Header.Get("grpc-status") != "" && len(resp.Trailer) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var block bytes.Buffer
+	for _, k := range keys {
+		for _, v := range resp.Trailer[k] {
+			block.WriteString(strings.ToLower(k) + ": " + v + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
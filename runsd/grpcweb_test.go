@@ -0,0 +1,124 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// grpcFrame returns a length-prefixed gRPC message frame.
+func grpcFrame(flag byte, msg string) []byte {
+	n := len(msg)
+	return append([]byte{flag, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, msg...)
+}
+
+func TestProxyGRPCWeb(t *testing.T) {
+	var gotHeader http.Header
+	var gotBody []byte
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHeader = req.Header.Clone()
+		gotBody, _ = ioutil.ReadAll(req.Body)
+		if req.Header.Get("x-fail") != "" {
+			w.Header().Set("content-type", "application/grpc+proto")
+			w.Header().Set("grpc-status", "5")
+			w.Header().Set("grpc-message", "not found")
+			return
+		}
+		w.Header().Set("trailer", "grpc-status, grpc-message")
+		w.Header().Set("content-type", "application/grpc+proto")
+		w.Write(grpcFrame(0, "world"))
+		w.Header().Set("grpc-status", "0")
+		w.Header().Set("grpc-message", "ok")
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.grpcWeb = true
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	wantTrailers := grpcFrame(grpcWebTrailerFlag, "grpc-message: ok\r\ngrpc-status: 0\r\n")
+	cases := []struct {
+		contentType string
+		encode      func([]byte) []byte
+		decode      func([]byte) []byte
+	}{
+		{
+			contentType: "application/grpc-web+proto",
+			encode:      func(b []byte) []byte { return b },
+			decode:      func(b []byte) []byte { return b },
+		},
+		{
+			contentType: "application/grpc-web-text+proto",
+			encode:      func(b []byte) []byte { return []byte(base64.StdEncoding.EncodeToString(b)) },
+			decode: func(b []byte) []byte {
+				// the chunks are padded separately, so decode each quantum
+				var out []byte
+				for i := 0; i+4 <= len(b); i += 4 {
+					v, _ := base64.StdEncoding.DecodeString(string(b[i : i+4]))
+					out = append(out, v...)
+				}
+				return out
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.contentType, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, proxyURL+"/hello.Greeter/SayHello", bytes.NewReader(tt.encode(grpcFrame(0, "hello"))))
+			req.Host = "greeter"
+			req.Header.Set("content-type", tt.contentType)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if v := gotHeader.Get("content-type"); v != "application/grpc+proto" {
+				t.Errorf("backend got content-type=%q", v)
+			}
+			if v := gotHeader.Get("te"); v != "trailers" {
+				t.Errorf("backend got te=%q", v)
+			}
+			if !bytes.Equal(gotBody, grpcFrame(0, "hello")) {
+				t.Errorf("backend got body=%q", gotBody)
+			}
+			if v := resp.Header.Get("content-type"); v != tt.contentType {
+				t.Errorf("response content-type=%q, want=%q", v, tt.contentType)
+			}
+			want := append(grpcFrame(0, "world"), wantTrailers...)
+			if got := tt.decode(body); !bytes.Equal(got, want) {
+				t.Errorf("response body=%q, want=%q", got, want)
+			}
+		})
+	}
+
+	// trailers-only responses keep the status in the headers
+	req, _ := http.NewRequest(http.MethodPost, proxyURL+"/hello.Greeter/SayHello", bytes.NewReader(grpcFrame(0, "hello")))
+	req.Host = "greeter"
+	req.Header.Set("content-type", "application/grpc-web+proto")
+	req.Header.Set("x-fail", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("grpc-status") != "5" || len(body) != 0 {
+		t.Errorf("trailers-only response: grpc-status=%q body=%q", resp.Header.Get("grpc-status"), body)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const ctxKeyOriginalHost = `original-host`
+
+// headerRuleSpec is the rule for a destination in the -header_rules_file.
+type headerRuleSpec struct {
+	// Set headers replace the headers with the same name. Values can refer to
+	// environment variables as ${VAR}.
+	Set map[string]string `json:"set"`
+	// Remove headers are deleted from the requests.
+	Remove []string `json:"remove"`
+	// BasicAuthEnv is the environment variable with the USER:PASSWORD to send
+	// in a basic Authorization header. As the request then has an
+	// Authorization header, no ID token is added to it.
+	BasicAuthEnv string `json:"basicAuthEnv"`
+}
+
+type headerRule struct {
+	set    http.Header
+	remove []string
+}
+
+// headerRules are the header mutations applied to the requests, keyed by the
+// destination (service names or hostnames, or "*" for all requests).
+type headerRules map[string]headerRule
+
+// loadHeaderRules reads a JSON file of destinations to header rules, e.g.
+//
+//	{"payments": {"set": {"X-Api-Version": "2"}},
+//	 "legacy": {"basicAuthEnv": "LEGACY_CREDENTIALS"}}
+func loadHeaderRules(path string, getenv func(string) string) (headerRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string]headerRuleSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse header rules file %s: %w", path, err)
+	}
+	out := make(headerRules, len(specs))
+	for dest, spec := range specs {
+		r := headerRule{set: make(http.Header)}
+		for k, v := range spec.Set {
+			r.set.Set(k, os.Expand(v, getenv))
+		}
+		for _, k := range spec.Remove {
+			r.remove = append(r.remove, http.CanonicalHeaderKey(k))
+		}
+		if spec.BasicAuthEnv != "" {
+			creds := getenv(spec.BasicAuthEnv)
+			if !strings.Contains(creds, ":") {
+				return nil, fmt.Errorf("header rule for %s: environment variable %s must be set to USER:PASSWORD", dest, spec.BasicAuthEnv)
+			}
+			r.set.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+		}
+		out[strings.ToLower(strings.TrimSuffix(dest, "."))] = r
+	}
+	klog.V(1).Infof("loaded header rules for %d destination(s) from %s", len(out), path)
+	return out, nil
+}
+
+// apply mutates the headers per the rules for all requests and for the host.
+func (h headerRules) apply(host string, hdr http.Header) {
+	if len(h) == 0 {
+		return
+	}
+	host = hostWithoutPort(host)
+	rules := []headerRule{h["*"]}
+	if r, ok := h[host]; ok {
+		rules = append(rules, r)
+	} else if r, ok := h[serviceName(host)]; ok {
+		rules = append(rules, r)
+	}
+	for _, r := range rules {
+		for _, k := range r.remove {
+			hdr.Del(k)
+		}
+		for k, v := range r.set {
+			hdr[k] = append([]string(nil), v...)
+		}
+	}
+}
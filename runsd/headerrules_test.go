@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadHeaderRules(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeTempFile(t, dir, "headers.json", `{
+		"*": {"remove": ["x-debug"]},
+		"payments": {"set": {"x-api-version": "2", "x-tenant": "${TENANT}"}},
+		"legacy.europe-west1": {"basicAuthEnv": "LEGACY_CREDENTIALS"}
+	}`)
+	env := map[string]string{"TENANT": "acme", "LEGACY_CREDENTIALS": "user:pass"}
+	rules, err := loadHeaderRules(path, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host string
+		want http.Header
+	}{
+		{host: "payments", want: http.Header{"X-Api-Version": {"2"}, "X-Tenant": {"acme"}, "Accept": {"*/*"}}},
+		{host: "payments.us-central1.run.internal:80", want: http.Header{"X-Api-Version": {"2"}, "X-Tenant": {"acme"}, "Accept": {"*/*"}}},
+		{host: "legacy.europe-west1", want: http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}, "Accept": {"*/*"}}},
+		{host: "other", want: http.Header{"Accept": {"*/*"}}},
+	}
+	for _, tt := range cases {
+		hdr := http.Header{"X-Debug": {"1"}, "Accept": {"*/*"}}
+		rules.apply(tt.host, hdr)
+		if diff := cmp.Diff(tt.want, hdr); diff != "" {
+			t.Errorf("host=%s headers (-want,+got):\n%s", tt.host, diff)
+		}
+	}
+}
+
+func TestLoadHeaderRulesMissingCredentials(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeTempFile(t, dir, "headers.json", `{"legacy": {"basicAuthEnv": "LEGACY_CREDENTIALS"}}`)
+	if _, err := loadHeaderRules(path, func(string) string { return "" }); err == nil {
+		t.Error("expected error for unset credentials")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+
+	// healthCheckAudience is the audience of the ID token minted to verify
+	// that token minting works.
+	healthCheckAudience = "https://runsd-healthz"
+)
+
+const (
+	childNotStarted int32 = iota
+	childRunning
+	childExited
+)
+
+// healthChecker aggregates the health of the runsd components (for /healthz)
+// and, for readiness, the subprocess too (for /readyz), so that runsd failures
+// can be told apart from the app failures.
+type healthChecker struct {
+	dnsAddr   string // dns server to query, skipped if empty
+	dnsName   string // internal name to resolve
+	proxyAddr string // proxy server to connect to, skipped if empty
+	checkAuth bool   // whether to mint an ID token (for readiness)
+	appAddr   string // address the subprocess listens on, skipped if empty
+
+	childState int32 // accessed atomically
+}
+
+type healthCheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (h *healthChecker) setChildState(v int32) { atomic.StoreInt32(&h.childState, v) }
+
+// checks returns the checks of the runsd components, and of the subprocess
+// and the token minting if readiness is set (so that a short metadata server
+// outage doesn't fail the liveness probes and restart the instance).
+func (h *healthChecker) checks(readiness bool) map[string]func() error {
+	out := make(map[string]func() error)
+	if readiness {
+		out["subprocess"] = func() error {
+			switch atomic.LoadInt32(&h.childState) {
+			case childRunning:
+				return nil
+			case childNotStarted:
+				return fmt.Errorf("subprocess is not started yet")
+			default:
+				return fmt.Errorf("subprocess has exited")
+			}
+		}
+	}
+	if h.dnsAddr != "" {
+		out["dns"] = func() error {
+			m := new(dns.Msg)
+			m.SetQuestion(h.dnsName, dns.TypeA)
+			c := &dns.Client{Timeout: healthCheckTimeout}
+			r, _, err := c.Exchange(m, h.dnsAddr)
+			if err != nil {
+				return err
+			}
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 {
+				return fmt.Errorf("unexpected answer for %s: rcode=%s answers=%d", h.dnsName, dns.RcodeToString[r.Rcode], len(r.Answer))
+			}
+			return nil
+		}
+	}
+	if h.proxyAddr != "" {
+		out["proxy"] = func() error { return dialCheck(h.proxyAddr) }
+	}
+	if readiness && h.checkAuth {
+		out["token"] = func() error {
+			_, err := identityToken(healthCheckAudience)
+			return err
+		}
+	}
+	if readiness && h.appAddr != "" {
+		out["app_port"] = func() error { return dialCheck(h.appAddr) }
+	}
+	return out
+}
+
+func dialCheck(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// run runs all the checks in parallel.
+func (h *healthChecker) run(readiness bool) ([]healthCheckResult, bool) {
+	checks := h.checks(readiness)
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		healthy = true
+		results = make([]healthCheckResult, 0, len(checks))
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+			err := check()
+			mu.Lock()
+			defer mu.Unlock()
+			res := healthCheckResult{Name: name, OK: err == nil}
+			if err != nil {
+				healthy = false
+				res.Error = err.Error()
+			}
+			results = append(results, res)
+		}(name, check)
+	}
+	wg.Wait()
+	return results, healthy
+}
+
+// ServeHTTP responds with HTTP 200 if the checks of the runsd components
+// pass, and 503 otherwise.
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	h.serve(w, false)
+}
+
+// readiness returns the handler that also requires the subprocess to be
+// running (and with -healthz_check_app_port, to accept connections).
+func (h *healthChecker) readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		h.serve(w, true)
+	})
+}
+
+func (h *healthChecker) serve(w http.ResponseWriter, readiness bool) {
+	results, healthy := h.run(readiness)
+	status, code := "ok", http.StatusOK
+	if !healthy {
+		status, code = "fail", http.StatusServiceUnavailable
+		klog.V(2).Infof("health check (readiness=%v) failed: %+v", readiness, results)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string              `json:"status"`
+		Checks []healthCheckResult `json:"checks"`
+	}{status, results})
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHealthChecker(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	h := &healthChecker{proxyAddr: lis.Addr().String()}
+	check := func(wantHealthz, wantReadyz int) {
+		t.Helper()
+		for path, want := range map[string]int{"/healthz": wantHealthz, "/readyz": wantReadyz} {
+			handler := http.Handler(h)
+			if path == "/readyz" {
+				handler = h.readiness()
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != want {
+				t.Fatalf("%s: got status=%d, want=%d; body=%s", path, rec.Code, want, rec.Body.String())
+			}
+		}
+	}
+
+	check(http.StatusOK, http.StatusServiceUnavailable) // subprocess not started
+	h.setChildState(childRunning)
+	check(http.StatusOK, http.StatusOK)
+	h.setChildState(childExited)
+	check(http.StatusOK, http.StatusServiceUnavailable)
+
+	h.setChildState(childRunning)
+	lis.Close()
+	check(http.StatusServiceUnavailable, http.StatusServiceUnavailable) // proxy not bound
+}
+
+func TestHealthCheckerChecks(t *testing.T) {
+	h := &healthChecker{proxyAddr: "127.0.0.1:80", checkAuth: true, appAddr: "127.0.0.1:8080"}
+	names := func(readiness bool) []string {
+		var out []string
+		for name := range h.checks(readiness) {
+			out = append(out, name)
+		}
+		sort.Strings(out)
+		return out
+	}
+	if diff := cmp.Diff([]string{"proxy"}, names(false)); diff != "" {
+		t.Errorf("liveness checks: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"app_port", "proxy", "subprocess", "token"}, names(true)); diff != "" {
+		t.Errorf("readiness checks: %s", diff)
+	}
+}
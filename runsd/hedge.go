@@ -0,0 +1,151 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// hedgeBudget limits the hedged requests to a ratio of all requests: each
+// request adds ratio tokens (up to maxTokens), and each hedged request takes
+// one.
+type hedgeBudget struct {
+	mu        sync.Mutex
+	ratio     float64
+	tokens    float64
+	maxTokens float64
+}
+
+// hedgeBudgetMaxTokens is the number of hedged requests that can be sent at
+// once, e.g. after an idle period.
+const hedgeBudgetMaxTokens = 10
+
+func newHedgeBudget(ratio float64) *hedgeBudget {
+	return &hedgeBudget{ratio: ratio, tokens: hedgeBudgetMaxTokens, maxTokens: hedgeBudgetMaxTokens}
+}
+
+func (b *hedgeBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens += b.ratio; b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// hedgingTransport sends a second attempt of the idempotent requests without
+// a body (GET and HEAD) that don't get a response within delay (e.g. because
+// of a cold start of the backend), and uses whichever responds first.
+type hedgingTransport struct {
+	next   http.RoundTripper
+	delay  time.Duration
+	budget *hedgeBudget
+}
+
+var _ http.Flusher = hedgingTransport{} // ensure it's a Flusher
+
+func (h hedgingTransport) Flush() {
+	if v, ok := h.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// discard releases the resources of a response that's not used.
+func (r hedgeResult) discard() {
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+}
+
+func (h hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+		(req.Body != nil && req.Body != http.NoBody) || isUpgrade(req.Header) {
+		return h.next.RoundTrip(req)
+	}
+	h.budget.deposit()
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := h.next.RoundTrip(req.Clone(ctx))
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+		}()
+	}
+	send()
+	pending := 1
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	hedge := timer.C
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			if !h.budget.withdraw() {
+				klog.V(4).Infof("[hedge] no budget to hedge %s url=%s", req.Method, req.URL)
+				continue
+			}
+			klog.V(3).Infof("[hedge] no response for %s url=%s in %s, sending a hedged request", req.Method, req.URL, h.delay)
+			send()
+			pending++
+		case r := <-results:
+			pending--
+			if (r.err != nil || r.resp.StatusCode >= http.StatusInternalServerError) && pending > 0 {
+				r.discard() // use the other attempt
+				cancels[r.attempt]()
+				continue
+			}
+			for i, cancel := range cancels {
+				if i != r.attempt {
+					cancel()
+				}
+			}
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					(<-results).discard()
+				}
+			}(pending)
+			if r.err != nil {
+				cancels[r.attempt]()
+				return nil, r.err
+			}
+			r.resp.Body = cancelOnClose{ReadCloser: r.resp.Body, cancel: cancels[r.attempt]}
+			return r.resp, nil
+		}
+	}
+}
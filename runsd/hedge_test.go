@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFirstTransport doesn't respond to the first request until it's
+// canceled, and responds to the others right away.
+type slowFirstTransport struct {
+	requests  int32
+	canceled  chan struct{}
+	firstOnly bool // respond to the first request after 10ms instead
+}
+
+func (s *slowFirstTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := atomic.AddInt32(&s.requests, 1)
+	if n == 1 {
+		if s.firstOnly {
+			time.Sleep(10 * time.Millisecond)
+		} else {
+			<-req.Context().Done()
+			close(s.canceled)
+			return nil, req.Context().Err()
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Attempt": {string('0' + n)}},
+		Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestHedgingTransport(t *testing.T) {
+	backend := &slowFirstTransport{canceled: make(chan struct{})}
+	tr := hedgingTransport{next: backend, delay: time.Millisecond, budget: newHedgeBudget(0.1)}
+	req, _ := http.NewRequest(http.MethodGet, "http://hello/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get("attempt"); v != "2" {
+		t.Errorf("got response of attempt %s, want the hedged one", v)
+	}
+	select {
+	case <-backend.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("slow attempt not canceled")
+	}
+}
+
+func TestHedgingTransportNotHedged(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		method string
+		budget *hedgeBudget
+	}{
+		{"not idempotent", http.MethodPost, newHedgeBudget(0.1)},
+		{"no budget", http.MethodGet, &hedgeBudget{ratio: 0.1, maxTokens: 10}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &slowFirstTransport{firstOnly: true}
+			tr := hedgingTransport{next: backend, delay: time.Millisecond, budget: tt.budget}
+			req, _ := http.NewRequest(tt.method, "http://hello/", nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if n := atomic.LoadInt32(&backend.requests); n != 1 {
+				t.Errorf("sent %d requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	b := &hedgeBudget{ratio: 0.25, maxTokens: 2}
+	for i := 0; i < 3; i++ {
+		b.deposit()
+	}
+	if b.withdraw() {
+		t.Fatal("hedge allowed with 0.75 tokens")
+	}
+	for i := 0; i < 20; i++ {
+		b.deposit()
+	}
+	if !b.withdraw() || !b.withdraw() {
+		t.Fatal("hedges not allowed within budget")
+	}
+	if b.withdraw() {
+		t.Fatal("budget exceeded max tokens")
+	}
+}
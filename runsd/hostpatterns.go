@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// hostPatterns are patterns of internal names, in the SVC (any region) or
+// SVC.REGION form, where * matches any characters (e.g. public-*).
+type hostPatterns []string
+
+// parseHostPatterns parses the comma-separated patterns.
+func parseHostPatterns(s string) (hostPatterns, error) {
+	var out hostPatterns
+	for _, v := range parseNames(s) {
+		parts := strings.Split(v, ".")
+		if len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid pattern %q: not in SVC or SVC.REGION form", v)
+		}
+		for _, p := range parts {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", v, err)
+			}
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// matches reports whether the internal hostname matches any of the patterns.
+func (n hostPatterns) matches(hostname, domain, curRegion string) bool {
+	if len(n) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(hostname), "."), "."+strings.Trim(domain, "."))
+	_, svc, region, err := parseInternalName(name, curRegion)
+	if err != nil {
+		return false
+	}
+	for _, p := range n {
+		parts := strings.SplitN(p, ".", 2)
+		if ok, _ := path.Match(parts[0], svc); !ok {
+			continue
+		}
+		if len(parts) == 1 {
+			return true
+		}
+		if ok, _ := path.Match(parts[1], region); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestHostPatterns(t *testing.T) {
+	n, err := parseHostPatterns("Public-*, hello.us-east1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{host: "public-api", want: true},
+		{host: "public-api.europe-west1.run.internal.", want: true},
+		{host: "hello.us-east1", want: true},
+		{host: "hello.us-east1.run.internal", want: true},
+		{host: "hello", want: false},
+		{host: "private", want: false},
+		{host: "public-api.example.com", want: false},
+	}
+	for _, tt := range cases {
+		if got := n.matches(tt.host, "run.internal.", "us-central1"); got != tt.want {
+			t.Errorf("matches(%s)=%v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"a.b.c", "[x"} {
+		if _, err := parseHostPatterns(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestReverseProxyNoAuthHosts(t *testing.T) {
+	rp := newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")
+	rp.aliases = serviceAliases{"www": "public-web"}
+	rp.noAuthHosts = hostPatterns{"public-*"}
+	if !rp.noAuth("www.us-central1.run.internal.") {
+		t.Error("expected no auth for alias of public-web")
+	}
+	if rp.noAuth("hello") {
+		t.Error("expected auth for hello")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// hostOverride is a static entry from the -hosts_file. Names either resolve
+// to the given IPs, or resolve to runsd and are proxied to target.
+type hostOverride struct {
+	ips    []net.IP
+	target *url.URL
+}
+
+// hostOverrides maps lowercase names (without the trailing dot) to entries.
+type hostOverrides map[string]hostOverride
+
+// loadHostsFile reads a hosts-style file ("VALUE NAME [NAME...]") or, if the
+// file has a .yaml/.yml extension, a YAML map of names to a value or a list
+// of values. Values are IP addresses or URLs of the backends to proxy to.
+func loadHostsFile(path string) (hostOverrides, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][2]string // name, value
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		entries, err = parseHostsYAML(f)
+	default:
+		entries, err = parseHostsText(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hosts file %s: %w", path, err)
+	}
+
+	out := make(hostOverrides)
+	for _, e := range entries {
+		name := strings.ToLower(strings.TrimSuffix(e[0], "."))
+		v := out[name]
+		if ip := net.ParseIP(e[1]); ip != nil {
+			v.ips = append(v.ips, ip)
+		} else {
+			u, err := url.Parse(e[1])
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid value for %s: %q is neither an ip address nor a http(s) url", name, e[1])
+			}
+			v.target = u
+		}
+		if v.target != nil && len(v.ips) > 0 {
+			return nil, fmt.Errorf("name %s cannot have both ip addresses and a url", name)
+		}
+		out[name] = v
+	}
+	klog.V(1).Infof("loaded %d host overrides from %s", len(out), path)
+	return out, nil
+}
+
+func parseHostsText(r io.Reader) ([][2]string, error) {
+	var out [][2]string
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(stripComment(s.Text()))
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected VALUE NAME [NAME...]", n)
+		}
+		for _, name := range fields[1:] {
+			out = append(out, [2]string{name, fields[0]})
+		}
+	}
+	return out, s.Err()
+}
+
+// parseHostsYAML parses the subset of YAML needed for a flat map of names to
+// a scalar or a block list of scalars.
+func parseHostsYAML(r io.Reader) ([][2]string, error) {
+	var (
+		out  [][2]string
+		last string // key of a list being parsed
+	)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimRight(stripComment(s.Text()), " \t")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") {
+			if last == "" || trimmed == line {
+				return nil, fmt.Errorf("line %d: unexpected list item", n)
+			}
+			out = append(out, [2]string{last, unquote(strings.TrimSpace(trimmed[2:]))})
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 || trimmed != line {
+			return nil, fmt.Errorf("line %d: expected NAME: VALUE", n)
+		}
+		key, val := unquote(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		last = ""
+		if val == "" {
+			last = key
+			continue
+		}
+		if strings.HasPrefix(val, "[") && strings.HasSuffix(val, "]") {
+			for _, v := range strings.Split(strings.Trim(val, "[]"), ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					out = append(out, [2]string{key, unquote(v)})
+				}
+			}
+			continue
+		}
+		out = append(out, [2]string{key, unquote(val)})
+	}
+	return out, s.Err()
+}
+
+func stripComment(s string) string {
+	if i := strings.Index(s, "#"); i >= 0 {
+		// a "#" in a url is a fragment, only strip comments after whitespace
+		if i == 0 || s[i-1] == ' ' || s[i-1] == '\t' {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// lookup finds the entry for the (possibly fully qualified) name.
+func (h hostOverrides) lookup(name string) (hostOverride, bool) {
+	v, ok := h[strings.ToLower(strings.TrimSuffix(name, "."))]
+	return v, ok
+}
+
+// handleHostOverride answers the query authoritatively if the name (or the
+// name it is a search-list expansion of) is in the hosts file.
+func (d *dnsHijack) handleHostOverride(w dns.ResponseWriter, msg *dns.Msg) bool {
+	if len(d.hosts) == 0 || len(msg.Question) != 1 {
+		return false
+	}
+	q := msg.Question[0]
+	matched := q.Name
+	v, ok := d.hosts.lookup(q.Name)
+	for _, orig := range d.searchExpansionOf(q.Name) {
+		if ok {
+			break
+		}
+		matched = orig
+		v, ok = d.hosts.lookup(orig)
+	}
+	if !ok {
+		return false
+	}
+	ips := v.ips
+	if v.target != nil {
+		ips = d.proxyIPs(matched)
+	}
+	klog.V(5).Infof("[dns] < HOSTS type=%v name=%v", dns.TypeToString[q.Qtype], q.Name)
+	d.answerAddrs(w, msg, ips)
+	return true
+}
+
+// proxyIPs returns the addresses of the reverse proxy the name resolves to.
+func (d *dnsHijack) proxyIPs(name string) []net.IP {
+	ips := []net.IP{d.answerIPv4(name), d.answerIPv6()}
+	if d.ipv6Only {
+		return ips[1:]
+	} else if !d.serveIPv6 {
+		return ips[:1]
+	}
+	return ips
+}
+
+// answerAddrs answers the A or AAAA query authoritatively with the addresses
+// of its type among ips.
+func (d *dnsHijack) answerAddrs(w dns.ResponseWriter, msg *dns.Msg, ips []net.IP) {
+	q := msg.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	r.Authoritative = true
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: d.answerTTL}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	w.WriteMsg(r)
+}
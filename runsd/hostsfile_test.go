@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "runsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeTempFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadHostsFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	text := writeTempFile(t, dir, "hosts", `# static entries
+10.0.0.5   db db.internal.
+10.0.0.6   db
+https://billing-abc-uc.a.run.app  billing   # proxied
+`)
+	yaml := writeTempFile(t, dir, "hosts.yaml", `---
+db: 10.0.0.5
+DB.internal.: "10.0.0.5"
+multi:
+  - 10.0.0.6
+  - "fd00::6"
+inline: [10.0.0.7, 10.0.0.8]
+billing: https://billing-abc-uc.a.run.app
+`)
+	for _, p := range []string{text, yaml} {
+		h, err := loadHostsFile(p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if v, ok := h.lookup("DB.internal."); !ok || len(v.ips) != 1 || v.ips[0].String() != "10.0.0.5" {
+			t.Errorf("%s: wrong entry for db.internal: %+v", p, v)
+		}
+		if v, ok := h.lookup("billing"); !ok || v.target == nil || v.target.Host != "billing-abc-uc.a.run.app" {
+			t.Errorf("%s: wrong entry for billing: %+v", p, v)
+		}
+	}
+	h, _ := loadHostsFile(yaml)
+	if v := h["multi"]; len(v.ips) != 2 {
+		t.Errorf("expected two ips for list entry, got %v", v.ips)
+	}
+	if v := h["inline"]; len(v.ips) != 2 {
+		t.Errorf("expected two ips for inline list entry, got %v", v.ips)
+	}
+
+	for _, bad := range []string{"10.0.0.5\n", "foo bar\n", "10.0.0.5 x\nhttps://a.run.app x\n"} {
+		if _, err := loadHostsFile(writeTempFile(t, dir, "hosts", bad)); err == nil {
+			t.Errorf("expected error for hosts file %q", bad)
+		}
+	}
+}
+
+func TestDNSHostOverrides(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	hosts, err := loadHostsFile(writeTempFile(t, dir, "hosts", "10.0.0.5 db\n10.0.0.6 db\nhttps://billing-abc-uc.a.run.app billing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver:    "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:        "foo.bar.",
+		dots:          4,
+		searchDomains: []string{"us-central1.foo.bar."},
+		hosts:         hosts,
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{name: "db.", want: []string{"10.0.0.5", "10.0.0.6"}},
+		{name: "db.us-central1.foo.bar.", want: []string{"10.0.0.5", "10.0.0.6"}}, // search expansion
+		{name: "billing.", want: []string{"127.0.0.1"}},
+	}
+	for _, tt := range cases {
+		got, err := r.LookupHost(context.TODO(), tt.name)
+		if err != nil {
+			t.Fatalf("LookupHost(%s): %v", tt.name, err)
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("LookupHost(%s): %s", tt.name, diff)
+		}
+	}
+}
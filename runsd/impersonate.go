@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// cloudPlatformScope is the OAuth2 scope of the access tokens the IAM
+// Credentials API is called with.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var (
+	// iamCredentialsURL is the endpoint of the IAM Credentials API.
+	iamCredentialsURL = "https://iamcredentials.googleapis.com"
+	// iamCredentialsClient is used for the IAM Credentials API calls.
+	iamCredentialsClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// impersonatedIdentityToken returns an ID token of the service account for
+// the audience, minted with the IAM Credentials API using the identity of
+// runsd (which needs the Service Account OpenID Connect Identity Token
+// Creator role on it).
+func impersonatedIdentityToken(serviceAccount, audience string) (string, error) {
+	// cached separately from the tokens of the runtime service account
+	return idTokenCache.getOrFetch(audience+" as "+serviceAccount, time.Now(), func() (string, error) {
+		return generateIdentityToken(serviceAccount, audience)
+	})
+}
+
+// generateIdentityToken calls the generateIdToken method of the IAM
+// Credentials API.
+func generateIdentityToken(serviceAccount, audience string) (string, error) {
+	tok, err := accessToken([]string{cloudPlatformScope})
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token: %w", err)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"audience": audience, "includeEmail": true})
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateIdToken",
+		iamCredentialsURL, url.PathEscape(serviceAccount)), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("authorization", "Bearer "+tok)
+	req.Header.Set("content-type", "application/json")
+	resp, err := iamCredentialsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("iamcredentials api responded with code=%d for %s: %s", resp.StatusCode, serviceAccount, bytes.TrimSpace(b))
+	}
+	var v struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", fmt.Errorf("failed to parse generateIdToken response: %w", err)
+	}
+	return v.Token, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestImpersonatedIdentityToken(t *testing.T) {
+	token := testJWT(time.Now().Add(time.Hour))
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if want := "/v1/projects/-/serviceAccounts/invoker@p.iam.gserviceaccount.com:generateIdToken"; req.URL.Path != want {
+			t.Errorf("path=%s, want %s", req.URL.Path, want)
+		}
+		if v := req.Header.Get("authorization"); v != "Bearer test-access-token" {
+			t.Errorf("authorization=%q", v)
+		}
+		var body struct {
+			Audience string `json:"audience"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Audience != "https://hello-xyz-uc.a.run.app" {
+			http.Error(w, "unexpected audience "+body.Audience, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+	}))
+	defer srv.Close()
+	defer func(v string) { iamCredentialsURL = v }(iamCredentialsURL)
+	iamCredentialsURL = srv.URL
+	defer func(v *tokenCache) { idTokenCache = v }(idTokenCache)
+	idTokenCache = newTokenCache("")
+	os.Setenv("CLOUD_RUN_ACCESS_TOKEN", "test-access-token")
+	defer os.Unsetenv("CLOUD_RUN_ACCESS_TOKEN")
+
+	for i := 0; i < 2; i++ {
+		got, err := impersonatedIdentityToken("invoker@p.iam.gserviceaccount.com", "https://hello-xyz-uc.a.run.app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != token {
+			t.Fatalf("got token %q", got)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("token not cached, got %d calls", calls)
+	}
+	if _, ok := idTokenCache.get("https://hello-xyz-uc.a.run.app", time.Now()); ok {
+		t.Error("impersonated token cached as the token of the runtime service account")
+	}
+
+	if _, err := impersonatedIdentityToken("invoker@p.iam.gserviceaccount.com", "https://other"); err == nil {
+		t.Error("expected error for failed api call")
+	}
+}
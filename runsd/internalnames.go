@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// internalNameMap maps the internal names in the "svc" (current region) or
+// "svc.region" form to a setting of theirs, such as the audience of their ID
+// tokens for the services that expect another audience than their run.app URL
+// (e.g. behind IAP).
+type internalNameMap map[string]string
+
+// parseInternalNameMap parses comma-separated NAME=VALUE pairs, such as
+// hello=https://hello.example.com.
+func parseInternalNameMap(s string) (internalNameMap, error) {
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(internalNameMap, len(kv))
+	for k, v := range kv {
+		if parts := strings.Split(k, "."); len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid value for %q: not in SVC or SVC.REGION form", k)
+		}
+		if v == "" {
+			return nil, fmt.Errorf("empty value for %s", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// lookup returns the value for the internal hostname.
+func (a internalNameMap) lookup(hostname, domain, curRegion string) (string, bool) {
+	if len(a) == 0 {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(hostname), "."), "."+strings.Trim(domain, "."))
+	svc, region := name, curRegion
+	if parts := strings.Split(name, "."); len(parts) == 2 {
+		svc, region = parts[0], parts[1]
+	} else if len(parts) > 2 {
+		return "", false
+	}
+	v, ok := a[svc+"."+region]
+	if !ok && region == curRegion {
+		v, ok = a[svc]
+	}
+	return v, ok
+}
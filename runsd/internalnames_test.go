@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestParseInternalNameMap(t *testing.T) {
+	a, err := parseInternalNameMap("Hello=https://hello.example.com, iap.europe-west1=1234-abc.apps.googleusercontent.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host string
+		want string
+	}{
+		{host: "hello.us-central1.run.internal.", want: "https://hello.example.com"},
+		{host: "hello.europe-west1", want: ""},
+		{host: "iap.europe-west1", want: "1234-abc.apps.googleusercontent.com"},
+		{host: "iap", want: ""},
+	}
+	for _, tt := range cases {
+		if got, _ := a.lookup(tt.host, "run.internal.", "us-central1"); got != tt.want {
+			t.Errorf("lookup(%s)=%q, want %q", tt.host, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"hello=", "a.b.c=https://x", "hello"} {
+		if _, err := parseInternalNameMap(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
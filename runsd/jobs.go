@@ -0,0 +1,228 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// validJobName matches the Cloud Run job names.
+var validJobName = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+// jobsAPI serves the requests to the jobs host (e.g. POST http://jobs/JOB) by
+// running the Cloud Run job with the Admin API, and streaming the status of
+// the execution as JSON lines until it completes.
+type jobsAPI struct {
+	// host is the internal name the API is served on.
+	host           string
+	internalDomain string
+	region         string
+
+	baseURL      string // of the Admin API, e.g. https://run.googleapis.com
+	client       *http.Client
+	project      func() (string, error)
+	accessToken  func() (string, error)
+	pollInterval time.Duration
+}
+
+// jobStatus is a line of the execution status streamed back to the client.
+type jobStatus struct {
+	Execution      string `json:"execution"`
+	Running        int    `json:"running"`
+	Succeeded      int    `json:"succeeded"`
+	Failed         int    `json:"failed"`
+	Cancelled      int    `json:"cancelled"`
+	CompletionTime string `json:"completionTime,omitempty"`
+}
+
+func newJobsAPI(host, internalDomain, region string) *jobsAPI {
+	return &jobsAPI{
+		host:           host,
+		internalDomain: internalDomain,
+		region:         region,
+		baseURL:        "https://run.googleapis.com",
+		client:         &http.Client{Timeout: 30 * time.Second},
+		project: func() (string, error) {
+			return queryMetadata("http://metadata.google.internal./computeMetadata/v1/project/project-id")
+		},
+		accessToken:  defaultAccessToken,
+		pollInterval: 2 * time.Second,
+	}
+}
+
+func (j *jobsAPI) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !j.isJobsHost(req.Host) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		j.ServeHTTP(w, req)
+	})
+}
+
+func (j *jobsAPI) isJobsHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == j.host || host == j.host+"."+strings.Trim(j.internalDomain, ".")
+}
+
+// ServeHTTP runs the job named in the path in the region given with the
+// ?region= parameter (or the current region). The request body, if any, is
+// sent as the run request (e.g. {"overrides": {...}}). With ?wait=false, it
+// responds once the execution is started.
+func (j *jobsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("allow", http.MethodPost)
+		newProxyError(http.StatusMethodNotAllowed, "method_not_allowed", j.host, "jobs can only be run with POST requests").write(w)
+		return
+	}
+	job := strings.Trim(req.URL.Path, "/")
+	if !validJobName.MatchString(job) {
+		newProxyError(http.StatusNotFound, "invalid_job_name", j.host, fmt.Sprintf("invalid job name %q, use POST http://%s/JOB", job, j.host)).write(w)
+		return
+	}
+	region := j.region
+	if v := req.URL.Query().Get("region"); v != "" {
+		region = v
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		newProxyError(http.StatusBadRequest, "bad_request", j.host, fmt.Sprintf("failed to read request body: %v", err)).write(w)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		body = []byte("{}")
+	}
+	project, err := j.project()
+	if err != nil {
+		newProxyError(http.StatusServiceUnavailable, "metadata_unavailable", j.host, fmt.Sprintf("failed to get project id: %v", err)).write(w)
+		return
+	}
+	klog.V(1).Infof("[jobs] running job=%s region=%s", job, region)
+	var op struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if status, err := j.call(http.MethodPost, fmt.Sprintf("/v2/projects/%s/locations/%s/jobs/%s:run", project, region, job), body, &op); err != nil {
+		newProxyError(status, "job_run_failed", j.host, fmt.Sprintf("failed to run job %s: %v", job, err)).write(w)
+		return
+	}
+	execution := op.Metadata.Name
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(jobStatus{Execution: execution})
+	if req.URL.Query().Get("wait") == "false" || execution == "" {
+		return
+	}
+	var last jobStatus
+	for {
+		flush(w)
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(j.pollInterval):
+		}
+		st, err := j.executionStatus(execution)
+		if err != nil {
+			klog.Warningf("WARN: [jobs] failed to get the status of execution=%s: %v", execution, err)
+			continue
+		}
+		if st != last {
+			enc.Encode(st)
+			last = st
+		}
+		if st.CompletionTime != "" {
+			klog.V(1).Infof("[jobs] execution=%s completed: succeeded=%d failed=%d cancelled=%d", execution, st.Succeeded, st.Failed, st.Cancelled)
+			return
+		}
+	}
+}
+
+func (j *jobsAPI) executionStatus(execution string) (jobStatus, error) {
+	var v struct {
+		RunningCount   int    `json:"runningCount"`
+		SucceededCount int    `json:"succeededCount"`
+		FailedCount    int    `json:"failedCount"`
+		CancelledCount int    `json:"cancelledCount"`
+		CompletionTime string `json:"completionTime"`
+	}
+	if _, err := j.call(http.MethodGet, "/v2/"+execution, nil, &v); err != nil {
+		return jobStatus{}, err
+	}
+	return jobStatus{
+		Execution:      execution,
+		Running:        v.RunningCount,
+		Succeeded:      v.SucceededCount,
+		Failed:         v.FailedCount,
+		Cancelled:      v.CancelledCount,
+		CompletionTime: v.CompletionTime,
+	}, nil
+}
+
+// call sends the request to the Admin API and decodes the response into out.
+// On failure, it returns the status code to respond with.
+func (j *jobsAPI) call(method, path string, body []byte, out interface{}) (int, error) {
+	tok, err := j.accessToken()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get access token: %w", err)
+	}
+	req, err := http.NewRequest(method, j.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		status := http.StatusBadGateway
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			status = resp.StatusCode
+		}
+		return status, fmt.Errorf("admin api responded with code=%d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return http.StatusBadGateway, fmt.Errorf("failed to decode admin api response: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
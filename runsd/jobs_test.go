@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobsAPI(t *testing.T) {
+	const execution = "projects/proj/locations/us-central1/jobs/backfill/executions/backfill-abc"
+	var gotRun string
+	polls := 0
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("authorization") != "Bearer test-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/v2/projects/proj/locations/us-central1/jobs/backfill:run":
+			b, _ := ioutil.ReadAll(req.Body)
+			gotRun = string(b)
+			w.Write([]byte(`{"name": "op", "metadata": {"name": "` + execution + `"}}`))
+		case "/v2/" + execution:
+			polls++
+			if polls < 3 {
+				w.Write([]byte(`{"runningCount": 1}`))
+				return
+			}
+			w.Write([]byte(`{"succeededCount": 1, "completionTime": "2021-01-01T00:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"message": "not found"}}`))
+		}
+	}))
+	defer admin.Close()
+
+	j := newJobsAPI("jobs", "run.internal.", "us-central1")
+	j.baseURL = admin.URL
+	j.project = func() (string, error) { return "proj", nil }
+	j.accessToken = func() (string, error) { return "test-access-token", nil }
+	j.pollInterval = time.Millisecond
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	srv := httptest.NewServer(j.handler(next))
+	defer srv.Close()
+
+	do := func(method, host, path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPost, "jobs.run.internal.", "/backfill", `{"overrides": {"taskCount": 2}}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d", resp.StatusCode)
+	}
+	var lines []jobStatus
+	for sc := bufio.NewScanner(resp.Body); sc.Scan(); {
+		var st jobStatus
+		if err := json.Unmarshal(sc.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, st)
+	}
+	if gotRun != `{"overrides": {"taskCount": 2}}` {
+		t.Errorf("run request body = %s", gotRun)
+	}
+	if len(lines) != 3 || lines[1].Running != 1 || lines[2].Succeeded != 1 || lines[2].CompletionTime == "" {
+		t.Errorf("unexpected status lines: %+v", lines)
+	}
+
+	for _, tt := range []struct {
+		method, host, path string
+		want               int
+	}{
+		{http.MethodGet, "jobs", "/backfill", http.StatusMethodNotAllowed},
+		{http.MethodPost, "jobs", "/", http.StatusNotFound},
+		{http.MethodPost, "jobs:80", "/missing", http.StatusNotFound},
+		{http.MethodPost, "hello", "/backfill", http.StatusTeapot},
+	} {
+		resp := do(tt.method, tt.host, tt.path, "")
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s http://%s%s: status=%d, want %d", tt.method, tt.host, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
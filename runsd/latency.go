@@ -0,0 +1,193 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// maxLatencySamples bounds the number of samples kept per destination.
+const maxLatencySamples = 1000
+
+// latencyBudgets tracks the rolling p95 latency of the destinations with a
+// latency budget and reports when the budget is exceeded.
+type latencyBudgets struct {
+	budgets map[string]time.Duration // keyed by "service.region" or "service"
+	window  time.Duration
+	deps    *dependencyTracker // used to normalize destinations
+	out     io.Writer
+
+	mu        sync.Mutex
+	samples   map[string][]latencySample
+	violating map[string]bool
+}
+
+type latencySample struct {
+	at   time.Time
+	took time.Duration
+}
+
+type latencyBudgetStatus struct {
+	Destination string  `json:"destination"`
+	BudgetMs    float64 `json:"budgetMs"`
+	P95Ms       float64 `json:"p95Ms"`
+	Samples     int     `json:"samples"`
+	Exceeded    bool    `json:"exceeded"`
+}
+
+func parseLatencyBudgets(s string) (map[string]time.Duration, error) {
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]time.Duration, len(kv))
+	for k, v := range kv {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid latency budget %q for %s", v, k)
+		}
+		out[k] = d
+	}
+	return out, nil
+}
+
+func newLatencyBudgets(budgets map[string]time.Duration, window time.Duration, deps *dependencyTracker, out io.Writer) *latencyBudgets {
+	return &latencyBudgets{
+		budgets:   budgets,
+		window:    window,
+		deps:      deps,
+		out:       out,
+		samples:   make(map[string][]latencySample),
+		violating: make(map[string]bool),
+	}
+}
+
+// budgetFor returns the latency budget for the "service.region" destination.
+func (l *latencyBudgets) budgetFor(dest string) (time.Duration, bool) {
+	if v, ok := l.budgets[dest]; ok {
+		return v, true
+	}
+	v, ok := l.budgets[serviceName(dest)]
+	return v, ok
+}
+
+func (l *latencyBudgets) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, req)
+		dest := l.deps.destination(req.Host)
+		if _, ok := l.budgetFor(dest); ok {
+			l.record(dest, start, time.Since(start))
+		}
+	})
+}
+
+func (l *latencyBudgets) record(dest string, at time.Time, took time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := append(l.samples[dest], latencySample{at: at, took: took})
+	if len(s) > maxLatencySamples {
+		s = s[len(s)-maxLatencySamples:]
+	}
+	l.samples[dest] = s
+}
+
+// status computes the rolling p95 of all destinations with samples, dropping
+// the samples older than the window.
+func (l *latencyBudgets) status() []latencyBudgetStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-l.window)
+	var out []latencyBudgetStatus
+	for dest, samples := range l.samples {
+		i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(cutoff) })
+		samples = samples[i:]
+		l.samples[dest] = samples
+		if len(samples) == 0 {
+			continue
+		}
+		durs := make([]time.Duration, len(samples))
+		for i, s := range samples {
+			durs[i] = s.took
+		}
+		sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+		budget, _ := l.budgetFor(dest)
+		p95 := percentile(durs, 95)
+		out = append(out, latencyBudgetStatus{
+			Destination: dest,
+			BudgetMs:    float64(budget) / float64(time.Millisecond),
+			P95Ms:       float64(p95) / float64(time.Millisecond),
+			Samples:     len(durs),
+			Exceeded:    p95 > budget,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Destination < out[j].Destination })
+	return out
+}
+
+// evaluatePeriodically checks the budgets at every interval and writes a
+// structured warning when a destination starts or stops exceeding its budget.
+func (l *latencyBudgets) evaluatePeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, st := range l.status() {
+			l.mu.Lock()
+			changed := l.violating[st.Destination] != st.Exceeded
+			l.violating[st.Destination] = st.Exceeded
+			l.mu.Unlock()
+			if changed {
+				l.report(st)
+			}
+		}
+	}
+}
+
+func (l *latencyBudgets) report(st latencyBudgetStatus) {
+	severity, msg := "WARNING", fmt.Sprintf("latency budget exceeded for %s: p95=%.1fms budget=%.1fms",
+		st.Destination, st.P95Ms, st.BudgetMs)
+	if !st.Exceeded {
+		severity, msg = "INFO", fmt.Sprintf("latency of %s is back within budget: p95=%.1fms budget=%.1fms",
+			st.Destination, st.P95Ms, st.BudgetMs)
+	}
+	b, err := json.Marshal(struct {
+		Severity string              `json:"severity"`
+		Message  string              `json:"message"`
+		Budget   latencyBudgetStatus `json:"latencyBudget"`
+	}{severity, msg, st})
+	if err != nil {
+		klog.Warningf("failed to marshal latency budget status: %v", err)
+		return
+	}
+	l.out.Write(append(b, '\n'))
+}
+
+// ServeHTTP serves the current latency budget status on the admin endpoint.
+func (l *latencyBudgets) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		Budgets []latencyBudgetStatus `json:"budgets"`
+	}{l.status()}); err != nil {
+		klog.V(1).Infof("failed to write latency budgets response: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLatencyBudgetStatus(t *testing.T) {
+	budgets, err := parseLatencyBudgets("hello=100ms, world.europe-west1=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := newDependencyTracker("caller", "run.internal.", "us-central1")
+	l := newLatencyBudgets(budgets, time.Minute, deps, ioutil.Discard)
+
+	now := time.Now()
+	l.record("old.us-central1", now.Add(-2*time.Minute), time.Second) // outside the window
+	for i := 0; i < 100; i++ {
+		l.record("hello.us-central1", now, 10*time.Millisecond)
+		l.record("world.europe-west1", now, 10*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		l.record("hello.us-central1", now, 500*time.Millisecond) // >5% slow requests
+	}
+
+	st := l.status()
+	if len(st) != 2 {
+		t.Fatalf("expected 2 destinations in status, got %+v", st)
+	}
+	if st[0].Destination != "hello.us-central1" || !st[0].Exceeded {
+		t.Errorf("expected hello.us-central1 to exceed budget: %+v", st[0])
+	}
+	if st[1].Destination != "world.europe-west1" || st[1].Exceeded {
+		t.Errorf("expected world.europe-west1 to be within budget: %+v", st[1])
+	}
+
+	if _, err := parseLatencyBudgets("hello=fast"); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+}
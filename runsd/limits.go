@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// headerLimiter rejects requests with too many or too large headers with
+// HTTP 431. Unlike http.Server.MaxHeaderBytes, the limits are applied
+// exactly and the same way for HTTP/1.x and h2c requests.
+type headerLimiter struct {
+	maxBytes int // 0 means no limit
+	maxCount int // 0 means no limit
+}
+
+func (h headerLimiter) handler(next http.Handler) http.Handler {
+	if h.maxBytes <= 0 && h.maxCount <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		count, size := headerSize(req.Header)
+		if h.maxCount > 0 && count > h.maxCount {
+			klog.V(4).Infof("[proxy] rejecting request to host=%s with %d header fields (max=%d)", req.Host, count, h.maxCount)
+			newProxyError(http.StatusRequestHeaderFieldsTooLarge, errCodeHeadersTooLarge, req.Host,
+				fmt.Sprintf("request has %d header fields, limit is %d", count, h.maxCount)).write(w)
+			return
+		}
+		if h.maxBytes > 0 && size > h.maxBytes {
+			klog.V(4).Infof("[proxy] rejecting request to host=%s with %d bytes of headers (max=%d)", req.Host, size, h.maxBytes)
+			newProxyError(http.StatusRequestHeaderFieldsTooLarge, errCodeHeadersTooLarge, req.Host,
+				fmt.Sprintf("request headers are %d bytes, limit is %d", size, h.maxBytes)).write(w)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// headerSize returns the number of header fields and their approximate size
+// on the wire (as "Name: value\r\n" lines).
+func headerSize(hdr http.Header) (count, size int) {
+	for k, vs := range hdr {
+		for _, v := range vs {
+			count++
+			size += len(k) + len(v) + 4
+		}
+	}
+	return count, size
+}
+
+// bodySizeError is returned when a request or response body is larger than
+// the limit.
+type bodySizeError struct {
+	what  string // "request" or "response"
+	limit int64
+}
+
+func (e *bodySizeError) Error() string {
+	return fmt.Sprintf("%s body is larger than the limit of %d bytes", e.what, e.limit)
+}
+
+// limitedBody fails the reads after limit bytes with a *bodySizeError.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       *bodySizeError
+	exceeded  int32
+}
+
+func newLimitedBody(rc io.ReadCloser, what string, limit int64) *limitedBody {
+	return &limitedBody{ReadCloser: rc, remaining: limit, err: &bodySizeError{what: what, limit: limit}}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.exceeded) == 1 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = 0
+	atomic.StoreInt32(&b.exceeded, 1)
+	return n, b.err
+}
+
+// exceededLimit returns the error if the body was larger than the limit.
+func (b *limitedBody) exceededLimit() error {
+	if atomic.LoadInt32(&b.exceeded) == 1 {
+		return b.err
+	}
+	return nil
+}
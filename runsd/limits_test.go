@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderSize(t *testing.T) {
+	hdr := http.Header{"A": {"1", "22"}, "Bb": {"333"}}
+	count, size := headerSize(hdr)
+	// "A: 1\r\n" + "A: 22\r\n" + "Bb: 333\r\n"
+	if count != 3 || size != 6+7+9 {
+		t.Errorf("headerSize()=(%d, %d), want (3, 22)", count, size)
+	}
+}
+
+func TestHeaderLimiter(t *testing.T) {
+	cases := []struct {
+		name       string
+		limiter    headerLimiter
+		header     http.Header
+		wantStatus int
+	}{
+		{name: "no limits", limiter: headerLimiter{}, header: http.Header{"X-Big": {strings.Repeat("x", 1<<16)}}, wantStatus: http.StatusOK},
+		{name: "within limits", limiter: headerLimiter{maxBytes: 100, maxCount: 3}, header: http.Header{"X-A": {"1"}, "X-B": {"2"}}, wantStatus: http.StatusOK},
+		{name: "too many fields", limiter: headerLimiter{maxCount: 3}, header: http.Header{"X-A": {"1", "2"}, "X-B": {"3", "4"}}, wantStatus: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "too many bytes", limiter: headerLimiter{maxBytes: 100}, header: http.Header{"X-Big": {strings.Repeat("x", 100)}}, wantStatus: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "count limit only", limiter: headerLimiter{maxCount: 3}, header: http.Header{"X-Big": {strings.Repeat("x", 1<<16)}}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := tt.limiter.handler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { called = true }))
+			req := httptest.NewRequest(http.MethodGet, "http://hello/", nil)
+			req.Header = tt.header
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status=%d, want=%d", rec.Code, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("next handler called=%v", called)
+			}
+			if tt.wantStatus != http.StatusOK && rec.Header().Get(errorHeader) != errCodeHeadersTooLarge {
+				t.Errorf("%s=%q, want=%q", errorHeader, rec.Header().Get(errorHeader), errCodeHeadersTooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCA is a certificate authority generated at startup to issue the
+// certificates of the HTTPS listener of the reverse proxy, so that the
+// applications can use https:// URLs for the internal names. It's constrained
+// to the domains of these names, so trusting it doesn't let it impersonate the
+// other sites.
+type localCA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	domains []string // permitted
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // by server name
+}
+
+const (
+	// caValidity is the validity of the generated CA and the certificates it
+	// issues.
+	caValidity = 365 * 24 * time.Hour
+
+	// caCommonName is the subject of the generated CAs, used to find the ones
+	// left in the trust stores by the previous runs.
+	caCommonName = "runsd local CA"
+)
+
+// loopbackNets are the IP addresses the CA can issue certificates for.
+var loopbackNets = []*net.IPNet{
+	{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// newLocalCA generates a CA that can only issue certificates for the names in
+// the domains (and their subdomains) and the loopback addresses.
+func newLocalCA(domains []string) (*localCA, error) {
+	permitted := make([]string, 0, len(domains))
+	for _, d := range domains {
+		if d = strings.ToLower(strings.Trim(d, ".")); d != "" {
+			permitted = append(permitted, d)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, fmt.Errorf("no domains to issue certificates for")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: caCommonName, Organization: []string{"runsd"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         permitted,
+		PermittedIPRanges:           loopbackNets,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ca certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &localCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		domains: permitted,
+		certs:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// GetCertificate issues (or returns the previously issued) certificate for the
+// server name in the TLS handshake.
+func (ca *localCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		name = "localhost" // clients don't send SNI for IP addresses
+	}
+	if !ca.permits(name) {
+		return nil, fmt.Errorf("refusing to issue a certificate for %q outside the domains %v", name, ca.domains)
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if c, ok := ca.certs[name]; ok {
+		return c, nil
+	}
+	c, err := ca.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	ca.certs[name] = c
+	return c, nil
+}
+
+// permits reports whether the name is in the domains the CA is constrained to.
+func (ca *localCA) permits(name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.IsLoopback()
+	}
+	for _, d := range ca.domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ca *localCA) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     ca.cert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{ipv4Loopback, net.IPv6loopback},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tpl.DNSNames, tpl.IPAddresses = nil, append(tpl.IPAddresses, ip)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate for %s: %w", name, err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}, nil
+}
+
+// loadClientCAs returns the CAs in the PEM file to verify the client
+// certificates presented to the HTTPS listener with.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// writeCert writes the CA certificate (in PEM format) to path.
+func (ca *localCA) writeCert(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, ca.certPEM, 0644)
+}
+
+// trustStores are the CA bundles of the common Linux distributions.
+var trustStores = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL, CentOS
+	"/etc/ssl/ca-bundle.pem",             // OpenSUSE
+}
+
+// addToTrustStores appends the CA certificate to the system CA bundles that
+// exist (removing the CAs left in them by the previous runs), and returns the
+// paths of the updated bundles.
+func (ca *localCA) addToTrustStores(stores []string) ([]string, error) {
+	return updateTrustStores(stores, func(b []byte) []byte {
+		b = removeLocalCAs(b)
+		if len(b) > 0 && !bytes.HasSuffix(b, []byte("\n")) {
+			b = append(b, '\n')
+		}
+		return append(b, ca.certPEM...)
+	})
+}
+
+// removeFromTrustStores removes the CA certificates generated by runsd from
+// the system CA bundles, and returns the paths of the updated bundles.
+func removeFromTrustStores(stores []string) ([]string, error) {
+	return updateTrustStores(stores, removeLocalCAs)
+}
+
+// updateTrustStores rewrites the CA bundles that exist with fn, and returns
+// the paths of the ones that changed.
+func updateTrustStores(stores []string, fn func([]byte) []byte) ([]string, error) {
+	var updated []string
+	for _, p := range stores {
+		b, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return updated, err
+		}
+		out := fn(append([]byte(nil), b...))
+		if bytes.Equal(out, b) {
+			continue
+		}
+		if err := ioutil.WriteFile(p, out, 0644); err != nil {
+			return updated, err
+		}
+		updated = append(updated, p)
+	}
+	return updated, nil
+}
+
+// removeLocalCAs returns the PEM bundle without the CA certificates generated
+// by runsd, keeping the rest of it as is.
+func removeLocalCAs(b []byte) []byte {
+	var out []byte
+	for rest := b; ; {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			return append(out, rest...)
+		}
+		chunk := rest[:len(rest)-len(next)] // block with the text before it
+		rest = next
+		if block.Type == "CERTIFICATE" {
+			if c, err := x509.ParseCertificate(block.Bytes); err == nil && c.IsCA && c.Subject.CommonName == caCommonName {
+				chunk = chunk[:bytes.LastIndex(chunk, []byte("-----BEGIN"))]
+			}
+		}
+		out = append(out, chunk...)
+	}
+}
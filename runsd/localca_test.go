@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalCA(t *testing.T) {
+	ca, err := newLocalCA([]string{"run.internal.", "us-central1", "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, &tls.Config{GetCertificate: ca.GetCertificate})
+	srv.Start()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca.certPEM) {
+		t.Fatal("failed to parse ca certificate")
+	}
+	get := func(name string) (string, error) {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: name}}
+		c := &http.Client{Transport: tr}
+		_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, "https://"+net.JoinHostPort("127.0.0.1", port), nil)
+		req.Host = name
+		resp, err := c.Do(req)
+		if err != nil {
+			return "", err
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b), nil
+	}
+	for _, name := range []string{"billing.us-central1", "billing.us-central1.run.internal", "127.0.0.1"} {
+		got, err := get(name)
+		if err != nil {
+			t.Fatalf("request for %s failed: %v", name, err)
+		}
+		if got != name {
+			t.Errorf("got host %q, want %q", got, name)
+		}
+	}
+	for _, name := range []string{"billing", "www.example.com", "run.internal.example.com"} {
+		if _, err := get(name); err == nil {
+			t.Errorf("expected no certificate for %s", name)
+		}
+	}
+	if len(ca.certs) != 3 {
+		t.Errorf("issued %d certificates, want 3", len(ca.certs))
+	}
+
+	// the clients refuse the certificates outside the domains even if the ca
+	// issued them
+	cert, err := ca.issue("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: pool}); err == nil {
+		t.Error("expected the certificate outside the permitted domains to fail verification")
+	}
+}
+
+func TestNewLocalCANoDomains(t *testing.T) {
+	if _, err := newLocalCA([]string{"", "."}); err == nil {
+		t.Fatal("expected error without domains")
+	}
+}
+
+func TestTrustStores(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	const orig = "# comment\n-----BEGIN CERTIFICATE-----\nfoo\n-----END CERTIFICATE-----"
+
+	previous, err := newLocalCA([]string{"run.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := writeTempFile(t, dir, "ca-certificates.crt", orig+"\n"+string(previous.certPEM))
+
+	ca, err := newLocalCA([]string{"run.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := []string{filepath.Join(dir, "missing.crt"), bundle}
+	for i := 0; i < 2; i++ {
+		updated, err := ca.addToTrustStores(stores)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 1 - i; len(updated) != want {
+			t.Fatalf("attempt %d: updated %v, want %d bundles", i, updated, want)
+		}
+	}
+	b, _ := ioutil.ReadFile(bundle)
+	if want := orig + "\n" + string(ca.certPEM); string(b) != want {
+		t.Fatalf("unexpected bundle contents:\n%s\nwant:\n%s", b, want)
+	}
+
+	updated, err := removeFromTrustStores(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != 1 {
+		t.Fatalf("updated %v, want 1 bundle", updated)
+	}
+	b, _ = ioutil.ReadFile(bundle)
+	if want := orig + "\n"; string(b) != want {
+		t.Fatalf("unexpected bundle contents after removal:\n%s\nwant:\n%s", b, want)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	modeCloudRun = "cloudrun"
+	modeLocalDev = "localdev"
+)
+
+// serviceDirectory resolves the internal names to the run.app URLs of the
+// services listed by the Cloud Run Admin API. It is used in -mode=localdev,
+// where the project hash isn't known, instead of composing the URLs.
+type serviceDirectory struct {
+	list       func(region string) ([]cloudRunService, error)
+	minRefresh time.Duration // between the listings of a region
+
+	mu      sync.Mutex
+	regions map[string]*regionServices
+}
+
+// regionServices are the run.app hosts of the services in a region.
+type regionServices struct {
+	hosts   map[string]string
+	fetched time.Time
+}
+
+func newServiceDirectory() *serviceDirectory {
+	return &serviceDirectory{
+		list:       listCloudRunServices,
+		minRefresh: time.Minute,
+		regions:    make(map[string]*regionServices),
+	}
+}
+
+// resolve returns the run.app host of the service the internal hostname is
+// for. The services of the region are listed again (at most every minRefresh)
+// if the service isn't known, so the services deployed after the listing are
+// found.
+func (d *serviceDirectory) resolve(internalDomain, hostname, curRegion string) (string, error) {
+	trimmed := strings.TrimSuffix(strings.ToLower(hostname), "."+strings.Trim(internalDomain, "."))
+	tag, svc, region, err := parseInternalName(trimmed, curRegion)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse hostname %q: %w", hostname, err)
+	}
+	host, err := d.lookup(svc, region)
+	if err != nil {
+		return "", err
+	}
+	if tag != "" {
+		host = taggedHost(tag, host)
+	}
+	return host, nil
+}
+
+func (d *serviceDirectory) lookup(svc, region string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rs := d.regions[region]
+	if rs != nil {
+		if host, ok := rs.hosts[svc]; ok {
+			return host, nil
+		}
+		if time.Since(rs.fetched) < d.minRefresh {
+			return "", fmt.Errorf("service %q not found in region %q", svc, region)
+		}
+	}
+	if err := d.refreshLocked(region); err != nil {
+		return "", fmt.Errorf("failed to list the services in region %q: %w", region, err)
+	}
+	host, ok := d.regions[region].hosts[svc]
+	if !ok {
+		return "", fmt.Errorf("service %q not found in region %q", svc, region)
+	}
+	return host, nil
+}
+
+func (d *serviceDirectory) refreshLocked(region string) error {
+	svcs, err := d.list(region)
+	if err != nil {
+		return err
+	}
+	rs := &regionServices{hosts: make(map[string]string, len(svcs)), fetched: time.Now()}
+	for _, s := range svcs {
+		u, err := url.Parse(s.URL)
+		if err != nil || u.Host == "" {
+			klog.V(3).Infof("skipping service %s without a url (%q)", s.Name, s.URL)
+			continue
+		}
+		rs.hosts[s.Name] = u.Host
+	}
+	klog.V(1).Infof("found %d services in region %s", len(rs.hosts), region)
+	d.regions[region] = rs
+	return nil
+}
+
+// localDevEnv returns the environment of the subprocess in -mode=localdev,
+// where the names of the services don't resolve to runsd: the HTTP clients
+// of the app are pointed at the reverse proxy with HTTP_PROXY instead, unless
+// the app already uses a proxy.
+func localDevEnv(environ []string, proxyAddr string) []string {
+	for _, kv := range environ {
+		if k := strings.SplitN(kv, "=", 2)[0]; strings.EqualFold(k, "HTTP_PROXY") {
+			return environ
+		}
+	}
+	out := append([]string(nil), environ...)
+	return append(out, "HTTP_PROXY=http://"+proxyAddr, "http_proxy=http://"+proxyAddr)
+}
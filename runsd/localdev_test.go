@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestServiceDirectory(t *testing.T) {
+	var listed []string
+	services := map[string][]cloudRunService{
+		"us-central1": {
+			{Name: "hello", URL: "https://hello-abcdef-uc.a.run.app"},
+			{Name: "pending"},
+		},
+		"europe-west1": {{Name: "world", URL: "https://world-abcdef-ew.a.run.app"}},
+	}
+	d := newServiceDirectory()
+	d.list = func(region string) ([]cloudRunService, error) {
+		listed = append(listed, region)
+		if region == "asia-east1" {
+			return nil, errors.New("permission denied")
+		}
+		return services[region], nil
+	}
+
+	tests := []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{hostname: "hello", want: "hello-abcdef-uc.a.run.app"},
+		{hostname: "hello.us-central1.run.internal", want: "hello-abcdef-uc.a.run.app"},
+		{hostname: "world.europe-west1", want: "world-abcdef-ew.a.run.app"},
+		{hostname: "pending", wantErr: true},
+		{hostname: "missing", wantErr: true},
+		{hostname: "hello.asia-east1", wantErr: true},
+		{hostname: "a.b.c.d", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := d.resolve("run.internal.", tt.hostname, "us-central1")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolve(%s) err=%v, wantErr=%v", tt.hostname, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("resolve(%s)=%q, want=%q", tt.hostname, got, tt.want)
+		}
+	}
+	if want := []string{"us-central1", "europe-west1", "asia-east1"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("listed regions=%v, want=%v", listed, want)
+	}
+
+	// services deployed after the listing are found once minRefresh passes
+	services["us-central1"] = append(services["us-central1"], cloudRunService{Name: "new", URL: "https://new-abcdef-uc.a.run.app"})
+	if _, err := d.resolve("run.internal.", "new", "us-central1"); err == nil {
+		t.Error("expected the service list not to be refreshed before minRefresh")
+	}
+	d.minRefresh = 0
+	if got, err := d.resolve("run.internal.", "new", "us-central1"); err != nil || got != "new-abcdef-uc.a.run.app" {
+		t.Errorf("resolve(new)=%q err=%v", got, err)
+	}
+}
+
+func TestLocalDevEnv(t *testing.T) {
+	got := localDevEnv([]string{"PATH=/bin"}, "127.0.0.1:8080")
+	want := []string{"PATH=/bin", "HTTP_PROXY=http://127.0.0.1:8080", "http_proxy=http://127.0.0.1:8080"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	existing := []string{"PATH=/bin", "http_proxy=http://proxy:3128"}
+	if got := localDevEnv(existing, "127.0.0.1:8080"); !reflect.DeepEqual(got, existing) {
+		t.Errorf("expected the existing proxy to be kept, got=%v", got)
+	}
+}
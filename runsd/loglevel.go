@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// maxLogLevel is the most verbose klog level used in runsd.
+const maxLogLevel = 6
+
+func logLevel() int {
+	f := flag.Lookup("v")
+	if f == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(f.Value.String())
+	return v
+}
+
+func setLogLevel(v int) error {
+	if v < 0 || v > maxLogLevel {
+		return fmt.Errorf("log level must be between 0 and %d", maxLogLevel)
+	}
+	return flag.Set("v", strconv.Itoa(v))
+}
+
+// cycleLogLevel raises the log verbosity by one on every signal received,
+// wrapping around to the initial level after maxLogLevel.
+func cycleLogLevel(sigs <-chan os.Signal, initial int) {
+	for sig := range sigs {
+		next := logLevel() + 1
+		if next > maxLogLevel {
+			next = initial
+		}
+		if err := setLogLevel(next); err != nil {
+			klog.Warningf("failed to set log level: %v", err)
+			continue
+		}
+		klog.Infof("received signal=%s, log verbosity is now v=%d", sig, next)
+	}
+}
+
+// serveLogLevel reports the current log verbosity, or sets it if the "v"
+// query parameter is given on a POST or PUT request.
+func serveLogLevel(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		v, err := strconv.Atoi(req.URL.Query().Get("v"))
+		if err != nil {
+			http.Error(w, "specify the log level as ?v=N", http.StatusBadRequest)
+			return
+		}
+		if err := setLogLevel(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		klog.Infof("log verbosity set to v=%d through the admin endpoint", v)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "v=%d\n", logLevel())
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+// withLogLevel registers the klog flags if needed and sets the log level to v
+// for the test, returning a func to restore it.
+func withLogLevel(t *testing.T, v int) func() {
+	t.Helper()
+	if flag.Lookup("v") == nil {
+		klog.InitFlags(nil)
+	}
+	prev := logLevel()
+	if err := setLogLevel(v); err != nil {
+		t.Fatal(err)
+	}
+	return func() { setLogLevel(prev) }
+}
+
+func TestServeLogLevel(t *testing.T) {
+	defer withLogLevel(t, 1)()
+
+	cases := []struct {
+		method, query string
+		wantStatus    int
+		wantBody      string
+		wantLevel     int
+	}{
+		{method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "v=1\n", wantLevel: 1},
+		{method: http.MethodGet, query: "?v=4", wantStatus: http.StatusOK, wantBody: "v=1\n", wantLevel: 1},
+		{method: http.MethodPut, query: "?v=4", wantStatus: http.StatusOK, wantBody: "v=4\n", wantLevel: 4},
+		{method: http.MethodPost, query: "?v=0", wantStatus: http.StatusOK, wantBody: "v=0\n", wantLevel: 0},
+		{method: http.MethodPut, query: "?v=7", wantStatus: http.StatusBadRequest, wantLevel: 0},
+		{method: http.MethodPut, query: "?v=-1", wantStatus: http.StatusBadRequest, wantLevel: 0},
+		{method: http.MethodPut, query: "?v=debug", wantStatus: http.StatusBadRequest, wantLevel: 0},
+		{method: http.MethodPut, wantStatus: http.StatusBadRequest, wantLevel: 0},
+		{method: http.MethodDelete, query: "?v=3", wantStatus: http.StatusMethodNotAllowed, wantLevel: 0},
+	}
+	for _, tt := range cases {
+		rec := httptest.NewRecorder()
+		serveLogLevel(rec, httptest.NewRequest(tt.method, "/loglevel"+tt.query, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s %s: status=%d, want=%d", tt.method, tt.query, rec.Code, tt.wantStatus)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("%s %s: body=%q, want=%q", tt.method, tt.query, rec.Body.String(), tt.wantBody)
+		}
+		if tt.wantStatus == http.StatusBadRequest && strings.HasPrefix(rec.Body.String(), "v=") {
+			t.Errorf("%s %s: unexpected body %q", tt.method, tt.query, rec.Body.String())
+		}
+		if got := logLevel(); got != tt.wantLevel {
+			t.Errorf("%s %s: log level=%d, want=%d", tt.method, tt.query, got, tt.wantLevel)
+		}
+	}
+}
+
+func TestCycleLogLevel(t *testing.T) {
+	defer withLogLevel(t, maxLogLevel-2)()
+
+	// cycle sends n signals and waits for cycleLogLevel to handle them.
+	cycle := func(n int) {
+		sigs := make(chan os.Signal)
+		done := make(chan struct{})
+		go func() {
+			cycleLogLevel(sigs, 2)
+			close(done)
+		}()
+		for i := 0; i < n; i++ {
+			sigs <- syscall.SIGUSR1
+		}
+		close(sigs)
+		<-done
+	}
+	for _, want := range []int{maxLogLevel - 1, maxLogLevel, 2, 3} {
+		cycle(1)
+		if got := logLevel(); got != want {
+			t.Fatalf("log level=%d, want=%d", got, want)
+		}
+	}
+	cycle(maxLogLevel - 3 + 1)
+	if got := logLevel(); got != 2 {
+		t.Fatalf("log level after a full cycle=%d, want=2", got)
+	}
+}
@@ -15,14 +15,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	"k8s.io/klog/v2"
@@ -31,27 +38,172 @@ import (
 const (
 	resolvConf            = "/etc/resolv.conf"
 	defaultInternalDomain = "run.internal."
-	defaultNdots          = 4
 	defaultDnsPort        = "53"
 	defaultHTTPProxyPort  = "80"
+
+	// metadataNameserver and metadataNameserverIPv6 are the addresses of the
+	// metadata server, which is the nameserver on Cloud Run.
+	metadataNameserver     = "169.254.169.254"
+	metadataNameserverIPv6 = "fd20:ce::254"
 )
 
 var (
 	flInternalDomain string
+	flDomains        = &repeatedFlag{values: []string{defaultInternalDomain}}
+	flDNSForwards    = new(repeatedFlag)
 	flNdots          int
 	flResolvConf     string
+	flEtcHosts       string
 	flNameserver     string
 	flRegion         string
+	flMode           string
+	flEmulated       string
+	flComposePort    string
+	flComposePorts   string
+	flComposeID      string
 	flProjectHash    string
 	flHTTPProxyPort  string
+	flHTTPSProxyPort string
+	flTLSPassthrough string
+	flSOCKS5Port     string
+	flCACertFile     string
+	flClientCAFile   string
+	flServiceIPRange string
 	flDNSPort        string
+	flAdminPort      string
+	flHealthzPort    string
+	flMetricsPort    string
+	flOTLPEndpoint   string
+	flUpstreamCAFile string
 	flUser           string
+	flBindIP         string
+	flCommandFile    string
+	flTokenCacheFile string
+	flNdotsOverrides string
+	flExtraSearch    string
+	flDNSExclude     string
+	flHostsFile      string
+	flHeaderRules    string
+	flTrafficSplit   string
+	flCustomDomains  string
+	flRoutesFile     string
+	flJobsAPIHost    string
+	flPrewarm        string
+	flNoAuthHosts    string
+	flStreamingHosts string
+	flOverwriteAuth  string
+	flAudiences      string
+	flAccessTokens   string
+	flAccessScopes   string
+	flImpersonate    string
+	flImpersonateFor string
+	flOrigHostHeader string
+	flAliases        string
+	flRegionHostTmpl string
+	flNameserverDoH  string
+
+	flAccessLog              bool
+	flAccessLogFormat        string
+	flAccessLogFile          string
+	flAccessLogSampleRate    float64
+	flAccessLogSlowThreshold time.Duration
+
+	flSlowRequestThreshold  time.Duration
+	flShutdownTimeout       time.Duration
+	flWebSocketIdleTimeout  time.Duration
+	flRetryMaxAttempts      int
+	flRetryMethods          string
+	flRetryStatusCodes      string
+	flRetryBackoff          time.Duration
+	flRetryMaxBackoff       time.Duration
+	flRetryMaxBodyBytes     int64
+	flPrewarmInterval       time.Duration
+	flTokenRefreshMargin    time.Duration
+	flTokenRefreshAhead     time.Duration
+	flHedgeDelay            time.Duration
+	flHedgeBudgetPercent    float64
+	flBreakerErrorRate      float64
+	flBreakerMinRequests    int
+	flBreakerWindow         time.Duration
+	flBreakerOpenDuration   time.Duration
+	flDialTimeout           time.Duration
+	flIdleConnTimeout       time.Duration
+	flExpectContinueTimeout time.Duration
+	flKeepAlive             time.Duration
+	flMaxIdleConns          int
+	flMaxIdleConnsPerHost   int
+	flMaxConnsPerHost       int
+	flRateLimitQPS          float64
+	flRateLimitBurst        int
+	flRateLimitOverrides    string
+	flMaxInFlight           int
+	flMaxInFlightPerDest    int
+	flCacheSizeMB           int
+	flCacheMaxObjectKB      int
+	flCacheMaxTTL           time.Duration
+	flMaxRequestBodyBytes   int64
+	flMaxResponseBodyBytes  int64
+	flHeaderTimeout         time.Duration
+	flHeaderTimeouts        string
+	flRequestTimeout        time.Duration
+	flRequestTimeouts       string
+	flDependencyLogInterval time.Duration
+	flLatencyBudgets        string
+	flLatencyBudgetWindow   time.Duration
+	flMaxHeaderBytes        int
+	flMaxHeaderCount        int
+	flDNSCacheSize          int
+	flDNSAnswerTTL          uint
+	flDNSClientQPS          float64
+	flDNSClientBurst        int
+	flDNSMaxRecursions      int
+	flDNSQueryLog           string
+	flDNSQueryLogMaxMB      int
+	flDNSQueryLogBackups    int
+	flEtcHostsSyncInterval  time.Duration
+	flDNSUpstreamTimeout    time.Duration
+	flDNSUpstreamRetries    int
+	flDNSHedgeUpstream      string
+	flDNSHedgeDelay         time.Duration
+
+	flFaultTargets      string
+	flFaultRulesFile    string
+	flFaultDelay        time.Duration
+	flFaultDelayPercent float64
+	flFaultAbortStatus  int
+	flFaultAbortPercent float64
+	flFaultResetPercent float64
 
 	flSkipDNSServer       bool
+	flBindIPCreate        bool
+	flNoHeaderMutation    bool
+	flNoForwardedHeaders  bool
+	flPreserveHost        bool
+	flNoTracePropagation  bool
+	flUpstreamInsecure    bool
+	flPassUnknownRegion   bool
+	flWatchResolvConf     bool
+	flEtcHostsSync        bool
+	flCATrustStore        bool
+	flDNS0x20             bool
+	flDiscoverRegionCodes bool
+	flRevisionTagNames    bool
+	flRedirectDNS         bool
+	flHealthzCheckAppPort bool
+	flFQDNOnly            bool
 	flSkipHTTPProxyServer bool
+	flGRPCWeb             bool
+	flBench               bool
+	flRunAppAuth          bool
 
 	ipv4Loopback = net.IPv4(127, 0, 0, 1)
 
+	// listenIPv4 and listenIPv6 are the addresses the dns and proxy servers
+	// listen on, and the internal names are resolved to.
+	listenIPv4 = ipv4Loopback
+	listenIPv6 = net.IPv6loopback
+
+	ipv4OK bool
 	ipv6OK bool
 )
 
@@ -66,28 +218,275 @@ func main() {
 
 	klog.InitFlags(nil)
 	defer klog.Flush()
+	flag.BoolVar(&flBench, "bench", false, "run the load-testing benchmark instead of a command, e.g. runsd -bench -- -n=500 -c=20 http://hello.us-central1/ (see runsd -bench -- -help)")
 	flag.StringVar(&flResolvConf, "resolv_conf_file", resolvConf, "[debug-only] path to resolv.conf(5) file to read/write")
-	flag.StringVar(&flInternalDomain, "domain", defaultInternalDomain, "internal zone (without a trailing dot)")
-	flag.IntVar(&flNdots, "ndots", defaultNdots, "ndots setting for resolv conf (e.g. for -domain=a.b. this should be 4)")
-	flag.StringVar(&flNameserver, "nameserver", "", "override used nameserver (default: from -resolv_conf_file)")
+	flag.Var(flDomains, "domain", "internal zone, can be repeated to serve multiple zones (the first one is the primary zone)")
+	flag.IntVar(&flNdots, "ndots", 0, "ndots setting for resolv conf, derived from -domain if not set (e.g. 4 for -domain=a.b.)")
+	flag.StringVar(&flExtraSearch, "extra_search_domains", "", "comma-separated search domains to add to resolv.conf after the internal zones (e.g. internal.corp)")
+	flag.StringVar(&flNdotsOverrides, "ndots_override", "", "comma-separated SUFFIX=NDOTS pairs to short-circuit search-list expansion of names under SUFFIX having at least NDOTS dots (e.g. mongodb.net=0 never expands *.mongodb.net)")
+	flag.StringVar(&flNameserver, "nameserver", "", "override used nameserver, or tls://HOST[:PORT] to recurse over DNS-over-TLS (default: from -resolv_conf_file)")
 	flag.StringVar(&flRegion, "gcp_region", "", "[debug-only] override GCP region (do not infer from metadata svc)")
+	flag.StringVar(&flMode, "mode", modeCloudRun, "cloudrun, or localdev to run outside Cloud Run (e.g. on a workstation) without hijacking dns: the app reaches the reverse proxy with HTTP_PROXY and the names are proxied to the run.app urls listed with the Cloud Run Admin API, emulator to proxy the names to -emulated_services offline, or compose to proxy the names to the containers of the services on a Docker Compose network")
+	flag.StringVar(&flComposePort, "compose_port", defaultComposePort, "with -mode=compose, the port the services listen on in their containers")
+	flag.StringVar(&flComposePorts, "compose_port_overrides", "", "with -mode=compose, comma-separated NAME=PORT pairs of the services listening on another port than -compose_port (e.g. billing=8081)")
+	flag.StringVar(&flComposeID, "compose_identity", "", "with -mode=compose, send the services unsigned ID tokens for this email (e.g. dev@example.com) instead of no token")
+	flag.StringVar(&flEmulated, "emulated_services", "", "with -mode=emulator, comma-separated NAME=HOST:PORT pairs of the local processes emulating the services (e.g. billing=localhost:8081,users.europe-west1=users:8080), sent no ID tokens")
 	flag.BoolVar(&flSkipDNSServer, "skip_dns_hijack", false, "[debug-only] do not start a DNS server for service discovery")
+	flag.BoolVar(&flFQDNOnly, "fqdn_only", false, "do not add search domains to resolv.conf, only fully qualified internal names (e.g. hello.us-central1.run.internal) are resolved")
 	flag.BoolVar(&flSkipHTTPProxyServer, "skip_http_proxy", false, "[debug-only] do not start a HTTP proxy server")
 	flag.StringVar(&flProjectHash, "gcp_project_hash", "", "gcp cloud run project hash (or use CLOUD_RUN_PROJECT_HASH")
-	flag.StringVar(&flHTTPProxyPort, "http_proxy_port", defaultHTTPProxyPort, "[debug-only] reverse proxy port to listen on for loopback interface(s)")
+	flag.StringVar(&flHTTPProxyPort, "http_proxy_port", defaultHTTPProxyPort, "comma-separated reverse proxy ports to listen on for loopback interface(s), e.g. 80,8080 (internal names resolve to the first one in srv records)")
+	flag.StringVar(&flHTTPSProxyPort, "https_proxy_port", "", "port to serve the reverse proxy over https on loopback interface(s) with a certificate from a generated ca (e.g. 443, disabled if empty)")
+	flag.StringVar(&flTLSPassthrough, "tls_passthrough_port", "", "port to tunnel tls connections on loopback interface(s) to the service picked by sni without terminating them (no ID token is added, disabled if empty)")
+	flag.StringVar(&flSOCKS5Port, "socks5_port", "", "port to serve a socks5 proxy on loopback interface(s) for the clients without http proxy support, which serves the connections to the internal names with the reverse proxy and tunnels the others (disabled if empty)")
+	flag.StringVar(&flServiceIPRange, "service_ip_range", "", "loopback range (e.g. 127.77.0.0/16) to allocate an address to each internal name from, the proxy listens on these addresses (and the first one in the range for any name) instead of 127.0.0.1, the addresses unused for 30m are released")
+	flag.StringVar(&flCACertFile, "ca_cert_file", "/etc/runsd/ca.pem", "path to write the certificate of the generated ca to with -https_proxy_port (or -mode=localdev -run_app_auth)")
+	flag.StringVar(&flClientCAFile, "https_client_ca_file", "", "pem file of the cas to verify the client certificates presented to -https_proxy_port with, their subject and sans are forwarded to the routes with clientSubjectHeader or clientSANHeader (optional)")
+	flag.BoolVar(&flCATrustStore, "ca_trust_store", false, "append the certificate of the generated ca to the system ca bundles with -https_proxy_port (or -mode=localdev -run_app_auth), removing it on exit")
 	flag.StringVar(&flDNSPort, "dns_port", defaultDnsPort, "[debug-only] custom port to start dns server on loopback interface(s), note resolv.conf doesn't support custom ports")
+	flag.StringVar(&flBindIP, "bind_ip", "", "address to use instead of the loopback address (127.0.0.1 or ::1) of the same family for the dns and proxy servers, e.g. 127.0.0.53")
+	flag.BoolVar(&flBindIPCreate, "bind_ip_create", false, "add -bind_ip to the loopback interface if it's not assigned yet (requires NET_ADMIN capability)")
+	flag.StringVar(&flAdminPort, "admin_port", "", "port to serve the admin endpoints on the loopback interface (disabled if empty)")
+	flag.DurationVar(&flDependencyLogInterval, "dependency_log_interval", 0, "interval to log the destinations called through the proxy as structured logs (0 to disable)")
+	flag.StringVar(&flLatencyBudgets, "latency_budget", "", "comma-separated DESTINATION=DURATION latency budgets (e.g. hello=200ms,world.europe-west1=1s) to warn about when exceeded by the rolling p95")
+	flag.DurationVar(&flLatencyBudgetWindow, "latency_budget_window", time.Minute, "rolling window to compute the p95 latency for -latency_budget over")
+	flag.BoolVar(&flNoHeaderMutation, "no_header_mutation", false, "do not add or rewrite any request headers (such as User-Agent or X-Forwarded-For) other than Authorization")
+	flag.BoolVar(&flNoForwardedHeaders, "no_forwarded_headers", false, "do not add the X-Forwarded-For, X-Forwarded-Host (the internal name called) and X-Forwarded-Proto headers to the proxied requests")
+	flag.BoolVar(&flNoTracePropagation, "no_trace_propagation", false, "do not send the trace context (traceparent and X-Cloud-Trace-Context headers, propagated from the request or newly generated) to the backends")
+	flag.BoolVar(&flPreserveHost, "preserve_host", false, "send the proxied requests with their original Host header (e.g. hello) rather than the backend host, for the backends (such as the ones in -routes_file) doing virtual-host routing (Cloud Run itself requires the run.app host)")
+	flag.StringVar(&flOrigHostHeader, "original_host_header", "", "header to send the original Host of the proxied requests in (e.g. X-Original-Host), even with -no_header_mutation")
+	flag.StringVar(&flUpstreamCAFile, "upstream_ca_bundle", "", "pem file of the CA certificates (in addition to the system ones) to verify the backend certificates with, e.g. for the -routes_file backends with a private CA")
+	flag.BoolVar(&flUpstreamInsecure, "upstream_insecure_skip_verify", false, "do not verify the backend certificates (insecure, only for debugging)")
+	flag.StringVar(&flOTLPEndpoint, "otlp_endpoint", "", "OpenTelemetry collector endpoint to export the spans of the proxied requests to over OTLP/HTTP, e.g. http://localhost:4318 (disabled if empty)")
+	flag.StringVar(&flMetricsPort, "metrics_port", "", "port to serve the prometheus /metrics endpoint of the proxy on the loopback interface (disabled if empty, also served on -admin_port)")
+	flag.StringVar(&flHealthzPort, "healthz_port", "", "port to serve the /healthz (runsd components) and /readyz (runsd, token minting and the subprocess) endpoints on all interfaces, e.g. for Cloud Run liveness and startup probes (disabled if empty)")
+	flag.BoolVar(&flHealthzCheckAppPort, "healthz_check_app_port", false, "also require the subprocess to accept connections on $PORT for /readyz to pass")
+	flag.StringVar(&flTokenCacheFile, "token_cache_file", "", "file (preferably on tmpfs, e.g. /dev/shm/runsd-tokens.json) to persist the cached ID tokens in across runsd restarts (only cached in memory if empty)")
+	flag.DurationVar(&flTokenRefreshAhead, "token_background_refresh", 5*time.Minute, "refresh the cached tokens in the background this long before -token_refresh_margin, so the requests don't wait for new tokens (0 to disable)")
+	flag.DurationVar(&flTokenRefreshMargin, "token_refresh_margin", time.Minute, "time before their expiry to stop using the cached tokens and fetch new ones")
+	flag.StringVar(&flDNSExclude, "dns_exclude_suffixes", "", "comma-separated name suffixes or wildcard patterns (e.g. googleapis.com,*.rds.amazonaws.com) to recurse immediately and never expand with search domains")
+	flag.StringVar(&flHeaderRules, "header_rules_file", "", "json file of destinations (service names or hostnames, or * for all) to headers to set or remove on the proxied requests")
+	flag.BoolVar(&flRevisionTagNames, "revision_tag_names", false, "resolve TAG.SVC.REGION.run.internal (and TAG.SVC) names to the revision tag urls (e.g. https://TAG---SVC-HASH-uc.a.run.app), note that two-label external names (e.g. example.com) are then resolved as TAG.SVC when looked up via the search domains")
+	flag.StringVar(&flTrafficSplit, "traffic_split_file", "", "json file of services (SVC or SVC.REGION) to the weights of the revision tags to route their requests to, e.g. {\"search\": {\"stable\": 90, \"canary\": 10}}")
+	flag.StringVar(&flRoutesFile, "routes_file", "", "json file of internal names (SVC or SVC.REGION) to proxy to other backends than their run.app urls, e.g. {\"ledger\": {\"url\": \"http://10.128.0.9:8080\", \"noAuth\": true}}, with optional \"clientCert\" and \"clientKey\" pem files for backends requiring mutual TLS")
+	flag.StringVar(&flNoAuthHosts, "no_auth_hosts", "", "comma-separated internal names to proxy without an ID token (e.g. for public services), in SVC (any region) or SVC.REGION form where * matches any characters, e.g. public-*,hello.us-east1")
+	flag.StringVar(&flAudiences, "audiences", "", "comma-separated NAME=AUDIENCE pairs of internal names (SVC or SVC.REGION) to fetch ID tokens with another audience than their url for, e.g. for services behind IAP or custom domains: hello=https://hello.example.com")
+	flag.StringVar(&flImpersonate, "impersonate_service_account", "", "email of the service account to mint the ID tokens for (with the IAM Credentials API) instead of the runtime service account, which needs the Service Account OpenID Connect Identity Token Creator role on it")
+	flag.StringVar(&flImpersonateFor, "impersonate_service_account_overrides", "", "comma-separated NAME=EMAIL pairs of internal names (SVC or SVC.REGION) to mint the ID tokens as another service account for, overriding -impersonate_service_account")
+	flag.StringVar(&flAccessTokens, "access_token_hosts", "", "comma-separated internal names (in the -no_auth_hosts form) to send an OAuth2 access token to instead of an ID token, e.g. for Cloud Endpoints")
+	flag.StringVar(&flAccessScopes, "access_token_scopes", "", "space-separated OAuth2 scopes of the access tokens for -access_token_hosts (default: the scopes of the service account)")
+	flag.StringVar(&flOverwriteAuth, "overwrite_auth_hosts", "", "comma-separated internal names (in the -no_auth_hosts form) to replace the Authorization header of the requests with an ID token for, rather than keeping the header set by the app")
+	flag.StringVar(&flPrewarm, "prewarm", "", "comma-separated internal names (e.g. hello,ledger.us-east1) of the services the app depends on, to open connections and fetch ID tokens for while the subprocess is starting")
+	flag.DurationVar(&flPrewarmInterval, "prewarm_interval", 0, "interval to repeat -prewarm at, to keep the connections from being closed while idle (0 to only prewarm at startup)")
+	flag.StringVar(&flJobsAPIHost, "jobs_api_host", "", "internal name (e.g. jobs) to serve POST http://NAME/JOB[?region=REGION] requests on by running the Cloud Run job and streaming back its execution status (shadows a service with the same name)")
+	flag.StringVar(&flCustomDomains, "custom_domains", "", "comma-separated DOMAIN=SVC[.REGION] custom domains mapped to services (e.g. api.example.com=api) to resolve to runsd and proxy to the run.app url of the service with an ID token")
+	flag.BoolVar(&flRunAppAuth, "run_app_auth", false, "also add ID tokens to the requests made with the run.app urls of the services: resolves the run.app names to runsd (requires -https_proxy_port=443), or with -mode=localdev, sets HTTPS_PROXY for the app and serves the connections to them with a certificate from a generated ca")
+	flag.StringVar(&flHostsFile, "hosts_file", "", "hosts-style (or .yaml) file of static names to answer with the given ip addresses, or to proxy to the given urls")
+	flag.DurationVar(&flDNSUpstreamTimeout, "dns_upstream_timeout", 2*time.Second, "timeout for each query to the upstream nameserver")
+	flag.IntVar(&flDNSUpstreamRetries, "dns_upstream_retries", 0, "number of times to retry failed (or SERVFAIL) queries to the upstream nameserver, with exponential backoff starting at 100ms")
+	flag.BoolVar(&flRedirectDNS, "redirect_dns", false, "redirect all dns queries (udp/tcp port 53) sent from the container to runsd with iptables, for resolvers not using resolv.conf (requires CAP_NET_ADMIN)")
+	flag.BoolVar(&flDiscoverRegionCodes, "discover_region_codes", true, "find the codes of the regions unknown to runsd from the service urls in the region with the admin api (requires run.services.list permission)")
+	flag.BoolVar(&flDNS0x20, "dns_0x20", false, "randomize the case of the names in queries to the upstream nameservers over udp, and reject the responses not preserving it")
+	flag.BoolVar(&flEtcHostsSync, "etc_hosts_sync", false, "periodically write the names of the services in the region to the hosts file (for resolvers with broken search domain handling)")
+	flag.DurationVar(&flEtcHostsSyncInterval, "etc_hosts_sync_interval", 5*time.Minute, "interval to refresh the services in the hosts file with -etc_hosts_sync")
+	flag.StringVar(&flEtcHosts, "etc_hosts_file", "/etc/hosts", "[debug-only] path to hosts(5) file to write with -etc_hosts_sync")
+	flag.BoolVar(&flWatchResolvConf, "watch_resolv_conf", true, "restore the runsd-managed resolv.conf if another process overwrites it")
+	flag.Var(flDNSForwards, "forward", "ZONE=NAMESERVER rule (nameserver as IP[:PORT] or tls://HOST[:PORT]) to recurse queries for names under ZONE to a designated nameserver, can be repeated")
+	flag.StringVar(&flDNSHedgeUpstream, "dns_hedge_upstream", "", "secondary nameserver (ip address or tls://HOST[:PORT]) to race the external queries against, taking the first answer")
+	flag.DurationVar(&flDNSHedgeDelay, "dns_hedge_delay", 0, "how long to wait for the primary nameserver before querying the -dns_hedge_upstream (0 races both immediately)")
+	flag.StringVar(&flNameserverDoH, "nameserver_doh", "", "DNS-over-HTTPS endpoint (e.g. https://dns.google/dns-query) to resolve external names with instead of the nameserver")
+	flag.BoolVar(&flPassUnknownRegion, "unknown_region_recurse", false, "recurse the queries for internal names in regions without a known region code instead of answering NXDOMAIN")
+	flag.StringVar(&flRegionHostTmpl, "unknown_region_host", "", "hostname template to proxy to for regions without a known region code, e.g. {service}-123456789012.{region}.run.app ({service}, {region} and {project_hash} are replaced)")
+	flag.StringVar(&flAliases, "aliases", "", "comma-separated ALIAS=TARGET internal names (SVC or SVC.REGION) to answer as CNAMEs and proxy to the target, e.g. billing=billing-v2.europe-west1")
+	flag.UintVar(&flDNSAnswerTTL, "dns_answer_ttl", 10, "ttl (in seconds) of the dns answers for internal names")
+	flag.Float64Var(&flDNSClientQPS, "dns_client_qps", 0, "maximum dns queries per second from each client ip, exceeding queries are refused (0 is unlimited)")
+	flag.IntVar(&flDNSClientBurst, "dns_client_burst", 100, "number of dns queries a client can send at once above -dns_client_qps")
+	flag.IntVar(&flDNSMaxRecursions, "dns_max_concurrent_recursions", 0, "maximum number of concurrent queries to upstream nameservers, exceeding queries are refused (0 is unlimited)")
+	flag.StringVar(&flDNSQueryLog, "dns_query_log", "", "file to write a json line for each dns query to (\"-\" for stderr)")
+	flag.IntVar(&flDNSQueryLogMaxMB, "dns_query_log_max_size_mb", 100, "size (in megabytes) after which -dns_query_log is rotated (0 disables rotation)")
+	flag.IntVar(&flDNSQueryLogBackups, "dns_query_log_max_backups", 3, "number of rotated -dns_query_log files to keep")
+	flag.IntVar(&flDNSCacheSize, "dns_cache_size", 1024, "maximum number of external dns responses to cache per their ttl (0 disables caching)")
+	flag.StringVar(&flCommandFile, "command_file", "", "file to read the subprocess command line from (one argument per line) if not specified as positional args")
 	flag.StringVar(&flUser, "user", "", "uid or user name to run the app subprocess as")
+	flag.BoolVar(&flAccessLog, "access_log", false, "write access logs for proxied requests (see -access_log_format and -access_log_file)")
+	flag.StringVar(&flAccessLogFormat, "access_log_format", accessLogJSON, "format of the access logs: json (Cloud Logging structured logs) or combined")
+	flag.StringVar(&flAccessLogFile, "access_log_file", "", "file to append the access logs to (default: stderr)")
+	flag.Float64Var(&flAccessLogSampleRate, "access_log_sample_rate", 1.0, "fraction (0.0-1.0) of successful requests to write access logs for (errors are always logged)")
+	flag.DurationVar(&flAccessLogSlowThreshold, "access_log_slow_threshold", 0, "always write access logs for requests taking longer than this (0 to disable)")
+	flag.DurationVar(&flShutdownTimeout, "shutdown_timeout", 10*time.Second, "time to wait for in-flight proxied requests to complete after the subprocess exits")
+	flag.IntVar(&flMaxHeaderBytes, "max_header_bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers accepted by the reverse proxy (larger requests get HTTP 431)")
+	flag.IntVar(&flMaxHeaderCount, "max_header_count", 0, "maximum number of request header fields accepted by the reverse proxy (0 for no limit)")
+	flag.DurationVar(&flWebSocketIdleTimeout, "websocket_idle_timeout", 0, "close the proxied websocket (or other upgraded) connections after no data is sent in either direction for this long (0 to disable)")
+	flag.BoolVar(&flGRPCWeb, "grpc_web", false, "translate the gRPC-Web requests (e.g. forwarded from browsers) to gRPC for the backends, and their responses back")
+	flag.StringVar(&flStreamingHosts, "streaming_hosts", "", "comma-separated internal names whose responses are streamed like Server-Sent Events, never held to be cached or checked against -max_response_body_bytes (as the text/event-stream and gRPC responses always are), in SVC (any region) or SVC.REGION form where * matches any characters")
+	flag.IntVar(&flRetryMaxAttempts, "retry_max_attempts", 1, "number of times to send a proxied request that fails with -retry_status_codes or a connection error, including the first attempt (1 to disable retries)")
+	flag.StringVar(&flRetryMethods, "retry_methods", "GET,HEAD,OPTIONS,PUT,DELETE", "comma-separated request methods to retry with -retry_max_attempts")
+	flag.StringVar(&flRetryStatusCodes, "retry_status_codes", "429,503", "comma-separated response status codes to retry with -retry_max_attempts")
+	flag.DurationVar(&flRetryBackoff, "retry_backoff", 100*time.Millisecond, "maximum random delay before the first retry, doubled for each following retry")
+	flag.DurationVar(&flRetryMaxBackoff, "retry_max_backoff", 2*time.Second, "maximum delay between retries (Retry-After headers up to this value are honored)")
+	flag.Int64Var(&flRetryMaxBodyBytes, "retry_max_body_bytes", 64<<10, "largest request body to keep in memory (as it is sent) to replay on retries, requests with larger bodies are not retried")
+	flag.DurationVar(&flHedgeDelay, "hedge_delay", 0, "time after which a second attempt of the GET and HEAD requests is sent if there's no response yet (e.g. the p95 latency), using whichever responds first (0 to disable)")
+	flag.Float64Var(&flHedgeBudgetPercent, "hedge_budget_percent", 10, "maximum percentage of the requests that can be hedged with -hedge_delay")
+	flag.Float64Var(&flBreakerErrorRate, "circuit_breaker_error_rate", 0, "ratio (0-1] of failed (5xx or connection error) requests to a backend within -circuit_breaker_window to fail its requests fast with 503 (0 to disable)")
+	flag.IntVar(&flBreakerMinRequests, "circuit_breaker_min_requests", 20, "minimum number of requests to a backend within -circuit_breaker_window before its circuit can open")
+	flag.DurationVar(&flBreakerWindow, "circuit_breaker_window", 10*time.Second, "period to count the failed requests to a backend over for -circuit_breaker_error_rate")
+	flag.DurationVar(&flBreakerOpenDuration, "circuit_breaker_open_duration", 5*time.Second, "time to fail the requests to a backend fast before sending a probe request to it")
+	flag.DurationVar(&flDialTimeout, "dial_timeout", 30*time.Second, "timeout to connect to the backends of the proxied requests")
+	flag.DurationVar(&flIdleConnTimeout, "idle_conn_timeout", 90*time.Second, "time to keep the idle connections to the backends open for reuse (0 for no limit)")
+	flag.DurationVar(&flExpectContinueTimeout, "expect_continue_timeout", time.Second, "time to wait for the 100 Continue response of the backends to the requests with an 'Expect: 100-continue' header before sending the body anyway (0 to send the body right away)")
+	flag.DurationVar(&flKeepAlive, "tcp_keep_alive", 30*time.Second, "tcp keep-alive period of the connections to the backends (negative to disable)")
+	flag.IntVar(&flMaxIdleConns, "max_idle_conns", 1000, "maximum number of idle connections to keep open to all backends (0 for no limit)")
+	flag.IntVar(&flMaxIdleConnsPerHost, "max_idle_conns_per_host", 100, "maximum number of idle connections to keep open to each backend")
+	flag.IntVar(&flMaxConnsPerHost, "max_conns_per_host", 0, "maximum number of connections to each backend, requests wait for a connection beyond it (0 for no limit)")
+	flag.IntVar(&flMaxInFlight, "max_in_flight_requests", 0, "maximum number of concurrent proxied requests, requests beyond it get 503 right away (0 for no limit)")
+	flag.IntVar(&flMaxInFlightPerDest, "max_in_flight_requests_per_destination", 0, "maximum number of concurrent proxied requests to each destination, requests beyond it get 503 right away (0 for no limit)")
+	flag.Float64Var(&flRateLimitQPS, "rate_limit_qps", 0, "maximum requests per second to each destination, exceeding requests get 429 with a Retry-After header (0 is unlimited)")
+	flag.IntVar(&flRateLimitBurst, "rate_limit_burst", 10, "number of requests that can be sent to a destination at once above its rate limit")
+	flag.StringVar(&flRateLimitOverrides, "rate_limit_overrides", "", "comma-separated DESTINATION=QPS pairs to override -rate_limit_qps for, where destination is a service name or hostname (e.g. hello=5,ledger=0)")
+	flag.Int64Var(&flMaxRequestBodyBytes, "max_request_body_bytes", 0, "reject proxied requests with larger bodies with 413 (0 for no limit)")
+	flag.Int64Var(&flMaxResponseBodyBytes, "max_response_body_bytes", 0, "fail proxied requests with larger response bodies with 502, or abort the response if its size is not known upfront (0 for no limit)")
+	flag.IntVar(&flCacheSizeMB, "response_cache_size_mb", 0, "size of the in-memory cache for the responses to the proxied GET requests per their Cache-Control headers, in megabytes (0 to disable)")
+	flag.IntVar(&flCacheMaxObjectKB, "response_cache_max_object_kb", 512, "size of the largest response body to store in the response cache, in kilobytes")
+	flag.DurationVar(&flCacheMaxTTL, "response_cache_max_ttl", 5*time.Minute, "maximum time to serve a response from the response cache without revalidating it")
+	flag.DurationVar(&flHeaderTimeout, "response_header_timeout", 0, "timeout to receive the response headers of the proxied requests, fails with 504 (0 for no timeout)")
+	flag.StringVar(&flHeaderTimeouts, "response_header_timeout_overrides", "", "comma-separated DESTINATION=DURATION response header timeouts (e.g. hello=5s,stream=0) overriding -response_header_timeout")
+	flag.DurationVar(&flRequestTimeout, "request_timeout", 0, "total timeout of the proxied requests including reading the response body (0 for no timeout)")
+	flag.StringVar(&flRequestTimeouts, "request_timeout_overrides", "", "comma-separated DESTINATION=DURATION total timeouts (e.g. hello=30s,stream=0) overriding -request_timeout")
+	flag.DurationVar(&flSlowRequestThreshold, "slow_request_threshold", 0, "log a warning with timing breakdown for proxied requests taking longer than this (0 to disable)")
+	flag.StringVar(&flFaultTargets, "fault_targets", "", "[testing-only] comma-separated service names or hostnames to inject faults for (default: all)")
+	flag.StringVar(&flFaultRulesFile, "fault_rules_file", "", "[testing-only] json file of destinations (service names or hostnames) to the faults injected for them instead of the -fault_* flags, e.g. {\"ledger\": {\"delay\": \"200ms\", \"abortStatus\": 503, \"abortPercent\": 5}}")
+	flag.DurationVar(&flFaultDelay, "fault_delay", 0, "[testing-only] artificial latency to add to proxied requests")
+	flag.Float64Var(&flFaultDelayPercent, "fault_delay_percent", 0, "[testing-only] percentage of proxied requests to delay by -fault_delay")
+	flag.IntVar(&flFaultAbortStatus, "fault_abort_status", 503, "[testing-only] http status code (400-599) to respond with for aborted requests")
+	flag.Float64Var(&flFaultAbortPercent, "fault_abort_percent", 0, "[testing-only] percentage of proxied requests to abort with -fault_abort_status")
+	flag.Float64Var(&flFaultResetPercent, "fault_reset_percent", 0, "[testing-only] percentage of proxied requests to reset the connection for")
 	flag.Set("logtostderr", "true")
 	flag.Parse()
+	if flBench {
+		if err := runBench(flag.Args()); err != nil {
+			klog.Exitf("bench failed: %v", err)
+		}
+		return
+	}
+	for i, v := range flDomains.values {
+		flDomains.values[i] = dns.Fqdn(strings.ToLower(v))
+	}
+	flInternalDomain = flDomains.values[0]
+	extraDomains := flDomains.values[1:]
+	var explicitNdots *int
+	if isFlagSet(flag.CommandLine, "ndots") {
+		explicitNdots = &flNdots
+	}
+	ndots, err := resolvNdots(flInternalDomain, explicitNdots)
+	if err != nil {
+		klog.Exitf("invalid -ndots or -domain: %v", err)
+	}
+	flNdots = ndots
 
 	klog.V(1).Infof("starting runsd version=%s commit=%s pid=%d", version, commit, os.Getpid())
 
+	logLevelCh := make(chan os.Signal, 1)
+	signal.Notify(logLevelCh, syscall.SIGUSR2)
+	go cycleLogLevel(logLevelCh, logLevel())
+
+	execEnv := detectExecutionEnvironment()
+	klog.V(1).Infof("execution environment: %s", execEnv)
+	cfg := &effectiveConfig{
+		Version:              version,
+		Commit:               commit,
+		ExecutionEnvironment: execEnv.String(),
+		Domain:               flInternalDomain,
+		ExtraDomains:         extraDomains,
+		Ndots:                flNdots,
+		IDTokenSource:        idTokenSource(),
+	}
+
+	if flTokenRefreshMargin < 0 || flTokenRefreshMargin >= time.Hour {
+		klog.Exit("-token_refresh_margin must be between 0 and 1h (the lifetime of the ID tokens)")
+	}
+	tokenExpiryMargin = flTokenRefreshMargin
+	if flTokenCacheFile != "" {
+		idTokenCache = newTokenCache(flTokenCacheFile)
+		if err := idTokenCache.load(time.Now()); err != nil {
+			klog.Warningf("ignoring token cache file: %v", err)
+		}
+	}
+	if flTokenRefreshAhead > 0 {
+		go idTokenCache.refreshPeriodically(30*time.Second, flTokenRefreshAhead)
+	}
+
 	new(sync.Once).Do(func() {
-		ipv6OK = ipv6Available()
+		// gVisor may let us listen on ::1 without being able to connect to it,
+		// so verify the loopback round trip there.
+		ipv6OK = ipv6Available(execEnv == envGen1)
+		ipv4OK = ipv4Available()
 	})
+	if !ipv4OK {
+		if !ipv6OK {
+			klog.Exit("neither ipv4 nor ipv6 loopback interfaces are available")
+		}
+		klog.V(1).Infof("ipv4 stack not available, running in ipv6-only mode")
+		// dial the metadata server, the apis, the run.app urls and the
+		// upstream nameservers over ipv6.
+		http.DefaultTransport = ipv6OnlyTransport()
+		addUpstreamDialControl(ipv6OnlyDialControl)
+	}
+	cfg.IPv4, cfg.IPv6 = ipv4OK, ipv6OK
 
-	if os.Getenv("PORT") == "80" {
-		klog.Exit("your Cloud Run application is set to run on PORT=80, this conflicts with runsd")
+	if flBindIP != "" {
+		ip := net.ParseIP(flBindIP)
+		if ip == nil {
+			klog.Exitf("invalid -bind_ip address: %q", flBindIP)
+		}
+		if err := ensureLocalAddress(ip, flBindIPCreate); err != nil {
+			klog.Exitf("cannot use -bind_ip: %v", err)
+		}
+		if ip.To4() != nil {
+			listenIPv4 = ip.To4()
+		} else {
+			listenIPv6 = ip
+		}
+		klog.V(1).Infof("using bind address %s", ip)
+	}
+
+	proxyPorts, err := parsePorts(flHTTPProxyPort)
+	if err != nil {
+		klog.Exitf("invalid -http_proxy_port: %v", err)
+	}
+	var svcIPs *serviceIPs
+	if flServiceIPRange != "" {
+		if !ipv4OK {
+			klog.Exit("-service_ip_range requires ipv4")
+		}
+		if flHTTPSProxyPort != "" {
+			klog.Exit("-service_ip_range cannot be used with -https_proxy_port")
+		}
+		if flEtcHostsSync {
+			// the hosts file would point the names to the loopback address
+			// the proxy doesn't listen on
+			klog.Exit("-service_ip_range cannot be used with -etc_hosts_sync")
+		}
+		if svcIPs, err = newServiceIPs(flServiceIPRange, proxyPorts); err != nil {
+			klog.Exitf("invalid -service_ip_range: %v", err)
+		}
+		svcIPs.maxHeaderBytes = flMaxHeaderBytes
+	}
+	var clientCAs *x509.CertPool
+	if flClientCAFile != "" {
+		if flHTTPSProxyPort == "" {
+			klog.Exit("-https_client_ca_file requires -https_proxy_port")
+		}
+		if clientCAs, err = loadClientCAs(flClientCAFile); err != nil {
+			klog.Exitf("failed to load -https_client_ca_file: %v", err)
+		}
+	}
+	if flTLSPassthrough != "" && flTLSPassthrough == flHTTPSProxyPort {
+		klog.Exit("-tls_passthrough_port cannot be the same as -https_proxy_port")
+	}
+	for _, p := range append(proxyPorts, flHTTPSProxyPort, flTLSPassthrough, flSOCKS5Port) {
+		if p != "" && os.Getenv("PORT") == p && svcIPs == nil {
+			klog.Exitf("your Cloud Run application is set to run on PORT=%s, this conflicts with runsd", p)
+		}
 	}
 
 	var uid *uint32
@@ -99,9 +498,12 @@ func main() {
 		uid = &u
 	}
 
-	posArgs := flag.Args()
+	posArgs, err := subprocessArgs(flag.Args(), flCommandFile, os.Getenv("RUNSD_COMMAND"))
+	if err != nil {
+		klog.Exitf("cannot determine subprocess command: %v", err)
+	}
 	if len(posArgs) == 0 {
-		klog.Exit("specify subprocess as positional args, e.g: '/runsd -- python3 server.py'")
+		klog.Exit("specify subprocess as positional args (e.g: '/runsd -- python3 server.py'), with -command_file or RUNSD_COMMAND")
 	}
 
 	rc, err := dns.ClientConfigFromFile(flResolvConf)
@@ -109,123 +511,628 @@ func main() {
 		klog.Exitf("failed to read dns client configuration from %s: %v", flResolvConf, err)
 	}
 
-	var useNameserver string
-	if flNameserver != "" {
+	var (
+		useNameserver string
+		dotUpstream   *dotExchanger
+	)
+	if strings.HasPrefix(flNameserver, "tls://") {
+		// the nameserver from resolv.conf is still used to resolve the
+		// hostname of the dot nameserver.
+		if dotUpstream, err = newDoTExchanger(flNameserver, flDNSUpstreamTimeout); err != nil {
+			klog.Exitf("invalid -nameserver: %v", err)
+		}
+	}
+	if flNameserver != "" && dotUpstream == nil {
 		useNameserver = flNameserver
 	} else if len(rc.Servers) > 0 {
-		useNameserver = rc.Servers[0]
+		useNameserver = pickNameserver(rc.Servers, ipv4OK)
 	} else {
 		klog.Exitf("no nameservers in %s and no nameserver is specified as option", flResolvConf)
 	}
 	klog.V(3).Infof("original nameserver: %s, ndots=%d", useNameserver, flNdots)
+	cfg.Nameserver = useNameserver
 
 	// do not hijack dns for this process
 	net.DefaultResolver = resolver(net.JoinHostPort(useNameserver, "53"))
 
-	onCloudRun := flRegion != "" || useNameserver == "169.254.169.254"
+	switch flMode {
+	case modeCloudRun, modeLocalDev, modeEmulator, modeCompose:
+	default:
+		klog.Exitf("invalid -mode=%q, must be %s, %s, %s or %s", flMode, modeCloudRun, modeLocalDev, modeEmulator, modeCompose)
+	}
+	localDev, emulate, compose := flMode == modeLocalDev, flMode == modeEmulator, flMode == modeCompose
+	// the names are proxied to local backends without minting tokens
+	localBackends := emulate || compose
+	onCloudRun := !localDev && !localBackends && (flRegion != "" || useNameserver == metadataNameserver || useNameserver == metadataNameserverIPv6)
 	klog.V(1).Infof("on cloudrun: %v", onCloudRun)
+	if flRunAppAuth {
+		if localBackends {
+			klog.Exitf("-run_app_auth cannot be used with -mode=%s", flMode)
+		}
+		if !localDev && flHTTPSProxyPort != "443" {
+			klog.Exit("-run_app_auth requires -https_proxy_port=443 to serve the https:// run.app urls")
+		}
+	}
 	projectHash := os.Getenv("CLOUD_RUN_PROJECT_HASH") // TODO find a way to infer this from runtime environment
+	cfg.ProjectHashSource = "env:CLOUD_RUN_PROJECT_HASH"
 	if flProjectHash != "" {
 		projectHash = flProjectHash
+		cfg.ProjectHashSource = "flag"
 	}
 	if onCloudRun && projectHash == "" {
 		klog.Exit("error: CLOUD_RUN_PROJECT_HASH environment variable is not set" +
 			"(e.g. this value is 'dpyb4duzqq' if the URLs for your project are like 'foo-dpyb4duzqq-uc.run.app')")
 	}
 
+	if onCloudRun && flDiscoverRegionCodes {
+		discoverRegionCode = regionCodeFromServices
+	}
+	revisionTagNames = flRevisionTagNames
+
 	var region string
 	if !onCloudRun || flRegion != "" {
 		region = flRegion
+		cfg.RegionSource = "flag"
 	} else {
 		klog.V(4).Info("inferring cloud run region from metadata server")
+		cfg.RegionSource = "metadata"
 		region, err = regionFromMetadata()
 		if err != nil {
 			klog.Exitf("failed to infer region from metadata service: %v", err)
 		}
 	}
+	if localDev && region == "" {
+		region = os.Getenv("CLOUDSDK_RUN_REGION")
+		cfg.RegionSource = "env:CLOUDSDK_RUN_REGION"
+	}
+	if localBackends && region == "" {
+		region = defaultEmulatorRegion
+		cfg.RegionSource = "default"
+	}
+	if localDev && region == "" {
+		klog.Exit("-mode=localdev requires -gcp_region (or CLOUDSDK_RUN_REGION) to be set")
+	}
 	if onCloudRun {
 		klog.V(3).Infof("using cloud run region: %s", region)
-		_, ok := cloudRunRegionCodes[region]
-		if !ok {
-			klog.Exitf("cloud run region %q does not have a region code in this tool yet", region)
+		_, ok := regionCode(region)
+		if !ok && flRegionHostTmpl == "" {
+			klog.Exitf("cloud run region %q does not have a region code in this tool yet (see -unknown_region_host)", region)
+		}
+	}
+
+	health := &healthChecker{checkAuth: onCloudRun || localDev}
+	if flHealthzCheckAppPort && os.Getenv("PORT") != "" {
+		health.appAddr = net.JoinHostPort("localhost", os.Getenv("PORT"))
+	}
+
+	var hosts hostOverrides
+	if flHostsFile != "" {
+		if hosts, err = loadHostsFile(flHostsFile); err != nil {
+			klog.Exitf("cannot use -hosts_file: %v", err)
+		}
+	}
+
+	customDomains, err := parseCustomDomains(flCustomDomains)
+	if err != nil {
+		klog.Exitf("failed to parse -custom_domains: %v", err)
+	}
+	if len(customDomains) > 0 {
+		if hosts == nil {
+			hosts = make(hostOverrides)
+		}
+		if err := hosts.addCustomDomains(customDomains, func(svc string) (string, error) {
+			return resolveCloudRunHostOrTemplate(flRegionHostTmpl, flInternalDomain, svc, region, projectHash)
+		}); err != nil {
+			klog.Exitf("cannot use -custom_domains: %v", err)
 		}
 	}
 
-	if !onCloudRun || flSkipDNSServer {
+	aliases, err := parseAliases(flAliases)
+	if err != nil {
+		klog.Exitf("failed to parse -aliases: %v", err)
+	}
+
+	var removeDNSRedirect, removeCA func()
+	if (!onCloudRun && !localBackends) || flSkipDNSServer {
 		klog.V(1).Infof("skipping dns servers initialization")
 	} else {
+		expansionOverrides, err := parseExpansionOverrides(flNdotsOverrides)
+		if err != nil {
+			klog.Exitf("failed to parse -ndots_override: %v", err)
+		}
+		searchDomains := cloudRunZones(region, flInternalDomain)
+		for _, domain := range extraDomains {
+			searchDomains = append(searchDomains, cloudRunZones(region, domain)...)
+		}
+		extraSearch, err := parseSearchDomains(flExtraSearch)
+		if err != nil {
+			klog.Exitf("failed to parse -extra_search_domains: %v", err)
+		}
+		if flFQDNOnly {
+			klog.V(1).Infof("fqdn-only mode: keeping original search domains %v and ndots=%d", rc.Search, rc.Ndots)
+		}
+		searchDomains, resolvNdots := resolvSearch(searchDomains, extraSearch, rc, flNdots, flFQDNOnly)
+		if len(searchDomains) > maxSearchDomains {
+			klog.Warningf("resolv.conf has %d search domains, some resolvers only use the first %d: %v", len(searchDomains), maxSearchDomains, searchDomains)
+		}
+		cfg.SearchDomains, cfg.Ndots = searchDomains, resolvNdots
+
 		// start dns server
 		dnsSrv := &dnsHijack{
-			nameserver: useNameserver,
-			domain:     flInternalDomain,
-			dots:       flNdots,
-			serveIPv6:  ipv6OK,
+			nameserver:         useNameserver,
+			domain:             flInternalDomain,
+			extraDomains:       extraDomains,
+			dots:               internalNdots(flInternalDomain),
+			serveIPv6:          ipv6OK && svcIPs == nil,
+			ipv6Only:           !ipv4OK,
+			ipv4:               listenIPv4,
+			ipv6:               listenIPv6,
+			searchDomains:      searchDomains,
+			expansionOverrides: expansionOverrides,
+			excludeSuffixes:    parseExcludeSuffixes(flDNSExclude),
+			hosts:              hosts,
+			runAppAuth:         flRunAppAuth,
+			projectHash:        projectHash,
+			region:             region,
+			answerTTL:          uint32(flDNSAnswerTTL),
+			aliases:            aliases,
+		}
+		dnsSrv.unknownRegionRecurse, dnsSrv.unknownRegionHost = flPassUnknownRegion, flRegionHostTmpl
+		dnsSrv.serviceIPs = svcIPs
+		if port, err := strconv.ParseUint(proxyPorts[0], 10, 16); err == nil {
+			dnsSrv.proxyPort = uint16(port)
+		}
+		var upstream dnsExchanger = plainExchanger{nameserver: useNameserver, timeout: flDNSUpstreamTimeout}
+		if dotUpstream != nil {
+			upstream = dotUpstream
+			cfg.Nameserver = dotUpstream.String()
+		}
+		if flNameserverDoH != "" {
+			doh, err := newDoHExchanger(flNameserverDoH, flDNSUpstreamTimeout)
+			if err != nil {
+				klog.Exitf("invalid -nameserver_doh: %v", err)
+			}
+			upstream = doh
+			cfg.Nameserver = doh.String()
+		}
+		if flDNS0x20 {
+			upstream = with0x20(upstream)
 		}
+		if flDNSHedgeUpstream != "" {
+			secondary, err := newUpstream(flDNSHedgeUpstream, flDNSUpstreamTimeout)
+			if err != nil {
+				klog.Exitf("invalid -dns_hedge_upstream: %v", err)
+			}
+			if flDNS0x20 {
+				secondary = with0x20(secondary)
+			}
+			upstream = hedgedExchanger{primary: upstream, secondary: secondary, delay: flDNSHedgeDelay}
+			cfg.Nameserver = upstream.String()
+		}
+		if flDNSUpstreamRetries > 0 {
+			upstream = retryingExchanger{next: upstream, retries: flDNSUpstreamRetries, backoff: 100 * time.Millisecond}
+		}
+		dnsSrv.upstream = upstream
 
-		// TODO reduce copypasta below starting [ipv4/ipv6][udp/tcp] combinations.
-		addrv4 := net.JoinHostPort(ipv4Loopback.String(), flDNSPort)
-		addrv6 := net.JoinHostPort(net.IPv6loopback.String(), flDNSPort)
-		go func() {
-			klog.V(1).Infof("starting dns ipv4 server at udp:%s", addrv4)
-			if err := dnsSrv.newServer("udp", addrv4).ListenAndServe(); err != nil {
-				klog.Fatalf("dns server start failure (udp/ipv4): %v", err)
+		forwards, err := parseForwardRules(flDNSForwards.values, flDNSUpstreamTimeout)
+		if err != nil {
+			klog.Exitf("invalid -forward: %v", err)
+		}
+		for i := range forwards {
+			if flDNS0x20 {
+				forwards[i].upstream = with0x20(forwards[i].upstream)
 			}
-		}()
-		go func() {
-			klog.V(1).Infof("starting dns ipv4 server at tcp:%s", addrv4)
-			if err := dnsSrv.newServer("tcp", addrv4).ListenAndServe(); err != nil {
-				klog.Fatalf("dns server start failure (tcp/ipv4): %v", err)
+			if flDNSUpstreamRetries > 0 {
+				forwards[i].upstream = retryingExchanger{next: forwards[i].upstream, retries: flDNSUpstreamRetries, backoff: 100 * time.Millisecond}
+			}
+			klog.V(1).Infof("forwarding dns queries for zone %s to %s", forwards[i].zone, forwards[i].upstream)
+		}
+		dnsSrv.forwards = forwards
+		if flDNSClientQPS > 0 {
+			dnsSrv.clientLimiter = newKeyedLimiter(flDNSClientQPS, flDNSClientBurst)
+		}
+		if flDNSMaxRecursions > 0 {
+			dnsSrv.recursions = make(chan struct{}, flDNSMaxRecursions)
+		}
+		if flDNSQueryLog == "-" {
+			dnsSrv.queryLog = &dnsQueryLogger{out: os.Stderr}
+		} else if flDNSQueryLog != "" {
+			f, err := openRotatingFile(flDNSQueryLog, int64(flDNSQueryLogMaxMB)<<20, flDNSQueryLogBackups)
+			if err != nil {
+				klog.Exitf("cannot open -dns_query_log: %v", err)
+			}
+			dnsSrv.queryLog = &dnsQueryLogger{out: f}
+		}
+		if flDNSCacheSize > 0 {
+			dnsSrv.cache = newDNSCache(flDNSCacheSize)
+		}
+
+		for _, ip := range listenIPs() {
+			addr := net.JoinHostPort(ip.String(), flDNSPort)
+			cfg.DNSListeners = append(cfg.DNSListeners, addr)
+			if health.dnsAddr == "" {
+				health.dnsAddr = addr
+				health.dnsName = dns.Fqdn("healthz." + region + "." + flInternalDomain)
+			}
+			for _, proto := range []string{"udp", "tcp"} {
+				go func(proto, addr string) {
+					klog.V(1).Infof("starting dns server at %s:%s", proto, addr)
+					if err := dnsSrv.newServer(proto, addr).ListenAndServe(); err != nil {
+						klog.Fatalf("dns server start failure (%s:%s): %v", proto, addr, err)
+					}
+				}(proto, addr)
 			}
-		}()
-		if !ipv6OK {
-			klog.V(1).Infof("skipping ipv6 dns server, stack not available")
-		} else {
-			go func() {
-				klog.V(1).Infof("starting dns ipv6 server at udp:%s", addrv6)
-				if err := dnsSrv.newServer("udp", addrv6).ListenAndServe(); err != nil {
-					klog.Fatalf("dns server start failure (udp/ipv6): %v", err)
-				}
-			}()
-			go func() {
-				klog.V(1).Infof("starting dns ipv6 server at tcp:%s", addrv6)
-				if err := dnsSrv.newServer("tcp", addrv6).ListenAndServe(); err != nil {
-					klog.Fatalf("dns server start failure (tcp/ipv6): %v", err)
-				}
-			}()
 		}
 
 		klog.V(4).Infof("hijacking resolv.conf file=%s", flResolvConf)
-		searchDomains := append(cloudRunZones(region, flInternalDomain), rc.Search...)
-		resolvers := []string{ipv4Loopback.String()}
-		if ipv6OK {
-			resolvers = append(resolvers, net.IPv6loopback.String())
+		var resolvers []string
+		for _, ip := range listenIPs() {
+			resolvers = append(resolvers, ip.String())
 		}
-		if err := configureResolvConf(flResolvConf, resolvers, searchDomains, flNdots); err != nil {
+		resolvContents := resolvConfContents(resolvers, searchDomains, resolvNdots)
+		if err := writeResolvConf(flResolvConf, resolvContents); err != nil {
 			klog.Fatal(err)
 		}
+		if flWatchResolvConf {
+			go (&resolvConfWatcher{path: flResolvConf, want: resolvContents}).run()
+		}
+		if flRedirectDNS {
+			cleanup, err := installDNSRedirect(listenIPs(), flDNSPort)
+			if err != nil {
+				klog.Exitf("failed to set up -redirect_dns: %v", err)
+			}
+			removeDNSRedirect = cleanup
+		}
 		klog.V(1).Info("dns hijack setup complete")
 	}
+	if onCloudRun && flEtcHostsSync {
+		syncer := &etcHostsSyncer{
+			path:         flEtcHosts,
+			domain:       flInternalDomain,
+			region:       region,
+			ips:          listenIPs(),
+			listServices: func() ([]string, error) { return cloudRunServiceNames(region) },
+		}
+		go syncer.run(flEtcHostsSyncInterval)
+	}
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("/loglevel", serveLogLevel)
+	admin.Handle("/healthz", health)
+	admin.Handle("/readyz", health.readiness())
+	metrics := newProxyMetrics(flInternalDomain, region)
+	admin.Handle("/metrics", metrics)
+	admin.Handle("/errors", recentProxyErrors)
+	admin.HandleFunc("/tokens", serveTokenCache)
 
 	// start local proxy
-	if !onCloudRun || flSkipHTTPProxyServer {
+	var proxyServers []*http.Server
+	if (!onCloudRun && !localDev && !localBackends) || flSkipHTTPProxyServer {
 		klog.V(1).Infof("skipping http proxy server initialization")
 	} else {
 		proxy := newReverseProxy(projectHash, region, flInternalDomain)
-		handler := allowh2c(proxy.newReverseProxyHandler(http.DefaultTransport))
+		if localDev {
+			proxy.services = newServiceDirectory()
+		}
+		proxy.noHeaderMutation = flNoHeaderMutation
+		proxy.noForwardedHeaders = flNoForwardedHeaders
+		proxy.preserveHost, proxy.originalHostHeader = flPreserveHost, flOrigHostHeader
+		proxy.noTracePropagation = flNoTracePropagation
+		proxy.hosts = hosts
+		proxy.runAppAuth = flRunAppAuth
+		proxy.aliases = aliases
+		proxy.extraDomains = extraDomains
+		proxy.unknownRegionHost = flRegionHostTmpl
+		proxy.upgradeIdleTimeout = flWebSocketIdleTimeout
+		proxy.grpcWeb = flGRPCWeb
+		if proxy.streamingHosts, err = parseHostPatterns(flStreamingHosts); err != nil {
+			klog.Exitf("failed to parse -streaming_hosts: %v", err)
+		}
+		admin.HandleFunc("/routes", proxy.serveRoutingTable)
+		if flOTLPEndpoint != "" {
+			serviceName := os.Getenv("K_SERVICE")
+			if serviceName == "" {
+				serviceName = "runsd"
+			}
+			proxy.tracer = newOTLPExporter(flOTLPEndpoint, serviceName)
+			go proxy.tracer.run()
+		}
+		if flTrafficSplit != "" {
+			if proxy.trafficSplits, err = loadTrafficSplits(flTrafficSplit); err != nil {
+				klog.Exitf("failed to load -traffic_split_file: %v", err)
+			}
+		}
+		if flRoutesFile != "" {
+			if proxy.routes, err = loadRoutes(flRoutesFile); err != nil {
+				klog.Exitf("failed to load -routes_file: %v", err)
+			}
+		}
+		if emulate {
+			emulated, err := parseEmulatedServices(flEmulated)
+			if err != nil {
+				klog.Exitf("failed to parse -emulated_services: %v", err)
+			}
+			if proxy.routes, err = proxy.routes.merge(emulated); err != nil {
+				klog.Exitf("cannot use -emulated_services with -routes_file: %v", err)
+			}
+			proxy.emulated = true
+			klog.V(1).Infof("emulating %d service(s)", len(emulated))
+		}
+		if compose {
+			if proxy.compose, err = newComposeNetwork(flComposePort, flComposePorts, flComposeID); err != nil {
+				klog.Exitf("invalid -compose_port or -compose_port_overrides: %v", err)
+			}
+		}
+		if proxy.noAuthHosts, err = parseHostPatterns(flNoAuthHosts); err != nil {
+			klog.Exitf("failed to parse -no_auth_hosts: %v", err)
+		}
+		if proxy.audiences, err = parseInternalNameMap(flAudiences); err != nil {
+			klog.Exitf("failed to parse -audiences: %v", err)
+		}
+		proxy.impersonate = flImpersonate
+		if proxy.impersonateOverrides, err = parseInternalNameMap(flImpersonateFor); err != nil {
+			klog.Exitf("failed to parse -impersonate_service_account_overrides: %v", err)
+		}
+		if proxy.accessTokenHosts, err = parseHostPatterns(flAccessTokens); err != nil {
+			klog.Exitf("failed to parse -access_token_hosts: %v", err)
+		}
+		proxy.accessTokenScopes = strings.Fields(flAccessScopes)
+		if proxy.overwriteAuthHosts, err = parseHostPatterns(flOverwriteAuth); err != nil {
+			klog.Exitf("failed to parse -overwrite_auth_hosts: %v", err)
+		}
+		if flHeaderRules != "" {
+			if proxy.headerRules, err = loadHeaderRules(flHeaderRules, os.Getenv); err != nil {
+				klog.Exitf("failed to load -header_rules_file: %v", err)
+			}
+		}
+		proxy.maxRequestBytes, proxy.maxResponseBytes = flMaxRequestBodyBytes, flMaxResponseBodyBytes
+		if proxy.retry, err = parseRetryPolicy(flRetryMaxAttempts, flRetryMethods, flRetryStatusCodes,
+			flRetryBackoff, flRetryMaxBackoff, flRetryMaxBodyBytes); err != nil {
+			klog.Exitf("invalid retry policy: %v", err)
+		}
+		if flCacheSizeMB > 0 {
+			maxEntry := int64(flCacheMaxObjectKB) << 10
+			if size := int64(flCacheSizeMB) << 20; maxEntry > size {
+				maxEntry = size
+			}
+			proxy.cache = newResponseCache(int64(flCacheSizeMB)<<20, maxEntry, flCacheMaxTTL)
+			admin.Handle("/cache", proxy.cache)
+		}
+		if flHedgeDelay > 0 {
+			if flHedgeBudgetPercent <= 0 || flHedgeBudgetPercent > 100 {
+				klog.Exit("-hedge_budget_percent must be between 0 and 100")
+			}
+			proxy.hedgeDelay, proxy.hedgeBudget = flHedgeDelay, newHedgeBudget(flHedgeBudgetPercent/100)
+		}
+		if flBreakerErrorRate > 0 {
+			if flBreakerErrorRate > 1 {
+				klog.Exit("-circuit_breaker_error_rate must be between 0 and 1")
+			}
+			proxy.breaker = newCircuitBreaker(flBreakerErrorRate, flBreakerMinRequests, flBreakerWindow, flBreakerOpenDuration)
+		}
+		faults := &faultInjector{
+			targets: parseTargets(flFaultTargets),
+			faultRule: faultRule{
+				delay:        flFaultDelay,
+				delayPercent: flFaultDelayPercent,
+				abortStatus:  flFaultAbortStatus,
+				abortPercent: flFaultAbortPercent,
+				resetPercent: flFaultResetPercent,
+			},
+		}
+		if err := faults.faultRule.validate(); err != nil {
+			klog.Exitf("invalid -fault_abort_status or -fault_*_percent: %v", err)
+		}
+		if flFaultRulesFile != "" {
+			if faults.destinations, err = loadFaultRules(flFaultRulesFile); err != nil {
+				klog.Exitf("failed to load -fault_rules_file: %v", err)
+			}
+		}
+		if faults.enabled() {
+			klog.Warningf("fault injection is enabled for the reverse proxy")
+		}
+		timeouts := proxyTimeouts{responseHeader: flHeaderTimeout, total: flRequestTimeout}
+		if timeouts.responseHeaderOverrides, err = parseTimeoutOverrides(flHeaderTimeouts); err != nil {
+			klog.Exitf("failed to parse -response_header_timeout_overrides: %v", err)
+		}
+		if timeouts.totalOverrides, err = parseTimeoutOverrides(flRequestTimeouts); err != nil {
+			klog.Exitf("failed to parse -request_timeout_overrides: %v", err)
+		}
+		var rootCAs *x509.CertPool
+		if flUpstreamCAFile != "" {
+			if rootCAs, err = loadCABundle(flUpstreamCAFile); err != nil {
+				klog.Exitf("failed to load -upstream_ca_bundle: %v", err)
+			}
+		}
+		if flUpstreamInsecure {
+			klog.Warningf("WARN: -upstream_insecure_skip_verify is set, the backend certificates are not verified")
+		}
+		tr := newProxyTransport(http.DefaultTransport.(*http.Transport), transportOptions{
+			rootCAs:               rootCAs,
+			insecureSkipVerify:    flUpstreamInsecure,
+			dialTimeout:           flDialTimeout,
+			keepAlive:             flKeepAlive,
+			idleConnTimeout:       flIdleConnTimeout,
+			expectContinueTimeout: flExpectContinueTimeout,
+			maxIdleConns:          flMaxIdleConns,
+			maxIdleConnsPerHost:   flMaxIdleConnsPerHost,
+			maxConnsPerHost:       flMaxConnsPerHost,
+		})
+		upstream := proxy.routes.transport(tr)
+		handler := faults.handler(timeouts.handler(proxy.newReverseProxyHandler(upstream)))
+		if names := parseNames(flPrewarm); len(names) > 0 {
+			go (&prewarmer{rp: proxy, tr: upstream, names: names}).runPeriodically(flPrewarmInterval)
+		}
+		handler = headerLimiter{maxBytes: flMaxHeaderBytes, maxCount: flMaxHeaderCount}.handler(handler)
+		limiter, err := newDestinationLimiter(flRateLimitQPS, flRateLimitBurst, flRateLimitOverrides, flInternalDomain, region)
+		if err != nil {
+			klog.Exitf("failed to parse -rate_limit_overrides: %v", err)
+		}
+		handler = limiter.handler(handler)
+		handler = newConcurrencyLimiter(flMaxInFlight, flMaxInFlightPerDest, flInternalDomain, region).handler(handler)
+		handler = metrics.handler(handler)
+		deps := newDependencyTracker(os.Getenv("K_SERVICE"), flInternalDomain, region)
+		handler = deps.handler(handler)
+		admin.Handle("/dependencies", deps)
+		if flDependencyLogInterval > 0 {
+			go deps.logPeriodically(os.Stderr, flDependencyLogInterval)
+		}
+		budgets, err := parseLatencyBudgets(flLatencyBudgets)
+		if err != nil {
+			klog.Exitf("failed to parse -latency_budget: %v", err)
+		}
+		if len(budgets) > 0 {
+			lb := newLatencyBudgets(budgets, flLatencyBudgetWindow, deps, os.Stderr)
+			handler = lb.handler(handler)
+			admin.Handle("/latency", lb)
+			go lb.evaluatePeriodically(10 * time.Second)
+		}
+		if flJobsAPIHost != "" {
+			handler = newJobsAPI(strings.ToLower(flJobsAPIHost), flInternalDomain, region).handler(handler)
+		}
+		if flSlowRequestThreshold > 0 {
+			handler = slowRequestLogger{threshold: flSlowRequestThreshold}.handler(handler)
+		}
+		if flAccessLog {
+			if flAccessLogFormat != accessLogJSON && flAccessLogFormat != accessLogCombined {
+				klog.Exitf("invalid -access_log_format=%q, must be %s or %s", flAccessLogFormat, accessLogJSON, accessLogCombined)
+			}
+			var out io.Writer = os.Stderr
+			if flAccessLogFile != "" {
+				f, err := os.OpenFile(flAccessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					klog.Exitf("failed to open -access_log_file: %v", err)
+				}
+				out = f
+			}
+			handler = (&accessLogger{
+				out:           out,
+				format:        flAccessLogFormat,
+				sampleRate:    flAccessLogSampleRate,
+				slowThreshold: flAccessLogSlowThreshold,
+			}).handler(handler)
+		}
+		var ca *localCA
+		if flHTTPSProxyPort != "" || (localDev && flRunAppAuth) {
+			caDomains := append([]string{"localhost", runAppZone}, flDomains.values...)
+			for region := range cloudRunRegionCodes {
+				caDomains = append(caDomains, region) // SVC.REGION names
+			}
+			for domain := range customDomains {
+				caDomains = append(caDomains, domain)
+			}
+			if ca, err = newLocalCA(caDomains); err != nil {
+				klog.Exitf("failed to generate ca for -https_proxy_port: %v", err)
+			}
+			if err := ca.writeCert(flCACertFile); err != nil {
+				klog.Exitf("failed to write -ca_cert_file: %v", err)
+			}
+			klog.V(1).Infof("wrote ca certificate to %s", flCACertFile)
+			if flCATrustStore {
+				updated, err := ca.addToTrustStores(trustStores)
+				if err != nil {
+					klog.Warningf("failed to add ca certificate to the system trust store: %v", err)
+				}
+				klog.V(1).Infof("added ca certificate to %v", updated)
+				removeCA = func() {
+					if updated, err := removeFromTrustStores(updated); err != nil {
+						klog.Warningf("failed to remove ca certificate from the system trust store: %v", err)
+					} else {
+						klog.V(1).Infof("removed ca certificate from %v", updated)
+					}
+				}
+			}
+		}
+		if localDev && flRunAppAuth {
+			connect := &connectProxy{rp: proxy, ca: ca, http: &http.Server{Handler: handler, MaxHeaderBytes: flMaxHeaderBytes}}
+			handler = connect.handler(handler)
+		}
+		handler = allowh2c(handler)
+		if svcIPs != nil {
+			if err := svcIPs.serve(handler); err != nil {
+				klog.Exitf("failed to start reverse proxy for -service_ip_range: %v", err)
+			}
+			cfg.ProxyListeners = append(cfg.ProxyListeners, flServiceIPRange+" ports="+strings.Join(proxyPorts, ","))
+			health.proxyAddr = svcIPs.proxyAddr()
+		} else {
+			for _, ip := range listenIPs() {
+				for _, port := range proxyPorts {
+					addr := net.JoinHostPort(ip.String(), port)
+					proxyServers = append(proxyServers, startProxyServer(addr, handler))
+					cfg.ProxyListeners = append(cfg.ProxyListeners, addr)
+					if health.proxyAddr == "" {
+						health.proxyAddr = addr
+					}
+				}
+			}
+		}
+		if flHTTPSProxyPort != "" {
+			for _, ip := range listenIPs() {
+				addr := net.JoinHostPort(ip.String(), flHTTPSProxyPort)
+				proxyServers = append(proxyServers, startTLSProxyServer(addr, handler, ca, clientCAs))
+				cfg.ProxyListeners = append(cfg.ProxyListeners, addr)
+			}
+		}
+		if flTLSPassthrough != "" {
+			passthrough := &tlsPassthrough{rp: proxy}
+			for _, ip := range listenIPs() {
+				addr := net.JoinHostPort(ip.String(), flTLSPassthrough)
+				lis, err := net.Listen("tcp", addr)
+				if err != nil {
+					klog.Exitf("failed to listen for -tls_passthrough_port: %v", err)
+				}
+				go func() {
+					klog.V(1).Infof("starting tls passthrough server at %s", addr)
+					klog.Fatalf("tls passthrough (%s) fail: %v", addr, passthrough.serve(lis))
+				}()
+				cfg.ProxyListeners = append(cfg.ProxyListeners, addr+" (tls passthrough)")
+			}
+		}
+		if flSOCKS5Port != "" {
+			socks := &socks5Server{rp: proxy, http: &http.Server{Handler: handler, MaxHeaderBytes: flMaxHeaderBytes}}
+			for _, ip := range listenIPs() {
+				addr := net.JoinHostPort(ip.String(), flSOCKS5Port)
+				lis, err := net.Listen("tcp", addr)
+				if err != nil {
+					klog.Exitf("failed to listen for -socks5_port: %v", err)
+				}
+				go func() {
+					klog.V(1).Infof("starting socks5 server at %s", addr)
+					klog.Fatalf("socks5 server (%s) fail: %v", addr, socks.serve(lis))
+				}()
+				cfg.ProxyListeners = append(cfg.ProxyListeners, addr+" (socks5)")
+			}
+		}
+		klog.V(1).Info("started reverse proxy server(s)")
+	}
+
+	cfg.OnCloudRun, cfg.Mode, cfg.Region, cfg.ProjectHash = onCloudRun, flMode, region, projectHash
+	cfg.Flags = flagValues(flag.CommandLine)
+	if flAdminPort != "" {
+		cfg.AdminListener = net.JoinHostPort(listenIPs()[0].String(), flAdminPort)
+		admin.Handle("/config", cfg)
+		startAdminServer(cfg.AdminListener, admin)
+	}
+	if flMetricsPort != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics)
 		go func() {
-			addr := net.JoinHostPort(net.IPv4(127, 0, 0, 1).String(), flHTTPProxyPort)
-			klog.Fatalf("reverse proxy (ipv4) fail: %v", http.ListenAndServe(addr, handler))
+			addr := net.JoinHostPort(listenIPs()[0].String(), flMetricsPort)
+			klog.V(1).Infof("starting metrics server at %s", addr)
+			klog.Fatalf("metrics server (%s) fail: %v", addr, http.ListenAndServe(addr, metricsMux))
 		}()
+	}
+	if flHealthzPort != "" {
+		healthMux := http.NewServeMux()
+		healthMux.Handle("/healthz", health)
+		healthMux.Handle("/readyz", health.readiness())
 		go func() {
-			if !ipv6OK {
-				klog.V(1).Infof("skipping http proxy server on ipv6, stack not available")
-				return
-			}
-			addr := net.JoinHostPort(net.IPv6loopback.String(), flHTTPProxyPort)
-			klog.Fatalf("reverse proxy (ipv6) fail: %v", http.ListenAndServe(addr, handler))
+			addr := net.JoinHostPort("", flHealthzPort)
+			klog.V(1).Infof("starting healthz server at %s", addr)
+			klog.Fatalf("healthz server (%s) fail: %v", addr, http.ListenAndServe(addr, healthMux))
 		}()
-		klog.V(1).Info("started reverse proxy server(s)")
 	}
+	klog.V(1).Infof("effective configuration: %s", cfg.json())
 
 	// start subprocess
 	var (
@@ -242,6 +1149,12 @@ func main() {
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
+	if localDev && health.proxyAddr != "" {
+		c.Env = localDevEnv(os.Environ(), health.proxyAddr)
+		if flRunAppAuth {
+			c.Env = runAppProxyEnv(c.Env, health.proxyAddr)
+		}
+	}
 	if uid != nil {
 		if c.SysProcAttr == nil {
 			c.SysProcAttr = &syscall.SysProcAttr{}
@@ -256,6 +1169,7 @@ func main() {
 		os.Exit(1)
 	}
 	klog.V(2).Infof("subprocess started successfully pid=%d", c.Process.Pid)
+	health.setChildState(childRunning)
 	go func() {
 		sig := <-sigCh
 		klog.V(2).Infof("received signal=%s", sig)
@@ -264,7 +1178,23 @@ func main() {
 		}
 		klog.V(2).Infof("delivered signal=%s to child=%d", sig, c.Process.Pid)
 	}()
-	if err := c.Wait(); err != nil {
+	err = c.Wait()
+	health.setChildState(childExited)
+	// The proxy keeps serving after the signal until the subprocess exits, as
+	// it may still call the other services while it's shutting down. The
+	// requests left then are of the processes it started that outlive it
+	// (e.g. the background jobs of a shell entrypoint).
+	if svcIPs != nil {
+		proxyServers = append(proxyServers, svcIPs.proxyServers()...)
+	}
+	shutdownServers(proxyServers, flShutdownTimeout)
+	if removeDNSRedirect != nil {
+		removeDNSRedirect()
+	}
+	if removeCA != nil {
+		removeCA()
+	}
+	if err != nil {
 		klog.Infof("subprocess terminated")
 		if v, ok := err.(*exec.ExitError); ok {
 			ec := v.ExitCode()
@@ -278,12 +1208,120 @@ func main() {
 	klog.V(1).Infof("subprocess exited successfully")
 }
 
-func ipv6Available() bool {
+// startProxyServer starts serving the reverse proxy handler on addr in the
+// background.
+func startProxyServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler, MaxHeaderBytes: flMaxHeaderBytes}
+	go func() {
+		klog.V(1).Infof("starting reverse proxy server at %s", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			klog.Fatalf("reverse proxy (%s) fail: %v", addr, err)
+		}
+	}()
+	return srv
+}
+
+// startTLSProxyServer starts serving the reverse proxy handler over TLS on addr
+// in the background, with the certificates issued by ca, verifying the client
+// certificates (if presented) with clientCAs if set.
+func startTLSProxyServer(addr string, handler http.Handler, ca *localCA, clientCAs *x509.CertPool) *http.Server {
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		MaxHeaderBytes: flMaxHeaderBytes,
+		TLSConfig:      &tls.Config{GetCertificate: ca.GetCertificate},
+	}
+	if clientCAs != nil {
+		srv.TLSConfig.ClientCAs = clientCAs
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	go func() {
+		klog.V(1).Infof("starting reverse proxy server at %s (https)", addr)
+		if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			klog.Fatalf("reverse proxy (%s) fail: %v", addr, err)
+		}
+	}()
+	return srv
+}
+
+// shutdownServers gracefully shuts down the servers, waiting up to timeout for
+// the active connections to drain.
+func shutdownServers(servers []*http.Server, timeout time.Duration) {
+	if len(servers) == 0 {
+		return
+	}
+	klog.V(1).Infof("shutting down %d proxy server(s), timeout=%s", len(servers), timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				klog.Warningf("failed to gracefully shut down proxy server %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// listenIPs returns the loopback addresses of the available IP stacks to
+// listen on.
+func listenIPs() []net.IP {
+	var out []net.IP
+	if ipv4OK {
+		out = append(out, listenIPv4)
+	} else {
+		klog.V(1).Infof("skipping ipv4 loopback, stack not available")
+	}
+	if ipv6OK {
+		out = append(out, listenIPv6)
+	} else {
+		klog.V(1).Infof("skipping ipv6 loopback, stack not available")
+	}
+	return out
+}
+
+// pickNameserver returns the first nameserver reachable with the available
+// IP stacks.
+func pickNameserver(servers []string, ipv4 bool) string {
+	if !ipv4 {
+		for _, s := range servers {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+				return s
+			}
+		}
+		klog.Warningf("no ipv6 nameservers found in %v on an ipv6-only stack", servers)
+	}
+	return servers[0]
+}
+
+func ipv4Available() bool {
+	lis, err := net.Listen("tcp4", net.JoinHostPort(ipv4Loopback.String(), "0"))
+	if err != nil {
+		klog.V(4).Infof("ipv4 stack not available: %v", err)
+		return false
+	}
+	lis.Close()
+	return true
+}
+
+func ipv6Available(verifyDial bool) bool {
 	lis, err := net.Listen("tcp6", net.JoinHostPort(net.IPv6loopback.String(), "0"))
 	if err != nil {
 		klog.V(4).Infof("ipv6 stack not available: %v", err)
 		return false
 	}
-	lis.Close()
+	defer lis.Close()
+	if !verifyDial {
+		return true
+	}
+	conn, err := net.DialTimeout("tcp6", lis.Addr().String(), time.Second)
+	if err != nil {
+		klog.V(4).Infof("ipv6 loopback not reachable: %v", err)
+		return false
+	}
+	conn.Close()
 	return true
 }
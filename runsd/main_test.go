@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startBlockingServer starts a server whose requests block until release is
+// closed, notifying started as they arrive.
+func startBlockingServer(t *testing.T, started chan<- struct{}, release <-chan struct{}) (*http.Server, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})}
+	go srv.Serve(lis)
+	return srv, lis.Addr().String()
+}
+
+func TestShutdownServers(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	srv, addr := startBlockingServer(t, started, release)
+
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		resCh <- result{string(b), err}
+	}()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		shutdownServers([]*http.Server{srv}, time.Minute)
+		close(done)
+	}()
+
+	// the new connections are refused while the in-flight request drains
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepting connections after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdownServers returned before the in-flight request completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Errorf("body=%q, want=%q", res.body, "done")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdownServers didn't return after the request completed")
+	}
+}
+
+func TestShutdownServersTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	srv, addr := startBlockingServer(t, started, release)
+	go func() {
+		if resp, err := http.Get("http://" + addr); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	start := time.Now()
+	shutdownServers([]*http.Server{srv}, 50*time.Millisecond)
+	if d := time.Since(start); d < 50*time.Millisecond || d > 5*time.Second {
+		t.Errorf("shutdownServers took %s, want about the timeout", d)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+var (
+	// metadataClient is used for the metadata server calls, keeping the
+	// connection to it alive across the calls.
+	metadataClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 2 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	// metadataMaxAttempts is the number of times a metadata server call is
+	// made before giving up on transient errors.
+	metadataMaxAttempts = 3
+	// metadataBackoff is the maximum delay before the first retry, doubled
+	// for each following attempt.
+	metadataBackoff = 100 * time.Millisecond
+)
+
+// metadataError is a non-200 response from the metadata server.
+type metadataError struct {
+	code   int
+	status string
+}
+
+func (e *metadataError) Error() string {
+	return fmt.Sprintf("metadata server responeded with code=%d %s", e.code, e.status)
+}
+
+// temporary reports whether the call may succeed if retried.
+func (e *metadataError) temporary() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= http.StatusInternalServerError
+}
+
+// queryMetadata returns the response of the metadata server to the url,
+// retrying the connection errors and the 5xx responses with backoff.
+func queryMetadata(url string) (string, error) {
+	backoff := metadataBackoff
+	for attempt := 1; ; attempt++ {
+		v, err := queryMetadataOnce(url)
+		if err == nil {
+			return v, nil
+		}
+		if me, ok := err.(*metadataError); (ok && !me.temporary()) || attempt >= metadataMaxAttempts {
+			return "", err
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff)) + 1)
+		klog.V(3).Infof("metadata server call to %s failed (attempt %d/%d): %v, retrying in %s",
+			url, attempt, metadataMaxAttempts, err, wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func queryMetadataOnce(url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err // TODO wrap
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err // TODO wrap
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err // TODO wrap
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &metadataError{code: resp.StatusCode, status: resp.Status}
+	}
+	return strings.TrimSpace(string(b)), nil
+}
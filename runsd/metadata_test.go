@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryMetadataRetries(t *testing.T) {
+	defer func(v time.Duration) { metadataBackoff = v }(metadataBackoff)
+	metadataBackoff = time.Millisecond
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if req.Header.Get("metadata-flavor") != "Google" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/flaky":
+			if calls < metadataMaxAttempts {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("us-central1\n"))
+		case "/down":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		path      string
+		want      string
+		wantErr   bool
+		wantCalls int
+	}{
+		{path: "/flaky", want: "us-central1", wantCalls: metadataMaxAttempts},
+		{path: "/down", wantErr: true, wantCalls: metadataMaxAttempts},
+		{path: "/missing", wantErr: true, wantCalls: 1},
+	}
+	for _, tt := range cases {
+		calls = 0
+		got, err := queryMetadata(srv.URL + tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got=%q err=%v", tt.path, got, err)
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", tt.path, calls, tt.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenFetchErrors counts the failures to get an ID token for the proxied
+// requests.
+var tokenFetchErrors uint64
+
+// durationBuckets are the upper bounds (in seconds) of the request duration
+// histogram buckets.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// proxyMetrics records the metrics of the proxied requests, served in the
+// Prometheus text format.
+type proxyMetrics struct {
+	internalDomain string
+	currentRegion  string
+	inFlight       int64
+
+	mu        sync.Mutex
+	requests  map[requestMetricKey]uint64
+	durations map[string]*durationHistogram // keyed by destination
+}
+
+type requestMetricKey struct {
+	destination string
+	class       string // e.g. 2xx
+}
+
+type durationHistogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newProxyMetrics(internalDomain, region string) *proxyMetrics {
+	return &proxyMetrics{
+		internalDomain: internalDomain,
+		currentRegion:  region,
+		requests:       make(map[requestMetricKey]uint64),
+		durations:      make(map[string]*durationHistogram),
+	}
+}
+
+func (m *proxyMetrics) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		m.record(internalDestinationName(req.Host, m.internalDomain, m.currentRegion), rec.status, time.Since(start))
+	})
+}
+
+// statusClass returns the class of the status code, like 2xx, or "error" if
+// no response was written.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func (m *proxyMetrics) record(dest string, status int, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestMetricKey{destination: dest, class: statusClass(status)}]++
+	h, ok := m.durations[dest]
+	if !ok {
+		h = &durationHistogram{counts: make([]uint64, len(durationBuckets)+1)}
+		m.durations[dest] = h
+	}
+	s := took.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, s)
+	h.counts[i]++
+	h.count++
+	h.sum += s
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *proxyMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *proxyMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestMetricKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].destination != keys[j].destination {
+			return keys[i].destination < keys[j].destination
+		}
+		return keys[i].class < keys[j].class
+	})
+	fmt.Fprintln(w, "# HELP runsd_proxy_requests_total Requests proxied by destination and status class.")
+	fmt.Fprintln(w, "# TYPE runsd_proxy_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "runsd_proxy_requests_total{destination=%q,code=%q} %d\n", k.destination, k.class, m.requests[k])
+	}
+
+	dests := make([]string, 0, len(m.durations))
+	for d := range m.durations {
+		dests = append(dests, d)
+	}
+	sort.Strings(dests)
+	fmt.Fprintln(w, "# HELP runsd_proxy_request_duration_seconds Duration of the proxied requests by destination.")
+	fmt.Fprintln(w, "# TYPE runsd_proxy_request_duration_seconds histogram")
+	for _, d := range dests {
+		h := m.durations[d]
+		var cum uint64
+		for i, le := range durationBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "runsd_proxy_request_duration_seconds_bucket{destination=%q,le=%q} %d\n", d, strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "runsd_proxy_request_duration_seconds_bucket{destination=%q,le=\"+Inf\"} %d\n", d, h.count)
+		fmt.Fprintf(w, "runsd_proxy_request_duration_seconds_sum{destination=%q} %g\n", d, h.sum)
+		fmt.Fprintf(w, "runsd_proxy_request_duration_seconds_count{destination=%q} %d\n", d, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP runsd_proxy_requests_in_flight Requests being proxied.")
+	fmt.Fprintln(w, "# TYPE runsd_proxy_requests_in_flight gauge")
+	fmt.Fprintf(w, "runsd_proxy_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+	fmt.Fprintln(w, "# HELP runsd_token_fetch_errors_total Failures to get an ID token for the proxied requests.")
+	fmt.Fprintln(w, "# TYPE runsd_token_fetch_errors_total counter")
+	fmt.Fprintf(w, "runsd_token_fetch_errors_total %d\n", atomic.LoadUint64(&tokenFetchErrors))
+}
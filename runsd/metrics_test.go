@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyMetrics(t *testing.T) {
+	m := newProxyMetrics("run.internal.", "us-central1")
+	h := m.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	for _, u := range []string{"http://hello/", "http://hello:80/", "http://hello.us-central1.run.internal/", "http://hello/fail", "http://billing.europe-west1/"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil))
+	}
+	m.record("slow.us-central1", http.StatusOK, 2*time.Second)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+	for _, want := range []string{
+		`runsd_proxy_requests_total{destination="billing.europe-west1",code="2xx"} 1`,
+		`runsd_proxy_requests_total{destination="hello.us-central1",code="2xx"} 3`,
+		`runsd_proxy_requests_total{destination="hello.us-central1",code="5xx"} 1`,
+		`runsd_proxy_request_duration_seconds_count{destination="hello.us-central1"} 4`,
+		`runsd_proxy_request_duration_seconds_bucket{destination="slow.us-central1",le="1"} 0`,
+		`runsd_proxy_request_duration_seconds_bucket{destination="slow.us-central1",le="2.5"} 1`,
+		`runsd_proxy_request_duration_seconds_bucket{destination="slow.us-central1",le="+Inf"} 1`,
+		`runsd_proxy_requests_in_flight 0`,
+		`# TYPE runsd_token_fetch_errors_total counter`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output does not contain %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// prewarmer opens connections (and fetches ID tokens) to the services the
+// app depends on, so that its first requests to them don't wait for the
+// connection and token setup.
+type prewarmer struct {
+	rp    *reverseProxy
+	tr    http.RoundTripper
+	names []string // internal names
+}
+
+// parseNames parses a comma-separated list of names, lowercased.
+func parseNames(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// run warms up the connections to all the services concurrently.
+func (p *prewarmer) run() {
+	var wg sync.WaitGroup
+	for _, name := range p.names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			start := time.Now()
+			if err := p.warm(name); err != nil {
+				klog.Warningf("WARN: failed to prewarm connection to %s: %v", name, err)
+				return
+			}
+			klog.V(3).Infof("[prewarm] connected to %s in %s", name, time.Since(start).Truncate(time.Millisecond))
+		}(name)
+	}
+	wg.Wait()
+}
+
+// runPeriodically warms up the connections now and then at every interval
+// (if positive), to keep them from being closed when idle.
+func (p *prewarmer) runPeriodically(interval time.Duration) {
+	p.run()
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		p.run()
+	}
+}
+
+// warm sends a HEAD request to the service, which leaves the connection open
+// in the pool of the transport, and the token in the token cache.
+func (p *prewarmer) warm(name string) error {
+	scheme, host, err := p.rp.backend(name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodHead, scheme+"://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(p.rp.authContext(req.Context(), name))
+	if !p.rp.noAuth(name) {
+		token, err := authenticatingTransport{accessTokenScopes: p.rp.accessTokenScopes}.token(req)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("authorization", "Bearer "+token)
+	}
+	req.Header.Set("user-agent", "runsd version="+version+" (prewarm)")
+	resp, err := p.tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
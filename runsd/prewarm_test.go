@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseNames(t *testing.T) {
+	got := parseNames(" Hello, ,ledger.us-east1,")
+	if diff := cmp.Diff([]string{"hello", "ledger.us-east1"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestPrewarmer(t *testing.T) {
+	var conns, heads int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+		}
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	rp := newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")
+	rp.routes = routes{"ledger": {target: u, noAuth: true}}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	defer tr.CloseIdleConnections()
+	p := &prewarmer{rp: rp, tr: tr, names: []string{"ledger", "unknown.region.that.is.invalid"}}
+	p.run()
+	if n := atomic.LoadInt32(&heads); n != 1 {
+		t.Fatalf("got %d prewarm requests, want 1", n)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("prewarmed connection not reused, got %d connections", n)
+	}
+}
@@ -15,14 +15,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -34,6 +35,94 @@ type reverseProxy struct {
 	projectHash    string
 	currentRegion  string
 	internalDomain string
+
+	// noHeaderMutation disables adding or rewriting request headers other than
+	// the Authorization header.
+	noHeaderMutation bool
+	// noForwardedHeaders disables adding the X-Forwarded-* headers.
+	noForwardedHeaders bool
+	// preserveHost keeps the Host header of the requests (rather than
+	// rewriting it to the backend host), for the backends routing by it.
+	preserveHost bool
+	// originalHostHeader, if set, is the header the Host of the requests is
+	// sent in.
+	originalHostHeader string
+	// hosts are the names proxied to the URLs in the hosts file.
+	hosts hostOverrides
+	// runAppAuth proxies the requests for the run.app names (made with the
+	// URLs of the services rather than the internal names) to themselves with
+	// an ID token.
+	runAppAuth bool
+	// services, if set, resolves the internal names to the run.app URLs of the
+	// services listed with the Admin API (in -mode=localdev).
+	services *serviceDirectory
+	// emulated, if set, proxies the internal names only to their routes (in
+	// -mode=emulator) rather than to the run.app URLs.
+	emulated bool
+	// compose, if set, proxies the internal names to the containers on the
+	// Docker Compose network (in -mode=compose).
+	compose *composeNetwork
+	// grpcWeb translates the gRPC-Web requests to gRPC for the backends.
+	grpcWeb bool
+	// streamingHosts are the destinations whose responses are streamed (like
+	// Server-Sent Events) regardless of their content type.
+	streamingHosts hostPatterns
+	// aliases are the internal names proxied to other internal names.
+	aliases serviceAliases
+	// extraDomains are the internal zones accepted in addition to the
+	// internalDomain.
+	extraDomains []string
+	// unknownRegionHost is the hostname template used for the regions
+	// without a known region code.
+	unknownRegionHost string
+	// upgradeIdleTimeout closes the upgraded connections (e.g. WebSockets)
+	// idle for this long, if positive.
+	upgradeIdleTimeout time.Duration
+	// retry is the policy to retry the failed requests with.
+	retry retryPolicy
+	// hedgeDelay, if positive, is the time after which a second attempt of
+	// the GET and HEAD requests without a response is sent, within the
+	// hedgeBudget.
+	hedgeDelay  time.Duration
+	hedgeBudget *hedgeBudget
+	// breaker, if set, fails the requests to the failing backends fast.
+	breaker *circuitBreaker
+	// cache, if set, serves the cacheable responses from memory.
+	cache *responseCache
+	// maxRequestBytes and maxResponseBytes limit the size of the request
+	// and response bodies, if positive.
+	maxRequestBytes  int64
+	maxResponseBytes int64
+	// headerRules are the header mutations for the destinations.
+	headerRules headerRules
+	// trafficSplits route the requests to the services across their
+	// revision tags.
+	trafficSplits trafficSplits
+	// routes are the internal names proxied to backends other than their
+	// run.app URLs.
+	routes routes
+	// audiences are the ID token audiences of the internal names expecting
+	// another audience than their backend URL.
+	audiences internalNameMap
+	// impersonate is the service account the ID tokens are minted for
+	// instead of the runtime service account, overridden per internal name
+	// with impersonateOverrides.
+	impersonate          string
+	impersonateOverrides internalNameMap
+	// accessTokenHosts are the internal names proxied with an OAuth2 access
+	// token (with accessTokenScopes) instead of an ID token.
+	accessTokenHosts  hostPatterns
+	accessTokenScopes []string
+	// noAuthHosts are the internal names proxied without an ID token.
+	noAuthHosts hostPatterns
+	// overwriteAuthHosts are the internal names the Authorization header of
+	// the requests is replaced with an ID token for, rather than kept if set.
+	overwriteAuthHosts hostPatterns
+	// tracer, if set, exports a span for each proxied request.
+	tracer *otlpExporter
+	// noTracePropagation disables sending the trace context headers to the
+	// backends.
+	noTracePropagation bool
 }
 
 func newReverseProxy(projectHash, currentRegion, internalDomain string) *reverseProxy {
@@ -46,71 +135,376 @@ func newReverseProxy(projectHash, currentRegion, internalDomain string) *reverse
 
 const (
 	ctxKeyEarlyResponse = `early-response`
+	ctxKeyTiming        = `timing`
+	ctxKeyRequestBody   = `request-body`
 )
 
 func (rp *reverseProxy) newReverseProxyHandler(tr http.RoundTripper) http.Handler {
-	tokenInject := authenticatingTransport{next: tr}
-	transport := loggingTransport{next: tokenInject}
+	var next http.RoundTripper = timingTransport{next: responseHeaderTimeoutTransport{next: tr}}
+	if rp.retry.enabled() {
+		next = retryTransport{next: next, policy: rp.retry}
+	}
+	if rp.hedgeDelay > 0 {
+		next = hedgingTransport{next: next, delay: rp.hedgeDelay, budget: rp.hedgeBudget}
+	}
+	tokenInject := authenticatingTransport{
+		next:                     next,
+		noHeaderMutation:         rp.noHeaderMutation,
+		headerRules:              rp.headerRules,
+		noForwardedAuthorization: rp.noHeaderMutation || rp.noForwardedHeaders,
+		accessTokenScopes:        rp.accessTokenScopes,
+	}
+	var transport http.RoundTripper = tokenInject
+	if rp.breaker != nil {
+		transport = circuitBreakerTransport{next: transport, breaker: rp.breaker}
+	}
+	if rp.cache != nil {
+		transport = cachingTransport{next: transport, cache: rp.cache}
+	}
+	transport = grpcTrailersTransport{next: transport}
+	if rp.grpcWeb {
+		transport = grpcWebTransport{next: transport}
+	}
+	transport = upgradeTransport{next: transport, idleTimeout: rp.upgradeIdleTimeout}
+	if propagate := !rp.noHeaderMutation && !rp.noTracePropagation; rp.tracer != nil || propagate {
+		transport = tracingTransport{next: transport, exporter: rp.tracer, propagate: propagate, currentRegion: rp.currentRegion}
+	}
+	transport = loggingTransport{next: transport}
 
-	return &httputil.ReverseProxy{
+	// upgrade requests (e.g. websockets) are handled by httputil.ReverseProxy
+	// which hijacks the client connection, and the transport which sends them
+	// over http/1.1 even if the backend supports http/2.
+	proxy := &httputil.ReverseProxy{
 		Transport:     transport,
 		FlushInterval: -1, // to support grpc streaming responses
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			// the transports (e.g. retries) may have replaced the request body,
+			// so the limited body is looked up from the context.
+			if lb, ok := req.Context().Value(ctxKeyRequestBody).(*limitedBody); ok && lb.exceededLimit() != nil {
+				err = lb.exceededLimit()
+			}
+			if req.Context().Err() == context.Canceled {
+				klog.V(3).Infof("[proxy] request to host=%s canceled: %v", req.Host, err)
+			} else {
+				klog.Warningf("WARN: reverse proxy failed to send request to host=%s: %v", req.Host, err)
+			}
+			if se, ok := err.(*bodySizeError); ok {
+				status, code := http.StatusBadGateway, errCodeResponseTooLarge
+				if se.what == "request" {
+					status, code = http.StatusRequestEntityTooLarge, errCodeRequestTooLarge
+				}
+				newProxyError(status, code, req.URL.Host, se.Error()).write(w)
+				return
+			}
+			if isTimeout(err) {
+				newProxyError(http.StatusGatewayTimeout, errCodeUpstreamTimeout, req.URL.Host,
+					fmt.Sprintf("timed out waiting for %s: %v", req.URL.Host, err)).
+					withHint("increase -request_timeout or -response_header_timeout if the backend is slow").write(w)
+				return
+			}
+			newProxyError(http.StatusBadGateway, errCodeUpstreamFailed, req.URL.Host,
+				fmt.Sprintf("failed to send the request to %s: %v", req.URL.Host, err)).write(w)
+		},
 		Director: func(req *http.Request) {
 			klog.V(5).Infof("[director] receive req host=%s", req.Host)
-			origHost := req.Host
+			origHost, forwardedHost, forwardedProto := req.Host, req.Host, "http"
+			if req.TLS != nil {
+				forwardedProto = "https"
+			}
 			if h, p, err := net.SplitHostPort(origHost); err == nil {
 				klog.V(6).Infof("discarding port=%v in host=%s", p, origHost)
 				origHost = h
 			}
-			runHost, err := resolveCloudRunHost(rp.internalDomain, origHost, rp.currentRegion, rp.projectHash)
+			scheme, runHost, err := rp.backend(origHost)
 			if err != nil {
 				// this only fails due to region code not being registered –which would be handled
 				// by the DNS resolver so the request should not come here with an invalid region.
 				klog.Warningf("WARN: reverse proxy failed to find a Cloud Run URL for host=%s: %v", req.Host, err)
-				resp := &http.Response{
-					Request:    req,
-					StatusCode: http.StatusInternalServerError,
-					Body: ioutil.NopCloser(bytes.NewReader([]byte(
-						fmt.Sprintf("runsd doesn't know how to handle host=%q: %v", req.Host, err)))),
-				}
+				resp := newProxyError(http.StatusBadGateway, errCodeUnknownHost, req.Host,
+					fmt.Sprintf("doesn't know how to handle host=%q: %v", req.Host, err)).
+					withHint("use SVC or SVC.REGION as the hostname, or -unknown_region_host for the regions runsd doesn't know").
+					response(req)
 				newReq := req.WithContext(context.WithValue(req.Context(), ctxKeyEarlyResponse, resp))
 				*req = *newReq
 				return
 			}
-			req.URL.Scheme = "https"
+			ctx := rp.authContext(context.WithValue(req.Context(), ctxKeyOriginalHost, origHost), origHost)
+			if rp.streamingHosts.matches(rp.resolveName(origHost), rp.internalDomain, rp.currentRegion) {
+				ctx = context.WithValue(ctx, ctxKeyStreaming, true)
+			}
+			*req = *req.WithContext(ctx)
+			if v, ok := rp.routes.lookup(rp.resolveName(origHost), rp.internalDomain, rp.currentRegion); ok {
+				v.setClientIdentity(req)
+			}
+			req.URL.Scheme = scheme
 			req.URL.Host = runHost
-			req.Host = runHost
-			req.Header.Set("host", runHost)
+			if !rp.preserveHost {
+				req.Host = runHost
+			}
+			if rp.originalHostHeader != "" {
+				req.Header.Set(rp.originalHostHeader, forwardedHost)
+			}
+			if rp.noHeaderMutation || rp.noForwardedHeaders {
+				// prevent httputil.ReverseProxy from adding X-Forwarded-For
+				req.Header["X-Forwarded-For"] = nil
+			} else {
+				// let the backend know the name it was called with, e.g. to
+				// build links
+				req.Header.Set("x-forwarded-host", forwardedHost)
+				req.Header.Set("x-forwarded-proto", forwardedProto)
+			}
+			if !rp.noHeaderMutation && !rp.preserveHost {
+				req.Header.Set("host", runHost)
+			}
+			proxyDetailsFromContext(req.Context()).record(func(d *proxyDetails) { d.backend = scheme + "://" + runHost })
 			klog.V(5).Infof("[director] rewrote host=%s to=%s new_url=%q", origHost, runHost, req.URL)
 		},
 	}
+	if rp.maxResponseBytes > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if resp.StatusCode == http.StatusSwitchingProtocols || isStreamingResponse(resp.Request, resp) {
+				return nil
+			}
+			if resp.ContentLength > rp.maxResponseBytes {
+				return &bodySizeError{what: "response", limit: rp.maxResponseBytes}
+			}
+			// as the headers are sent by then, larger bodies of unknown length
+			// abort the response
+			resp.Body = newLimitedBody(resp.Body, "response", rp.maxResponseBytes)
+			return nil
+		}
+	}
+	if rp.maxRequestBytes <= 0 {
+		return proxy
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > rp.maxRequestBytes {
+			klog.V(4).Infof("[proxy] rejecting request to host=%s with %d bytes of body (max=%d)", req.Host, req.ContentLength, rp.maxRequestBytes)
+			newProxyError(http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, req.Host,
+				(&bodySizeError{what: "request", limit: rp.maxRequestBytes}).Error()).write(w)
+			return
+		}
+		if req.Body != nil && req.Body != http.NoBody && !isUpgrade(req.Header) {
+			lb := newLimitedBody(req.Body, "request", rp.maxRequestBytes)
+			req.Body = lb
+			req = req.WithContext(context.WithValue(req.Context(), ctxKeyRequestBody, lb))
+		}
+		proxy.ServeHTTP(w, req)
+	})
+}
+
+// backend returns the scheme and the host the requests for the hostname are
+// proxied to.
+func (rp *reverseProxy) backend(hostname string) (scheme, host string, err error) {
+	hostname = rp.resolveName(hostname)
+	if v, ok := rp.hosts.lookup(hostname); ok && v.target != nil {
+		klog.V(5).Infof("[director] host=%s is in the hosts file", hostname)
+		return v.target.Scheme, v.target.Host, nil
+	}
+	if rp.runAppAuth && isRunAppHost(hostname) {
+		klog.V(5).Infof("[director] host=%s is a run.app url", hostname)
+		return "https", hostname, nil
+	}
+	if v, ok := rp.routes.lookup(hostname, rp.internalDomain, rp.currentRegion); ok {
+		klog.V(5).Infof("[director] host=%s is routed to %s", hostname, v.target)
+		return v.target.Scheme, v.target.Host, nil
+	}
+	if rp.compose != nil {
+		host, err := rp.compose.host(rp.internalDomain, hostname, rp.currentRegion)
+		return "http", host, err
+	}
+	if rp.emulated {
+		return "", "", fmt.Errorf("%s is not one of the -emulated_services", hostname)
+	}
+	if rp.services != nil {
+		host, err = rp.services.resolve(rp.internalDomain, hostname, rp.currentRegion)
+	} else {
+		host, err = resolveCloudRunHostOrTemplate(rp.unknownRegionHost, rp.internalDomain, hostname, rp.currentRegion, rp.projectHash)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if split, ok := rp.trafficSplits.lookup(hostname, rp.internalDomain, rp.currentRegion); ok && strings.HasSuffix(host, ".run.app") {
+		tag := split.choose()
+		klog.V(5).Infof("[director] host=%s routed to tag=%s", hostname, tag)
+		host = taggedHost(tag, host)
+	}
+	return "https", host, nil
+}
+
+// resolveName returns the internal name the requests for the hostname are
+// for, after resolving the extra zones and the aliases.
+func (rp *reverseProxy) resolveName(hostname string) string {
+	hostname = rp.canonicalHost(hostname)
+	if target, ok := rp.aliases.resolve(hostname, rp.internalDomain, rp.currentRegion); ok {
+		klog.V(5).Infof("[director] host=%s is an alias of %s", hostname, target)
+		hostname = target
+	}
+	return hostname
+}
+
+// isInternalName reports whether the hostname is one of the names the reverse
+// proxy handles (rather than an external name).
+func (rp *reverseProxy) isInternalName(hostname string) bool {
+	hostname = rp.canonicalHost(hostname)
+	if v, ok := rp.hosts.lookup(hostname); ok {
+		return v.target != nil
+	}
+	if strings.HasSuffix(hostname, "."+strings.Trim(rp.internalDomain, ".")) {
+		return true
+	}
+	if net.ParseIP(hostname) != nil || hostname == "localhost" {
+		return false
+	}
+	switch parts := strings.Split(hostname, "."); len(parts) {
+	case 1:
+		return true
+	case 2:
+		_, ok := regionCode(parts[1])
+		return ok
+	}
+	return false
+}
+
+// noAuth reports whether the requests for the hostname are sent without an
+// ID token.
+func (rp *reverseProxy) noAuth(hostname string) bool {
+	hostname = rp.resolveName(hostname)
+	if rp.noAuthHosts.matches(hostname, rp.internalDomain, rp.currentRegion) {
+		return true
+	}
+	if v, ok := rp.routes.lookup(hostname, rp.internalDomain, rp.currentRegion); ok {
+		return v.noAuth
+	}
+	return rp.compose != nil && rp.compose.identity == ""
+}
+
+// authContext returns the context with the settings of authenticatingTransport
+// for the requests for the hostname.
+func (rp *reverseProxy) authContext(ctx context.Context, hostname string) context.Context {
+	if rp.noAuth(hostname) {
+		return context.WithValue(ctx, ctxKeyNoAuth, true)
+	}
+	name := rp.resolveName(hostname)
+	if rp.overwriteAuthHosts.matches(name, rp.internalDomain, rp.currentRegion) {
+		ctx = context.WithValue(ctx, ctxKeyOverwriteAuth, true)
+	}
+	if rp.compose != nil && rp.compose.identity != "" {
+		if _, ok := rp.routes.lookup(name, rp.internalDomain, rp.currentRegion); !ok {
+			return context.WithValue(ctx, ctxKeyFakeIdentity, rp.compose.identity)
+		}
+	}
+	if rp.accessTokenHosts.matches(name, rp.internalDomain, rp.currentRegion) {
+		ctx = context.WithValue(ctx, ctxKeyAccessToken, true)
+	}
+	if aud, ok := rp.audience(hostname); ok {
+		ctx = context.WithValue(ctx, ctxKeyAudience, aud)
+	}
+	if sa, ok := rp.impersonateOverrides.lookup(name, rp.internalDomain, rp.currentRegion); ok {
+		ctx = context.WithValue(ctx, ctxKeyImpersonate, sa)
+	} else if rp.impersonate != "" {
+		ctx = context.WithValue(ctx, ctxKeyImpersonate, rp.impersonate)
+	}
+	return ctx
+}
+
+// audience returns the ID token audience configured for the hostname, if
+// any, instead of the backend URL.
+func (rp *reverseProxy) audience(hostname string) (string, bool) {
+	return rp.audiences.lookup(rp.resolveName(hostname), rp.internalDomain, rp.currentRegion)
+}
+
+// canonicalHost returns the hostname in the primary internal zone, if it is in
+// one of the extra zones.
+func (rp *reverseProxy) canonicalHost(hostname string) string {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	for _, domain := range rp.extraDomains {
+		if suffix := "." + strings.Trim(domain, "."); strings.HasSuffix(hostname, suffix) {
+			return strings.TrimSuffix(hostname, suffix) + "." + strings.Trim(rp.internalDomain, ".")
+		}
+	}
+	return hostname
 }
 
 func resolveCloudRunHost(internalDomain, hostname, curRegion, projectHash string) (string, error) {
 	hostname = strings.ToLower(hostname) // TODO surprisingly not canonicalized by now
 
-	if !strings.Contains(hostname, ".") {
+	trimmed := strings.TrimSuffix(hostname, "."+strings.Trim(internalDomain, "."))
+	tag, svc, svcRegion, err := parseInternalName(trimmed, curRegion)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse hostname %q: %w", hostname, err)
+	}
+
+	rc, ok := regionCode(svcRegion)
+	if !ok && !strings.Contains(trimmed, ".") {
 		// in the same region
-		rc, ok := cloudRunRegionCodes[curRegion]
-		if !ok {
-			return "", fmt.Errorf("region %q is not handled", curRegion)
-		}
-		return mkCloudRunHost(hostname, rc, projectHash), nil
+		return "", &unknownRegionError{svc: svc, tag: tag, region: curRegion,
+			msg: fmt.Sprintf("region %q is not handled", curRegion)}
+	} else if !ok {
+		return "", &unknownRegionError{svc: svc, tag: tag, region: svcRegion,
+			msg: fmt.Sprintf("region %q is not handled (inferred from hostname %s), try upgrading runsd", svcRegion, hostname)}
 	}
+	host := mkCloudRunHost(svc, rc, projectHash)
+	if tag != "" {
+		host = taggedHost(tag, host)
+	}
+	return host, nil
+}
 
-	trimmed := strings.TrimSuffix(hostname, "."+strings.Trim(internalDomain, "."))
-	if strings.Count(trimmed, ".") != 1 {
-		return "", fmt.Errorf("found too many dots in hostname %q, (trimmed: %s)", hostname, trimmed)
+// revisionTagNames enables the internal names with a revision tag label
+// (e.g. canary.hello.us-central1.run.internal).
+var revisionTagNames bool
+
+// regionPattern matches the names of the GCP regions, including the ones
+// without a known region code.
+var regionPattern = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+$`)
+
+func looksLikeRegion(s string) bool {
+	_, ok := regionCode(s)
+	return ok || regionPattern.MatchString(s)
+}
+
+// parseInternalName splits the internal hostname (without the domain) in the
+// SVC or SVC.REGION form, or if revisionTagNames is set, in the TAG.SVC or
+// TAG.SVC.REGION form where TAG is a revision tag. Two-label names are
+// TAG.SVC only if the second label doesn't look like a region name.
+func parseInternalName(name, curRegion string) (tag, svc, region string, err error) {
+	parts := strings.Split(name, ".")
+	switch {
+	case len(parts) == 1:
+		return "", parts[0], curRegion, nil
+	case len(parts) == 2 && revisionTagNames && !looksLikeRegion(parts[1]):
+		return parts[0], parts[1], curRegion, nil
+	case len(parts) == 2:
+		return "", parts[0], parts[1], nil
+	case len(parts) == 3 && revisionTagNames && !looksLikeRegion(parts[1]):
+		return parts[0], parts[1], parts[2], nil
 	}
+	return "", "", "", fmt.Errorf("found too many dots in %q", name)
+}
 
-	splits := strings.SplitN(trimmed, ".", 2)
-	svc, svcRegion := splits[0], splits[1]
+// unknownRegionError is returned for hostnames in regions without a known
+// region code.
+type unknownRegionError struct {
+	svc, tag, region string
+	msg              string
+}
+
+func (e *unknownRegionError) Error() string { return e.msg }
 
-	rc, ok := cloudRunRegionCodes[svcRegion]
-	if !ok {
-		return "", fmt.Errorf("region %q is not handled (inferred from hostname %s), try upgrading runsd", svcRegion, hostname)
+// resolveCloudRunHostOrTemplate is like resolveCloudRunHost, but uses the
+// hostname template (if not empty) for the regions without a known region
+// code. The template can refer to {service}, {region} and {project_hash}.
+func resolveCloudRunHostOrTemplate(tpl, internalDomain, hostname, curRegion, projectHash string) (string, error) {
+	host, err := resolveCloudRunHost(internalDomain, hostname, curRegion, projectHash)
+	if ue, ok := err.(*unknownRegionError); ok && tpl != "" {
+		host := strings.NewReplacer("{service}", ue.svc, "{region}", ue.region, "{project_hash}", projectHash).Replace(tpl)
+		if ue.tag != "" {
+			host = taggedHost(ue.tag, host)
+		}
+		return host, nil
 	}
-	return mkCloudRunHost(svc, rc, projectHash), nil
+	return host, err
 }
 
 func mkCloudRunHost(svc, regionCode, projectHash string) string {
@@ -119,5 +513,25 @@ func mkCloudRunHost(svc, regionCode, projectHash string) string {
 
 func allowh2c(next http.Handler) http.Handler {
 	h2server := &http2.Server{IdleTimeout: time.Second * 60}
-	return h2c.NewHandler(next, h2server)
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && req.Body != nil && req.Body != http.NoBody {
+			req.Body = &syncCloseBody{ReadCloser: req.Body}
+		}
+		next.ServeHTTP(w, req)
+	}), h2server)
+}
+
+// syncCloseBody is a request body that is safe to close concurrently. Both the
+// reverse proxy and the transport (once it's done sending it) close the
+// request bodies, and the bodies of the x/net/http2 server (at the version in
+// go.mod) race when they are closed at the same time.
+type syncCloseBody struct {
+	io.ReadCloser
+	once sync.Once
+	err  error
+}
+
+func (b *syncCloseBody) Close() error {
+	b.once.Do(func() { b.err = b.ReadCloser.Close() })
+	return b.err
 }
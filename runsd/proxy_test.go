@@ -0,0 +1,663 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy starts a TLS backend serving h and a reverse proxy that sends
+// all requests to it, and returns the proxy's URL.
+func newTestProxy(t *testing.T, rp *reverseProxy, h http.Handler) (string, func()) {
+	t.Helper()
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "test-token")
+
+	backend := httptest.NewUnstartedServer(h)
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+	}
+	proxy := httptest.NewServer(allowh2c(rp.newReverseProxyHandler(tr)))
+	return proxy.URL, func() {
+		proxy.Close()
+		backend.Close()
+		os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	})
+
+	cases := []struct {
+		name        string
+		noMutation  bool
+		noForwarded bool
+		wantUA      string
+		wantXFF     bool
+	}{
+		{name: "default", wantUA: "runsd version=" + version + "; test-agent", wantXFF: true},
+		{name: "no header mutation", noMutation: true, wantUA: "test-agent", wantXFF: false},
+		{name: "no forwarded headers", noForwarded: true, wantUA: "runsd version=" + version + "; test-agent", wantXFF: false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.noHeaderMutation = tt.noMutation
+			rp.noForwardedHeaders = tt.noForwarded
+			proxyURL, cleanup := newTestProxy(t, rp, backend)
+			defer cleanup()
+
+			req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+			req.Host = "hello"
+			req.Header.Set("user-agent", "test-agent")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if v := got.Get("authorization"); v != "Bearer test-token" {
+				t.Errorf("authorization header = %q", v)
+			}
+			if v := got.Get("user-agent"); v != tt.wantUA {
+				t.Errorf("user-agent = %q, want %q", v, tt.wantUA)
+			}
+			if _, ok := got["X-Forwarded-For"]; ok != tt.wantXFF {
+				t.Errorf("x-forwarded-for present = %v, want %v", ok, tt.wantXFF)
+			}
+			wantHost, wantProto := "", ""
+			if tt.wantXFF {
+				wantHost, wantProto = "hello", "http"
+			}
+			if v := got.Get("x-forwarded-host"); v != wantHost {
+				t.Errorf("x-forwarded-host = %q, want %q", v, wantHost)
+			}
+			if v := got.Get("x-forwarded-proto"); v != wantProto {
+				t.Errorf("x-forwarded-proto = %q, want %q", v, wantProto)
+			}
+		})
+	}
+}
+
+func TestProxyPreserveHost(t *testing.T) {
+	var gotHost, gotOrig string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHost, gotOrig = req.Host, req.Header.Get("x-original-host")
+	})
+	cases := []struct {
+		name         string
+		preserveHost bool
+		origHeader   string
+		wantHost     string
+		wantOrig     string
+	}{
+		{name: "default", wantHost: "hello-hash-uc.a.run.app"},
+		{name: "preserve host", preserveHost: true, wantHost: "hello:8080"},
+		{name: "original host header", origHeader: "X-Original-Host", wantHost: "hello-hash-uc.a.run.app", wantOrig: "hello:8080"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.preserveHost, rp.originalHostHeader = tt.preserveHost, tt.origHeader
+			proxyURL, cleanup := newTestProxy(t, rp, backend)
+			defer cleanup()
+
+			req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+			req.Host = "hello:8080"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if gotHost != tt.wantHost {
+				t.Errorf("host = %q, want %q", gotHost, tt.wantHost)
+			}
+			if gotOrig != tt.wantOrig {
+				t.Errorf("x-original-host = %q, want %q", gotOrig, tt.wantOrig)
+			}
+		})
+	}
+}
+
+// echoUpgradeHandler switches to the requested protocol and echoes back what
+// it reads from the connection.
+var echoUpgradeHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	if !isUpgrade(req.Header) || req.Header.Get("authorization") == "" {
+		http.Error(w, "bad upgrade request", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + req.Header.Get("upgrade") + "\r\n\r\n")
+	rw.Flush()
+	io.Copy(conn, rw)
+})
+
+// dialUpgrade sends an upgrade request for host to the proxy and returns the
+// upgraded connection.
+func dialUpgrade(t *testing.T, proxyURL, host string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	u, _ := url.Parse(proxyURL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/socket.io/?transport=websocket", nil)
+	req.Header.Set("connection", "Upgrade")
+	req.Header.Set("upgrade", "websocket")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func TestProxyWebSocketUpgrade(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	proxyURL, cleanup := newTestProxy(t, rp, echoUpgradeHandler)
+	defer cleanup()
+
+	conn, br := dialUpgrade(t, proxyURL, "hello")
+	defer conn.Close()
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Errorf("echo = %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestProxyWebSocketIdleTimeout(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.upgradeIdleTimeout = 100 * time.Millisecond
+	proxyURL, cleanup := newTestProxy(t, rp, echoUpgradeHandler)
+	defer cleanup()
+
+	conn, br := dialUpgrade(t, proxyURL, "hello")
+	defer conn.Close()
+	conn.Write([]byte("ping\n"))
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("idle connection read err = %v, want EOF", err)
+	}
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.noHeaderMutation = true
+	rp.headerRules = headerRules{
+		"payments": {set: http.Header{"X-Api-Version": {"2"}}},
+		"legacy":   {set: http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}},
+	}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	for host, want := range map[string]http.Header{
+		"payments": {"X-Api-Version": {"2"}, "Authorization": {"Bearer test-token"}},
+		"legacy":   {"Authorization": {"Basic dXNlcjpwYXNz"}},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for k, v := range want {
+			if got.Get(k) != v[0] {
+				t.Errorf("host=%s header %s = %q, want %q", host, k, got.Get(k), v[0])
+			}
+		}
+	}
+}
+
+func TestProxyRoutesNoAuth(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.routes = routes{
+		"ledger": {target: &url.URL{Scheme: "https", Host: "10.128.0.9"}, noAuth: true},
+		"orders": {target: &url.URL{Scheme: "https", Host: "10.128.0.10"}},
+	}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	for host, want := range map[string]string{"ledger": "", "orders": "Bearer test-token", "hello": "Bearer test-token"} {
+		req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if v := got.Get("Authorization"); v != want {
+			t.Errorf("host=%s authorization = %q, want %q", host, v, want)
+		}
+	}
+}
+
+func TestProxyOverwriteAuth(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.overwriteAuthHosts = hostPatterns{"ledger"}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	for host, want := range map[string]string{"ledger": "Bearer test-token", "hello": "Bearer stale"} {
+		req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer stale")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if v := got.Get("Authorization"); v != want {
+			t.Errorf("host=%s authorization = %q, want %q", host, v, want)
+		}
+		if v, want := got.Get("X-Forwarded-Authorization"), map[string]string{"ledger": "Bearer stale"}[host]; v != want {
+			t.Errorf("host=%s x-forwarded-authorization = %q, want %q", host, v, want)
+		}
+	}
+}
+
+func TestProxyAudiences(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.audiences = internalNameMap{"hello": "https://hello.example.com"}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+	os.Unsetenv("CLOUD_RUN_ID_TOKEN") // use the cached token for the audience
+
+	token := testJWT(time.Now().Add(time.Hour))
+	defer func(v *tokenCache) { idTokenCache = v }(idTokenCache)
+	idTokenCache = newTokenCache("")
+	idTokenCache.put("https://hello.example.com", token)
+
+	req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+	req.Host = "hello"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := got.Get("Authorization"); v != "Bearer "+token {
+		t.Errorf("authorization = %q, want the token for the configured audience", v)
+	}
+}
+
+func TestProxyAccessTokenHosts(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.accessTokenHosts = hostPatterns{"endpoints"}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+	os.Setenv("CLOUD_RUN_ACCESS_TOKEN", "test-access-token")
+	defer os.Unsetenv("CLOUD_RUN_ACCESS_TOKEN")
+
+	for host, want := range map[string]string{"endpoints": "Bearer test-access-token", "hello": "Bearer test-token"} {
+		req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if v := got.Get("Authorization"); v != want {
+			t.Errorf("host=%s authorization = %q, want %q", host, v, want)
+		}
+	}
+}
+
+func TestProxyBodySizeLimits(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+		if req.URL.Path == "/large" {
+			w.Write([]byte(strings.Repeat("x", 20)))
+		}
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.maxRequestBytes, rp.maxResponseBytes = 10, 10
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	cases := []struct {
+		name       string
+		path       string
+		body       io.Reader
+		wantStatus int
+	}{
+		{name: "within limits", path: "/", body: strings.NewReader("small"), wantStatus: http.StatusOK},
+		{name: "large request", path: "/", body: strings.NewReader(strings.Repeat("x", 20)), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "large chunked request", path: "/", body: ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20))), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "large response", path: "/large", wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, proxyURL+tt.path, tt.body)
+			req.Host = "hello"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			var body struct {
+				Error  string `json:"error"`
+				Status int    `json:"status"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("error response is not json: %v", err)
+			}
+			if body.Status != tt.wantStatus || !strings.Contains(body.Error, "limit of 10 bytes") {
+				t.Errorf("unexpected error response: %+v", body)
+			}
+		})
+	}
+}
+
+// bodyReadingFailingTransport reads the request bodies and fails the requests
+// with err, like a backend resetting the connection.
+type bodyReadingFailingTransport struct{ err error }
+
+func (f bodyReadingFailingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+	}
+	return nil, f.err
+}
+
+func TestProxyRequestBodyLimitTransportError(t *testing.T) {
+	retries := retryPolicy{
+		maxAttempts:  3,
+		methods:      map[string]bool{http.MethodPost: true},
+		statusCodes:  map[int]bool{http.StatusServiceUnavailable: true},
+		maxBodyBytes: 1 << 10,
+	}
+	for name, retry := range map[string]retryPolicy{"no retries": {}, "with retries": retries} {
+		t.Run(name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.maxRequestBytes = 10
+			rp.retry = retry
+			tr := bodyReadingFailingTransport{err: errors.New("connection reset by peer")}
+			proxy := httptest.NewServer(rp.newReverseProxyHandler(tr))
+			defer proxy.Close()
+
+			os.Setenv("CLOUD_RUN_ID_TOKEN", "test-token")
+			defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+			req, _ := http.NewRequest(http.MethodPost, proxy.URL, ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20))))
+			req.Host = "hello"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("status=%d, want=%d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+func TestProxyErrorResponses(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	for host, want := range map[string]proxyError{
+		"hello.mars-north1": {Code: errCodeUnknownHost, Status: http.StatusBadGateway, Destination: "hello.mars-north1"},
+		"hello":             {Code: errCodeUpstreamFailed, Status: http.StatusBadGateway, Destination: "hello-hash-uc.a.run.app"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got proxyError
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("host=%s: error response is not json: %v", host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want.Status || resp.Header.Get(errorHeader) != want.Code {
+			t.Errorf("host=%s: status=%d %s=%q, want %d %q", host, resp.StatusCode, errorHeader, resp.Header.Get(errorHeader), want.Status, want.Code)
+		}
+		if got.Code != want.Code || got.Status != want.Status || got.Destination != want.Destination || !strings.HasPrefix(got.Error, "runsd: ") {
+			t.Errorf("host=%s: unexpected error body: %+v", host, got)
+		}
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	cases := []struct {
+		h    http.Header
+		want bool
+	}{
+		{h: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, want: true},
+		{h: http.Header{"Connection": {"keep-alive, upgrade"}, "Upgrade": {"websocket"}}, want: true},
+		{h: http.Header{"Upgrade": {"websocket"}}, want: false},
+		{h: http.Header{"Connection": {"Upgrade"}}, want: false},
+	}
+	for _, tt := range cases {
+		if got := isUpgrade(tt.h); got != tt.want {
+			t.Errorf("isUpgrade(%v) = %v, want %v", tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	rp := newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")
+	rp.extraDomains = []string{"cloudrun.internal."}
+	cases := map[string]string{
+		"hello":                                "hello",
+		"hello.us-central1.run.internal":       "hello.us-central1.run.internal",
+		"Hello.us-central1.cloudrun.internal":  "hello.us-central1.run.internal",
+		"hello.us-central1.cloudrun.internal.": "hello.us-central1.run.internal",
+		"example.com":                          "example.com",
+	}
+	for in, want := range cases {
+		if got := rp.canonicalHost(in); got != want {
+			t.Errorf("canonicalHost(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestResolveCloudRunHostRevisionTags(t *testing.T) {
+	cases := map[string]string{
+		"hello":                                  "hello-dpyb4duzqq-uc.a.run.app",
+		"hello.europe-west1":                     "hello-dpyb4duzqq-ew.a.run.app",
+		"canary.hello":                           "canary---hello-dpyb4duzqq-uc.a.run.app",
+		"canary.hello.europe-west1":              "canary---hello-dpyb4duzqq-ew.a.run.app",
+		"canary.hello.europe-west1.run.internal": "canary---hello-dpyb4duzqq-ew.a.run.app",
+	}
+	revisionTagNames = true
+	defer func() { revisionTagNames = false }()
+	for in, want := range cases {
+		got, err := resolveCloudRunHost("run.internal.", in, "us-central1", "dpyb4duzqq")
+		if err != nil {
+			t.Errorf("resolveCloudRunHost(%s) failed: %v", in, err)
+		} else if got != want {
+			t.Errorf("resolveCloudRunHost(%s) = %s, want %s", in, got, want)
+		}
+	}
+	if _, err := resolveCloudRunHost("run.internal.", "hello.us-central1.us-central1", "us-central1", "dpyb4duzqq"); err == nil {
+		t.Error("expected error for service name that looks like a region")
+	}
+
+	revisionTagNames = false
+	if _, err := resolveCloudRunHost("run.internal.", "canary.hello", "us-central1", "dpyb4duzqq"); err == nil {
+		t.Error("expected error for tagged name when disabled")
+	}
+}
+
+func TestResolveCloudRunHostOrTemplate(t *testing.T) {
+	const tpl = "{service}-123456789012.{region}.run.app"
+	got, err := resolveCloudRunHostOrTemplate(tpl, "run.internal.", "hello.mars-north1", "us-central1", "dpyb4duzqq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello-123456789012.mars-north1.run.app"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	got, err = resolveCloudRunHostOrTemplate(tpl, "run.internal.", "hello", "us-central1", "dpyb4duzqq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello-dpyb4duzqq-uc.a.run.app"; got != want {
+		t.Errorf("known region: got %s, want %s", got, want)
+	}
+	if _, err := resolveCloudRunHostOrTemplate("", "run.internal.", "hello.mars-north1", "us-central1", "dpyb4duzqq"); err == nil {
+		t.Error("expected error for unknown region without template")
+	}
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	var gotBytes int
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotBytes = 0
+		if req.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		gotBytes = len(b)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "test-token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	base := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}
+	tr := newProxyTransport(base, transportOptions{expectContinueTimeout: 10 * time.Second})
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	retries, err := parseRetryPolicy(2, "POST", "503", 0, 0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client waits for the 100 Continue response this long before
+	// sending the body anyway
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+	body := strings.Repeat("x", 256<<10)
+	cases := []struct {
+		name       string
+		retry      retryPolicy
+		path       string
+		wantStatus int
+		wantBytes  int
+	}{
+		{name: "continue", path: "/upload", wantStatus: http.StatusOK, wantBytes: len(body)},
+		{name: "rejected before the body", path: "/reject", wantStatus: http.StatusUnauthorized},
+		{name: "with retries", retry: retries, path: "/upload", wantStatus: http.StatusOK, wantBytes: len(body)},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReverseProxy("hash", "us-central1", "run.internal.")
+			rp.retry = tt.retry
+			proxy := httptest.NewServer(allowh2c(rp.newReverseProxyHandler(tr)))
+			defer proxy.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, proxy.URL+tt.path, strings.NewReader(body))
+			req.Host = "hello"
+			req.Header.Set("expect", "100-continue")
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("request stalled for %v", took)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status=%d, want=%d", resp.StatusCode, tt.wantStatus)
+			}
+			if gotBytes != tt.wantBytes {
+				t.Errorf("backend got %d bytes, want=%d", gotBytes, tt.wantBytes)
+			}
+		})
+	}
+}
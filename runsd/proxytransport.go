@@ -15,10 +15,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -26,6 +32,18 @@ import (
 
 type authenticatingTransport struct {
 	next http.RoundTripper
+
+	// noHeaderMutation disables rewriting the User-Agent header.
+	noHeaderMutation bool
+	// headerRules are the configured header mutations, applied regardless of
+	// noHeaderMutation.
+	headerRules headerRules
+	// noForwardedAuthorization disables keeping the replaced Authorization
+	// header of the requests in X-Forwarded-Authorization.
+	noForwardedAuthorization bool
+	// accessTokenScopes are the scopes of the access tokens sent to the
+	// destinations expecting one instead of an ID token.
+	accessTokenScopes []string
 }
 
 var _ http.Flusher = authenticatingTransport{} // ensure it's a Flusher
@@ -41,16 +59,33 @@ func (a authenticatingTransport) RoundTrip(req *http.Request) (*http.Response, e
 		return v, nil
 	}
 
-	idToken, err := identityToken("https://" + req.Host)
-	if err != nil {
-		klog.V(1).Infof("WARN: failed to get ID token for host=%s: %v", req.Host, err)
-		r := new(http.Response)
-		r.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf("failed to fetch metadata token: %v", err)))
-		r.StatusCode = http.StatusInternalServerError
-		return r, nil
+	if host, ok := req.Context().Value(ctxKeyOriginalHost).(string); ok {
+		a.headerRules.apply(host, req.Header)
 	}
-	if req.Header.Get("authorization") == "" {
-		req.Header.Set("authorization", "Bearer "+idToken)
+
+	if noAuth, _ := req.Context().Value(ctxKeyNoAuth).(bool); !noAuth {
+		tokenStart := time.Now()
+		token, err := a.token(req)
+		timingFromContext(req.Context()).record(func(t *requestTiming) { t.tokenFetch = time.Since(tokenStart) })
+		if err != nil {
+			klog.V(1).Infof("WARN: failed to get token for host=%s: %v", req.URL.Host, err)
+			atomic.AddUint64(&tokenFetchErrors, 1)
+			return newProxyError(http.StatusServiceUnavailable, errCodeTokenUnavailable, req.URL.Host,
+				fmt.Sprintf("failed to fetch metadata token: %v", err)).
+				withHint("check that the metadata server is reachable and the service account can create ID tokens").
+				response(req), nil
+		}
+		if overwrite, _ := req.Context().Value(ctxKeyOverwriteAuth).(bool); overwrite || req.Header.Get("authorization") == "" {
+			if v := req.Header.Get("authorization"); v != "" && !a.noForwardedAuthorization {
+				// let the backend authorize the end user, like ESPv2 does
+				req.Header.Set("x-forwarded-authorization", v)
+			}
+			req.Header.Set("authorization", "Bearer "+token)
+			proxyDetailsFromContext(req.Context()).record(func(d *proxyDetails) { d.tokenInjected = true })
+		}
+	}
+	if a.noHeaderMutation {
+		return a.next.RoundTrip(req)
 	}
 	ua := req.Header.Get("user-agent")
 	req.Header.Set("user-agent", fmt.Sprintf("runsd version=%s", version))
@@ -60,6 +95,35 @@ func (a authenticatingTransport) RoundTrip(req *http.Request) (*http.Response, e
 	return a.next.RoundTrip(req)
 }
 
+// token returns the access token for the destinations configured to get
+// one, or an ID token.
+func (a authenticatingTransport) token(req *http.Request) (string, error) {
+	if v, _ := req.Context().Value(ctxKeyAccessToken).(bool); v {
+		return accessToken(a.accessTokenScopes)
+	}
+	// the audience is the backend host (which may differ from the Host
+	// header with -preserve_host) unless configured otherwise
+	audience := "https://" + req.URL.Host
+	if v, ok := req.Context().Value(ctxKeyAudience).(string); ok {
+		audience = v
+	}
+	if email, ok := req.Context().Value(ctxKeyFakeIdentity).(string); ok {
+		return fakeIdentityToken(email, audience, time.Now()), nil
+	}
+	if sa, ok := req.Context().Value(ctxKeyImpersonate).(string); ok {
+		tok, err := impersonatedIdentityToken(sa, audience)
+		if err != nil {
+			return "", fmt.Errorf("failed to get ID token of %s for audience=%s: %w", sa, audience, err)
+		}
+		return tok, nil
+	}
+	tok, err := identityToken(audience)
+	if err != nil {
+		return "", fmt.Errorf("failed to get ID token for audience=%s: %w", audience, err)
+	}
+	return tok, nil
+}
+
 type loggingTransport struct {
 	next http.RoundTripper
 }
@@ -91,3 +155,173 @@ func (l loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	return resp, err
 }
+
+// upgradeTransport closes the connections upgraded to another protocol (e.g.
+// WebSockets) after no data is sent in either direction for idleTimeout.
+type upgradeTransport struct {
+	next        http.RoundTripper
+	idleTimeout time.Duration
+}
+
+var _ http.Flusher = upgradeTransport{} // ensure it's a Flusher
+
+func (u upgradeTransport) Flush() {
+	if v, ok := u.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (u upgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upgrade := isUpgrade(req.Header)
+	if upgrade {
+		klog.V(5).Infof("[proxy] upgrade: %s url=%s protocol=%s", req.Method, req.URL, req.Header.Get("upgrade"))
+	}
+	resp, err := u.next.RoundTrip(req)
+	if err != nil || !upgrade || resp.StatusCode != http.StatusSwitchingProtocols || u.idleTimeout <= 0 {
+		return resp, err
+	}
+	// httputil.ReverseProxy copies the upgraded connection to/from the body,
+	// and closes the client connection once the body is closed.
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = newIdleTimeoutConn(rwc, u.idleTimeout)
+	}
+	return resp, nil
+}
+
+// isUpgrade reports whether the headers request a protocol upgrade.
+func isUpgrade(h http.Header) bool {
+	if h.Get("upgrade") == "" {
+		return false
+	}
+	for _, v := range h["Connection"] {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idleTimeoutConn closes the underlying connection when there are no reads or
+// writes for the timeout.
+type idleTimeoutConn struct {
+	io.ReadWriteCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutConn(rwc io.ReadWriteCloser, timeout time.Duration) *idleTimeoutConn {
+	return &idleTimeoutConn{
+		ReadWriteCloser: rwc,
+		timeout:         timeout,
+		timer: time.AfterFunc(timeout, func() {
+			klog.V(3).Infof("[proxy] closing upgraded connection idle for %s", timeout)
+			rwc.Close()
+		}),
+	}
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleTimeoutConn) Close() error {
+	c.timer.Stop()
+	return c.ReadWriteCloser.Close()
+}
+
+// transportOptions tunes the connections of the reverse proxy to the backends.
+type transportOptions struct {
+	dialTimeout     time.Duration
+	keepAlive       time.Duration // tcp keep-alive period, disabled if negative
+	idleConnTimeout time.Duration
+	// expectContinueTimeout is how long to wait for the 100 Continue response
+	// of the backends before sending the bodies of the requests with an
+	// "Expect: 100-continue" header.
+	expectContinueTimeout time.Duration
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+
+	// rootCAs, if set, are the CAs the backend certificates are verified
+	// with, instead of the system ones.
+	rootCAs *x509.CertPool
+	// insecureSkipVerify disables verifying the backend certificates.
+	insecureSkipVerify bool
+}
+
+// loadCABundle returns the system CAs with the ones in the PEM file added.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		klog.V(1).Infof("WARN: failed to load the system CAs, only using %s: %v", path, err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// dialer returns the dialer of the connections to the backends, defaulting to
+// the timeout and keep-alive period of http.DefaultTransport.
+func (o transportOptions) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if o.dialTimeout > 0 {
+		d.Timeout = o.dialTimeout
+	}
+	if o.keepAlive != 0 {
+		d.KeepAlive = o.keepAlive
+	}
+	return d
+}
+
+// newProxyTransport returns a copy of the base transport tuned with the
+// options. The connections are dialed with the dialer of the options rather
+// than the one of the base transport, so that its timeout doesn't cap
+// dialTimeout.
+func newProxyTransport(base *http.Transport, o transportOptions) *http.Transport {
+	tr := base.Clone()
+	tr.IdleConnTimeout = o.idleConnTimeout
+	tr.ExpectContinueTimeout = o.expectContinueTimeout
+	tr.MaxIdleConns = o.maxIdleConns
+	tr.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+	tr.MaxConnsPerHost = o.maxConnsPerHost
+	if o.rootCAs != nil || o.insecureSkipVerify {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = new(tls.Config)
+		}
+		tr.TLSClientConfig.RootCAs = o.rootCAs
+		tr.TLSClientConfig.InsecureSkipVerify = o.insecureSkipVerify
+	}
+	tr.DialContext = o.dialer().DialContext
+	return tr
+}
+
+// ipv6OnlyTransport returns a copy of the default transport that dials the
+// upstream servers only over IPv6.
+func ipv6OnlyTransport() *http.Transport {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network = "tcp6"
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return tr
+}
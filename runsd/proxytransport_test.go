@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewProxyTransport(t *testing.T) {
+	base := &http.Transport{}
+	tr := newProxyTransport(base, transportOptions{
+		dialTimeout:         50 * time.Millisecond,
+		idleConnTimeout:     time.Minute,
+		maxIdleConns:        10,
+		maxIdleConnsPerHost: 5,
+		maxConnsPerHost:     20,
+	})
+	if tr.IdleConnTimeout != time.Minute || tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 5 || tr.MaxConnsPerHost != 20 {
+		t.Errorf("options not applied: %+v", tr)
+	}
+	if base.MaxIdleConnsPerHost != 0 {
+		t.Error("base transport was modified")
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	conn, err := tr.DialContext(context.Background(), "tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestTransportOptionsDialer(t *testing.T) {
+	cases := []struct {
+		o                          transportOptions
+		wantTimeout, wantKeepAlive time.Duration
+	}{
+		{wantTimeout: 30 * time.Second, wantKeepAlive: 30 * time.Second},
+		{o: transportOptions{dialTimeout: 2 * time.Minute}, wantTimeout: 2 * time.Minute, wantKeepAlive: 30 * time.Second}, // not capped by http.DefaultTransport
+		{o: transportOptions{dialTimeout: time.Second, keepAlive: time.Minute}, wantTimeout: time.Second, wantKeepAlive: time.Minute},
+		{o: transportOptions{keepAlive: -1}, wantTimeout: 30 * time.Second, wantKeepAlive: -1},
+	}
+	for _, tt := range cases {
+		d := tt.o.dialer()
+		if d.Timeout != tt.wantTimeout || d.KeepAlive != tt.wantKeepAlive {
+			t.Errorf("dialer(%+v): timeout=%s keepalive=%s, want timeout=%s keepalive=%s",
+				tt.o, d.Timeout, d.KeepAlive, tt.wantTimeout, tt.wantKeepAlive)
+		}
+	}
+}
+
+func TestNewProxyTransportTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer backend.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	caFile := writeTempFile(t, dir, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})))
+	rootCAs, err := loadCABundle(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCABundle(writeTempFile(t, dir, "empty.pem", "")); err == nil {
+		t.Error("expected error for bundle without certificates")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		o       transportOptions
+		wantErr bool
+	}{
+		{name: "system CAs", wantErr: true},
+		{name: "CA bundle", o: transportOptions{rootCAs: rootCAs}},
+		{name: "skip verify", o: transportOptions{insecureSkipVerify: true}},
+	} {
+		tr := newProxyTransport(&http.Transport{}, tt.o)
+		req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err=%v, wantErr=%v", tt.name, err, tt.wantErr)
+		}
+	}
+}
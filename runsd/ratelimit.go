@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows events at rate per second with bursts of up to burst
+// events.
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// allow reports whether an event may happen now, and consumes a token if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// delay returns the time until a token is available, after a refill.
+func (b *tokenBucket) delay() time.Duration {
+	if b.tokens >= 1 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// keyedLimiter rate limits events separately for each key (e.g. client IP).
+type keyedLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+// maxIdleBuckets is the number of buckets after which the full (idle)
+// buckets are removed.
+const maxIdleBuckets = 1024
+
+func newKeyedLimiter(rate float64, burst int) *keyedLimiter {
+	return &keyedLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *keyedLimiter) allow(key string, now time.Time) bool {
+	ok, _ := l.reserve(key, now)
+	return ok
+}
+
+// reserve is like allow, but also returns the time until the next event is
+// allowed for the key if not.
+func (l *keyedLimiter) reserve(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.pruneLocked(now)
+		}
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[key] = b
+	}
+	if b.allow(now) {
+		return true, 0
+	}
+	return false, b.delay()
+}
+
+// pruneLocked removes the buckets that are full, as they are equivalent to
+// new buckets.
+func (l *keyedLimiter) pruneLocked(now time.Time) {
+	for k, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// destinationLimiter rate limits the proxied requests to each destination,
+// so that a busy code path can't use up the capacity of a service for the
+// others.
+type destinationLimiter struct {
+	internalDomain string
+	region         string
+
+	limiter *keyedLimiter // for all destinations, if set
+	// overrides are the limiters for specific destinations (service names or
+	// hostnames).
+	overrides map[string]*keyedLimiter
+}
+
+// newDestinationLimiter returns a limiter allowing qps requests per second to
+// each destination, or the ones in overrides (comma-separated
+// DESTINATION=QPS pairs, e.g. hello=5,ledger=100) for those. Zero qps means no
+// limit.
+func newDestinationLimiter(qps float64, burst int, overrides, internalDomain, region string) (*destinationLimiter, error) {
+	kv, err := parseKeyValues(overrides)
+	if err != nil {
+		return nil, err
+	}
+	l := &destinationLimiter{
+		internalDomain: internalDomain,
+		region:         region,
+		overrides:      make(map[string]*keyedLimiter, len(kv)),
+	}
+	if qps > 0 {
+		l.limiter = newKeyedLimiter(qps, burst)
+	}
+	for k, v := range kv {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid rate limit %q for %s", v, k)
+		}
+		if rate > 0 {
+			l.overrides[k] = newKeyedLimiter(rate, burst)
+		} else {
+			l.overrides[k] = nil // unlimited
+		}
+	}
+	return l, nil
+}
+
+func (l *destinationLimiter) enabled() bool {
+	if l.limiter != nil {
+		return true
+	}
+	for _, v := range l.overrides {
+		if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the limiter for the host (nil if not limited), and the key
+// of the destination in it.
+func (l *destinationLimiter) lookup(host string) (*keyedLimiter, string) {
+	key := internalDestinationName(host, l.internalDomain, l.region)
+	host = hostWithoutPort(host)
+	if v, ok := l.overrides[host]; ok {
+		return v, key
+	}
+	if v, ok := l.overrides[serviceName(host)]; ok {
+		return v, key
+	}
+	return l.limiter, key
+}
+
+// handler responds with 429 to the requests over the rate limit of their
+// destination. If no limits are configured, next is returned as is.
+func (l *destinationLimiter) handler(next http.Handler) http.Handler {
+	if !l.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limiter, dest := l.lookup(req.Host)
+		if limiter == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if ok, wait := limiter.reserve(dest, time.Now()); !ok {
+			w.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			newProxyError(http.StatusTooManyRequests, errCodeRateLimited, dest,
+				fmt.Sprintf("rate limit of requests to %s exceeded", dest)).
+				withHint("the limit is set by -rate_limit_qps or -rate_limit_overrides of runsd").
+				write(w)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("event %d within burst not allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("event over burst allowed")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !b.allow(now) {
+		t.Fatal("event after refill not allowed")
+	}
+	if b.allow(now) {
+		t.Fatal("second event after partial refill allowed")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("event %d after long idle not allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("refill exceeded burst")
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newKeyedLimiter(1, 1)
+	if !l.allow("a", now) {
+		t.Fatal("a not allowed")
+	}
+	if l.allow("a", now) {
+		t.Fatal("a allowed over its limit")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("b limited by a")
+	}
+
+	for i := 0; i < maxIdleBuckets; i++ {
+		l.allow(fmt.Sprintf("c%d", i), now)
+	}
+	now = now.Add(time.Minute)
+	l.allow("d", now)
+	if n := len(l.buckets); n != 1 {
+		t.Fatalf("idle buckets not pruned, got %d buckets", n)
+	}
+}
+
+func TestDestinationLimiter(t *testing.T) {
+	l, err := newDestinationLimiter(0.001, 2, "orders=0", "run.internal.", "us-central1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := l.handler(next)
+
+	do := func(host string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		return rec
+	}
+	// hello, hello.us-central1 and its FQDN are the same destination
+	for _, host := range []string{"hello", "hello.us-central1.run.internal.:80"} {
+		if rec := do(host); rec.Code != http.StatusOK {
+			t.Fatalf("host=%s: got status %d", host, rec.Code)
+		}
+	}
+	rec := do("hello.us-central1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the limit, got %d", rec.Code)
+	}
+	if v := rec.Header().Get("retry-after"); v != "1000" {
+		t.Errorf("retry-after=%q", v)
+	}
+	if v := rec.Header().Get(errorHeader); v != errCodeRateLimited {
+		t.Errorf("%s=%q", errorHeader, v)
+	}
+	if rec := do("hello.europe-west1"); rec.Code != http.StatusOK {
+		t.Errorf("other region limited: %d", rec.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if rec := do("orders"); rec.Code != http.StatusOK {
+			t.Fatalf("unlimited destination got %d", rec.Code)
+		}
+	}
+}
+
+func TestDestinationLimiterDisabled(t *testing.T) {
+	l, err := newDestinationLimiter(0, 10, "hello=0", "run.internal.", "us-central1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.enabled() {
+		t.Fatal("expected limiter without rates to be disabled")
+	}
+	if _, err := newDestinationLimiter(0, 10, "hello=fast", "run.internal.", "us-central1"); err == nil {
+		t.Fatal("expected error for invalid rate")
+	}
+}
@@ -16,9 +16,12 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
 )
 
 var (
@@ -51,37 +54,135 @@ var (
 		"us-west3":                "wm",
 		"us-west4":                "wn",
 	}
+
+	// discoverRegionCode, if set, finds the code of the regions that are not
+	// in cloudRunRegionCodes.
+	discoverRegionCode func(region string) (string, error)
+
+	regionCodesMu      sync.Mutex
+	discoveredCodes    = map[string]string{}
+	pendingDiscoveries = map[string]*regionDiscovery{}
+	failedDiscoveries  = map[string]time.Time{}
+	rediscoverInterval = time.Minute
 )
 
-func regionFromMetadata() (string, error) {
-	v, err := queryMetadata("http://metadata.google.internal/computeMetadata/v1/instance/zone")
-	if err != nil {
-		return "", err // TODO wrap
+// maxFailedDiscoveries caps the regions remembered as undiscoverable (for
+// rediscoverInterval), after which no new regions are tried until they expire.
+const maxFailedDiscoveries = 256
+
+// regionDiscovery is a region code discovery in progress, which the lookups of
+// the same region wait for instead of calling the Admin API again.
+type regionDiscovery struct {
+	done chan struct{}
+	code string
+	err  error
+}
+
+// regionCode returns the code of the region in the run.app hostnames.
+func regionCode(region string) (string, bool) {
+	if rc, ok := cloudRunRegionCodes[region]; ok {
+		return rc, true
 	}
-	vs := strings.SplitAfter(v, "/zones/")
-	if len(vs) != 2 {
-		return "", fmt.Errorf("malformed zone value split into %#v", vs)
+	// the region comes from the queried names, so only the names that can be
+	// regions are looked up with the Admin API
+	if discoverRegionCode == nil || !regionPattern.MatchString(region) {
+		return "", false
 	}
-	return strings.TrimSuffix(vs[1], "-1"), nil
+	regionCodesMu.Lock()
+	if rc, ok := discoveredCodes[region]; ok {
+		regionCodesMu.Unlock()
+		return rc, true
+	}
+	d, pending := pendingDiscoveries[region]
+	if !pending {
+		if t, ok := failedDiscoveries[region]; ok && time.Since(t) < rediscoverInterval {
+			regionCodesMu.Unlock()
+			return "", false
+		}
+		if !pruneFailedDiscoveriesLocked() {
+			regionCodesMu.Unlock()
+			klog.V(3).Infof("not discovering the code of region %q: too many undiscoverable regions", region)
+			return "", false
+		}
+		d = &regionDiscovery{done: make(chan struct{})}
+		pendingDiscoveries[region] = d
+	}
+	regionCodesMu.Unlock()
+	if pending {
+		<-d.done
+	} else {
+		d.code, d.err = discoverRegionCode(region)
+		regionCodesMu.Lock()
+		delete(pendingDiscoveries, region)
+		if d.err != nil {
+			klog.Warningf("failed to discover the code of region %q: %v", region, d.err)
+			failedDiscoveries[region] = time.Now()
+		} else {
+			klog.V(1).Infof("discovered region code=%s for region=%s", d.code, region)
+			discoveredCodes[region] = d.code
+			delete(failedDiscoveries, region)
+		}
+		regionCodesMu.Unlock()
+		close(d.done)
+	}
+	return d.code, d.err == nil
+}
+
+// pruneFailedDiscoveriesLocked forgets the failed discoveries older than
+// rediscoverInterval, and reports whether there is room for another one.
+func pruneFailedDiscoveriesLocked() bool {
+	if len(failedDiscoveries) < maxFailedDiscoveries {
+		return true
+	}
+	for region, t := range failedDiscoveries {
+		if time.Since(t) >= rediscoverInterval {
+			delete(failedDiscoveries, region)
+		}
+	}
+	return len(failedDiscoveries) < maxFailedDiscoveries
 }
 
-func queryMetadata(url string) (string, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// regionCodeFromServices finds the region code from the run.app URL of any of
+// the services in the region.
+func regionCodeFromServices(region string) (string, error) {
+	svcs, err := listCloudRunServices(region)
 	if err != nil {
-		return "", err // TODO wrap
+		return "", err
+	}
+	for _, s := range svcs {
+		if rc, ok := regionCodeFromURL(s.Name, s.URL); ok {
+			return rc, nil
+		}
 	}
-	req.Header.Set("Metadata-Flavor", "Google")
-	resp, err := http.DefaultClient.Do(req)
+	return "", fmt.Errorf("none of the %d services in the region has a run.app url with a region code", len(svcs))
+}
+
+// regionCodeFromURL parses the region code from the URL of a service (in
+// https://SVC-HASH-CODE.a.run.app form).
+func regionCodeFromURL(svc, u string) (string, bool) {
+	v, err := url.Parse(u)
 	if err != nil {
-		return "", err // TODO wrap
+		return "", false
+	}
+	host := v.Hostname()
+	if !strings.HasPrefix(host, svc+"-") || !strings.HasSuffix(host, ".a.run.app") {
+		return "", false
 	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("metadata server responeded with code=%d %s", resp.StatusCode, resp.Status)
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(host, svc+"-"), ".a.run.app"), "-")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
 	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
+	return parts[1], true
+}
+
+func regionFromMetadata() (string, error) {
+	v, err := queryMetadata("http://metadata.google.internal/computeMetadata/v1/instance/zone")
 	if err != nil {
 		return "", err // TODO wrap
 	}
-	return strings.TrimSpace(string(b)), err
+	vs := strings.SplitAfter(v, "/zones/")
+	if len(vs) != 2 {
+		return "", fmt.Errorf("malformed zone value split into %#v", vs)
+	}
+	return strings.TrimSuffix(vs[1], "-1"), nil
 }
@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegionCodeFromURL(t *testing.T) {
+	cases := []struct {
+		svc, url string
+		want     string
+		ok       bool
+	}{
+		{"hello", "https://hello-dpyb4duzqq-uc.a.run.app", "uc", true},
+		{"my-svc", "https://my-svc-dpyb4duzqq-xy.a.run.app", "xy", true},
+		{"hello", "https://hello-123456789012.us-central1.run.app", "", false},
+		{"hello", "https://other-dpyb4duzqq-uc.a.run.app", "", false},
+		{"hello", "", "", false},
+	}
+	for _, tt := range cases {
+		got, ok := regionCodeFromURL(tt.svc, tt.url)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("regionCodeFromURL(%s, %s) = (%q, %v), want (%q, %v)", tt.svc, tt.url, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRegionCodeDiscovery(t *testing.T) {
+	calls := 0
+	discoverRegionCode = func(region string) (string, error) {
+		calls++
+		if region == "test-discovered1" {
+			return "mn", nil
+		}
+		return "", errors.New("no services")
+	}
+	defer func() {
+		discoverRegionCode = nil
+		delete(discoveredCodes, "test-discovered1")
+		delete(failedDiscoveries, "test-undiscoverable1")
+	}()
+
+	if rc, ok := regionCode("us-central1"); rc != "uc" || !ok {
+		t.Fatalf("known region: got (%q, %v)", rc, ok)
+	}
+	for i := 0; i < 2; i++ {
+		if rc, ok := regionCode("test-discovered1"); rc != "mn" || !ok {
+			t.Fatalf("discovered region: got (%q, %v)", rc, ok)
+		}
+		if _, ok := regionCode("test-undiscoverable1"); ok {
+			t.Fatal("undiscoverable region found")
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("discovery called %d times, want 2 (results should be remembered)", calls)
+	}
+}
+
+func TestRegionCodeDiscoveryOnlyRegionNames(t *testing.T) {
+	discoverRegionCode = func(region string) (string, error) {
+		t.Errorf("discovery called for %q", region)
+		return "", errors.New("unexpected")
+	}
+	defer func() { discoverRegionCode = nil }()
+
+	// e.g. github.com.run.internal. from the search domain
+	for _, s := range []string{"com", "internal", "example-com", "US-CENTRAL1"} {
+		if _, ok := regionCode(s); ok {
+			t.Errorf("%q: found a region code", s)
+		}
+	}
+}
+
+func TestRegionCodeDiscoveryConcurrent(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	discoverRegionCode = func(region string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		if region == "test-slow1" {
+			<-release
+			return "sl", nil
+		}
+		return "fa", nil
+	}
+	defer func() {
+		discoverRegionCode = nil
+		regionCodesMu.Lock()
+		delete(discoveredCodes, "test-slow1")
+		delete(discoveredCodes, "test-fast1")
+		regionCodesMu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rc, ok := regionCode("test-slow1"); rc != "sl" || !ok {
+				t.Errorf("slow region: got (%q, %v)", rc, ok)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// other regions aren't blocked by the discovery in progress
+	if rc, ok := regionCode("test-fast1"); rc != "fa" || !ok {
+		t.Fatalf("fast region: got (%q, %v)", rc, ok)
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("discovery called %d times, want 2 (once per region)", n)
+	}
+}
+
+func TestRegionCodeDiscoveryFailuresBounded(t *testing.T) {
+	var calls int32
+	discoverRegionCode = func(region string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", errors.New("no services")
+	}
+	defer func() {
+		discoverRegionCode = nil
+		regionCodesMu.Lock()
+		failedDiscoveries = map[string]time.Time{}
+		regionCodesMu.Unlock()
+	}()
+
+	regionCodesMu.Lock()
+	for i := 0; i < maxFailedDiscoveries; i++ {
+		failedDiscoveries[fmt.Sprintf("test-failed%d", i)] = time.Now()
+	}
+	regionCodesMu.Unlock()
+	if _, ok := regionCode("test-new1"); ok || atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("discovery attempted with %d recent failures", maxFailedDiscoveries)
+	}
+
+	regionCodesMu.Lock()
+	failedDiscoveries["test-failed0"] = time.Now().Add(-rediscoverInterval)
+	regionCodesMu.Unlock()
+	regionCode("test-new1")
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("discovery not attempted after a failure expired")
+	}
+	regionCodesMu.Lock()
+	defer regionCodesMu.Unlock()
+	if _, ok := failedDiscoveries["test-failed0"]; ok || len(failedDiscoveries) != maxFailedDiscoveries {
+		t.Fatalf("failed discoveries not pruned: %d entries", len(failedDiscoveries))
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// resolvConfPollInterval is how often resolv.conf is checked for drift if
+// file change notifications are not available.
+const resolvConfPollInterval = 10 * time.Second
+
+// resolvConfWatcher re-asserts the runsd-managed resolv.conf contents if
+// something else (e.g. dhclient hooks) overwrites the file.
+type resolvConfWatcher struct {
+	path string
+	want []byte
+}
+
+// check rewrites the file if its contents drifted, and reports whether it
+// did so.
+func (r *resolvConfWatcher) check() bool {
+	b, err := ioutil.ReadFile(r.path)
+	if err == nil && bytes.Equal(b, r.want) {
+		return false
+	}
+	klog.Warningf("%s was modified by another process (read error: %v), restoring runsd configuration; contents were:\n%s", r.path, err, b)
+	if err := writeResolvConf(r.path, r.want); err != nil {
+		klog.Errorf("failed to restore %s: %v", r.path, err)
+	}
+	return true
+}
+
+// run watches the file for changes (falling back to polling if change
+// notifications are not available) and never returns.
+func (r *resolvConfWatcher) run() {
+	err := watchFileChanges(r.path, func() { r.check() })
+	klog.V(1).Infof("cannot watch %s for changes (%v), polling every %v", r.path, err, resolvConfPollInterval)
+	for range time.Tick(resolvConfPollInterval) {
+		r.check()
+	}
+}
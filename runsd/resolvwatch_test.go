@@ -0,0 +1,49 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestResolvConfWatcher(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	want := resolvConfContents([]string{"127.0.0.1"}, []string{"us-central1.run.internal.", "run.internal."}, 4)
+	path := writeTempFile(t, dir, "resolv.conf", string(want))
+
+	w := &resolvConfWatcher{path: path, want: want}
+	if w.check() {
+		t.Fatal("check() rewrote an unmodified file")
+	}
+	go w.run()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := ioutil.WriteFile(path, []byte("nameserver 10.0.0.2\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if b, _ := ioutil.ReadFile(path); bytes.Equal(b, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resolv.conf was not restored")
+		}
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// responseCache is an in-memory LRU cache of the responses to the proxied
+// GET requests that honors the Cache-Control, Expires and Vary headers, and
+// revalidates stale responses with their ETag or Last-Modified validators.
+// As it caches the responses for a single workload, responses marked
+// "private" are cached as well.
+type responseCache struct {
+	maxBytes      int64         // total size of the cached bodies
+	maxEntryBytes int64         // size of the largest body to cache
+	maxTTL        time.Duration // caps the freshness lifetime of responses
+
+	mu      sync.Mutex
+	lru     *list.List // of *cachedResponse, most recently used at the front
+	entries map[string]*list.Element
+	bytes   int64
+	stats   responseCacheStats
+}
+
+type responseCacheStats struct {
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Revalidations int64 `json:"revalidations"`
+	Evictions     int64 `json:"evictions"`
+}
+
+type cachedResponse struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	// vary has the values of the request headers listed in the Vary header.
+	vary map[string]string
+	// stored is when the response was received, with the age it already had.
+	stored time.Time
+	age    time.Duration
+	ttl    time.Duration
+	// noCache requires revalidation before each use.
+	noCache bool
+}
+
+func newResponseCache(maxBytes, maxEntryBytes int64, maxTTL time.Duration) *responseCache {
+	return &responseCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		maxTTL:        maxTTL,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+// parseCacheControl parses the Cache-Control header directives, with the
+// directive names lowercased.
+func parseCacheControl(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			parts := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if parts[0] == "" {
+				continue
+			}
+			val := ""
+			if len(parts) == 2 {
+				val = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+			}
+			out[strings.ToLower(parts[0])] = val
+		}
+	}
+	return out
+}
+
+// freshness returns the freshness lifetime of the response and whether it
+// can be cached at all.
+func (c *responseCache) freshness(resp *http.Response, now time.Time) (time.Duration, bool) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0, false
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if resp.Header.Get("vary") == "*" || resp.Header.Get("set-cookie") != "" {
+		return 0, false
+	}
+	var ttl time.Duration
+	var explicit bool
+	if v, ok := cc["max-age"]; ok {
+		if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+			ttl, explicit = time.Duration(s)*time.Second, true
+		}
+	} else if v := resp.Header.Get("expires"); v != "" {
+		explicit = true // invalid dates mean already expired
+		if exp, err := http.ParseTime(v); err == nil {
+			date := now
+			if d, err := http.ParseTime(resp.Header.Get("date")); err == nil {
+				date = d
+			}
+			if exp.After(date) {
+				ttl = exp.Sub(date)
+			}
+		}
+	}
+	if !explicit && !hasValidator(resp.Header) {
+		return 0, false
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl, true
+}
+
+func hasValidator(h http.Header) bool {
+	return h.Get("etag") != "" || h.Get("last-modified") != ""
+}
+
+// lookup returns a copy of the cached response for the request, if any.
+func (c *responseCache) lookup(key string, req *http.Request) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	e := el.Value.(*cachedResponse)
+	for name, v := range e.vary {
+		if req.Header.Get(name) != v {
+			return cachedResponse{}, false
+		}
+	}
+	c.lru.MoveToFront(el)
+	out := *e
+	out.header = e.header.Clone()
+	return out, true
+}
+
+func (e cachedResponse) fresh(now time.Time) bool {
+	return !e.noCache && e.age+now.Sub(e.stored) < e.ttl
+}
+
+// response returns the cached response to the request.
+func (e cachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	h := e.header.Clone()
+	h.Set("age", strconv.Itoa(int((e.age+now.Sub(e.stored))/time.Second)))
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// store caches the response with the body.
+func (c *responseCache) store(key string, req *http.Request, resp *http.Response, body []byte, ttl time.Duration, now time.Time) {
+	e := &cachedResponse{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		vary:    make(map[string]string),
+		stored:  now,
+		age:     responseAge(resp.Header),
+		ttl:     ttl,
+		noCache: hasDirective(resp.Header, "no-cache"),
+	}
+	for _, v := range resp.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				e.vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += int64(len(body))
+	for c.bytes > c.maxBytes && c.lru.Len() > 1 {
+		c.removeLocked(c.lru.Back().Value.(*cachedResponse).key)
+		c.stats.Evictions++
+	}
+}
+
+// refresh updates the headers and the freshness of the cached response after
+// it's revalidated with a 304 Not Modified response.
+func (c *responseCache) refresh(key string, resp *http.Response, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*cachedResponse)
+	for k, v := range resp.Header {
+		e.header[k] = v
+	}
+	e.stored, e.age, e.ttl = now, responseAge(resp.Header), ttl
+	e.noCache = hasDirective(e.header, "no-cache")
+}
+
+// invalidate removes the cached response for the key.
+func (c *responseCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *responseCache) removeLocked(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.bytes -= int64(len(el.Value.(*cachedResponse).body))
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *responseCache) count(f func(s *responseCacheStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.stats)
+}
+
+func hasDirective(h http.Header, name string) bool {
+	_, ok := parseCacheControl(h)[name]
+	return ok
+}
+
+func responseAge(h http.Header) time.Duration {
+	if s, err := strconv.Atoi(h.Get("age")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 0
+}
+
+// ServeHTTP serves the cache statistics as JSON on the admin endpoint.
+func (c *responseCache) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	c.mu.Lock()
+	stats := c.stats
+	stats.Entries, stats.Bytes = c.lru.Len(), c.bytes
+	c.mu.Unlock()
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stats); err != nil {
+		klog.V(1).Infof("failed to write response cache stats: %v", err)
+	}
+}
+
+// cachingTransport serves the GET requests from the response cache when
+// possible.
+type cachingTransport struct {
+	next  http.RoundTripper
+	cache *responseCache
+}
+
+var _ http.Flusher = cachingTransport{} // ensure it's a Flusher
+
+func (t cachingTransport) Flush() {
+	if v, ok := t.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (t cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Value(ctxKeyEarlyResponse).(*http.Response); ok {
+		return t.next.RoundTrip(req)
+	}
+	key := req.URL.String()
+	if req.Method != http.MethodGet {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions && resp.StatusCode < 400 {
+			t.cache.invalidate(key)
+		}
+		return resp, err
+	}
+	// requests with their own credentials or for partial content are not
+	// cached, nor are the ones asking not to be
+	if req.Header.Get("authorization") != "" || req.Header.Get("range") != "" || isUpgrade(req.Header) ||
+		hasDirective(req.Header, "no-store") {
+		return t.next.RoundTrip(req)
+	}
+
+	now := time.Now()
+	cached, ok := t.cache.lookup(key, req)
+	reqCC := parseCacheControl(req.Header)
+	_, reqNoCache := reqCC["no-cache"]
+	if ok && cached.fresh(now) && !reqNoCache && reqCC["max-age"] != "0" {
+		t.cache.count(func(s *responseCacheStats) { s.Hits++ })
+		klog.V(5).Infof("[cache] hit url=%s", key)
+		return cached.response(req, now), nil
+	}
+
+	outReq := req
+	revalidate := ok && hasValidator(cached.header) &&
+		req.Header.Get("if-none-match") == "" && req.Header.Get("if-modified-since") == ""
+	if revalidate {
+		outReq = req.Clone(req.Context())
+		if v := cached.header.Get("etag"); v != "" {
+			outReq.Header.Set("if-none-match", v)
+		}
+		if v := cached.header.Get("last-modified"); v != "" {
+			outReq.Header.Set("if-modified-since", v)
+		}
+	}
+	resp, err := t.next.RoundTrip(outReq)
+	if err != nil {
+		return nil, err
+	}
+	now = time.Now()
+	if revalidate && resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		merged := &http.Response{StatusCode: cached.status, Header: cached.header}
+		for k, v := range resp.Header {
+			merged.Header[k] = v
+		}
+		if ttl, ok := t.cache.freshness(merged, now); ok {
+			t.cache.refresh(key, resp, ttl, now)
+		} else {
+			t.cache.invalidate(key)
+		}
+		t.cache.count(func(s *responseCacheStats) { s.Revalidations++ })
+		klog.V(5).Infof("[cache] revalidated url=%s", key)
+		cached.header = merged.Header
+		cached.stored, cached.age = now, responseAge(resp.Header)
+		return cached.response(req, now), nil
+	}
+	t.cache.count(func(s *responseCacheStats) { s.Misses++ })
+
+	ttl, cacheable := t.cache.freshness(resp, now)
+	if !cacheable || resp.ContentLength > t.cache.maxEntryBytes || isStreamingResponse(req, resp) {
+		// reading the streamed responses to store them would hold them
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.cache.maxEntryBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.cache.maxEntryBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	t.cache.store(key, req, resp, body, ttl, now)
+	klog.V(5).Infof("[cache] stored url=%s ttl=%s", key, ttl)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
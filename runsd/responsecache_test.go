@@ -0,0 +1,178 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cacheTestBackend serves the paths with the Cache-Control header in the
+// "cc" query parameter, answers conditional requests with the ETag "v1" and
+// counts the requests and 304 responses.
+type cacheTestBackend struct {
+	mu                  sync.Mutex
+	requests, notModify int
+}
+
+func (b *cacheTestBackend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+	if cc := req.URL.Query().Get("cc"); cc != "" {
+		w.Header().Set("cache-control", cc)
+	}
+	if v := req.URL.Query().Get("vary"); v != "" {
+		w.Header().Set("vary", v)
+	}
+	if req.URL.Query().Get("etag") != "" {
+		w.Header().Set("etag", `"v1"`)
+		if req.Header.Get("if-none-match") == `"v1"` {
+			b.notModify++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write([]byte("hello " + req.Header.Get("accept-language")))
+}
+
+func (b *cacheTestBackend) counts() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests, b.notModify
+}
+
+func cacheTestGet(t *testing.T, rt http.RoundTripper, url string, hdr ...string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	return string(b)
+}
+
+func TestCachingTransport(t *testing.T) {
+	cases := []struct {
+		name         string
+		path         string
+		hdr          []string
+		wantRequests int
+		want304      int
+	}{
+		{name: "max-age", path: "/?cc=max-age=60", wantRequests: 1},
+		{name: "no-store", path: "/?cc=no-store,max-age=60", wantRequests: 3},
+		{name: "no explicit freshness", path: "/", wantRequests: 3},
+		{name: "expired, revalidated", path: "/?cc=max-age=0&etag=1", wantRequests: 3, want304: 2},
+		{name: "no-cache, revalidated", path: "/?cc=no-cache&etag=1", wantRequests: 3, want304: 2},
+		{name: "request no-cache", path: "/?cc=max-age=60&etag=1", hdr: []string{"cache-control", "no-cache"}, wantRequests: 3, want304: 2},
+		{name: "own credentials", path: "/?cc=max-age=60", hdr: []string{"authorization", "Bearer x"}, wantRequests: 3},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := new(cacheTestBackend)
+			srv := httptest.NewServer(backend)
+			defer srv.Close()
+			rt := cachingTransport{next: http.DefaultTransport, cache: newResponseCache(1<<20, 1<<10, time.Hour)}
+			for i := 0; i < 3; i++ {
+				if got := cacheTestGet(t, rt, srv.URL+tt.path, tt.hdr...); got != "hello " {
+					t.Fatalf("body = %q", got)
+				}
+			}
+			if got, got304 := backend.counts(); got != tt.wantRequests || got304 != tt.want304 {
+				t.Errorf("backend got %d requests (%d not modified), want %d (%d)", got, got304, tt.wantRequests, tt.want304)
+			}
+		})
+	}
+}
+
+func TestCachingTransportVary(t *testing.T) {
+	backend := new(cacheTestBackend)
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+	rt := cachingTransport{next: http.DefaultTransport, cache: newResponseCache(1<<20, 1<<10, time.Hour)}
+	url := srv.URL + "/?cc=max-age=60&vary=accept-language"
+
+	if got := cacheTestGet(t, rt, url, "accept-language", "en"); got != "hello en" {
+		t.Errorf("body = %q", got)
+	}
+	if got := cacheTestGet(t, rt, url, "accept-language", "tr"); got != "hello tr" {
+		t.Errorf("body = %q, want response for the new header value", got)
+	}
+	if got := cacheTestGet(t, rt, url, "accept-language", "tr"); got != "hello tr" {
+		t.Errorf("body = %q", got)
+	}
+	if got, _ := backend.counts(); got != 2 {
+		t.Errorf("backend got %d requests, want 2", got)
+	}
+}
+
+func TestCachingTransportInvalidate(t *testing.T) {
+	backend := new(cacheTestBackend)
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+	rt := cachingTransport{next: http.DefaultTransport, cache: newResponseCache(1<<20, 1<<10, time.Hour)}
+	url := srv.URL + "/?cc=max-age=60"
+
+	cacheTestGet(t, rt, url)
+	req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader("x"))
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cacheTestGet(t, rt, url)
+	if got, _ := backend.counts(); got != 3 {
+		t.Errorf("backend got %d requests, want 3 (put invalidates the cached response)", got)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(10, 10, time.Hour)
+	now := time.Unix(1000, 0)
+	req, _ := http.NewRequest(http.MethodGet, "https://hello-xyz-uc.a.run.app/", nil)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	c.store("a", req, resp, []byte("12345"), time.Minute, now)
+	c.store("b", req, resp, []byte("12345"), time.Minute, now)
+	c.lookup("a", req) // a is now the most recently used
+	c.store("c", req, resp, []byte("12345"), time.Minute, now)
+	if _, ok := c.lookup("b", req); ok {
+		t.Error("least recently used entry should be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.lookup(k, req); !ok {
+			t.Errorf("entry %s should be cached", k)
+		}
+	}
+	if c.bytes != 10 || c.stats.Evictions != 1 {
+		t.Errorf("bytes=%d evictions=%d", c.bytes, c.stats.Evictions)
+	}
+}
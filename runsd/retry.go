@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// retryPolicy configures which proxied requests are retried and how.
+type retryPolicy struct {
+	// maxAttempts is the number of times a request is sent, including the
+	// first attempt. Values less than 2 disable retries.
+	maxAttempts int
+	// methods are the (idempotent) request methods that are retried.
+	methods map[string]bool
+	// statusCodes are the response status codes that are retried. Failed
+	// round trips (e.g. connection errors) are always retried.
+	statusCodes map[int]bool
+	// backoff is the maximum delay before the first retry, doubled for each
+	// following attempt up to maxBackoff. A random delay up to this value is
+	// used.
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// maxBodyBytes is the size of the largest request body kept (as it is
+	// sent) to be replayed on retries. Requests with larger bodies are not
+	// retried.
+	maxBodyBytes int64
+}
+
+// parseRetryPolicy parses the comma-separated methods and status codes of the
+// retry policy.
+func parseRetryPolicy(maxAttempts int, methods, statusCodes string, backoff, maxBackoff time.Duration, maxBodyBytes int64) (retryPolicy, error) {
+	p := retryPolicy{
+		maxAttempts:  maxAttempts,
+		methods:      make(map[string]bool),
+		statusCodes:  make(map[int]bool),
+		backoff:      backoff,
+		maxBackoff:   maxBackoff,
+		maxBodyBytes: maxBodyBytes,
+	}
+	for _, m := range strings.Split(methods, ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			p.methods[m] = true
+		}
+	}
+	for _, v := range strings.Split(statusCodes, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 100 || code > 599 {
+			return p, fmt.Errorf("invalid status code %q", v)
+		}
+		p.statusCodes[code] = true
+	}
+	if backoff < 0 || maxBackoff < backoff {
+		return p, fmt.Errorf("invalid backoff=%s max_backoff=%s", backoff, maxBackoff)
+	}
+	return p, nil
+}
+
+func (p retryPolicy) enabled() bool { return p.maxAttempts > 1 }
+
+// delay returns the time to wait before the retry after the given number of
+// attempts, honoring the Retry-After header of the response (if any) when it
+// is not longer than maxBackoff.
+func (p retryPolicy) delay(attempts int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("retry-after")); err == nil && s >= 0 {
+			if d := time.Duration(s) * time.Second; d <= p.maxBackoff {
+				return d
+			}
+		}
+	}
+	d := p.backoff
+	for i := 1; i < attempts && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// retryTransport retries the requests per the policy with exponential
+// backoff.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy retryPolicy
+}
+
+var _ http.Flusher = retryTransport{} // ensure it's a Flusher
+
+func (r retryTransport) Flush() {
+	if v, ok := r.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (r retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !r.policy.methods[req.Method] || isUpgrade(req.Header) {
+		return r.next.RoundTrip(req)
+	}
+	// the body is streamed to the backend as it arrives, and recorded to be
+	// replayed only if it was sent entirely
+	var body *replayableBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &replayableBody{ReadCloser: req.Body, maxBytes: r.policy.maxBodyBytes}
+		req.Body = body
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := r.next.RoundTrip(req)
+		if attempt >= r.policy.maxAttempts || !r.retryable(resp, err) {
+			return resp, err
+		}
+		if body != nil {
+			replay, ok := body.replay()
+			if !ok {
+				klog.V(3).Infof("[retry] not retrying %s url=%s, the request body was not sent entirely or is larger than %d bytes",
+					req.Method, req.URL, r.policy.maxBodyBytes)
+				return resp, err
+			}
+			req.Body = replay
+		}
+		wait := r.policy.delay(attempt, resp)
+		if err != nil {
+			klog.V(3).Infof("[retry] attempt %d/%d for %s url=%s failed: %v, retrying in %s",
+				attempt, r.policy.maxAttempts, req.Method, req.URL, err, wait)
+		} else {
+			klog.V(3).Infof("[retry] attempt %d/%d for %s url=%s got status=%d, retrying in %s",
+				attempt, r.policy.maxAttempts, req.Method, req.URL, resp.StatusCode, wait)
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r retryTransport) retryable(resp *http.Response, err error) bool {
+	return err != nil || r.policy.statusCodes[resp.StatusCode]
+}
+
+// replayableBody records the request body as the transport reads it (rather
+// than buffering it up front, which would hold the streamed bodies), so that
+// it can be sent again if it was read entirely and is at most maxBytes.
+type replayableBody struct {
+	io.ReadCloser
+	maxBytes int64
+
+	mu        sync.Mutex // the transport may still be reading the body
+	buf       bytes.Buffer
+	truncated bool
+	eof       bool
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.truncated && int64(b.buf.Len()+n) > b.maxBytes {
+		b.truncated = true
+		b.buf = bytes.Buffer{}
+	} else if !b.truncated {
+		b.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// replay returns a copy of the body if it was read entirely.
+func (b *replayableBody) replay() (io.ReadCloser, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.eof || b.truncated {
+		return nil, false
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.buf.Bytes())), true
+}
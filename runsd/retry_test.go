@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// sequenceTransport responds with the status codes in order (0 for an error)
+// and records the request bodies it receives (or responds without reading
+// them if unread is set).
+type sequenceTransport struct {
+	statuses []int
+	bodies   []string
+	unread   bool
+}
+
+func (s *sequenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	if req.Body != nil && !s.unread {
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	}
+	s.bodies = append(s.bodies, body)
+	code := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	if code == 0 {
+		return nil, errors.New("connection reset")
+	}
+	return &http.Response{StatusCode: code, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func testRetryPolicy(t *testing.T, maxBodyBytes int64) retryPolicy {
+	t.Helper()
+	p, err := parseRetryPolicy(3, "GET,PUT", "429,503", time.Millisecond, 5*time.Millisecond, maxBodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRetryTransport(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		body       string
+		maxBody    int64
+		unread     bool
+		statuses   []int
+		wantStatus int
+		wantBodies []string
+	}{
+		{name: "success", method: "GET", statuses: []int{200}, wantStatus: 200, wantBodies: []string{""}},
+		{name: "retried until success", method: "GET", statuses: []int{503, 0, 200}, wantStatus: 200, wantBodies: []string{"", "", ""}},
+		{name: "gives up after max attempts", method: "GET", statuses: []int{429}, wantStatus: 429, wantBodies: []string{"", "", ""}},
+		{name: "status not retried", method: "GET", statuses: []int{500, 200}, wantStatus: 500, wantBodies: []string{""}},
+		{name: "method not retried", method: "POST", statuses: []int{503, 200}, wantStatus: 503, wantBodies: []string{""}},
+		{name: "body replayed", method: "PUT", body: "hello", maxBody: 10, statuses: []int{503, 200}, wantStatus: 200, wantBodies: []string{"hello", "hello"}},
+		{name: "large body not retried", method: "PUT", body: "hello world", maxBody: 10, statuses: []int{503, 200}, wantStatus: 503, wantBodies: []string{"hello world"}},
+		{name: "body not sent entirely not retried", method: "PUT", body: "hello", maxBody: 10, unread: true, statuses: []int{503, 200}, wantStatus: 503, wantBodies: []string{""}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &sequenceTransport{statuses: tt.statuses, unread: tt.unread}
+			rt := retryTransport{next: next, policy: testRetryPolicy(t, tt.maxBody)}
+			req, _ := http.NewRequest(tt.method, "https://hello-xyz-uc.a.run.app/", strings.NewReader(tt.body))
+			if tt.body == "" {
+				req.Body = nil
+			}
+			req.ContentLength = -1 // unknown, as with chunked requests
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if diff := cmp.Diff(tt.wantBodies, next.bodies); diff != "" {
+				t.Errorf("request bodies (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempts, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 5: time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := p.delay(attempts, nil); d <= 0 || d > max {
+				t.Errorf("delay(%d) = %s, want in (0,%s]", attempts, d, max)
+			}
+		}
+	}
+	resp := &http.Response{Header: http.Header{"Retry-After": {"1"}}}
+	if d := p.delay(1, resp); d != time.Second {
+		t.Errorf("delay with retry-after = %s, want 1s", d)
+	}
+	resp.Header.Set("retry-after", "30")
+	if d := p.delay(1, resp); d > 100*time.Millisecond {
+		t.Errorf("delay with long retry-after = %s, want backoff", d)
+	}
+}
+
+func TestParseRetryPolicy(t *testing.T) {
+	p, err := parseRetryPolicy(2, "get, put", "503", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.enabled() || !p.methods["GET"] || !p.methods["PUT"] || !p.statusCodes[503] {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+	if _, err := parseRetryPolicy(2, "GET", "abc", 0, 0, 0); err == nil {
+		t.Error("expected error for invalid status code")
+	}
+	if _, err := parseRetryPolicy(2, "GET", "503", time.Second, time.Millisecond, 0); err == nil {
+		t.Error("expected error for max backoff shorter than backoff")
+	}
+}
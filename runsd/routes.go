@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	ctxKeyNoAuth        = `no-auth`
+	ctxKeyOverwriteAuth = `overwrite-auth`
+	ctxKeyAccessToken   = `access-token`
+	ctxKeyAudience      = `audience`
+	ctxKeyImpersonate   = `impersonate`
+	ctxKeyFakeIdentity  = `fake-identity`
+)
+
+// routeSpec is the entry for a name in the -routes_file.
+type routeSpec struct {
+	URL    string `json:"url"`
+	NoAuth bool   `json:"noAuth"`
+
+	// ClientCert and ClientKey are the PEM files of the client certificate
+	// presented to a backend requiring mutual TLS.
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+
+	// ClientSubjectHeader and ClientSANHeader are the headers to forward the
+	// subject and the SANs of the client certificates verified by the
+	// -https_proxy_port listener to the backend in.
+	ClientSubjectHeader string `json:"clientSubjectHeader"`
+	ClientSANHeader     string `json:"clientSANHeader"`
+}
+
+// route is the backend an internal name is proxied to instead of its run.app
+// URL.
+type route struct {
+	target *url.URL
+	// noAuth disables adding an ID token to the requests.
+	noAuth bool
+	// clientCert, if set, is presented to the backend in the TLS handshake.
+	clientCert *tls.Certificate
+	// subjectHeader and sanHeader, if set, are the headers the client
+	// certificate details are forwarded in.
+	subjectHeader, sanHeader string
+}
+
+// routes maps the internal names in the "svc" (current region) or
+// "svc.region" form to their backends.
+type routes map[string]route
+
+// loadRoutes reads a JSON file of internal names to their backends, e.g.
+// {"ledger": {"url": "http://10.128.0.9:8080", "noAuth": true}}, or with
+// "clientCert" and "clientKey" files for backends requiring mutual TLS (and
+// optionally "clientSubjectHeader" and "clientSANHeader").
+func loadRoutes(path string) (routes, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string]routeSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse routes file %s: %w", path, err)
+	}
+	out := make(routes, len(specs))
+	for name, spec := range specs {
+		name = strings.ToLower(name)
+		if parts := strings.Split(name, "."); len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid route for %q: not in SVC or SVC.REGION form", name)
+		}
+		u, err := url.Parse(spec.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route for %s: %w", name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid route for %s: url %q is not in http(s)://HOST[:PORT] form", name, spec.URL)
+		}
+		rt := route{target: &url.URL{Scheme: u.Scheme, Host: u.Host}, noAuth: spec.NoAuth}
+		if spec.ClientCert != "" || spec.ClientKey != "" {
+			if spec.ClientCert == "" || spec.ClientKey == "" {
+				return nil, fmt.Errorf("invalid route for %s: clientCert and clientKey must be set together", name)
+			}
+			if u.Scheme != "https" {
+				return nil, fmt.Errorf("invalid route for %s: client certificates require an https url", name)
+			}
+			cert, err := tls.LoadX509KeyPair(spec.ClientCert, spec.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route for %s: failed to load client certificate: %w", name, err)
+			}
+			rt.clientCert = &cert
+		}
+		if spec.ClientSubjectHeader != "" || spec.ClientSANHeader != "" {
+			// the backend can only trust these headers if it authenticates
+			// runsd
+			if rt.clientCert == nil {
+				return nil, fmt.Errorf("invalid route for %s: clientSubjectHeader and clientSANHeader require clientCert", name)
+			}
+			rt.subjectHeader = http.CanonicalHeaderKey(spec.ClientSubjectHeader)
+			rt.sanHeader = http.CanonicalHeaderKey(spec.ClientSANHeader)
+		}
+		out[name] = rt
+	}
+	klog.V(1).Infof("loaded %d route(s) from %s", len(out), path)
+	return out, nil
+}
+
+// lookup returns the route for the internal hostname.
+func (r routes) lookup(hostname, domain, curRegion string) (route, bool) {
+	if len(r) == 0 {
+		return route{}, false
+	}
+	name := strings.TrimSuffix(strings.ToLower(hostname), "."+strings.Trim(domain, "."))
+	svc, region := name, curRegion
+	if parts := strings.Split(name, "."); len(parts) == 2 {
+		svc, region = parts[0], parts[1]
+	} else if len(parts) > 2 {
+		return route{}, false
+	}
+	v, ok := r[svc+"."+region]
+	if !ok && region == curRegion {
+		v, ok = r[svc]
+	}
+	return v, ok
+}
+
+// setClientIdentity sets the headers of the route to the subject and the SANs
+// of the verified client certificate of the request, after removing the ones
+// sent by the client.
+func (rt route) setClientIdentity(req *http.Request) {
+	for _, h := range []string{rt.subjectHeader, rt.sanHeader} {
+		if h != "" {
+			req.Header.Del(h)
+		}
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	if rt.subjectHeader != "" {
+		req.Header.Set(rt.subjectHeader, cert.Subject.String())
+	}
+	if sans := certSANs(cert); rt.sanHeader != "" && len(sans) > 0 {
+		req.Header.Set(rt.sanHeader, strings.Join(sans, ","))
+	}
+}
+
+// certSANs returns the subject alternative names of the certificate in the
+// DNS:name, email:address, IP:address and URI:uri forms.
+func certSANs(cert *x509.Certificate) []string {
+	var out []string
+	for _, v := range cert.DNSNames {
+		out = append(out, "DNS:"+v)
+	}
+	for _, v := range cert.EmailAddresses {
+		out = append(out, "email:"+v)
+	}
+	for _, v := range cert.IPAddresses {
+		out = append(out, "IP:"+v.String())
+	}
+	for _, v := range cert.URIs {
+		out = append(out, "URI:"+v.String())
+	}
+	return out
+}
+
+// clientCertTransport sends the requests to the backends with a client
+// certificate over their own transport (as a tls.Config can't pick the
+// certificate by the server name), and the others over the next transport.
+type clientCertTransport struct {
+	next   http.RoundTripper
+	byHost map[string]http.RoundTripper
+}
+
+// transport returns base, or a clientCertTransport wrapping it if any of the
+// routes have a client certificate.
+func (r routes) transport(base *http.Transport) http.RoundTripper {
+	byHost := make(map[string]http.RoundTripper)
+	for _, rt := range r {
+		if rt.clientCert == nil {
+			continue
+		}
+		tr := base.Clone()
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = new(tls.Config)
+		}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{*rt.clientCert}
+		byHost[rt.target.Host] = tr
+	}
+	if len(byHost) == 0 {
+		return base
+	}
+	return clientCertTransport{next: base, byHost: byHost}
+}
+
+func (c clientCertTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr, ok := c.byHost[req.URL.Host]; ok && req.URL.Scheme == "https" {
+		return tr.RoundTrip(req)
+	}
+	return c.next.RoundTrip(req)
+}
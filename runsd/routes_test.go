@@ -0,0 +1,265 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeTempFile(t, dir, "routes.json", `{
+		"Ledger": {"url": "http://10.128.0.9:8080", "noAuth": true},
+		"orders.europe-west1": {"url": "https://orders.internal.example.com/"}
+	}`)
+	r, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := r.lookup("ledger.us-central1.run.internal", "run.internal.", "us-central1")
+	if !ok || v.target.String() != "http://10.128.0.9:8080" || !v.noAuth {
+		t.Fatalf("ledger: got=%+v ok=%v", v, ok)
+	}
+	if _, ok := r.lookup("ledger.europe-west1", "run.internal.", "us-central1"); ok {
+		t.Error("route for ledger should only apply in the current region")
+	}
+	v, ok = r.lookup("orders.europe-west1", "run.internal.", "us-central1")
+	if !ok || v.target.String() != "https://orders.internal.example.com" || v.noAuth {
+		t.Fatalf("orders: got=%+v ok=%v", v, ok)
+	}
+}
+
+func TestLoadRoutesInvalid(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, content := range []string{
+		`{"ledger": {"url": "10.128.0.9:8080"}}`,
+		`{"ledger": {"url": "ftp://10.128.0.9"}}`,
+		`{"ledger": {"url": "http://10.128.0.9/api"}}`,
+		`{"ledger.us-central1.run.internal": {"url": "http://10.128.0.9"}}`,
+		`{"ledger": {"url": "https://10.128.0.9", "clientCert": "cert.pem"}}`,
+		`{"ledger": {"url": "https://10.128.0.9", "clientCert": "missing.pem", "clientKey": "missing.pem"}}`,
+		`{"ledger": {"url": "https://10.128.0.9", "clientSubjectHeader": "X-Client-Subject"}}`,
+	} {
+		path := writeTempFile(t, dir, "routes.json", content)
+		if _, err := loadRoutes(path); err == nil {
+			t.Errorf("expected error for %s", content)
+		}
+	}
+}
+
+func TestReverseProxyBackendRoutes(t *testing.T) {
+	rp := newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")
+	rp.aliases = serviceAliases{"books": "ledger"}
+	rp.routes = routes{"ledger": {target: &url.URL{Scheme: "http", Host: "10.128.0.9:8080"}, noAuth: true}}
+	scheme, host, err := rp.backend("books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheme != "http" || host != "10.128.0.9:8080" {
+		t.Errorf("got=%s://%s", scheme, host)
+	}
+	if !rp.noAuth("books.us-central1.run.internal.") {
+		t.Error("expected no auth for alias of ledger")
+	}
+	if rp.noAuth("hello") {
+		t.Error("expected auth for hello")
+	}
+}
+
+// writeClientCert writes a certificate (issued for name) and its key to dir.
+func writeClientCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	ca, err := newLocalCA([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.issue(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeTempFile(t, dir, "client.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+	keyFile = writeTempFile(t, dir, "client.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})))
+	return certFile, keyFile
+}
+
+func TestRoutesTransportClientCert(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := writeClientCert(t, dir, "runsd-client")
+	path := writeTempFile(t, dir, "routes.json", `{"ledger": {"url": "`+backend.URL+`",
+		"clientCert": "`+filepath.ToSlash(certFile)+`", "clientKey": "`+filepath.ToSlash(keyFile)+`"}}`)
+	r, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := backend.Client().Transport.(*http.Transport)
+	for _, tt := range []struct {
+		name string
+		r    routes
+		want string
+	}{
+		{"with client cert", r, "runsd-client"},
+		{"without routes", nil, ""},
+		{"other host", routes{"ledger": {target: &url.URL{Scheme: "https", Host: "10.0.0.1"}, clientCert: r["ledger"].clientCert}}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://"+u.Host, nil)
+			resp, err := tt.r.transport(base).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			if string(b) != tt.want {
+				t.Errorf("client cert cn=%q, want=%q", b, tt.want)
+			}
+		})
+	}
+}
+
+// issueClientCert returns a client certificate issued by ca.
+func issueClientCert(t *testing.T, ca *localCA) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe, _ := url.Parse("spiffe://example.com/app")
+	tpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: "app", Organization: []string{"example"}},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:       []string{"app.example.com"},
+		EmailAddresses: []string{"app@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestProxyClientIdentityHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	}))
+	defer backend.Close()
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+	}
+
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.routes = routes{
+		"ledger": {target: &url.URL{Scheme: "https", Host: "ledger.example.com"}, noAuth: true,
+			subjectHeader: "X-Client-Subject", sanHeader: "X-Client-San"},
+	}
+	ca, err := newLocalCA([]string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	proxy := httptest.NewUnstartedServer(rp.newReverseProxyHandler(tr))
+	proxy.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	cases := []struct {
+		name        string
+		host        string
+		certs       []tls.Certificate
+		wantSubject string
+		wantSAN     string
+	}{
+		{name: "verified client cert", host: "ledger", certs: []tls.Certificate{issueClientCert(t, ca)},
+			wantSubject: "CN=app,O=example", wantSAN: "DNS:app.example.com,email:app@example.com,URI:spiffe://example.com/app"},
+		{name: "no client cert", host: "ledger"},
+		{name: "route without the headers", host: "hello", certs: []tls.Certificate{issueClientCert(t, ca)}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("CLOUD_RUN_ID_TOKEN", "test-token")
+			defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+			tr := proxy.Client().Transport.(*http.Transport).Clone()
+			tr.TLSClientConfig.Certificates = tt.certs
+			client := &http.Client{Transport: tr}
+			req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			req.Host = tt.host
+			req.Header.Set("X-Client-Subject", "CN=spoofed")
+			req.Header.Set("X-Client-San", "DNS:spoofed")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if tt.host != "ledger" {
+				if got.Get("X-Client-Subject") != "CN=spoofed" {
+					t.Errorf("headers of the routes without client identity headers should be passed through, got=%q", got.Get("X-Client-Subject"))
+				}
+				return
+			}
+			if v := got.Get("X-Client-Subject"); v != tt.wantSubject {
+				t.Errorf("subject=%q, want=%q", v, tt.wantSubject)
+			}
+			if v := got.Get("X-Client-San"); v != tt.wantSAN {
+				t.Errorf("san=%q, want=%q", v, tt.wantSAN)
+			}
+		})
+	}
+}
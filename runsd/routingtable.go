@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// routingTableEntry is a name with a configured backend.
+type routingTableEntry struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"` // hosts, alias, route or traffic_split
+	Target  string `json:"target"`
+	NoAuth  bool   `json:"noAuth,omitempty"`
+	Weights string `json:"weights,omitempty"`
+}
+
+// routingTable lists the names with configured backends.
+func (rp *reverseProxy) routingTable() []routingTableEntry {
+	var out []routingTableEntry
+	for name, v := range rp.hosts {
+		if v.target != nil {
+			out = append(out, routingTableEntry{Name: name, Kind: "hosts", Target: v.target.String()})
+		}
+	}
+	for name, target := range rp.aliases {
+		out = append(out, routingTableEntry{Name: name, Kind: "alias", Target: target})
+	}
+	for name, v := range rp.routes {
+		out = append(out, routingTableEntry{Name: name, Kind: "route", Target: v.target.String(), NoAuth: v.noAuth})
+	}
+	for name, s := range rp.trafficSplits {
+		var weights string
+		for i, tag := range s.tags {
+			if i > 0 {
+				weights += ","
+			}
+			weights += tag + "=" + strconv.Itoa(s.weights[i])
+		}
+		out = append(out, routingTableEntry{Name: name, Kind: "traffic_split", Target: name, Weights: weights})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Kind < out[j].Kind
+	})
+	return out
+}
+
+// serveRoutingTable serves the routing table on the admin endpoint, and with
+// ?name=NAME, the backend the requests for NAME are proxied to.
+func (rp *reverseProxy) serveRoutingTable(w http.ResponseWriter, req *http.Request) {
+	type lookup struct {
+		Name    string `json:"name"`
+		Backend string `json:"backend,omitempty"`
+		NoAuth  bool   `json:"noAuth,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}
+	v := struct {
+		ProjectHash   string              `json:"projectHash"`
+		CurrentRegion string              `json:"currentRegion"`
+		Domain        string              `json:"domain"`
+		Entries       []routingTableEntry `json:"entries"`
+		Lookup        *lookup             `json:"lookup,omitempty"`
+	}{
+		ProjectHash:   rp.projectHash,
+		CurrentRegion: rp.currentRegion,
+		Domain:        rp.internalDomain,
+		Entries:       rp.routingTable(),
+	}
+	if name := req.URL.Query().Get("name"); name != "" {
+		v.Lookup = &lookup{Name: name}
+		if scheme, host, err := rp.backend(name); err != nil {
+			v.Lookup.Error = err.Error()
+		} else {
+			v.Lookup.Backend, v.Lookup.NoAuth = scheme+"://"+host, rp.noAuth(name)
+		}
+	}
+	writeAdminJSON(w, v)
+}
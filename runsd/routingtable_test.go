@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestServeRoutingTable(t *testing.T) {
+	rp := newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")
+	rp.hosts = hostOverrides{"api.example.com": {target: &url.URL{Scheme: "https", Host: "api-dpyb4duzqq-uc.a.run.app"}}}
+	rp.aliases = serviceAliases{"books": "ledger"}
+	rp.routes = routes{"ledger": {target: &url.URL{Scheme: "http", Host: "10.128.0.9:8080"}, noAuth: true}}
+	rp.trafficSplits = trafficSplits{"search": {tags: []string{"canary", "stable"}, weights: []int{10, 90}, total: 100}}
+
+	rec := httptest.NewRecorder()
+	rp.serveRoutingTable(rec, httptest.NewRequest(http.MethodGet, "/routes?name=books", nil))
+	var got struct {
+		CurrentRegion string              `json:"currentRegion"`
+		Entries       []routingTableEntry `json:"entries"`
+		Lookup        struct {
+			Backend string `json:"backend"`
+			NoAuth  bool   `json:"noAuth"`
+		} `json:"lookup"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []routingTableEntry{
+		{Name: "api.example.com", Kind: "hosts", Target: "https://api-dpyb4duzqq-uc.a.run.app"},
+		{Name: "books", Kind: "alias", Target: "ledger"},
+		{Name: "ledger", Kind: "route", Target: "http://10.128.0.9:8080", NoAuth: true},
+		{Name: "search", Kind: "traffic_split", Target: "search", Weights: "canary=10,stable=90"},
+	}
+	if diff := cmp.Diff(want, got.Entries); diff != "" {
+		t.Errorf("entries (-want,+got):\n%s", diff)
+	}
+	if got.CurrentRegion != "us-central1" || got.Lookup.Backend != "http://10.128.0.9:8080" || !got.Lookup.NoAuth {
+		t.Errorf("unexpected response: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// runAppZone is the zone of the URLs Cloud Run assigns to the services.
+const runAppZone = "run.app."
+
+// connectDialTimeout is how long dialing the destination of a CONNECT request
+// can take.
+const connectDialTimeout = 10 * time.Second
+
+// isRunAppHost reports whether the hostname is in the run.app zone, such as
+// the URL of a service (e.g. hello-2wvlk7vg3a-uc.a.run.app).
+func isRunAppHost(hostname string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(hostname), "."), "."+strings.TrimSuffix(runAppZone, "."))
+}
+
+// handleRunApp answers the queries for the run.app names with the addresses
+// of the reverse proxy (with -run_app_auth), so that the requests made with
+// the run.app URLs of the services get an ID token too.
+func (d *dnsHijack) handleRunApp(w dns.ResponseWriter, msg *dns.Msg) {
+	if len(msg.Question) != 1 || !isRunAppHost(msg.Question[0].Name) {
+		d.recurse(w, msg)
+		return
+	}
+	q := msg.Question[0]
+	klog.V(5).Infof("[dns] < RUNAPP type=%v name=%v", dns.TypeToString[q.Qtype], q.Name)
+	d.answerAddrs(w, msg, d.proxyIPs(q.Name))
+}
+
+// connectProxy handles the CONNECT requests of the apps using the reverse
+// proxy as their HTTPS_PROXY (with -mode=localdev and -run_app_auth). The
+// connections to the run.app names and the internal names (including the
+// custom domains) are terminated with a certificate of the local CA and their
+// requests are served by the reverse proxy with an ID token, and the others
+// are tunneled to their destination.
+type connectProxy struct {
+	rp *reverseProxy
+	ca *localCA
+	// http serves the terminated connections.
+	http *http.Server
+	// dial connects to the other destinations, defaults to net.Dialer.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (c *connectProxy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			next.ServeHTTP(w, req)
+			return
+		}
+		c.serveConnect(w, req)
+	})
+}
+
+// terminates reports whether the connections to the host are served by the
+// reverse proxy rather than tunneled.
+func (c *connectProxy) terminates(host string) bool {
+	return isRunAppHost(host) || c.rp.isInternalName(host)
+}
+
+func (c *connectProxy) serveConnect(w http.ResponseWriter, req *http.Request) {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "443"
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "runsd: CONNECT is only supported over HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	var backend net.Conn
+	addr := net.JoinHostPort(host, port)
+	if !c.terminates(host) {
+		dial := c.dial
+		if dial == nil {
+			dial = new(net.Dialer).DialContext
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), connectDialTimeout)
+		backend, err = dial(ctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			klog.V(3).Infof("[connect] failed to dial %s: %v", addr, err)
+			newProxyError(http.StatusBadGateway, errCodeUpstreamFailed, addr,
+				fmt.Sprintf("failed to connect to %s: %v", addr, err)).write(w)
+			return
+		}
+		defer backend.Close()
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		klog.V(3).Infof("[connect] failed to hijack the connection to %s: %v", addr, err)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	client := bufferedConn{Conn: conn, r: brw.Reader}
+	if backend == nil {
+		klog.V(5).Infof("[connect] serving connection to %s with the reverse proxy", addr)
+		c.http.Serve(&singleConnListener{conn: tls.Server(client, &tls.Config{
+			GetCertificate: c.ca.GetCertificate,
+			NextProtos:     []string{"http/1.1"},
+		})})
+		return
+	}
+	defer conn.Close()
+	klog.V(5).Infof("[connect] tunneling connection to %s", addr)
+	tunnel(client, backend)
+}
+
+// bufferedConn is a net.Conn reading from r, which buffers the data read from
+// the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// CloseWrite half-closes the underlying connection, if supported.
+func (c bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// runAppProxyEnv returns the environment with HTTPS_PROXY set to the reverse
+// proxy at proxyAddr (unless it is already set), for the apps to connect to
+// the run.app URLs through it.
+func runAppProxyEnv(environ []string, proxyAddr string) []string {
+	for _, kv := range environ {
+		if k := strings.SplitN(kv, "=", 2)[0]; strings.EqualFold(k, "HTTPS_PROXY") {
+			return environ
+		}
+	}
+	out := append([]string(nil), environ...)
+	return append(out, "HTTPS_PROXY=http://"+proxyAddr, "https_proxy=http://"+proxyAddr)
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestIsRunAppHost(t *testing.T) {
+	cases := map[string]bool{
+		"hello-2wvlk7vg3a-uc.a.run.app":             true,
+		"Hello-2wvlk7vg3a-UC.a.run.app.":            true,
+		"hello-123456789.us-central1.run.app":       true,
+		"run.app":                                   false,
+		"hello":                                     false,
+		"hello.us-central1.run.internal":            false,
+		"hello-2wvlk7vg3a-uc.a.run.app.example.com": false,
+		"notrun.app":                                false,
+	}
+	for host, want := range cases {
+		if got := isRunAppHost(host); got != want {
+			t.Errorf("isRunAppHost(%s)=%v, want=%v", host, got, want)
+		}
+	}
+}
+
+func TestDNSRunApp(t *testing.T) {
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		runAppAuth: true,
+	})
+	defer shutdown()
+	r := resolver(dnsSrv)
+
+	for _, name := range []string{"hello-2wvlk7vg3a-uc.a.run.app.", "hello-123456789.us-central1.run.app."} {
+		got, err := r.LookupHost(context.TODO(), name)
+		if err != nil {
+			t.Fatalf("LookupHost(%s): %v", name, err)
+		}
+		if want := []string{"127.0.0.1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost(%s)=%v, want=%v", name, got, want)
+		}
+	}
+}
+
+func TestReverseProxyBackendRunApp(t *testing.T) {
+	rp := newReverseProxy("2wvlk7vg3a", "us-central1", "run.internal.")
+	if _, _, err := rp.backend("hello-2wvlk7vg3a-uc.a.run.app"); err == nil {
+		t.Error("expected error for a run.app name without -run_app_auth")
+	}
+	rp.runAppAuth = true
+	if scheme, host, err := rp.backend("Hello-2wvlk7vg3a-uc.a.run.app."); err != nil || scheme != "https" || host != "hello-2wvlk7vg3a-uc.a.run.app" {
+		t.Errorf("got=%s://%s err=%v", scheme, host, err)
+	}
+	if _, host, err := rp.backend("hello"); err != nil || host != "hello-2wvlk7vg3a-uc.a.run.app" {
+		t.Errorf("internal name: got=%s err=%v", host, err)
+	}
+	if rp.noAuth("hello-2wvlk7vg3a-uc.a.run.app") {
+		t.Error("expected the run.app names to get an ID token")
+	}
+}
+
+func TestProxyRunAppAuth(t *testing.T) {
+	var gotHost, gotAuth string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHost, gotAuth = req.Host, req.Header.Get("authorization")
+	})
+	rp := newReverseProxy("2wvlk7vg3a", "us-central1", "run.internal.")
+	rp.runAppAuth = true
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	req, _ := http.NewRequest(http.MethodGet, proxyURL, nil)
+	req.Host = "users-2wvlk7vg3a-ew.a.run.app"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d", resp.StatusCode)
+	}
+	if gotHost != "users-2wvlk7vg3a-ew.a.run.app" {
+		t.Errorf("backend got host=%q", gotHost)
+	}
+	if gotAuth != "Bearer test-token" {
+		t.Errorf("backend got authorization=%q", gotAuth)
+	}
+}
+
+func TestConnectProxy(t *testing.T) {
+	ca, err := newLocalCA([]string{"run.app", "run.internal", "us-central1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneled := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("tunneled"))
+	}))
+	defer tunneled.Close()
+
+	served := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		w.Write([]byte(proto + " " + req.Host))
+	})
+	cp := &connectProxy{
+		rp:   newReverseProxy("hash", "us-central1", "run.internal."),
+		ca:   ca,
+		http: &http.Server{Handler: served},
+	}
+	proxy := httptest.NewServer(cp.handler(served))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.certPEM)
+	pool.AddCert(tunneled.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://hello-2wvlk7vg3a-uc.a.run.app/", want: "https hello-2wvlk7vg3a-uc.a.run.app"},
+		{url: "https://billing.us-central1/", want: "https billing.us-central1"},
+		{url: tunneled.URL, want: "tunneled"},
+		{url: "http://hello-2wvlk7vg3a-uc.a.run.app/", want: "http hello-2wvlk7vg3a-uc.a.run.app"},
+	}
+	for _, tt := range cases {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.url, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tt.want {
+			t.Errorf("GET %s: got=%q, want=%q", tt.url, b, tt.want)
+		}
+	}
+
+	if _, err := client.Get("https://127.0.0.1:1/"); err == nil {
+		t.Error("expected error connecting to an unreachable destination")
+	}
+}
+
+func TestRunAppProxyEnv(t *testing.T) {
+	got := runAppProxyEnv([]string{"PATH=/bin"}, "127.0.0.1:8080")
+	want := []string{"PATH=/bin", "HTTPS_PROXY=http://127.0.0.1:8080", "https_proxy=http://127.0.0.1:8080"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	existing := []string{"PATH=/bin", "https_proxy=http://proxy:3128"}
+	if got := runAppProxyEnv(existing, "127.0.0.1:8080"); !reflect.DeepEqual(got, existing) {
+		t.Errorf("expected the existing proxy to be kept, got=%v", got)
+	}
+}
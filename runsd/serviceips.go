@@ -0,0 +1,233 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// serviceIPs allocates a loopback address to each internal name, and serves
+// the reverse proxy for the name on that address. This way the proxy doesn't
+// need to own a port on 127.0.0.1 (e.g. 80) and the requests are routed by
+// their destination address instead of the Host header.
+type serviceIPs struct {
+	ports          []string
+	maxHeaderBytes int
+	// idleTimeout is how long an address is kept for a name without queries
+	// or connections for it, after which it is released for other names.
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	base    net.IP // first address, serving the proxy for any Host
+	next    uint32 // next address to allocate
+	last    uint32 // last address in the range
+	free    []net.IP
+	byName  map[string]*serviceIP
+	handler http.Handler // nil until serve is called
+	servers []*http.Server
+}
+
+// serviceIP is the address allocated to a name.
+type serviceIP struct {
+	ip       net.IP
+	servers  []*http.Server
+	lastUsed time.Time
+	conns    int // open connections
+}
+
+// defaultServiceIPIdleTimeout is much longer than the TTL of the answers, so
+// that the clients don't use a released address from their cache.
+const defaultServiceIPIdleTimeout = 30 * time.Minute
+
+// newServiceIPs returns an allocator for the addresses in cidr, which must be
+// in 127.0.0.0/8 and not contain 127.0.0.1. The first address in the range is
+// not allocated to a name, but serves the proxy like 127.0.0.1 would (e.g. for
+// the health checks).
+func newServiceIPs(cidr string, ports []string) (*serviceIPs, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	if ip4 == nil || !ip4.IsLoopback() || len(ipnet.Mask) != net.IPv4len {
+		return nil, fmt.Errorf("%s is not in 127.0.0.0/8", cidr)
+	}
+	if ipnet.Contains(ipv4Loopback) {
+		return nil, fmt.Errorf("%s must not contain %s", cidr, ipv4Loopback)
+	}
+	first := binary.BigEndian.Uint32(ip4)
+	last := first | ^binary.BigEndian.Uint32(ipnet.Mask)
+	if last-first < 3 {
+		return nil, fmt.Errorf("%s is too small", cidr)
+	}
+	return &serviceIPs{
+		ports:       ports,
+		idleTimeout: defaultServiceIPIdleTimeout,
+		base:        uint32ToIP(first + 1), // skip the network address
+		next:        first + 2,
+		last:        last - 1, // and the broadcast address
+		byName:      make(map[string]*serviceIP),
+	}, nil
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// ipFor returns the address allocated to the name, allocating one if needed.
+func (s *serviceIPs) ipFor(name string) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.byName[name]; ok {
+		v.lastUsed = time.Now()
+		return v.ip, nil
+	}
+	v := &serviceIP{lastUsed: time.Now()}
+	if n := len(s.free); n > 0 {
+		v.ip, s.free = s.free[n-1], s.free[:n-1]
+	} else if s.next <= s.last {
+		v.ip = uint32ToIP(s.next)
+		s.next++
+	} else {
+		return nil, fmt.Errorf("no addresses left for %s (%d allocated)", name, len(s.byName))
+	}
+	if s.handler != nil {
+		if err := s.listenLocked(name, v); err != nil {
+			s.free = append(s.free, v.ip)
+			return nil, err
+		}
+	}
+	s.byName[name] = v
+	klog.V(3).Infof("allocated ip=%s for name=%s", v.ip, name)
+	return v.ip, nil
+}
+
+// proxyAddr returns the address serving the proxy for any Host.
+func (s *serviceIPs) proxyAddr() string {
+	return net.JoinHostPort(s.base.String(), s.ports[0])
+}
+
+// serve starts serving the reverse proxy handler on the base address and the
+// allocated addresses (and on the ones allocated later), and releasing the
+// idle addresses.
+func (s *serviceIPs) serve(h http.Handler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = h
+	base, err := s.listen("", s.base, h, nil)
+	if err != nil {
+		return err
+	}
+	s.servers = base
+	for name, v := range s.byName {
+		if err := s.listenLocked(name, v); err != nil {
+			return err
+		}
+	}
+	if s.idleTimeout > 0 {
+		go func() {
+			for range time.Tick(s.idleTimeout / 10) {
+				s.releaseIdle(time.Now())
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *serviceIPs) listenLocked(name string, v *serviceIP) error {
+	servers, err := s.listen(name, v.ip, withHost(name, s.handler), func(_ net.Conn, state http.ConnState) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch state {
+		case http.StateNew:
+			v.conns++
+		case http.StateClosed, http.StateHijacked:
+			v.conns--
+		}
+		v.lastUsed = time.Now()
+	})
+	v.servers = servers
+	return err
+}
+
+func (s *serviceIPs) listen(name string, ip net.IP, h http.Handler, connState func(net.Conn, http.ConnState)) ([]*http.Server, error) {
+	var servers []*http.Server
+	for _, port := range s.ports {
+		addr := net.JoinHostPort(ip.String(), port)
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, srv := range servers {
+				srv.Close()
+			}
+			return nil, fmt.Errorf("failed to listen for %s: %w", name, err)
+		}
+		srv := &http.Server{Addr: addr, Handler: h, MaxHeaderBytes: s.maxHeaderBytes, ConnState: connState}
+		go func() {
+			klog.V(1).Infof("starting reverse proxy server for name=%s at %s", name, addr)
+			if err := srv.Serve(lis); err != http.ErrServerClosed {
+				klog.Warningf("reverse proxy (%s) fail: %v", addr, err)
+			}
+		}()
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// releaseIdle stops serving the names without open connections that weren't
+// used for idleTimeout, and releases their addresses for the other names.
+func (s *serviceIPs) releaseIdle(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, v := range s.byName {
+		if v.conns > 0 || now.Sub(v.lastUsed) < s.idleTimeout {
+			continue
+		}
+		for _, srv := range v.servers {
+			srv.Close()
+		}
+		delete(s.byName, name)
+		s.free = append(s.free, v.ip)
+		klog.V(3).Infof("released idle ip=%s of name=%s", v.ip, name)
+	}
+}
+
+// proxyServers returns the servers started so far.
+func (s *serviceIPs) proxyServers() []*http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]*http.Server(nil), s.servers...)
+	for _, v := range s.byName {
+		out = append(out, v.servers...)
+	}
+	return out
+}
+
+// withHost sets the Host of the requests to host, so that they are proxied
+// regardless of the hostname used by the client.
+func withHost(host string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Host = host
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServiceIPsAllocation(t *testing.T) {
+	for _, bad := range []string{"10.0.0.0/8", "127.0.0.0/8", "::1/128", "127.77.0.0", "127.77.0.0/31"} {
+		if _, err := newServiceIPs(bad, nil); err == nil {
+			t.Errorf("newServiceIPs(%s) expected error", bad)
+		}
+	}
+
+	s, err := newServiceIPs("127.77.0.0/29", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "127.77.0.2", "b": "127.77.0.3", "c": "127.77.0.4", "d": "127.77.0.5", "e": "127.77.0.6"}
+	for _, name := range []string{"a", "b", "a", "c", "d", "e"} {
+		ip, err := s.ipFor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != want[name] {
+			t.Errorf("ipFor(%s) = %s, want %s", name, ip, want[name])
+		}
+	}
+	if _, err := s.ipFor("f"); err == nil {
+		t.Error("expected error when the range is exhausted")
+	}
+}
+
+func TestServiceIPsReleaseIdle(t *testing.T) {
+	s, err := newServiceIPs("127.77.3.0/30", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := s.ipFor("typo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ipFor("hello"); err == nil {
+		t.Fatal("expected error when the range is exhausted")
+	}
+
+	s.releaseIdle(time.Now())
+	if _, ok := s.byName["typo"]; !ok {
+		t.Fatal("recently used address released")
+	}
+	s.byName["typo"].conns = 1
+	s.releaseIdle(time.Now().Add(s.idleTimeout))
+	if _, ok := s.byName["typo"]; !ok {
+		t.Fatal("address with open connections released")
+	}
+	s.byName["typo"].conns = 0
+	s.releaseIdle(time.Now().Add(s.idleTimeout))
+	if _, ok := s.byName["typo"]; ok {
+		t.Fatal("idle address not released")
+	}
+	got, err := s.ipFor("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(ip) {
+		t.Errorf("ipFor(hello) = %s, want the released %s", got, ip)
+	}
+}
+
+func TestServiceIPsServe(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	lis.Close()
+
+	s, err := newServiceIPs("127.77.1.0/24", []string{port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, srv := range s.proxyServers() {
+			srv.Close()
+		}
+	}()
+	before, err := s.ipFor("hello.us-central1.run.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.serve(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	})); err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.ipFor("world.us-central1.run.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]string{
+		net.JoinHostPort(before.String(), port): "hello.us-central1.run.internal",
+		net.JoinHostPort(after.String(), port):  "world.us-central1.run.internal",
+		s.proxyAddr():                           "127.77.1.1:" + port,
+	} {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != want {
+			t.Errorf("request to %s got host %q, want %q", addr, b, want)
+		}
+	}
+}
+
+func TestDNSServiceIPs(t *testing.T) {
+	s, err := newServiceIPs("127.77.2.0/24", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dnsHijack{domain: "run.internal.", extraDomains: []string{"cloudrun.internal."}, dots: 4, serviceIPs: s}
+	for _, name := range []string{"hello.us-central1.run.internal.", "Hello.us-central1.cloudrun.internal.", "world.us-central1.run.internal."} {
+		w := &fakeResponseWriter{}
+		d.handleLocal(w, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("%s: unexpected answers %v", name, w.msg.Answer)
+		}
+	}
+	ip, _ := s.ipFor("hello.us-central1.run.internal")
+	if ip.String() != "127.77.2.2" || len(s.byName) != 2 {
+		t.Fatalf("unexpected allocations: %v", s.byName)
+	}
+}
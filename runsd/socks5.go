@@ -0,0 +1,200 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// SOCKS5 (RFC 1928) protocol constants.
+const (
+	socks5Version       = 0x05
+	socks5NoAuth        = 0x00
+	socks5NoMethods     = 0xff
+	socks5CmdConnect    = 0x01
+	socks5AddrIPv4      = 0x01
+	socks5AddrDomain    = 0x03
+	socks5AddrIPv6      = 0x04
+	socks5OK            = 0x00
+	socks5Failure       = 0x01
+	socks5HostUnreach   = 0x04
+	socks5CmdNotSupp    = 0x07
+	socks5AddrNotSupp   = 0x08
+	socks5HandshakeTime = 10 * time.Second
+)
+
+// socks5Server is a SOCKS5 proxy for the clients that don't support HTTP
+// proxies. The connections to the internal names are served by the reverse
+// proxy (so they should speak plain HTTP), and the others are tunneled to
+// their destination.
+type socks5Server struct {
+	rp *reverseProxy
+	// http serves the connections to the internal names.
+	http *http.Server
+	// dial connects to the other destinations, defaults to net.Dialer.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// serve accepts connections on lis until it's closed.
+func (s *socks5Server) serve(lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks5Server) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTime))
+	host, port, err := readSOCKS5Request(conn)
+	if err != nil {
+		klog.V(3).Infof("[socks5] handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if s.rp.isInternalName(host) {
+		klog.V(5).Infof("[socks5] serving connection to %s with the reverse proxy", net.JoinHostPort(host, port))
+		conn.SetDeadline(time.Time{})
+		writeSOCKS5Reply(conn, socks5OK)
+		s.http.Serve(&singleConnListener{conn: conn})
+		return
+	}
+	defer conn.Close()
+	addr := net.JoinHostPort(host, port)
+	dial := s.dial
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), socks5HandshakeTime)
+	backend, err := dial(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		klog.V(3).Infof("[socks5] failed to dial %s: %v", addr, err)
+		writeSOCKS5Reply(conn, socks5HostUnreach)
+		return
+	}
+	defer backend.Close()
+	conn.SetDeadline(time.Time{})
+	if err := writeSOCKS5Reply(conn, socks5OK); err != nil {
+		return
+	}
+	klog.V(5).Infof("[socks5] tunneling connection to %s", addr)
+	tunnel(conn, backend)
+}
+
+// readSOCKS5Request negotiates the authentication method with the client,
+// reads its CONNECT request and returns the destination. The failures are
+// replied to the client.
+func readSOCKS5Request(rw io.ReadWriter) (host, port string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", "", fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", "", err
+	}
+	if bytes.IndexByte(methods, socks5NoAuth) < 0 {
+		rw.Write([]byte{socks5Version, socks5NoMethods})
+		return "", "", errors.New("client does not support the no authentication method")
+	}
+	if _, err := rw.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", "", err
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", "", err
+	}
+	if req[0] != socks5Version {
+		return "", "", fmt.Errorf("unsupported socks version %d", req[0])
+	}
+	if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(rw, socks5CmdNotSupp)
+		return "", "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(rw, n[:]); err != nil {
+			return "", "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(rw, b); err != nil {
+			return "", "", err
+		}
+		host = string(b)
+	default:
+		writeSOCKS5Reply(rw, socks5AddrNotSupp)
+		return "", "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(rw, p[:]); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:]))), nil
+}
+
+// writeSOCKS5Reply replies to the CONNECT request with the status code (and an
+// unspecified bound address).
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// singleConnListener is a net.Listener accepting only conn, to serve it with
+// an http.Server.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() { c = l.conn })
+	if c == nil {
+		return nil, io.EOF
+	}
+	return c, nil
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
@@ -0,0 +1,151 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func startSOCKS5(t *testing.T, s *socks5Server) (string, func()) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(lis)
+	return lis.Addr().String(), func() { lis.Close() }
+}
+
+func socks5Connect(t *testing.T, proxyAddr, host string, port uint16) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req bytes.Buffer
+	req.Write([]byte{socks5Version, 1, socks5NoAuth})
+	req.Write([]byte{socks5Version, socks5CmdConnect, 0, socks5AddrDomain, byte(len(host))})
+	req.WriteString(host)
+	binary.Write(&req, binary.BigEndian, port)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != socks5NoAuth {
+		t.Fatalf("unexpected method selection: %v", resp[:2])
+	}
+	return conn, resp[3]
+}
+
+func TestSOCKS5(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("proxied " + req.Host))
+	})
+	external, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer external.Close()
+	go func() {
+		for {
+			c, err := external.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	addr, stop := startSOCKS5(t, &socks5Server{rp: rp, http: &http.Server{Handler: handler}})
+	defer stop()
+
+	t.Run("internal name", func(t *testing.T) {
+		conn, code := socks5Connect(t, addr, "hello", 80)
+		defer conn.Close()
+		if code != socks5OK {
+			t.Fatalf("reply code=%d", code)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://hello/", nil)
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if string(b) != "proxied hello" {
+			t.Fatalf("got=%q", b)
+		}
+	})
+	t.Run("external address", func(t *testing.T) {
+		conn, code := socks5Connect(t, addr, "127.0.0.1", uint16(external.Addr().(*net.TCPAddr).Port))
+		defer conn.Close()
+		if code != socks5OK {
+			t.Fatalf("reply code=%d", code)
+		}
+		conn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Fatalf("got=%q err=%v", b, err)
+		}
+	})
+	t.Run("unsupported command", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{socks5Version, 1, socks5NoAuth, socks5Version, 0x02, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 80})
+		resp := make([]byte, 2+10)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp[3] != socks5CmdNotSupp {
+			t.Fatalf("reply code=%d", resp[3])
+		}
+	})
+}
+
+func TestIsInternalName(t *testing.T) {
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.hosts = hostOverrides{"db": {ips: []net.IP{net.IPv4(10, 0, 0, 5)}}}
+	for name, want := range map[string]bool{
+		"hello":                          true,
+		"hello.us-central1":              true,
+		"hello.us-central1.run.internal": true,
+		"example.com":                    false,
+		"localhost":                      false,
+		"10.0.0.1":                       false,
+		"db":                             false,
+		strings.Repeat("a.", 3) + "com":  false,
+	} {
+		if got := rp.isInternalName(name); got != want {
+			t.Errorf("isInternalName(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
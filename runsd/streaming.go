@@ -0,0 +1,37 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// ctxKeyStreaming marks the requests to the -streaming_hosts.
+const ctxKeyStreaming = `streaming`
+
+// isStreamingResponse reports whether the response is streamed to the client
+// as it arrives, so it must never be held by the proxy (e.g. to be cached or
+// checked against -max_response_body_bytes): Server-Sent Events and gRPC
+// responses, and the responses of the -streaming_hosts.
+func isStreamingResponse(req *http.Request, resp *http.Response) bool {
+	if req != nil {
+		if v, _ := req.Context().Value(ctxKeyStreaming).(bool); v {
+			return true
+		}
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("content-type"))
+	return mt == "text/event-stream" || isGRPCResponse(resp)
+}
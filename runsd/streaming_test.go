@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestProxyStreamingResponses(t *testing.T) {
+	release := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// cacheable, and longer than -max_response_body_bytes
+		w.Header().Set("cache-control", "max-age=60")
+		w.Header().Set("content-type", req.URL.Query().Get("type"))
+		fmt.Fprintf(w, "data: %s\n\n", strings.Repeat("a", 100))
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: done\n\n")
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.cache = newResponseCache(1<<20, 1<<10, time.Hour)
+	rp.maxResponseBytes = 64
+	rp.streamingHosts = hostPatterns{"feed"}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+	defer close(release)
+
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	cases := []struct {
+		name        string
+		client      *http.Client
+		host        string
+		contentType string
+	}{
+		{name: "sse", client: http.DefaultClient, host: "hello", contentType: "text/event-stream"},
+		{name: "sse with params", client: http.DefaultClient, host: "hello", contentType: "text/event-stream; charset=utf-8"},
+		{name: "sse over h2c", client: h2c, host: "hello", contentType: "text/event-stream"},
+		{name: "streaming host", client: http.DefaultClient, host: "feed", contentType: "application/octet-stream"},
+		{name: "streaming host over h2c", client: h2c, host: "feed.us-central1", contentType: "application/octet-stream"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, proxyURL+"/events?type="+url.QueryEscape(tt.contentType), nil)
+			req.Host = tt.host
+			got := make(chan string, 1)
+			go func() {
+				resp, err := tt.client.Do(req)
+				if err != nil {
+					got <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				got <- line
+			}()
+			select {
+			case line := <-got:
+				if !strings.HasPrefix(line, "data: aaa") {
+					t.Errorf("got first line=%q", line)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("the first event was held by the proxy")
+			}
+		})
+	}
+}
+
+func TestProxyStreamingRequestBodies(t *testing.T) {
+	received := make(chan string, 1)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(req.Body, buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- string(buf)
+		b, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s%s", buf, b)
+	})
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	rp.retry = retryPolicy{
+		maxAttempts:  3,
+		methods:      map[string]bool{http.MethodPost: true},
+		statusCodes:  map[int]bool{http.StatusServiceUnavailable: true},
+		maxBodyBytes: 1 << 20,
+	}
+	proxyURL, cleanup := newTestProxy(t, rp, backend)
+	defer cleanup()
+
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	cases := []struct {
+		name   string
+		client *http.Client
+	}{
+		{name: "http/1.1", client: http.DefaultClient},
+		{name: "h2c", client: h2c},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			req, _ := http.NewRequest(http.MethodPost, proxyURL+"/upload", pr)
+			req.Host = "hello"
+			type result struct {
+				body string
+				err  error
+			}
+			got := make(chan result, 1)
+			go func() {
+				resp, err := tt.client.Do(req)
+				if err != nil {
+					got <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				b, err := ioutil.ReadAll(resp.Body)
+				got <- result{body: string(b), err: err}
+			}()
+
+			fmt.Fprint(pw, "hello")
+			select {
+			case first := <-received:
+				if first != "hello" {
+					t.Errorf("backend got first bytes=%q", first)
+				}
+			case <-time.After(2 * time.Second):
+				pw.Close()
+				t.Fatal("the request body was held by the proxy")
+			}
+			fmt.Fprint(pw, " world")
+			pw.Close()
+
+			select {
+			case r := <-got:
+				if r.err != nil {
+					t.Fatal(r.err)
+				}
+				if r.body != "hello world" {
+					t.Errorf("got body=%q", r.body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("request timed out")
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const ctxKeyResponseHeaderTimeout = `response-header-timeout`
+
+// errResponseHeaderTimeout is returned when the backend doesn't send the
+// response headers in time.
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// proxyTimeouts limits the time the proxied requests can take, optionally
+// overridden per destination (service names or hostnames). Zero durations
+// mean no timeout.
+type proxyTimeouts struct {
+	responseHeader          time.Duration
+	responseHeaderOverrides map[string]time.Duration
+	total                   time.Duration
+	totalOverrides          map[string]time.Duration
+}
+
+// parseTimeoutOverrides parses comma-separated DESTINATION=DURATION pairs
+// (e.g. hello=5s,stream=0).
+func parseTimeoutOverrides(s string) (map[string]time.Duration, error) {
+	kv, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]time.Duration, len(kv))
+	for k, v := range kv {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid timeout %q for %s", v, k)
+		}
+		out[k] = d
+	}
+	return out, nil
+}
+
+// lookupTimeout returns the timeout for the host from the overrides, or def.
+func lookupTimeout(host string, overrides map[string]time.Duration, def time.Duration) time.Duration {
+	host = hostWithoutPort(host)
+	if v, ok := overrides[host]; ok {
+		return v
+	}
+	if v, ok := overrides[serviceName(host)]; ok {
+		return v
+	}
+	return def
+}
+
+func (p proxyTimeouts) enabled() bool {
+	return p.responseHeader > 0 || p.total > 0 || len(p.responseHeaderOverrides) > 0 || len(p.totalOverrides) > 0
+}
+
+// handler applies the total timeout of the destination to the requests, and
+// passes the response header timeout on to responseHeaderTimeoutTransport.
+func (p proxyTimeouts) handler(next http.Handler) http.Handler {
+	if !p.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		if d := lookupTimeout(req.Host, p.totalOverrides, p.total); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		if d := lookupTimeout(req.Host, p.responseHeaderOverrides, p.responseHeader); d > 0 {
+			ctx = context.WithValue(ctx, ctxKeyResponseHeaderTimeout, d)
+		}
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// responseHeaderTimeoutTransport cancels the requests not getting response
+// headers within the timeout set by proxyTimeouts.
+type responseHeaderTimeoutTransport struct {
+	next http.RoundTripper
+}
+
+var _ http.Flusher = responseHeaderTimeoutTransport{} // ensure it's a Flusher
+
+func (t responseHeaderTimeoutTransport) Flush() {
+	if v, ok := t.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (t responseHeaderTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d, ok := req.Context().Value(ctxKeyResponseHeaderTimeout).(time.Duration)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	timer := time.AfterFunc(d, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			klog.V(3).Infof("[proxy] no response headers from host=%s in %s", req.Host, d)
+			return nil, errResponseHeaderTimeout
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the upgraded connection lives as long as the request context
+		return resp, nil
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of the request when the response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// isTimeout reports whether the proxy error is due to a timeout.
+func isTimeout(err error) bool {
+	if err == errResponseHeaderTimeout || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyTimeoutsHandler(t *testing.T) {
+	p := proxyTimeouts{
+		responseHeader:          time.Second,
+		responseHeaderOverrides: map[string]time.Duration{"hello": 5 * time.Second, "stream": 0},
+		totalOverrides:          map[string]time.Duration{"hello.europe-west1": time.Minute},
+	}
+	cases := []struct {
+		host         string
+		wantHeader   time.Duration
+		wantDeadline bool
+	}{
+		{host: "hello", wantHeader: 5 * time.Second},
+		{host: "hello.europe-west1:80", wantHeader: 5 * time.Second, wantDeadline: true},
+		{host: "stream", wantHeader: 0},
+		{host: "world", wantHeader: time.Second},
+	}
+	for _, tt := range cases {
+		var gotHeader time.Duration
+		var gotDeadline bool
+		h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotHeader, _ = req.Context().Value(ctxKeyResponseHeaderTimeout).(time.Duration)
+			_, gotDeadline = req.Context().Deadline()
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tt.host
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if gotHeader != tt.wantHeader {
+			t.Errorf("host=%s response header timeout = %s, want %s", tt.host, gotHeader, tt.wantHeader)
+		}
+		if gotDeadline != tt.wantDeadline {
+			t.Errorf("host=%s has deadline = %v, want %v", tt.host, gotDeadline, tt.wantDeadline)
+		}
+	}
+}
+
+func TestResponseHeaderTimeoutTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-req.Context().Done():
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	rt := responseHeaderTimeoutTransport{next: http.DefaultTransport}
+	ctx := context.WithValue(context.Background(), ctxKeyResponseHeaderTimeout, 50*time.Millisecond)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/slow", nil)
+	if _, err := rt.RoundTrip(req.WithContext(ctx)); err != errResponseHeaderTimeout {
+		t.Errorf("slow response err = %v, want %v", err, errResponseHeaderTimeout)
+	}
+	if !isTimeout(errResponseHeaderTimeout) {
+		t.Error("response header timeout should be a timeout")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/fast", nil)
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // past the timeout, body should still be readable
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(b) != "ok" {
+		t.Errorf("body = %q, err = %v", b, err)
+	}
+}
+
+func TestParseTimeoutOverrides(t *testing.T) {
+	got, err := parseTimeoutOverrides("hello=5s, Stream=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["hello"] != 5*time.Second || got["stream"] != 0 || len(got) != 2 {
+		t.Errorf("unexpected overrides: %v", got)
+	}
+	if _, err := parseTimeoutOverrides("hello=-1s"); err == nil {
+		t.Error("expected error for negative timeout")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// requestTiming records how long the phases of a proxied request took.
+type requestTiming struct {
+	mu sync.Mutex
+
+	tokenFetch   time.Duration
+	dnsLookup    time.Duration
+	dial         time.Duration
+	tlsHandshake time.Duration
+	ttfb         time.Duration // from writing the request to the first response byte
+	reusedConn   bool
+
+	dnsStart, dialStart, tlsStart, wroteRequest time.Time
+}
+
+func timingFromContext(ctx context.Context) *requestTiming {
+	v, _ := ctx.Value(ctxKeyTiming).(*requestTiming)
+	return v
+}
+
+// record runs f with the lock held, if t is not nil.
+func (t *requestTiming) record(f func(t *requestTiming)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(t)
+}
+
+func (t *requestTiming) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("token=%s dns=%s dial=%s tls=%s ttfb=%s reused_conn=%v",
+		t.tokenFetch.Truncate(time.Microsecond), t.dnsLookup.Truncate(time.Microsecond),
+		t.dial.Truncate(time.Microsecond), t.tlsHandshake.Truncate(time.Microsecond),
+		t.ttfb.Truncate(time.Microsecond), t.reusedConn)
+}
+
+func (t *requestTiming) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.record(func(t *requestTiming) { t.reusedConn = info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.record(func(t *requestTiming) { t.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.record(func(t *requestTiming) { t.dnsLookup = time.Since(t.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			t.record(func(t *requestTiming) { t.dialStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			t.record(func(t *requestTiming) { t.dial = time.Since(t.dialStart) })
+		},
+		TLSHandshakeStart: func() {
+			t.record(func(t *requestTiming) { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.record(func(t *requestTiming) { t.tlsHandshake = time.Since(t.tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.record(func(t *requestTiming) { t.wroteRequest = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			t.record(func(t *requestTiming) {
+				if !t.wroteRequest.IsZero() {
+					t.ttfb = time.Since(t.wroteRequest)
+				}
+			})
+		},
+	}
+}
+
+// timingTransport attaches an httptrace.ClientTrace to the outbound request
+// if the request is being timed.
+type timingTransport struct {
+	next http.RoundTripper
+}
+
+var _ http.Flusher = timingTransport{} // ensure it's a Flusher
+
+func (t timingTransport) Flush() {
+	if v, ok := t.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (t timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tm := timingFromContext(req.Context()); tm != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), tm.clientTrace()))
+	}
+	return t.next.RoundTrip(req)
+}
+
+// slowRequestLogger logs a warning with the timing breakdown of the proxied
+// requests taking longer than the threshold.
+type slowRequestLogger struct {
+	threshold time.Duration
+	// logf, if set, is used instead of klog.Warningf.
+	logf func(format string, args ...interface{})
+}
+
+func (s slowRequestLogger) handler(next http.Handler) http.Handler {
+	logf := s.logf
+	if logf == nil {
+		logf = klog.Warningf
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		tm := new(requestTiming)
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), ctxKeyTiming, tm)))
+		if took := time.Since(start); took >= s.threshold {
+			logf("slow request: %s http://%s%s status=%d total=%s %s",
+				req.Method, req.Host, req.URL.RequestURI(), rec.status, took.Truncate(time.Microsecond), tm)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLogger(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+	}
+	os.Setenv("CLOUD_RUN_ID_TOKEN", "test-token")
+	defer os.Unsetenv("CLOUD_RUN_ID_TOKEN")
+
+	var logs []string
+	rp := newReverseProxy("hash", "us-central1", "run.internal.")
+	h := slowRequestLogger{threshold: 100 * time.Millisecond, logf: func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}}.handler(rp.newReverseProxyHandler(tr))
+
+	for _, path := range []string{"/slow", "/fast"} {
+		req := httptest.NewRequest(http.MethodGet, "http://hello"+path, nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("got %d log entries, want 1 (only the slow request): %q", len(logs), logs)
+	}
+	// the first request opened the connection
+	re := regexp.MustCompile(`^slow request: GET http://hello/slow status=200 total=\S+ token=\S+ dns=\S+ dial=[1-9]\S* tls=[1-9]\S* ttfb=(\S+) reused_conn=false$`)
+	m := re.FindStringSubmatch(logs[0])
+	if m == nil {
+		t.Fatalf("unexpected log entry: %q", logs[0])
+	}
+	if ttfb, err := time.ParseDuration(m[1]); err != nil || ttfb < 150*time.Millisecond {
+		t.Errorf("ttfb=%s, want at least the backend's 150ms", m[1])
+	}
+}
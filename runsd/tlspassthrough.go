@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// clientHelloTimeout is how long a client can take to send its TLS
+// ClientHello to the passthrough listener.
+const clientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead aborts the handshake once the ClientHello is read.
+var errClientHelloRead = errors.New("client hello read")
+
+// tlsPassthrough tunnels TLS connections to the backend picked by their SNI
+// without terminating them, so no ID token can be added to the requests.
+type tlsPassthrough struct {
+	rp *reverseProxy
+	// dial connects to the backend address, defaults to net.Dialer.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// backendAddr returns the address the connections with the SNI serverName are
+// tunneled to. The run.app hostnames are passed through as is.
+func (p *tlsPassthrough) backendAddr(serverName string) (string, error) {
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	host := serverName
+	if !strings.HasSuffix(serverName, ".run.app") {
+		var err error
+		if _, host, err = p.rp.backend(serverName); err != nil {
+			return "", err
+		}
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	return net.JoinHostPort(host, "443"), nil
+}
+
+// serve accepts connections on lis until it's closed.
+func (p *tlsPassthrough) serve(lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *tlsPassthrough) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello, err := readClientHello(conn)
+	if err != nil {
+		klog.V(3).Infof("[tls passthrough] failed to read client hello from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	addr, err := p.backendAddr(serverName)
+	if err != nil {
+		klog.Warningf("WARN: tls passthrough failed to find a Cloud Run URL for sni=%s: %v", serverName, err)
+		return
+	}
+	dial := p.dial
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientHelloTimeout)
+	backend, err := dial(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		klog.Warningf("WARN: tls passthrough failed to dial %s for sni=%s: %v", addr, serverName, err)
+		return
+	}
+	defer backend.Close()
+	klog.V(5).Infof("[tls passthrough] tunneling sni=%s to=%s", serverName, addr)
+	if _, err := backend.Write(hello); err != nil {
+		klog.V(3).Infof("[tls passthrough] failed to write client hello to %s: %v", addr, err)
+		return
+	}
+	tunnel(conn, backend)
+}
+
+// tunnel copies the data between the connections in both directions until
+// both sides are done writing.
+func tunnel(conn, backend net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(backend, conn)
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, backend)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes the connection, if supported, to pass the EOF on.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// readClientHello reads the TLS ClientHello from r and returns the server name
+// it has in the SNI extension, and the bytes read to be replayed to the backend.
+func readClientHello(r io.Reader) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if err != nil && !errors.Is(err, errClientHelloRead) {
+		return "", nil, err
+	}
+	if serverName == "" {
+		return "", nil, errors.New("client hello has no server name")
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// readOnlyConn is a net.Conn that reads from r and fails the writes, to run
+// the server side of a handshake up to the ClientHello.
+type readOnlyConn struct{ r io.Reader }
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSPassthroughBackendAddr(t *testing.T) {
+	p := &tlsPassthrough{rp: newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")}
+	cases := map[string]string{
+		"hello":                           "hello-dpyb4duzqq-uc.a.run.app:443",
+		"hello.europe-west1.run.internal": "hello-dpyb4duzqq-ew.a.run.app:443",
+		"Foo-123-uc.a.run.app.":           "foo-123-uc.a.run.app:443",
+	}
+	for in, want := range cases {
+		got, err := p.backendAddr(in)
+		if err != nil {
+			t.Errorf("backendAddr(%s) failed: %v", in, err)
+		} else if got != want {
+			t.Errorf("backendAddr(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	var gotSNI string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotSNI = req.TLS.ServerName
+		w.Write([]byte("hi"))
+	}))
+	backend.StartTLS()
+	defer backend.Close()
+
+	var gotAddr string
+	p := &tlsPassthrough{
+		rp: newReverseProxy("dpyb4duzqq", "us-central1", "run.internal."),
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			gotAddr = addr
+			return new(net.Dialer).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go p.serve(lis)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, lis.Addr().String())
+		},
+	}}
+	resp, err := client.Get("https://hello/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hi" {
+		t.Errorf("body = %q", b)
+	}
+	if gotSNI != "hello" {
+		t.Errorf("backend got sni=%q, want the original one", gotSNI)
+	}
+	if want := "hello-dpyb4duzqq-uc.a.run.app:443"; gotAddr != want {
+		t.Errorf("dialed %s, want %s", gotAddr, want)
+	}
+}
+
+func TestReadClientHelloNoSNI(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go tls.Client(c2, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	if _, _, err := readClientHello(c1); err == nil {
+		t.Error("expected error for client hello without sni")
+	}
+	c2.Close()
+}
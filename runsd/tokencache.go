@@ -0,0 +1,261 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// tokenExpiryMargin is how long before their expiry the cached tokens are
+// no longer used.
+var tokenExpiryMargin = time.Minute
+
+// idTokenCache caches the ID tokens minted by the metadata server, in memory
+// unless -token_cache_file is set.
+var idTokenCache = newTokenCache("")
+
+type cachedToken struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// tokenFetcher mints a token for an audience, used to refresh it in the
+// background.
+type tokenFetcher struct {
+	fetch    func() (string, error)
+	lastUsed time.Time
+}
+
+// tokenRefreshIdleTime is how long after their last use the tokens are no
+// longer refreshed in the background.
+const tokenRefreshIdleTime = time.Hour
+
+// tokenCache holds ID tokens keyed by audience and persists them to a file so
+// that they survive restarts of runsd within the same instance.
+type tokenCache struct {
+	mu       sync.Mutex
+	file     string // persisted to, if not empty
+	tokens   map[string]cachedToken
+	fetchers map[string]*tokenFetcher // by audience, not persisted
+}
+
+func newTokenCache(file string) *tokenCache {
+	return &tokenCache{file: file, tokens: make(map[string]cachedToken), fetchers: make(map[string]*tokenFetcher)}
+}
+
+// getOrFetch returns the cached token for the audience, or fetches (and
+// caches) a new one. If fetching fails, a cached token that has not expired
+// yet is returned.
+func (c *tokenCache) getOrFetch(audience string, now time.Time, fetch func() (string, error)) (string, error) {
+	c.mu.Lock()
+	if f, ok := c.fetchers[audience]; ok {
+		f.lastUsed = now
+	} else {
+		c.fetchers[audience] = &tokenFetcher{fetch: fetch, lastUsed: now}
+	}
+	c.mu.Unlock()
+	if v, ok := c.get(audience, now); ok {
+		return v, nil
+	}
+	tok, err := fetch()
+	if err != nil {
+		if v, ok := c.stale(audience, now); ok {
+			klog.Warningf("WARN: failed to fetch token for audience=%s, using the cached one: %v", audience, err)
+			return v, nil
+		}
+		return "", err
+	}
+	c.put(audience, tok)
+	return tok, nil
+}
+
+// stale returns the cached token for the audience if it has not expired,
+// even if it's within tokenExpiryMargin of its expiry.
+func (c *tokenCache) stale(audience string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.tokens[audience]
+	if !ok || !now.Before(v.Expiry) {
+		return "", false
+	}
+	return v.Token, true
+}
+
+// refresh fetches new tokens for the audiences used recently whose tokens
+// expire within tokenExpiryMargin+ahead, so the requests don't wait for them.
+func (c *tokenCache) refresh(now time.Time, ahead time.Duration) {
+	var due []string
+	fetchers := make(map[string]func() (string, error))
+	c.mu.Lock()
+	for aud, f := range c.fetchers {
+		if now.Sub(f.lastUsed) > tokenRefreshIdleTime {
+			delete(c.fetchers, aud)
+			continue
+		}
+		if v, ok := c.tokens[aud]; ok && now.Add(tokenExpiryMargin+ahead).After(v.Expiry) {
+			due = append(due, aud)
+			fetchers[aud] = f.fetch
+		}
+	}
+	c.mu.Unlock()
+	for _, aud := range due {
+		tok, err := fetchers[aud]()
+		if err != nil {
+			klog.V(1).Infof("WARN: failed to refresh token for audience=%s: %v", aud, err)
+			continue
+		}
+		klog.V(4).Infof("refreshed token for audience=%s", aud)
+		c.put(aud, tok)
+	}
+}
+
+// refreshPeriodically refreshes the tokens expiring within ahead (plus the
+// tokenExpiryMargin) every interval.
+func (c *tokenCache) refreshPeriodically(interval, ahead time.Duration) {
+	for now := range time.Tick(interval) {
+		c.refresh(now, ahead)
+	}
+}
+
+func (c *tokenCache) get(audience string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.tokens[audience]
+	if !ok || now.Add(tokenExpiryMargin).After(v.Expiry) {
+		return "", false
+	}
+	return v.Token, true
+}
+
+// put adds the token to the cache and persists the cache. Tokens without a
+// parseable expiry are not cached.
+func (c *tokenCache) put(audience, token string) {
+	exp, err := tokenExpiry(token)
+	if err != nil {
+		klog.V(3).Infof("not caching token for audience=%s: %v", audience, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[audience] = cachedToken{Token: token, Expiry: exp}
+	c.pruneLocked(time.Now())
+	if err := c.saveLocked(); err != nil {
+		klog.Warningf("failed to persist token cache: %v", err)
+	}
+}
+
+// load reads the non-expired tokens from the cache file. A missing file is
+// not an error.
+func (c *tokenCache) load(now time.Time) error {
+	if c.file == "" {
+		return nil
+	}
+	fi, err := os.Stat(c.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("token cache file %s is accessible by other users (mode=%s)", c.file, fi.Mode().Perm())
+	}
+	b, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	var tokens map[string]cachedToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return fmt.Errorf("failed to parse token cache file: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for aud, v := range tokens {
+		if now.Add(tokenExpiryMargin).Before(v.Expiry) {
+			c.tokens[aud] = v
+		}
+	}
+	klog.V(3).Infof("loaded %d cached tokens from %s", len(c.tokens), c.file)
+	return nil
+}
+
+// pruneLocked removes the expired tokens.
+func (c *tokenCache) pruneLocked(now time.Time) {
+	for aud, v := range c.tokens {
+		if !now.Before(v.Expiry) {
+			delete(c.tokens, aud)
+		}
+	}
+}
+
+// saveLocked atomically writes the tokens to the cache file, readable only by
+// the current user.
+func (c *tokenCache) saveLocked() error {
+	if c.file == "" {
+		return nil
+	}
+	b, err := json.Marshal(c.tokens)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.file), ".runsd-tokens-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.file)
+}
+
+// tokenExpiry returns the expiry time in the "exp" claim of the JWT.
+func tokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse JWT claims: %w", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("JWT has no exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
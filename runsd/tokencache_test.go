@@ -0,0 +1,153 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":"x","exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".c2ln"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	got, err := tokenExpiry(testJWT(exp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(exp) {
+		t.Fatalf("got=%v want=%v", got, exp)
+	}
+	if _, err := tokenExpiry("test-token"); err == nil {
+		t.Fatal("expected error for non-JWT token")
+	}
+}
+
+func TestTokenCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runsd-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens.json")
+
+	now := time.Now()
+	valid, expiring := testJWT(now.Add(time.Hour)), testJWT(now.Add(time.Second))
+	c := newTokenCache(file)
+	c.put("https://a", valid)
+	c.put("https://b", expiring)
+	if _, ok := c.get("https://b", now); ok {
+		t.Fatal("token about to expire should not be served from cache")
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("cache file mode=%s, want 0600", perm)
+	}
+
+	c2 := newTokenCache(file)
+	if err := c2.load(now); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c2.get("https://a", now); !ok || got != valid {
+		t.Fatalf("token not reloaded from cache file: ok=%v", ok)
+	}
+	if _, ok := c2.tokens["https://b"]; ok {
+		t.Fatal("expiring token should not be reloaded")
+	}
+
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTokenCache(file).load(now); err == nil {
+		t.Fatal("expected error for world-readable cache file")
+	}
+}
+
+func TestTokenCacheInMemory(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache("")
+	c.put("https://a", testJWT(now.Add(-time.Second)))
+	c.put("https://b", testJWT(now.Add(time.Hour)))
+	if _, ok := c.tokens["https://a"]; ok {
+		t.Error("expired token not pruned")
+	}
+	if _, ok := c.get("https://b", now); !ok {
+		t.Fatal("token not served from cache")
+	}
+
+	defer func(v time.Duration) { tokenExpiryMargin = v }(tokenExpiryMargin)
+	tokenExpiryMargin = 59 * time.Minute
+	if _, ok := c.get("https://b", now.Add(2*time.Minute)); ok {
+		t.Error("token within -token_refresh_margin of its expiry served from cache")
+	}
+}
+
+func TestTokenCacheStaleFallback(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache("")
+	expiring := testJWT(now.Add(30 * time.Second)) // within tokenExpiryMargin
+	c.put("https://a", expiring)
+	failing := func() (string, error) { return "", errors.New("metadata server unavailable") }
+
+	got, err := c.getOrFetch("https://a", now, failing)
+	if err != nil || got != expiring {
+		t.Fatalf("expected the unexpired cached token, got=%q err=%v", got, err)
+	}
+	if _, err := c.getOrFetch("https://a", now.Add(time.Minute), failing); err == nil {
+		t.Fatal("expected error once the cached token expired")
+	}
+	if _, err := c.getOrFetch("https://b", now, failing); err == nil {
+		t.Fatal("expected error without a cached token")
+	}
+}
+
+func TestTokenCacheRefresh(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache("")
+	var fetches int
+	fetch := func() (string, error) {
+		fetches++
+		return testJWT(now.Add(time.Hour)), nil
+	}
+	if _, err := c.getOrFetch("https://a", now, fetch); err != nil {
+		t.Fatal(err)
+	}
+	c.refresh(now, 5*time.Minute)
+	if fetches != 1 {
+		t.Fatalf("fresh token refreshed, fetches=%d", fetches)
+	}
+	later := now.Add(55 * time.Minute)
+	c.refresh(later, 5*time.Minute)
+	if fetches != 2 {
+		t.Fatalf("token not refreshed ahead of its expiry, fetches=%d", fetches)
+	}
+	c.refresh(later.Add(tokenRefreshIdleTime), 5*time.Minute)
+	if fetches != 2 || len(c.fetchers) != 0 {
+		t.Fatalf("token of idle audience refreshed, fetches=%d fetchers=%d", fetches, len(c.fetchers))
+	}
+}
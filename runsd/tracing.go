@@ -0,0 +1,342 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// traceContext identifies a span in a trace, as in the W3C Trace Context.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header value, like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(v string) (traceContext, bool) {
+	var tc traceContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.traceID[:], []byte(parts[1])); err != nil || tc.traceID == [16]byte{} {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.spanID[:], []byte(parts[2])); err != nil || tc.spanID == [8]byte{} {
+		return tc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return tc, false
+	}
+	tc.sampled = flags&1 == 1
+	return tc, true
+}
+
+func (tc traceContext) traceparent() string {
+	flags := "00"
+	if tc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", tc.traceID, tc.spanID, flags)
+}
+
+// parseCloudTraceContext parses an X-Cloud-Trace-Context header value, like
+// 105445aa7843bc8bf206b12000100000/1;o=1.
+func parseCloudTraceContext(v string) (traceContext, bool) {
+	var tc traceContext
+	v = strings.TrimSpace(v)
+	opts := ""
+	if i := strings.Index(v, ";"); i >= 0 {
+		v, opts = v[:i], v[i+1:]
+	}
+	i := strings.Index(v, "/")
+	if i != 32 {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.traceID[:], []byte(v[:i])); err != nil || tc.traceID == [16]byte{} {
+		return tc, false
+	}
+	spanID, err := strconv.ParseUint(v[i+1:], 10, 64)
+	if err != nil || spanID == 0 {
+		return tc, false
+	}
+	binary.BigEndian.PutUint64(tc.spanID[:], spanID)
+	tc.sampled = opts == "o=1"
+	return tc, true
+}
+
+func (tc traceContext) cloudTraceContext() string {
+	sampled := 0
+	if tc.sampled {
+		sampled = 1
+	}
+	return fmt.Sprintf("%x/%d;o=%d", tc.traceID, binary.BigEndian.Uint64(tc.spanID[:]), sampled)
+}
+
+// incomingTraceContext returns the trace context in the traceparent or the
+// X-Cloud-Trace-Context header.
+func incomingTraceContext(h http.Header) (traceContext, bool) {
+	if tc, ok := parseTraceparent(h.Get("traceparent")); ok {
+		return tc, true
+	}
+	return parseCloudTraceContext(h.Get("x-cloud-trace-context"))
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		klog.Warningf("failed to generate random trace id: %v", err)
+	}
+}
+
+// clientSpan is a span of a proxied request.
+type clientSpan struct {
+	trace        traceContext
+	parentSpanID [8]byte // zero if it's a root span
+	name         string
+	start, end   time.Time
+	attrs        map[string]interface{} // string or int values
+	failed       bool
+}
+
+// otlpExporter exports the spans in batches to an OpenTelemetry collector
+// with the OTLP/HTTP protocol (in its JSON encoding).
+type otlpExporter struct {
+	url         string // e.g. http://localhost:4318/v1/traces
+	serviceName string
+	client      *http.Client
+	spans       chan clientSpan
+	batchSize   int
+	interval    time.Duration
+}
+
+func newOTLPExporter(endpoint, serviceName string) *otlpExporter {
+	u := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(u, "/v1/traces") {
+		u += "/v1/traces"
+	}
+	return &otlpExporter{
+		url:         u,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan clientSpan, 2048),
+		batchSize:   512,
+		interval:    5 * time.Second,
+	}
+}
+
+// export queues the span, or drops it if the queue is full.
+func (e *otlpExporter) export(s clientSpan) {
+	select {
+	case e.spans <- s:
+	default:
+		klog.V(3).Infof("[tracing] dropping span, export queue is full")
+	}
+}
+
+// run sends the queued spans in batches until the queue is closed.
+func (e *otlpExporter) run() {
+	tick := time.NewTicker(e.interval)
+	defer tick.Stop()
+	var batch []clientSpan
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= e.batchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []clientSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(e.payload(batch))
+	if err != nil {
+		klog.Warningf("failed to marshal spans: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		klog.Warningf("failed to export %d span(s) to %s: %v", len(batch), e.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		klog.Warningf("failed to export %d span(s) to %s: status=%d", len(batch), e.url, resp.StatusCode)
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		switch v := v.(type) {
+		case int:
+			out = append(out, otlpKeyValue{Key: k, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}})
+		default:
+			out = append(out, otlpKeyValue{Key: k, Value: map[string]interface{}{"stringValue": fmt.Sprint(v)}})
+		}
+	}
+	return out
+}
+
+// payload returns the ExportTraceServiceRequest message for the spans.
+func (e *otlpExporter) payload(batch []clientSpan) interface{} {
+	type otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes"`
+		Status            struct {
+			Code int `json:"code"`
+		} `json:"status"`
+	}
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		v := otlpSpan{
+			TraceID:           hex.EncodeToString(s.trace.traceID[:]),
+			SpanID:            hex.EncodeToString(s.trace.spanID[:]),
+			Name:              s.name,
+			Kind:              3, // SPAN_KIND_CLIENT
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.parentSpanID != [8]byte{} {
+			v.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+		}
+		if s.failed {
+			v.Status.Code = 2 // STATUS_CODE_ERROR
+		}
+		spans = append(spans, v)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "runsd", "version": version},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// tracingTransport records a client span for each proxied request if the
+// exporter is set, and propagates the trace context to the backend if
+// propagate is set (starting a new trace if the request has none).
+type tracingTransport struct {
+	next          http.RoundTripper
+	exporter      *otlpExporter
+	propagate     bool
+	currentRegion string
+}
+
+var _ http.Flusher = tracingTransport{} // ensure it's a Flusher
+
+func (t tracingTransport) Flush() {
+	if v, ok := t.next.(http.Flusher); ok {
+		v.Flush()
+	}
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := clientSpan{start: time.Now()}
+	parent, ok := incomingTraceContext(req.Header)
+	if ok {
+		span.trace.traceID, span.parentSpanID, span.trace.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		// without a span of our own, leave sampling to the backend
+		randomBytes(span.trace.traceID[:])
+		span.trace.sampled = t.exporter != nil
+	}
+	randomBytes(span.trace.spanID[:])
+	if t.propagate {
+		// the backend's span is the child of our span if it's exported, or
+		// the caller's span
+		out := span.trace
+		if t.exporter == nil && ok {
+			out.spanID = parent.spanID
+		}
+		req.Header.Set("traceparent", out.traceparent())
+		req.Header.Set("x-cloud-trace-context", out.cloudTraceContext())
+	}
+	if t.exporter == nil || !span.trace.sampled {
+		return t.next.RoundTrip(req)
+	}
+
+	host, _ := req.Context().Value(ctxKeyOriginalHost).(string)
+	if host == "" {
+		host = req.Host
+	}
+	dest := destinationName(host, t.currentRegion)
+	span.name = req.Method + " " + dest
+	span.attrs = map[string]interface{}{
+		"http.method":       req.Method,
+		"http.url":          req.URL.String(),
+		"net.peer.name":     req.URL.Host,
+		"runsd.destination": dest,
+	}
+	if i := strings.Index(dest, "."); i > 0 && !strings.Contains(dest[i+1:], ".") {
+		span.attrs["runsd.service"], span.attrs["runsd.region"] = dest[:i], dest[i+1:]
+	}
+	resp, err := t.next.RoundTrip(req)
+	span.end = time.Now()
+	if err != nil {
+		span.failed = true
+		span.attrs["error.message"] = err.Error()
+	} else {
+		span.failed = resp.StatusCode >= http.StatusInternalServerError
+		span.attrs["http.status_code"] = resp.StatusCode
+	}
+	t.exporter.export(span)
+	return resp, err
+}
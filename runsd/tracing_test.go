@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || hex.EncodeToString(tc.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(tc.spanID[:]) != "00f067aa0ba902b7" || !tc.sampled {
+		t.Fatalf("got=%+v ok=%v", tc, ok)
+	}
+	if got := tc.traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent() = %s", got)
+	}
+	for _, in := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(in); ok {
+			t.Errorf("expected %q to be invalid", in)
+		}
+	}
+}
+
+func TestParseCloudTraceContext(t *testing.T) {
+	tc, ok := parseCloudTraceContext("105445aa7843bc8bf206b12000100000/1;o=1")
+	if !ok || hex.EncodeToString(tc.traceID[:]) != "105445aa7843bc8bf206b12000100000" ||
+		hex.EncodeToString(tc.spanID[:]) != "0000000000000001" || !tc.sampled {
+		t.Fatalf("got=%+v ok=%v", tc, ok)
+	}
+	if got := tc.cloudTraceContext(); got != "105445aa7843bc8bf206b12000100000/1;o=1" {
+		t.Errorf("cloudTraceContext() = %s", got)
+	}
+	if tc, ok := parseCloudTraceContext("105445aa7843bc8bf206b12000100000/18446744073709551615"); !ok || tc.sampled {
+		t.Errorf("got=%+v ok=%v", tc, ok)
+	}
+	for _, in := range []string{"", "105445aa7843bc8bf206b12000100000", "105445aa7843bc8bf206b12000100000/0;o=1", "105445aa/1;o=1", "105445aa7843bc8bf206b12000100000/x"} {
+		if _, ok := parseCloudTraceContext(in); ok {
+			t.Errorf("expected %q to be invalid", in)
+		}
+	}
+}
+
+// headerCapturingTransport records the headers of the last request.
+type headerCapturingTransport struct{ header http.Header }
+
+func (h *headerCapturingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.header = req.Header.Clone()
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestTracePropagation(t *testing.T) {
+	next := new(headerCapturingTransport)
+	tr := tracingTransport{next: next, propagate: true, currentRegion: "us-central1"}
+	cases := []struct {
+		name, header, value string
+		wantTraceparent     string
+		wantCloudTrace      string
+	}{
+		{name: "traceparent", header: "traceparent", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantTraceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantCloudTrace:  "4bf92f3577b34da6a3ce929d0e0e4736/67667974448284343;o=1"},
+		{name: "cloud trace context", header: "x-cloud-trace-context", value: "105445aa7843bc8bf206b12000100000/1;o=0",
+			wantTraceparent: "00-105445aa7843bc8bf206b12000100000-0000000000000001-00",
+			wantCloudTrace:  "105445aa7843bc8bf206b12000100000/1;o=0"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://hello-xyz-uc.a.run.app/", nil)
+			req.Header.Set(tt.header, tt.value)
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			if v := next.header.Get("traceparent"); v != tt.wantTraceparent {
+				t.Errorf("traceparent = %q, want %q", v, tt.wantTraceparent)
+			}
+			if v := next.header.Get("x-cloud-trace-context"); v != tt.wantCloudTrace {
+				t.Errorf("x-cloud-trace-context = %q, want %q", v, tt.wantCloudTrace)
+			}
+		})
+	}
+	t.Run("synthesized", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "https://hello-xyz-uc.a.run.app/", nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		tp, ok := parseTraceparent(next.header.Get("traceparent"))
+		if !ok || tp.sampled {
+			t.Fatalf("unexpected synthesized traceparent %q", next.header.Get("traceparent"))
+		}
+		if ct, ok := parseCloudTraceContext(next.header.Get("x-cloud-trace-context")); !ok || ct != tp {
+			t.Errorf("x-cloud-trace-context %q does not match traceparent", next.header.Get("x-cloud-trace-context"))
+		}
+	})
+}
+
+func TestTracingTransport(t *testing.T) {
+	var got []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		got, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer collector.Close()
+
+	e := newOTLPExporter(collector.URL, "caller")
+	tr := tracingTransport{next: &sequenceTransport{statuses: []int{503}}, exporter: e, currentRegion: "us-central1"}
+	req, _ := http.NewRequest(http.MethodGet, "https://hello-xyz-uc.a.run.app/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyOriginalHost, "hello"))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	close(e.spans)
+	e.run()
+
+	var v struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string         `json:"traceId"`
+					ParentSpanID string         `json:"parentSpanId"`
+					Name         string         `json:"name"`
+					Kind         int            `json:"kind"`
+					Attributes   []otlpKeyValue `json:"attributes"`
+					Status       struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(got, &v); err != nil {
+		t.Fatalf("failed to parse exported spans %s: %v", got, err)
+	}
+	spans := v.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want 1 (unsampled requests are not traced)", len(spans))
+	}
+	s := spans[0]
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID != "00f067aa0ba902b7" ||
+		s.Name != "GET hello.us-central1" || s.Kind != 3 || s.Status.Code != 2 {
+		t.Errorf("unexpected span: %+v", s)
+	}
+	attrs := make(map[string]map[string]interface{})
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["runsd.region"]["stringValue"] != "us-central1" || attrs["http.status_code"]["intValue"] != "503" {
+		t.Errorf("unexpected span attributes: %v", attrs)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// validTag matches the Cloud Run revision tag names.
+var validTag = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+// trafficSplit is the weighted list of the revision tags the requests to a
+// service are routed to.
+type trafficSplit struct {
+	tags    []string
+	weights []int
+	total   int
+}
+
+// trafficSplits maps the services in the "svc" (current region) or
+// "svc.region" form to their traffic splits.
+type trafficSplits map[string]trafficSplit
+
+// loadTrafficSplits reads a JSON file of services to the weights of their
+// revision tags, e.g. {"search": {"stable": 90, "canary": 10}}.
+func loadTrafficSplits(path string) (trafficSplits, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string]map[string]int
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse traffic split file %s: %w", path, err)
+	}
+	out := make(trafficSplits, len(specs))
+	for svc, weights := range specs {
+		svc = strings.ToLower(svc)
+		if parts := strings.Split(svc, "."); len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid traffic split for %q: not in SVC or SVC.REGION form", svc)
+		}
+		var s trafficSplit
+		for tag := range weights {
+			s.tags = append(s.tags, tag)
+		}
+		sort.Strings(s.tags)
+		for _, tag := range s.tags {
+			w := weights[tag]
+			if !validTag.MatchString(tag) {
+				return nil, fmt.Errorf("invalid traffic split for %s: invalid tag name %q", svc, tag)
+			}
+			if w < 0 {
+				return nil, fmt.Errorf("invalid traffic split for %s: negative weight for tag %s", svc, tag)
+			}
+			s.weights = append(s.weights, w)
+			s.total += w
+		}
+		if s.total == 0 {
+			return nil, fmt.Errorf("invalid traffic split for %s: weights add up to zero", svc)
+		}
+		out[svc] = s
+	}
+	klog.V(1).Infof("loaded traffic splits for %d service(s) from %s", len(out), path)
+	return out, nil
+}
+
+// lookup returns the traffic split for the internal hostname.
+func (t trafficSplits) lookup(hostname, domain, curRegion string) (trafficSplit, bool) {
+	if len(t) == 0 {
+		return trafficSplit{}, false
+	}
+	name := strings.TrimSuffix(strings.ToLower(hostname), "."+strings.Trim(domain, "."))
+	svc, region := name, curRegion
+	if parts := strings.Split(name, "."); len(parts) == 2 {
+		svc, region = parts[0], parts[1]
+	} else if len(parts) > 2 {
+		return trafficSplit{}, false
+	}
+	s, ok := t[svc+"."+region]
+	if !ok && region == curRegion {
+		s, ok = t[svc]
+	}
+	return s, ok
+}
+
+// pick returns the tag for n in [0, total).
+func (s trafficSplit) pick(n int) string {
+	for i, w := range s.weights {
+		if n < w {
+			return s.tags[i]
+		}
+		n -= w
+	}
+	return s.tags[len(s.tags)-1]
+}
+
+// choose returns a random tag per the weights.
+func (s trafficSplit) choose() string { return s.pick(rand.Intn(s.total)) }
+
+// taggedHost returns the hostname of the run.app URL for the revision tag.
+func taggedHost(tag, host string) string { return tag + "---" + host }
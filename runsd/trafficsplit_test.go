@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadTrafficSplits(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeTempFile(t, dir, "split.json", `{"search": {"stable": 90, "canary": 10}, "billing.europe-west1": {"v2": 1}}`)
+	splits, err := loadTrafficSplits(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := splits.lookup("search.us-central1.run.internal", "run.internal.", "us-central1")
+	if !ok {
+		t.Fatal("split for search not found")
+	}
+	for n, want := range map[int]string{0: "canary", 9: "canary", 10: "stable", 99: "stable"} {
+		if got := s.pick(n); got != want {
+			t.Errorf("pick(%d) = %s, want %s", n, got, want)
+		}
+	}
+	if _, ok := splits.lookup("search.europe-west1", "run.internal.", "us-central1"); ok {
+		t.Error("split for search should only apply in the current region")
+	}
+	if _, ok := splits.lookup("billing.europe-west1", "run.internal.", "us-central1"); !ok {
+		t.Error("split for billing.europe-west1 not found")
+	}
+}
+
+func TestLoadTrafficSplitsInvalid(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, content := range []string{
+		`{"search": {"stable": 0}}`,
+		`{"search": {"Stable": 1}}`,
+		`{"search": {"stable": -1, "canary": 2}}`,
+		`{"search.us-central1.run.internal": {"stable": 1}}`,
+	} {
+		path := writeTempFile(t, dir, "split.json", content)
+		if _, err := loadTrafficSplits(path); err == nil {
+			t.Errorf("expected error for %s", content)
+		}
+	}
+}
+
+func TestReverseProxyBackendTrafficSplit(t *testing.T) {
+	rp := newReverseProxy("dpyb4duzqq", "us-central1", "run.internal.")
+	rp.trafficSplits = trafficSplits{"search": {tags: []string{"canary"}, weights: []int{1}, total: 1}}
+	_, host, err := rp.backend("search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "canary---search-dpyb4duzqq-uc.a.run.app"; host != want {
+		t.Errorf("host = %s, want %s", host, want)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+const dohMediaType = "application/dns-message"
+
+// upstreamDialer, if set, is used by the exchangers to dial the upstream
+// nameservers.
+var upstreamDialer *net.Dialer
+
+// addUpstreamDialControl adds a function called before the upstreamDialer
+// connects to an address (e.g. to set socket options or to reject address
+// families).
+func addUpstreamDialControl(fn func(network, address string, c syscall.RawConn) error) {
+	if fn == nil {
+		return
+	}
+	if upstreamDialer == nil {
+		upstreamDialer = new(net.Dialer)
+	}
+	prev := upstreamDialer.Control
+	upstreamDialer.Control = func(network, address string, c syscall.RawConn) error {
+		if prev != nil {
+			if err := prev(network, address, c); err != nil {
+				return err
+			}
+		}
+		return fn(network, address, c)
+	}
+}
+
+// upstreamDialerWithTimeout returns a copy of the upstreamDialer (if set) with
+// the timeout.
+func upstreamDialerWithTimeout(timeout time.Duration) *net.Dialer {
+	if upstreamDialer == nil {
+		return nil
+	}
+	d := *upstreamDialer
+	d.Timeout = timeout
+	return &d
+}
+
+// ipv6OnlyDialControl rejects connecting to IPv4 addresses, so that the
+// dialers fall back to the IPv6 addresses of the hosts.
+func ipv6OnlyDialControl(network, address string, _ syscall.RawConn) error {
+	if strings.HasSuffix(network, "4") {
+		return fmt.Errorf("%s: ipv4 is not available", address)
+	}
+	return nil
+}
+
+// dnsExchanger sends queries to an upstream resolver.
+type dnsExchanger interface {
+	Exchange(msg *dns.Msg) (r *dns.Msg, rtt time.Duration, err error)
+	String() string
+}
+
+// plainExchanger sends queries to a nameserver over UDP (port 53, unless
+// specified).
+//
+// As responses over UDP can be spoofed, each query is sent from a new socket
+// (with a random source port) with a random ID, and the responses not matching
+// the query are rejected.
+type plainExchanger struct {
+	nameserver string        // IP or IP:PORT
+	timeout    time.Duration // library default if zero
+	// mix0x20 randomizes the case of the query names (known as 0x20 encoding),
+	// which the nameserver must preserve in the responses.
+	mix0x20 bool
+}
+
+func (p plainExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	addr := p.nameserver
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	c := &dns.Client{Timeout: p.timeout, Dialer: upstreamDialerWithTimeout(p.timeout)}
+	q := msg.Copy()
+	q.Id = dns.Id()
+	if p.mix0x20 {
+		for i := range q.Question {
+			q.Question[i].Name = randomizeCase(q.Question[i].Name)
+		}
+	}
+	r, rtt, err := c.Exchange(q, addr)
+	if err == nil && r.Truncated {
+		klog.V(5).Infof("[dns] response for name=%v is truncated, retrying over tcp", msg.Question[0].Name)
+		c.Net = "tcp"
+		r, rtt, err = c.Exchange(q, addr)
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+	if err := verifyResponse(q, r, p.mix0x20); err != nil {
+		return nil, rtt, fmt.Errorf("rejected response from %s: %w", addr, err)
+	}
+	restoreQuery(msg, q, r)
+	return r, rtt, nil
+}
+
+// with0x20 enables the 0x20 encoding if e sends queries over UDP.
+func with0x20(e dnsExchanger) dnsExchanger {
+	if p, ok := e.(plainExchanger); ok {
+		p.mix0x20 = true
+		return p
+	}
+	return e
+}
+
+// randomizeCase randomly changes the case of the letters in the name.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits [8]byte
+	for i := range b {
+		if i%64 == 0 {
+			rand.Read(bits[:])
+		}
+		c := b[i] | 0x20
+		if c < 'a' || c > 'z' {
+			continue
+		}
+		if bits[(i%64)/8]&(1<<uint(i%8)) != 0 {
+			b[i] = c &^ 0x20
+		} else {
+			b[i] = c
+		}
+	}
+	return string(b)
+}
+
+// verifyResponse returns an error if r is not a response to q. Question names
+// are compared case-sensitively if exactCase is set.
+func verifyResponse(q, r *dns.Msg, exactCase bool) error {
+	if r.Id != q.Id {
+		return fmt.Errorf("id mismatch (%d != %d)", r.Id, q.Id)
+	}
+	if len(r.Question) == 0 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil // some servers omit the question in errors
+	}
+	if len(r.Question) != len(q.Question) {
+		return fmt.Errorf("response has %d questions, expected %d", len(r.Question), len(q.Question))
+	}
+	for i, want := range q.Question {
+		got := r.Question[i]
+		if got.Qtype != want.Qtype || got.Qclass != want.Qclass {
+			return fmt.Errorf("question mismatch (%s != %s)", got.String(), want.String())
+		}
+		if exactCase && got.Name != want.Name {
+			return fmt.Errorf("question name case mismatch, nameserver may not support 0x20 encoding (%s != %s)", got.Name, want.Name)
+		} else if !strings.EqualFold(got.Name, want.Name) {
+			return fmt.Errorf("question name mismatch (%s != %s)", got.Name, want.Name)
+		}
+	}
+	return nil
+}
+
+// restoreQuery changes the ID and the names in the response r to q, sent for
+// the original query msg.
+func restoreQuery(msg, q, r *dns.Msg) {
+	r.Id = msg.Id
+	for i := range r.Question {
+		if i < len(msg.Question) {
+			r.Question[i].Name = msg.Question[i].Name
+		}
+	}
+	for i, qq := range q.Question {
+		if qq.Name == msg.Question[i].Name {
+			continue
+		}
+		for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+			for _, rr := range section {
+				if rr.Header().Name == qq.Name {
+					rr.Header().Name = msg.Question[i].Name
+				}
+			}
+		}
+	}
+}
+
+func (p plainExchanger) String() string { return "udp://" + p.nameserver }
+
+// newUpstream returns the exchanger for a nameserver specified as IP[:PORT]
+// or tls://HOST[:PORT].
+func newUpstream(nameserver string, timeout time.Duration) (dnsExchanger, error) {
+	if strings.HasPrefix(nameserver, "tls://") {
+		return newDoTExchanger(nameserver, timeout)
+	}
+	host := nameserver
+	if h, _, err := net.SplitHostPort(nameserver); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("nameserver %q is not in IP[:PORT] or tls://HOST[:PORT] form", nameserver)
+	}
+	return plainExchanger{nameserver: nameserver, timeout: timeout}, nil
+}
+
+// forwardRule sends the queries for names under zone to upstream.
+type forwardRule struct {
+	zone     string // fully qualified
+	upstream dnsExchanger
+}
+
+// parseForwardRules parses ZONE=NAMESERVER rules, sorted with the longest
+// (most specific) zone first.
+func parseForwardRules(rules []string, timeout time.Duration) ([]forwardRule, error) {
+	var out []forwardRule
+	for _, v := range rules {
+		kv, err := parseKeyValues(v)
+		if err != nil {
+			return nil, err
+		}
+		for zone, ns := range kv {
+			upstream, err := newUpstream(ns, timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid forward rule for %s: %w", zone, err)
+			}
+			out = append(out, forwardRule{zone: dns.Fqdn(strings.Trim(zone, ".")), upstream: upstream})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return len(out[i].zone) > len(out[j].zone) })
+	return out, nil
+}
+
+// dohExchanger sends queries to a DNS-over-HTTPS (RFC 8484) endpoint.
+type dohExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHExchanger(endpoint string, timeout time.Duration) (*dohExchanger, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("doh endpoint %q must be a https:// url", endpoint)
+	}
+	return &dohExchanger{url: u.String(), client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (d *dohExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// use id=0 for cache friendliness (RFC 8484 section 4.1)
+	q := msg.Copy()
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to pack dns query: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("content-type", dohMediaType)
+	req.Header.Set("accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("doh request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read doh response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh endpoint responded with status=%d", resp.StatusCode)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse doh response: %w", err)
+	}
+	r.Id = msg.Id
+	return r, time.Since(start), nil
+}
+
+func (d *dohExchanger) String() string { return d.url }
+
+// dotExchanger sends queries to a DNS-over-TLS (RFC 7858) nameserver.
+type dotExchanger struct {
+	addr   string
+	client *dns.Client
+}
+
+// newDoTExchanger parses a tls://HOST[:PORT] nameserver. The certificate of
+// the nameserver is verified against HOST.
+func newDoTExchanger(nameserver string, timeout time.Duration) (*dotExchanger, error) {
+	u, err := url.Parse(nameserver)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" {
+		return nil, fmt.Errorf("dot nameserver %q must be in tls://HOST[:PORT] form", nameserver)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "853"
+	}
+	return &dotExchanger{
+		addr: net.JoinHostPort(u.Hostname(), port),
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{ServerName: u.Hostname()},
+			Timeout:   timeout,
+		},
+	}, nil
+}
+
+func (d *dotExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if dialer := upstreamDialerWithTimeout(d.client.Timeout); dialer != nil {
+		c := &dns.Client{Net: d.client.Net, TLSConfig: d.client.TLSConfig, Timeout: d.client.Timeout, Dialer: dialer}
+		return c.Exchange(msg, d.addr)
+	}
+	return d.client.Exchange(msg, d.addr)
+}
+
+func (d *dotExchanger) String() string { return "tls://" + d.addr }
+
+// retryingExchanger retries the queries that fail or get a SERVFAIL response
+// with exponential backoff.
+type retryingExchanger struct {
+	next    dnsExchanger
+	retries int
+	backoff time.Duration // before the first retry, doubled after each retry
+}
+
+func (r retryingExchanger) Exchange(msg *dns.Msg) (resp *dns.Msg, rtt time.Duration, err error) {
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		resp, rtt, err = r.next.Exchange(msg)
+		if attempt >= r.retries || (err == nil && resp.Rcode != dns.RcodeServerFailure) {
+			return resp, rtt, err
+		}
+		klog.V(4).Infof("[dns] upstream query for name=%v failed (attempt %d/%d), retrying in %v: err=%v",
+			msg.Question[0].Name, attempt+1, r.retries+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (r retryingExchanger) String() string { return r.next.String() }
+
+// hedgedExchanger races the queries against two upstreams and returns the
+// first successful response. The secondary is only queried if the primary has
+// not responded within delay.
+type hedgedExchanger struct {
+	primary, secondary dnsExchanger
+	delay              time.Duration
+}
+
+type exchangeResult struct {
+	resp *dns.Msg
+	rtt  time.Duration
+	err  error
+	from dnsExchanger
+}
+
+func (h hedgedExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	results := make(chan exchangeResult, 2)
+	query := func(e dnsExchanger) {
+		// each exchange gets its own copy as the message may be modified
+		r, rtt, err := e.Exchange(msg.Copy())
+		results <- exchangeResult{r, rtt, err, e}
+	}
+	go query(h.primary)
+
+	pending := 1
+	var timer <-chan time.Time
+	if h.delay > 0 {
+		t := time.NewTimer(h.delay)
+		defer t.Stop()
+		timer = t.C
+	} else {
+		go query(h.secondary)
+		pending++
+	}
+
+	var last exchangeResult
+	for hedged := h.delay <= 0; pending > 0; {
+		select {
+		case <-timer:
+			klog.V(5).Infof("[dns] no response from %s in %v, hedging query to %s", h.primary, h.delay, h.secondary)
+			go query(h.secondary)
+			pending++
+			hedged, timer = true, nil
+		case last = <-results:
+			pending--
+			if last.err == nil && last.resp.Rcode != dns.RcodeServerFailure {
+				klog.V(5).Infof("[dns] << hedged query answered by %s", last.from)
+				return last.resp, last.rtt, nil
+			}
+			if !hedged {
+				// primary failed before the delay, query the secondary now
+				go query(h.secondary)
+				pending++
+				hedged, timer = true, nil
+			}
+		}
+	}
+	return last.resp, last.rtt, last.err
+}
+
+func (h hedgedExchanger) String() string {
+	return fmt.Sprintf("hedged(%s,%s)", h.primary, h.secondary)
+}
@@ -0,0 +1,398 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHExchanger(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("content-type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			http.Error(w, "expected id=0", http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.1")
+		r.Answer = append(r.Answer, rr)
+		out, _ := r.Pack()
+		w.Header().Set("content-type", dohMediaType)
+		w.Write(out)
+	}))
+	defer srv.Close()
+
+	doh, err := newDoHExchanger(srv.URL+"/dns-query", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doh.client = srv.Client()
+
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, _, err := doh.Exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id {
+		t.Errorf("response id=%d, want %d", r.Id, q.Id)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer: %v", r.Answer)
+	}
+
+	if _, err := newDoHExchanger("http://dns.google/dns-query", time.Second); err == nil {
+		t.Error("expected error for non-https endpoint")
+	}
+}
+
+func TestDoTExchanger(t *testing.T) {
+	// borrow the test certificate (valid for 127.0.0.1) of httptest
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	srv := &dns.Server{
+		Addr:      "127.0.0.1:0",
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{Certificates: ts.TLS.Certificates},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			r := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.1")
+			r.Answer = append(r.Answer, rr)
+			w.WriteMsg(r)
+		}),
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ListenAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	dot, err := newDoTExchanger("tls://"+srv.Listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := dot.Exchange(q); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+
+	dot.client.TLSConfig.RootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	r, _, err := dot.Exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatalf("unexpected answer: %v", r.Answer)
+	}
+
+	if _, err := newDoTExchanger("1.1.1.1", time.Second); err == nil {
+		t.Error("expected error for nameserver without tls:// scheme")
+	}
+}
+
+type fakeExchanger struct {
+	calls    int
+	failures int // number of calls to fail before succeeding
+	rcode    int // rcode of the failures, or network error if zero
+}
+
+func (f *fakeExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		if f.rcode == 0 {
+			return nil, 0, errors.New("i/o timeout")
+		}
+		return new(dns.Msg).SetRcode(msg, f.rcode), 0, nil
+	}
+	return new(dns.Msg).SetReply(msg), 0, nil
+}
+
+func (f *fakeExchanger) String() string { return "fake" }
+
+func TestRetryingExchanger(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	cases := []struct {
+		name      string
+		fake      *fakeExchanger
+		retries   int
+		wantErr   bool
+		wantRcode int
+		wantCalls int
+	}{
+		{name: "success", fake: &fakeExchanger{}, retries: 2, wantCalls: 1},
+		{name: "recovers from errors", fake: &fakeExchanger{failures: 2}, retries: 2, wantCalls: 3},
+		{name: "recovers from servfail", fake: &fakeExchanger{failures: 1, rcode: dns.RcodeServerFailure}, retries: 2, wantCalls: 2},
+		{name: "gives up", fake: &fakeExchanger{failures: 5}, retries: 2, wantErr: true, wantCalls: 3},
+		{name: "gives up with servfail", fake: &fakeExchanger{failures: 5, rcode: dns.RcodeServerFailure}, retries: 1,
+			wantRcode: dns.RcodeServerFailure, wantCalls: 2},
+		{name: "nxdomain is not retried", fake: &fakeExchanger{failures: 5, rcode: dns.RcodeNameError}, retries: 2,
+			wantRcode: dns.RcodeNameError, wantCalls: 1},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, err := retryingExchanger{next: tt.fake, retries: tt.retries, backoff: time.Millisecond}.Exchange(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v, wantErr=%v", err, tt.wantErr)
+			}
+			if err == nil && r.Rcode != tt.wantRcode {
+				t.Errorf("rcode=%s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if tt.fake.calls != tt.wantCalls {
+				t.Errorf("calls=%d, want %d", tt.fake.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+type slowExchanger struct {
+	name  string
+	delay time.Duration
+	fail  bool
+	calls int32
+}
+
+func (s *slowExchanger) Exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	if s.fail {
+		return nil, 0, errors.New("i/o timeout")
+	}
+	r := new(dns.Msg).SetReply(msg)
+	rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN TXT " + s.name)
+	r.Answer = append(r.Answer, rr)
+	return r, s.delay, nil
+}
+
+func (s *slowExchanger) String() string { return s.name }
+
+func TestHedgedExchanger(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)
+	answeredBy := func(r *dns.Msg) string { return r.Answer[0].(*dns.TXT).Txt[0] }
+
+	cases := []struct {
+		name               string
+		primary, secondary *slowExchanger
+		delay              time.Duration
+		want               string
+		wantErr            bool
+		wantSecondaryCalls int32
+	}{
+		{name: "race, secondary faster",
+			primary:   &slowExchanger{name: "primary", delay: 200 * time.Millisecond},
+			secondary: &slowExchanger{name: "secondary"},
+			want:      "secondary", wantSecondaryCalls: 1},
+		{name: "primary within delay",
+			primary:   &slowExchanger{name: "primary"},
+			secondary: &slowExchanger{name: "secondary"},
+			delay:     time.Second,
+			want:      "primary", wantSecondaryCalls: 0},
+		{name: "primary slower than delay",
+			primary:   &slowExchanger{name: "primary", delay: time.Second},
+			secondary: &slowExchanger{name: "secondary"},
+			delay:     10 * time.Millisecond,
+			want:      "secondary", wantSecondaryCalls: 1},
+		{name: "primary fails before delay",
+			primary:   &slowExchanger{name: "primary", fail: true},
+			secondary: &slowExchanger{name: "secondary"},
+			delay:     time.Second,
+			want:      "secondary", wantSecondaryCalls: 1},
+		{name: "both fail",
+			primary:   &slowExchanger{name: "primary", fail: true},
+			secondary: &slowExchanger{name: "secondary", fail: true},
+			wantErr:   true, wantSecondaryCalls: 1},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, err := hedgedExchanger{primary: tt.primary, secondary: tt.secondary, delay: tt.delay}.Exchange(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v, wantErr=%v", err, tt.wantErr)
+			}
+			if err == nil && answeredBy(r) != tt.want {
+				t.Errorf("answered by %s, want %s", answeredBy(r), tt.want)
+			}
+			if n := atomic.LoadInt32(&tt.secondary.calls); n != tt.wantSecondaryCalls {
+				t.Errorf("secondary calls=%d, want %d", n, tt.wantSecondaryCalls)
+			}
+		})
+	}
+}
+
+func TestForwardRules(t *testing.T) {
+	// upstream answering every A query with 10.8.0.1
+	fwd := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 10.8.0.1")
+		r.Answer = append(r.Answer, rr)
+		w.WriteMsg(r)
+	})}
+	started := make(chan struct{})
+	fwd.NotifyStartedFunc = func() { close(started) }
+	go fwd.ListenAndServe()
+	<-started
+	defer fwd.Shutdown()
+
+	rules, err := parseForwardRules([]string{"corp.example.com=" + fwd.PacketConn.LocalAddr().String()}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsSrv, shutdown := newTestDNSServer(t, &dnsHijack{
+		nameserver: "192.0.2.255", // invalid ip (https://tools.ietf.org/html/rfc5737) as we don't want accidental recursion
+		domain:     "foo.bar.",
+		dots:       4,
+		upstream:   plainExchanger{nameserver: "192.0.2.255", timeout: 100 * time.Millisecond},
+		forwards:   rules,
+	})
+	defer shutdown()
+
+	r, err := dns.Exchange(new(dns.Msg).SetQuestion("db.Corp.Example.com.", dns.TypeA), dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.8.0.1" {
+		t.Fatalf("expected answer from the forwarder, got rcode=%s answers=%v", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+	r, err = dns.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA), dnsSrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected query outside the zone to go to the (unreachable) default upstream, got rcode=%s", dns.RcodeToString[r.Rcode])
+	}
+
+	for _, bad := range []string{"corp.example.com", "corp.example.com=not-an-ip"} {
+		if _, err := parseForwardRules([]string{bad}, time.Second); err == nil {
+			t.Errorf("expected error for rule %q", bad)
+		}
+	}
+}
+
+func TestPlainExchangerSpoofing(t *testing.T) {
+	var (
+		lowercase int32 // respond with lowercased names
+		mu        sync.Mutex
+		lastName  string // name in the last query received
+		lastID    uint16
+	)
+	srv := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		lastName, lastID = q.Question[0].Name, q.Id
+		mu.Unlock()
+		r := new(dns.Msg).SetReply(q)
+		if atomic.LoadInt32(&lowercase) == 1 {
+			r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		}
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		r.Answer = append(r.Answer, rr)
+		w.WriteMsg(r)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ListenAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	p := with0x20(plainExchanger{nameserver: srv.PacketConn.LocalAddr().String(), timeout: time.Second})
+	q := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	r, _, err := p.Exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if lastID == q.Id && lastName == q.Question[0].Name {
+		t.Errorf("query was sent without randomization (id=%d name=%s)", lastID, lastName)
+	}
+	if r.Id != q.Id || r.Question[0].Name != "www.example.com." || r.Answer[0].Header().Name != "www.example.com." {
+		t.Errorf("response not restored to the original query: %v", r)
+	}
+
+	mu.Unlock()
+	atomic.StoreInt32(&lowercase, 1)
+	q = new(dns.Msg).SetQuestion(strings.Repeat("abcdefgh.", 8)+"example.com.", dns.TypeA)
+	if _, _, err := p.Exchange(q); err == nil {
+		t.Error("expected error for response not preserving the case")
+	}
+}
+
+func TestVerifyResponse(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("wWw.example.com.", dns.TypeA)
+	cases := []struct {
+		name      string
+		mutate    func(r *dns.Msg)
+		exactCase bool
+		wantErr   bool
+	}{
+		{name: "ok", mutate: func(r *dns.Msg) {}},
+		{name: "case changed", mutate: func(r *dns.Msg) { r.Question[0].Name = "www.example.com." }},
+		{name: "case changed with 0x20", mutate: func(r *dns.Msg) { r.Question[0].Name = "www.example.com." }, exactCase: true, wantErr: true},
+		{name: "id", mutate: func(r *dns.Msg) { r.Id++ }, wantErr: true},
+		{name: "name", mutate: func(r *dns.Msg) { r.Question[0].Name = "evil.com." }, wantErr: true},
+		{name: "type", mutate: func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeMX }, wantErr: true},
+		{name: "no question", mutate: func(r *dns.Msg) { r.Question = nil }, wantErr: true},
+		{name: "no question in error", mutate: func(r *dns.Msg) { r.Question, r.Rcode = nil, dns.RcodeFormatError }},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg).SetReply(q)
+			tt.mutate(r)
+			if err := verifyResponse(q, r, tt.exactCase); (err != nil) != tt.wantErr {
+				t.Fatalf("verifyResponse() err=%v, wantErr=%v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamDialControl(t *testing.T) {
+	defer func() { upstreamDialer = nil }()
+	var calls []string
+	addUpstreamDialControl(func(network, address string, _ syscall.RawConn) error {
+		calls = append(calls, network)
+		return nil
+	})
+	addUpstreamDialControl(ipv6OnlyDialControl)
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if _, err := upstreamDialerWithTimeout(time.Second).Dial("tcp", lis.Addr().String()); err == nil {
+		t.Fatal("expected ipv4 dial to fail")
+	}
+	if len(calls) != 1 || calls[0] != "tcp4" {
+		t.Fatalf("first control function calls = %v", calls)
+	}
+}